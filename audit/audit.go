@@ -0,0 +1,296 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	chiMiddleware "github.com/go-chi/chi/v5/middleware"
+
+	"lod2/db"
+)
+
+// Records security-relevant actions: who did what to what, from where, and as part of which request.
+// The log is append-only; the database refuses to change or delete entries, even from the SQL console.
+//
+// An entry that can't be written is never just dropped. Where the action happens in a transaction, the
+// entry is written in the same one (RecordTx), so neither happens without the other. Otherwise it's written
+// once the action has succeeded (Record); if that fails, the whole entry goes to the server log and the
+// error is returned for the caller to report.
+
+// auditLog table has rows:
+// id INTEGER - increasing, so entries can be paged through
+// at INTEGER - when the action happened
+// actorId TEXT - the user who did it; empty if nobody was logged in (such as when redeeming an invite) or
+// it was done from the command line
+// actorName TEXT - their username at the time
+// action TEXT - one of the constants below
+// target TEXT - what was acted on, such as a user or group ID or a path
+// requestId TEXT - from chi's RequestID middleware, to match the entry with the request log
+// remoteAddr TEXT - where the request came from, without the port
+// details TEXT - JSON object with anything else worth knowing, such as the new roles
+
+const (
+	UserCreate         = "user.create"
+	UserDelete         = "user.delete"
+	UserRoles          = "user.roles"
+	UserSessionsEnd    = "user.sessions.end"
+	UserSessionReuse   = "user.session.token-reuse"
+	UserTwoFactorReset = "user.two-factor.reset"
+	UserUnlock         = "user.unlock"
+	UserInvites        = "user.invites"
+	UserPasswordLink   = "user.password.link"
+	UserPasswordRevoke = "user.password.link.revoke"
+	UserPasswordReset  = "user.password.reset"
+	UserPasswordChange = "user.password.require-change"
+	UserProfile        = "user.profile"
+	UserRename         = "user.rename"
+	UserDeleteSchedule = "user.delete.schedule"
+	UserDeleteCancel   = "user.delete.cancel"
+	UserRestore        = "user.restore"
+	RoleCreate         = "role.create"
+	RoleUpdate         = "role.update"
+	RoleDelete         = "role.delete"
+	GroupCreate        = "group.create"
+	GroupUpdate        = "group.update"
+	GroupDelete        = "group.delete"
+	GroupMemberAdd     = "group.member.add"
+	GroupMemberRemove  = "group.member.remove"
+	GroupRoles         = "group.roles"
+	InviteCreate       = "invite.create"
+	InviteRevoke       = "invite.revoke"
+	InviteRedeem       = "invite.redeem"
+	TwoFactorPolicy    = "two-factor.policy"
+	SigningKeyRotate   = "signing-key.rotate"
+	SqlExecute         = "sql.execute"
+	SqlQuerySave       = "sql.query.save"
+	SqlQueryDelete     = "sql.query.delete"
+	FileDelete         = "file.delete"
+	FileMove           = "file.move"
+	FileWrite          = "file.write"
+	TrashRestore       = "trash.restore"
+	TrashPurge         = "trash.purge"
+	TrashEmpty         = "trash.empty"
+	ShareCreate        = "share.create"
+	ShareRevoke        = "share.revoke"
+	GrantSet           = "grant.set"
+	GrantDelete        = "grant.delete"
+	OidcClientCreate   = "oidc.client.create"
+	OidcClientSecret   = "oidc.client.secret"
+	OidcClientDelete   = "oidc.client.delete"
+	OidcConsent        = "oidc.consent"
+	OidcConsentRevoke  = "oidc.consent.revoke"
+	OidcCodeReuse      = "oidc.code.reuse"
+)
+
+var AllActions = []string{
+	UserCreate, UserDelete, UserRoles, UserSessionsEnd, UserSessionReuse, UserTwoFactorReset, UserUnlock, UserInvites,
+	UserPasswordLink, UserPasswordRevoke, UserPasswordReset, UserPasswordChange,
+	UserProfile, UserRename, UserDeleteSchedule, UserDeleteCancel, UserRestore,
+	RoleCreate, RoleUpdate, RoleDelete,
+	GroupCreate, GroupUpdate, GroupDelete, GroupMemberAdd, GroupMemberRemove, GroupRoles,
+	InviteCreate, InviteRevoke, InviteRedeem, TwoFactorPolicy, SigningKeyRotate, SqlExecute, SqlQuerySave, SqlQueryDelete,
+	FileDelete, FileMove, FileWrite, TrashRestore, TrashPurge, TrashEmpty, ShareCreate, ShareRevoke, GrantSet, GrantDelete,
+	OidcClientCreate, OidcClientSecret, OidcClientDelete, OidcConsent, OidcConsentRevoke, OidcCodeReuse,
+}
+
+// Who is making the request. Put on the request's context by the auth middleware (and anything else that
+// authenticates requests itself, such as WebDAV).
+type Actor struct {
+	UserId     string
+	Username   string
+	RemoteAddr string
+}
+
+type actorContextKey struct{}
+
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	if host, _, err := net.SplitHostPort(actor.RemoteAddr); err == nil {
+		actor.RemoteAddr = host
+	}
+
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(Actor)
+	return actor
+}
+
+type Entry struct {
+	Id         int64           `json:"id"`
+	At         time.Time       `json:"at"`
+	ActorId    string          `json:"actorId"`
+	ActorName  string          `json:"actorName"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	RequestId  string          `json:"requestId"`
+	RemoteAddr string          `json:"remoteAddr"`
+	Details    json.RawMessage `json:"details"`
+}
+
+func newEntry(ctx context.Context, action string, target string, details interface{}) (Entry, error) {
+	actor := actorFrom(ctx)
+
+	entry := Entry{
+		At:         time.Now(),
+		ActorId:    actor.UserId,
+		ActorName:  actor.Username,
+		Action:     action,
+		Target:     target,
+		RequestId:  chiMiddleware.GetReqID(ctx),
+		RemoteAddr: actor.RemoteAddr,
+		Details:    json.RawMessage("{}"),
+	}
+
+	if details != nil {
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			return entry, err
+		}
+		entry.Details = encoded
+	}
+
+	return entry, nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func write(exec execer, entry Entry) error {
+	_, err := exec.Exec(`
+		INSERT INTO auditLog (at, actorId, actorName, action, target, requestId, remoteAddr, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.At.Unix(), entry.ActorId, entry.ActorName, entry.Action, entry.Target, entry.RequestId,
+		entry.RemoteAddr, string(entry.Details))
+
+	return err
+}
+
+// Records an action that has just happened.
+func Record(ctx context.Context, action string, target string, details interface{}) error {
+	entry, err := newEntry(ctx, action, target, details)
+	if err == nil {
+		err = write(db.DB, entry)
+	}
+
+	if err != nil {
+		logUnwritten(entry, err)
+		return fmt.Errorf("unable to record %s in the audit log: %w", action, err)
+	}
+
+	return nil
+}
+
+// Records an action as part of the transaction that does it, so the entry is only kept if the action is.
+func RecordTx(ctx context.Context, tx *sql.Tx, action string, target string, details interface{}) error {
+	entry, err := newEntry(ctx, action, target, details)
+	if err == nil {
+		err = write(tx, entry)
+	}
+
+	if err != nil {
+		logUnwritten(entry, err)
+		return fmt.Errorf("unable to record %s in the audit log: %w", action, err)
+	}
+
+	return nil
+}
+
+func logUnwritten(entry Entry, err error) {
+	encoded, _ := json.Marshal(entry)
+	log.Printf("audit: unable to write entry (%v): %s", err, encoded)
+}
+
+type Filter struct {
+	// Username of whoever did it.
+	Actor string
+
+	// An action, or the start of some (such as "file" for every file.* action).
+	Action string
+
+	// Either may be zero.
+	Since time.Time
+	Until time.Time
+
+	// Only entries older than this one, for paging. Zero for the newest.
+	BeforeId int64
+
+	// Zero for every matching entry.
+	Limit int
+}
+
+// Returns the entries matching the filter, newest first.
+func Query(filter Filter) ([]Entry, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Actor != "" {
+		conditions = append(conditions, "actorName = ?")
+		args = append(args, filter.Actor)
+	}
+
+	if filter.Action != "" {
+		conditions = append(conditions, "(action = ? OR action LIKE ?)")
+		args = append(args, filter.Action, strings.TrimSuffix(filter.Action, ".")+".%")
+	}
+
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "at >= ?")
+		args = append(args, filter.Since.Unix())
+	}
+
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "at < ?")
+		args = append(args, filter.Until.Unix())
+	}
+
+	if filter.BeforeId != 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, filter.BeforeId)
+	}
+
+	query := "SELECT id, at, actorId, actorName, action, target, requestId, remoteAddr, details FROM auditLog"
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	query += " ORDER BY id DESC"
+
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+
+	for rows.Next() {
+		var entry Entry
+		var at int64
+		var details string
+
+		if err := rows.Scan(&entry.Id, &at, &entry.ActorId, &entry.ActorName, &entry.Action, &entry.Target,
+			&entry.RequestId, &entry.RemoteAddr, &details); err != nil {
+			return nil, err
+		}
+
+		entry.At = time.Unix(at, 0)
+		entry.Details = json.RawMessage(details)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
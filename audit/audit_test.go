@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lod2/db"
+)
+
+func setupTestDatabase(t testing.TB) func() {
+	tempDir, err := os.MkdirTemp("", "audit_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	if err := db.Open(filepath.Join(tempDir, "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	if err := db.RunMigrations(); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	return func() {
+		db.DB.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestRecord_StoresActorAndDetails(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	ctx := WithActor(context.Background(), Actor{UserId: "user_alice", Username: "alice", RemoteAddr: "192.0.2.1:5000"})
+
+	if err := Record(ctx, FileDelete, "/notes.txt", map[string]string{"trashId": "trash_1"}); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	entries, err := Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.ActorId != "user_alice" || entry.ActorName != "alice" || entry.RemoteAddr != "192.0.2.1" {
+		t.Errorf("unexpected actor: %+v", entry)
+	}
+
+	if entry.Action != FileDelete || entry.Target != "/notes.txt" {
+		t.Errorf("unexpected action or target: %+v", entry)
+	}
+
+	var details map[string]string
+	if err := json.Unmarshal(entry.Details, &details); err != nil || details["trashId"] != "trash_1" {
+		t.Errorf("unexpected details %s: %v", entry.Details, err)
+	}
+}
+
+func TestRecordTx_DiscardedWithTransaction(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+
+	if err := RecordTx(context.Background(), tx, UserRoles, "user_bob", nil); err != nil {
+		t.Fatalf("RecordTx failed: %v", err)
+	}
+
+	tx.Rollback()
+
+	entries, err := Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected the entry to be rolled back, got %+v", entries)
+	}
+}
+
+func TestQuery_Filters(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	alice := WithActor(context.Background(), Actor{UserId: "user_alice", Username: "alice"})
+	bob := WithActor(context.Background(), Actor{UserId: "user_bob", Username: "bob"})
+
+	Record(alice, FileDelete, "/a", nil)
+	Record(alice, FileMove, "/b", nil)
+	Record(bob, FileDelete, "/c", nil)
+	Record(bob, UserDelete, "user_carol", nil)
+
+	targets := func(filter Filter) []string {
+		entries, err := Query(filter)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		var targets []string
+		for _, entry := range entries {
+			targets = append(targets, entry.Target)
+		}
+		return targets
+	}
+
+	if got := targets(Filter{Actor: "alice"}); len(got) != 2 || got[0] != "/b" || got[1] != "/a" {
+		t.Errorf("actor filter: got %v, want [/b /a]", got)
+	}
+
+	if got := targets(Filter{Action: "file"}); len(got) != 3 {
+		t.Errorf("action prefix filter: got %v, want 3 entries", got)
+	}
+
+	if got := targets(Filter{Action: FileDelete, Actor: "bob"}); len(got) != 1 || got[0] != "/c" {
+		t.Errorf("action and actor filter: got %v, want [/c]", got)
+	}
+
+	if got := targets(Filter{Since: time.Now().Add(time.Hour)}); len(got) != 0 {
+		t.Errorf("since filter: got %v, want none", got)
+	}
+
+	if got := targets(Filter{Limit: 1}); len(got) != 1 || got[0] != "user_carol" {
+		t.Errorf("limit: got %v, want [user_carol]", got)
+	}
+}
+
+func TestAuditLog_AppendOnly(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	if err := Record(context.Background(), SqlExecute, "", map[string]string{"query": "SELECT 1"}); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	for _, query := range []string{"UPDATE auditLog SET action = 'nothing'", "DELETE FROM auditLog"} {
+		if _, err := db.DB.Exec(query); err == nil {
+			t.Errorf("%q should have been refused", query)
+		}
+	}
+
+	var count int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM auditLog WHERE action = ?", SqlExecute).Scan(&count); err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected the entry to be unchanged, got %d matching entries", count)
+	}
+}
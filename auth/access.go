@@ -3,37 +3,136 @@ package auth
 import (
 	"errors"
 	"log"
+	"net/http"
+	"slices"
 	"time"
 
+	"lod2/db"
+
 	"github.com/lestrrat-go/jwx/v3/jwt"
 )
 
-func IssueAccessToken(refreshToken jwt.Token) (string, error) {
+const rolesClaim = "roles"
+const rolesVersionClaim = "rv"
+const totpSetupRequiredClaim = "totp_setup_required"
+const passwordChangeRequiredClaim = "password_change_required"
+const deletionScheduledClaim = "deletion_scheduled"
+const csrfTokenClaim = "csrf"
+
+var ErrStaleAccessToken = errors.New("access token is out of date")
+
+// How roles are packed into the "roles" claim.
+type roleClaim struct {
+	Level int `json:"level"`
+	Scope int `json:"scope"`
+}
+
+func init() {
+	// So that parsed tokens have these claims as their own types rather than as generic JSON values.
+	jwt.RegisterCustomField(rolesClaim, []roleClaim{})
+	jwt.RegisterCustomField(rolesVersionClaim, int64(0))
+	jwt.RegisterCustomField(totpSetupRequiredClaim, false)
+	jwt.RegisterCustomField(passwordChangeRequiredClaim, false)
+	jwt.RegisterCustomField(deletionScheduledClaim, false)
+}
+
+// Exchanges a refresh token for a new one and an access token, recording the client making the request
+// as the session's latest. Each refresh token can only be exchanged once (see rotateRefreshToken).
+func RefreshSession(refreshToken jwt.Token, r *http.Request) (string, string, error) {
+	if refreshToken == nil {
+		return "", "", errors.New("invalid refresh token")
+	}
+
 	sessionId, exists := refreshToken.Subject()
 	if !exists {
-		return "", errors.New("unable to extract session ID from refresh token")
+		return "", "", errors.New("unable to extract session ID from refresh token")
 	}
 
 	audience, exists := refreshToken.Audience()
 
-	if !exists || audience[0] != "refresh" {
-		return "", errors.New("unable to extract audience from refresh token")
+	if !exists || !slices.Contains(audience, "refresh") {
+		return "", "", errors.New("unable to extract audience from refresh token")
+	}
+
+	// Tokens from before rotation have no ID, as do the sessions they belong to.
+	tokenId, _ := refreshToken.JwtID()
+
+	session, err := rotateRefreshToken(sessionId, tokenId, r)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	// Looked up rather than taken from the refresh token, in case the user has been renamed since.
+	var username string
+	if err := db.DB.QueryRow("SELECT userName FROM authUsers WHERE userId = ?", session.userId).Scan(&username); err != nil {
+		return "", "", err
+	}
+
+	refreshTokenString, err := signRefreshToken(sessionId, session.refreshTokenId, username, session.expiresAt)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	accessTokenString, err := issueAccessToken(sessionId, session.userId, username, session.csrfToken)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return refreshTokenString, accessTokenString, nil
+}
+
+// Issues an access token for a session that has just been checked. It carries the user's roles, after
+// the two-factor policy, and whether they have to change their password or cancel their account's
+// deletion first, so requests don't need to look them up.
+func issueAccessToken(sessionId string, userId string, username string, csrfToken string) (string, error) {
+	// Read before the roles, so that if they change in between, the token is already out of date.
+	rolesVersion, err := GetRolesVersion(userId)
+	if err != nil {
+		return "", err
 	}
 
-	userId, isValid := getUserSessionId(sessionId)
+	userInfo := UserInfo{UserId: userId, Username: username}
 
-	if !isValid {
-		return "", errors.New("invalid session")
+	if userInfo.Roles, err = GetUserRoles(userId); err != nil {
+		return "", err
 	}
 
-	updateUserSessionRefresh(sessionId)
+	if err := ApplyTotpPolicy(&userInfo); err != nil {
+		return "", err
+	}
+
+	if userInfo.PasswordChangeRequired, err = PasswordChangeRequired(userId); err != nil {
+		return "", err
+	}
+
+	deleteAt, err := GetDeletionScheduled(userId)
+	if err != nil {
+		return "", err
+	}
+	userInfo.DeletionScheduled = !deleteAt.IsZero()
 
 	builder := getTokenBuilder(time.Now().Add(AccessTokenExpirationDuration))
 	builder.Subject(userId)
 	builder.Audience([]string{accessTokenAudience})
+	builder.Claim("sid", sessionId)
+	builder.Claim(csrfTokenClaim, csrfToken)
+	builder.Claim("username", username)
+	builder.Claim(rolesClaim, newRoleClaims(userInfo.Roles))
+	builder.Claim(rolesVersionClaim, rolesVersion)
 
-	if err := addAccessTokenClaims(builder, refreshToken, userId); err != nil {
-		return "", err
+	if userInfo.TotpSetupRequired {
+		builder.Claim(totpSetupRequiredClaim, true)
+	}
+
+	if userInfo.PasswordChangeRequired {
+		builder.Claim(passwordChangeRequiredClaim, true)
+	}
+
+	if userInfo.DeletionScheduled {
+		builder.Claim(deletionScheduledClaim, true)
 	}
 
 	signed, err := signToken(builder)
@@ -46,38 +145,84 @@ func IssueAccessToken(refreshToken jwt.Token) (string, error) {
 	return signed, nil
 }
 
-// addAccessTokenClaims adds standard and custom claims to the access token builder.
-func addAccessTokenClaims(builder *jwt.Builder, refreshToken jwt.Token, userId string) error {
-	var username string
-	if err := refreshToken.Get("username", &username); err != nil {
-		return err
+// Like ParseToken, but only accepts access tokens, so that other tokens we sign (such as the one for a
+// login waiting on a two-factor code) can't stand in for one.
+func ParseAccessToken(signedToken string) (jwt.Token, error) {
+	token, err := ParseToken(signedToken)
+
+	if err != nil {
+		return nil, err
 	}
-	builder.Claim("username", username)
 
-	if err := addRoleClaims(builder, userId); err != nil {
-		return err
+	audience, _ := token.Audience()
+
+	if !slices.Contains(audience, accessTokenAudience) {
+		return nil, errors.New("not an access token")
 	}
-	return nil
+
+	return token, nil
 }
 
-// addRoleClaims adds the user's roles to the token builder as the "roles" claim.
-func addRoleClaims(builder *jwt.Builder, userId string) error {
-	roles, err := GetUserRoles(userId)
+// Returns who the access token is for and what they can do, as of when it was issued. Fails with
+// ErrStaleAccessToken if the user's roles version has moved on since then; the token should be refreshed.
+func UserInfoFromAccessToken(token jwt.Token) (UserInfo, error) {
+	userInfo := UserInfo{}
+
+	subject, ok := token.Subject()
+	if !ok {
+		return userInfo, errors.New("access token has no subject")
+	}
+
+	userInfo.UserId = subject
+	token.Get("username", &userInfo.Username)
+	token.Get("sid", &userInfo.SessionId)
+	token.Get(totpSetupRequiredClaim, &userInfo.TotpSetupRequired)
+	token.Get(passwordChangeRequiredClaim, &userInfo.PasswordChangeRequired)
+	token.Get(deletionScheduledClaim, &userInfo.DeletionScheduled)
+
+	if err := token.Get(csrfTokenClaim, &userInfo.CsrfToken); err != nil || userInfo.CsrfToken == "" {
+		// Issued before sessions had CSRF tokens.
+		return userInfo, ErrStaleAccessToken
+	}
+
+	var tokenVersion int64
+	if err := token.Get(rolesVersionClaim, &tokenVersion); err != nil {
+		// Issued before tokens had a version.
+		return userInfo, ErrStaleAccessToken
+	}
+
+	currentVersion, err := GetRolesVersion(subject)
 	if err != nil {
-		// If roles cannot be loaded (e.g., during migrations), skip silently
-		log.Printf("unable to load roles for user %s; will be empty: %v", userId, err)
-		return nil
+		return userInfo, err
 	}
-	// pack roles as array of {level, scope}
-	type roleClaim struct {
-		Level int `json:"level"`
-		Scope int `json:"scope"`
+
+	if tokenVersion != currentVersion {
+		return userInfo, ErrStaleAccessToken
 	}
+
+	var claims []roleClaim
+	if err := token.Get(rolesClaim, &claims); err != nil {
+		return userInfo, err
+	}
+
+	levels := make(map[AccessScope]AccessLevel, len(claims))
+	for _, claim := range claims {
+		levels[AccessScope(claim.Scope)] = AccessLevel(claim.Level)
+	}
+
+	userInfo.Roles = make([]Role, 0, len(AllAccessScopes))
+	for _, scope := range AllAccessScopes {
+		userInfo.Roles = append(userInfo.Roles, Role{Scope: scope, Level: levels[scope]})
+	}
+
+	return userInfo, nil
+}
+
+func newRoleClaims(roles []Role) []roleClaim {
 	claims := make([]roleClaim, 0, len(roles))
-	for _, r := range roles {
-		claims = append(claims, roleClaim{Level: int(r.Level), Scope: int(r.Scope)})
+	for _, role := range roles {
+		claims = append(claims, roleClaim{Level: int(role.Level), Scope: int(role.Scope)})
 	}
 
-	builder.Claim("roles", claims)
-	return nil
+	return claims
 }
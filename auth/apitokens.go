@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"lod2/db"
+
+	"go.jetify.com/typeid"
+)
+
+// Personal API tokens let scripts and other non-browser clients act as a user. Each token carries a
+// subset of its owner's roles, and can never do more than its owner currently can. Only a hash of the
+// token is stored; the token itself is shown once, when it's created.
+
+// authApiTokens table has rows:
+// tokenId TEXT
+// userId TEXT
+// name TEXT -- chosen by the user, to tell tokens apart
+// tokenHash TEXT -- hex SHA-256 of the token
+// createdAt INTEGER
+// expiresAt INTEGER
+// lastUsedAt INTEGER -- NULL if never used
+// revokedAt INTEGER -- NULL unless revoked
+
+// authApiTokenRoles table has rows:
+// tokenId TEXT
+// level INTEGER
+// scope INTEGER
+
+// Every token starts with this, so they're easy to recognize (and to find if leaked).
+const ApiTokenPrefix = "lod2pat_"
+
+var ErrInvalidApiToken = errors.New("invalid or expired API token")
+
+type ApiToken struct {
+	TokenId string
+	UserId  string
+	Name    string
+
+	// The most the token can do. Limited further by the owner's roles when used.
+	Roles []Role
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// Zero if never used.
+	LastUsedAt time.Time
+
+	Revoked bool
+	Expired bool
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a token for the current user, returning the token itself. Roles the current user doesn't have
+// are rejected, so a token can't be used to create a more capable one.
+func CreateApiToken(userInfo UserInfo, name string, roles []Role, expiresAt time.Time) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("token name is required")
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return "", errors.New("expiry must be in the future")
+	}
+
+	userLevels := GetRoleMap(userInfo.Roles)
+	for _, role := range roles {
+		if role.Level > userLevels[role.Scope] {
+			return "", errors.New("a token can't have roles you don't have")
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	token := ApiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	tokenId, _ := typeid.WithPrefix("token")
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO authApiTokens (tokenId, userId, name, tokenHash, createdAt, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		tokenId.String(), userInfo.UserId, name, hashApiToken(token), time.Now().Unix(), expiresAt.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	for _, role := range roles {
+		if role.Level == AccessLevelNone {
+			continue
+		}
+
+		if _, err := tx.Exec(`INSERT INTO authApiTokenRoles (tokenId, level, scope) VALUES (?, ?, ?)`,
+			tokenId.String(), role.Level, role.Scope); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	log.Printf("API token %s created for %s", tokenId, userInfo.UserId)
+
+	return token, nil
+}
+
+// Returns the roles of a token, with None for scopes it doesn't have.
+func getApiTokenRoles(tokenId string) ([]Role, error) {
+	rows, err := db.DB.Query(`SELECT level, scope FROM authApiTokenRoles WHERE tokenId = ?`, tokenId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := make(map[AccessScope]AccessLevel)
+	for rows.Next() {
+		var level, scope int
+		if err := rows.Scan(&level, &scope); err != nil {
+			return nil, err
+		}
+		levels[AccessScope(scope)] = AccessLevel(level)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roles := make([]Role, 0, len(AllAccessScopes))
+	for _, scope := range AllAccessScopes {
+		roles = append(roles, Role{Level: levels[scope], Scope: scope})
+	}
+
+	return roles, nil
+}
+
+// Returns all of a user's tokens, newest first, including revoked and expired ones.
+func GetUserApiTokens(userId string) ([]ApiToken, error) {
+	rows, err := db.DB.Query(`
+		SELECT tokenId, name, createdAt, expiresAt, lastUsedAt, revokedAt
+		FROM authApiTokens
+		WHERE userId = ?
+		ORDER BY createdAt DESC`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tokens []ApiToken
+
+	for rows.Next() {
+		token := ApiToken{UserId: userId}
+		var createdAt, expiresAt int64
+		var lastUsedAt, revokedAt sql.NullInt64
+
+		if err := rows.Scan(&token.TokenId, &token.Name, &createdAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+
+		token.CreatedAt = time.Unix(createdAt, 0)
+		token.ExpiresAt = time.Unix(expiresAt, 0)
+		if lastUsedAt.Valid {
+			token.LastUsedAt = time.Unix(lastUsedAt.Int64, 0)
+		}
+		token.Revoked = revokedAt.Valid
+		token.Expired = !token.ExpiresAt.After(time.Now())
+
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tokens {
+		if tokens[i].Roles, err = getApiTokenRoles(tokens[i].TokenId); err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// Revokes one of a user's tokens. Revoked tokens are kept so they still show up in the token list.
+func RevokeApiToken(userId string, tokenId string) error {
+	_, err := db.DB.Exec("UPDATE authApiTokens SET revokedAt = ? WHERE tokenId = ? AND userId = ? AND revokedAt IS NULL",
+		time.Now().Unix(), tokenId, userId)
+
+	if err != nil {
+		log.Printf("error revoking API token %s: %v", tokenId, err)
+		return err
+	}
+
+	log.Printf("API token %s revoked", tokenId)
+
+	return nil
+}
+
+// Returns the user a token acts as. Their roles are limited to those of the token.
+func VerifyApiToken(token string) (UserInfo, error) {
+	if !strings.HasPrefix(token, ApiTokenPrefix) {
+		return UserInfo{}, ErrInvalidApiToken
+	}
+
+	var tokenId string
+	var userInfo UserInfo
+
+	err := db.DB.QueryRow(`
+		SELECT t.tokenId, u.userId, u.userName
+		FROM authApiTokens AS t
+		JOIN authUsers AS u ON u.userId = t.userId
+		WHERE t.tokenHash = ? AND t.revokedAt IS NULL AND t.expiresAt > ? AND u.deleted = 0 AND u.deleteAt IS NULL`,
+		hashApiToken(token), time.Now().Unix()).Scan(&tokenId, &userInfo.UserId, &userInfo.Username)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserInfo{}, ErrInvalidApiToken
+	}
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	userRoles, err := GetUserRoles(userInfo.UserId)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	tokenLevels, err := getApiTokenRoles(tokenId)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	userInfo.ApiTokenId = tokenId
+	userInfo.TokenRoles = tokenLevels
+
+	tokenLevelMap := GetRoleMap(tokenLevels)
+	for _, role := range userRoles {
+		role.Level = min(role.Level, tokenLevelMap[role.Scope])
+		userInfo.Roles = append(userInfo.Roles, role)
+	}
+
+	if err := ApplyTotpPolicy(&userInfo); err != nil {
+		return UserInfo{}, err
+	}
+
+	if _, err := db.DB.Exec("UPDATE authApiTokens SET lastUsedAt = ? WHERE tokenId = ?", time.Now().Unix(), tokenId); err != nil {
+		log.Printf("error updating API token %s: %v", tokenId, err)
+	}
+
+	return userInfo, nil
+}
@@ -4,15 +4,115 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 )
 
 func Init() {
 	initTokens()
 	PostMigrationSetup()
+
+	go runPeriodically(time.Hour, finishScheduledDeletions)
+}
+
+// Calls fn immediately, then once every interval, forever.
+func runPeriodically(interval time.Duration, fn func()) {
+	for {
+		fn()
+		time.Sleep(interval)
+	}
 }
 
+// Logs the user in by setting session cookies. For users with two-factor authentication enabled, it
+// instead remembers that the password was right and returns ErrTotpRequired; FinishTotpLogin then
+// takes the code and sets the session cookies.
 func SetTokenCookies(w http.ResponseWriter, r *http.Request, username string, password string) error {
-	refreshTokenString, err := IssueRefreshToken(username, password)
+	userId, err := checkLogin(username, password, r.RemoteAddr)
+
+	if err != nil {
+		return err
+	}
+
+	enabled, err := TotpEnabled(userId)
+
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		builder := getTokenBuilder(time.Now().Add(TotpLoginExpirationDuration))
+		builder.Audience([]string{totpLoginAudience})
+		builder.Subject(userId)
+		builder.Claim("username", username)
+
+		signed, err := signToken(builder)
+
+		if err != nil {
+			return err
+		}
+
+		SetCookie(w, TotpLoginCookieName, signed, TotpLoginExpirationDuration)
+
+		return ErrTotpRequired
+	}
+
+	return setSessionCookies(w, r, userId, username)
+}
+
+// Whether the request comes from someone who has entered their password and still needs to enter a code.
+func HasPendingTotpLogin(r *http.Request) bool {
+	_, _, err := getPendingTotpLogin(r)
+	return err == nil
+}
+
+// Returns the user ID and username of the pending login.
+func getPendingTotpLogin(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie(TotpLoginCookieName)
+
+	if err != nil || cookie.Value == "" {
+		return "", "", errors.New("log in with your password first")
+	}
+
+	token, err := ParseToken(cookie.Value)
+
+	if err != nil {
+		return "", "", errors.New("login expired; enter your password again")
+	}
+
+	audience, _ := token.Audience()
+	userId, ok := token.Subject()
+
+	if !ok || !slices.Contains(audience, totpLoginAudience) {
+		return "", "", errors.New("log in with your password first")
+	}
+
+	var username string
+	if err := token.Get("username", &username); err != nil {
+		return "", "", err
+	}
+
+	return userId, username, nil
+}
+
+// The second step of logging in with two-factor authentication: checks the code and sets session cookies.
+func FinishTotpLogin(w http.ResponseWriter, r *http.Request, code string) error {
+	userId, username, err := getPendingTotpLogin(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := VerifyTotp(userId, code); err != nil {
+		return err
+	}
+
+	_deleteAuthCookie(w, TotpLoginCookieName)
+
+	return setSessionCookies(w, r, userId, username)
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, userId string, username string) error {
+	refreshTokenString, err := issueRefreshToken(userId, username, r)
 
 	var accessTokenString string
 
@@ -20,8 +120,14 @@ func SetTokenCookies(w http.ResponseWriter, r *http.Request, username string, pa
 		return err
 	}
 	refreshToken, _ := ParseToken(refreshTokenString)
+	sessionId, _ := refreshToken.Subject()
+
+	csrfToken, err := getSessionCsrfToken(sessionId)
+	if err != nil {
+		return err
+	}
 
-	accessTokenString, err = IssueAccessToken(refreshToken)
+	accessTokenString, err = issueAccessToken(sessionId, userId, username, csrfToken)
 
 	if err != nil {
 		log.Printf("unable to issue access token from refresh token: %v", err)
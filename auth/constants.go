@@ -11,3 +11,17 @@ const AccessTokenExpirationDuration = time.Second * 15
 
 const RefreshTokenCookieName = "lod2.refresh"
 const AccessTokenCookieName = "lod2.access"
+
+// Between the password and the two-factor code: who has entered their password, for how long.
+const TotpLoginCookieName = "lod2.login"
+const TotpLoginExpirationDuration = time.Minute * 5
+const totpLoginAudience = "login-totp"
+
+// How long a password reset link works for.
+const PasswordResetExpirationDuration = time.Hour * 24
+
+// How long an OpenID Connect authorization code can be exchanged for tokens, and how long the tokens
+// last. Clients are sent back to log in again once they expire; there are no refresh tokens.
+const OidcCodeExpirationDuration = time.Minute * 5
+const OidcTokenExpirationDuration = time.Hour
+const oidcAccessTokenAudience = "oidc-userinfo"
@@ -8,8 +8,8 @@ import (
 // PostMigrationSetup handles admin user setup after database migrations are complete
 // This ensures the admin user has proper password hashing and all current roles
 func PostMigrationSetup() {
-	// Update admin user to have proper password hash and all roles
-	// This runs at every boot and makes sure the admin user has all roles even if additional scopes are added.
+	// Update admin user to have proper password hash and the Administrator role
+	// This runs at every boot and makes sure the Administrator role has all scopes even if additional scopes are added.
 
 	tx, err := db.DB.Begin()
 	if err != nil {
@@ -18,18 +18,24 @@ func PostMigrationSetup() {
 	}
 	defer tx.Rollback()
 
+	administratorRoleId, err := updateAdministratorRole(tx)
+	if err != nil {
+		log.Printf("failed to update the Administrator role: %v", err)
+		return
+	}
+
 	userId, err := AdminGetUserIdByUsername(tx, "admin")
 	if err != nil {
 		// Admin user doesn't exist, create it
-		userId, err = createUser(tx, "admin", "admin", AllRoles)
+		userId, err = createUser(tx, "admin", "admin", []string{administratorRoleId})
 		if err != nil {
 			log.Printf("failed to create admin user: %v", err)
 			return
 		}
 		log.Printf("created admin user with ID %s", userId)
 	} else {
-		// Admin user exists, update roles
-		if err := setRoles(tx, userId, AllRoles); err != nil {
+		// Admin user exists, make sure it's still an administrator
+		if _, err := tx.Exec("INSERT OR IGNORE INTO authUserRoles (userId, roleId) VALUES (?, ?)", userId, administratorRoleId); err != nil {
 			log.Printf("failed to update admin roles: %v", err)
 			return
 		}
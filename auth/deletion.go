@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"lod2/audit"
+	"lod2/config"
+	"lod2/db"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Deleting a user hides them everywhere and frees their username, but keeps their data, so an admin can
+// restore them later. Users can delete their own account too, after config.Config.Accounts.DeletionGrace:
+// until then, logging in only lets them cancel it (see AccountActionRequiredMiddleware).
+
+// authUsers has these columns for it:
+// deleted INTEGER -- 1 once deleted; their userName is then their userId
+// deletedAt INTEGER -- when they were deleted (NULL for users deleted before this was recorded)
+// deleteAt INTEGER -- when a deletion they asked for takes effect (NULL if they haven't)
+
+var ErrDeletionScheduled = errors.New("this account is scheduled for deletion")
+
+// Deletes the user straight away.
+func AdminDeleteUser(ctx context.Context, userId string) error {
+	return deleteUser(ctx, userId, nil)
+}
+
+func deleteUser(ctx context.Context, userId string, details map[string]interface{}) error {
+	var username string
+	if err := db.DB.QueryRow("SELECT userName FROM authUsers WHERE userId = ? AND deleted = 0", userId).Scan(&username); err != nil {
+		return errors.New("invalid user id")
+	}
+
+	now := time.Now()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Invalidate all sessions for this user first
+	if _, err := tx.Exec("UPDATE authSessions SET expiresAt = ? WHERE userId = ?", now.Unix(), userId); err != nil {
+		return err
+	}
+
+	// Then mark the user as deleted, keeping their name in their history so it can be given back.
+	if err := setUsernameTx(tx, userId, username, userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE authUsers SET deleted = 1, deletedAt = ?, deleteAt = NULL WHERE userId = ?", now.Unix(), userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM authGroupMembers WHERE userId = ?", userId); err != nil {
+		return err
+	}
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["username"] = username
+
+	if err := audit.RecordTx(ctx, tx, audit.UserDelete, userId, details); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("user %s (%s) deleted", userId, username)
+
+	// So their current access token stops working now, rather than when it expires.
+	return bumpRolesVersion(userId)
+}
+
+// Schedules the user's own account for deletion after the grace period and logs them out everywhere.
+// Returns when it will be deleted.
+func ScheduleAccountDeletion(ctx context.Context, userId string, password string) (time.Time, error) {
+	if err := verifyUserPassword(userId, password); err != nil {
+		return time.Time{}, errors.New("invalid password")
+	}
+
+	now := time.Now()
+	deleteAt := now.Add(config.Config.Accounts.DeletionGrace)
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE authUsers SET deleteAt = ? WHERE userId = ? AND deleted = 0 AND deleteAt IS NULL", deleteAt.Unix(), userId)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return time.Time{}, err
+	} else if changed == 0 {
+		return time.Time{}, ErrDeletionScheduled
+	}
+
+	if _, err := tx.Exec("UPDATE authSessions SET expiresAt = ? WHERE userId = ? AND expiresAt > ?", now.Unix(), userId, now.Unix()); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserDeleteSchedule, userId, map[string]int64{"deleteAt": deleteAt.Unix()}); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+
+	log.Printf("user %s scheduled for deletion at %s", userId, deleteAt)
+
+	return deleteAt, bumpRolesVersion(userId)
+}
+
+// Returns when the user's account will be deleted, or zero if it won't be.
+func GetDeletionScheduled(userId string) (time.Time, error) {
+	var deleteAt sql.NullInt64
+	err := db.DB.QueryRow("SELECT deleteAt FROM authUsers WHERE userId = ?", userId).Scan(&deleteAt)
+	return optionalUnix(deleteAt), err
+}
+
+// Cancels a deletion the user asked for. Used by the user themselves, or an admin.
+func CancelAccountDeletion(ctx context.Context, userId string) error {
+	result, err := db.DB.Exec("UPDATE authUsers SET deleteAt = NULL WHERE userId = ? AND deleted = 0 AND deleteAt IS NOT NULL", userId)
+	if err != nil {
+		return err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if changed == 0 {
+		return errors.New("this account isn't scheduled for deletion")
+	}
+
+	if err := bumpRolesVersion(userId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.UserDeleteCancel, userId, nil)
+}
+
+// Deletes the users whose grace period is over.
+func finishScheduledDeletions() {
+	rows, err := db.DB.Query("SELECT userId FROM authUsers WHERE deleted = 0 AND deleteAt <= ?", time.Now().Unix())
+	if err != nil {
+		log.Printf("unable to list scheduled deletions: %v", err)
+		return
+	}
+
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			log.Printf("unable to list scheduled deletions: %v", err)
+			break
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+
+	for _, userId := range userIds {
+		if err := deleteUser(context.Background(), userId, map[string]interface{}{"scheduled": true}); err != nil {
+			log.Printf("unable to delete %s: %v", userId, err)
+		}
+	}
+}
+
+type DeletedUser struct {
+	UserId string
+
+	// What they were called before they were deleted, or will be deleted; empty if unknown.
+	Username string
+
+	CreatedAt time.Time
+
+	// Zero if unknown, or not deleted yet.
+	DeletedAt time.Time
+
+	// Zero unless the user is waiting to be deleted.
+	DeleteAt time.Time
+}
+
+// Returns deleted users, and those waiting to be, most recent first.
+func AdminGetDeletedUsers() ([]DeletedUser, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.userId, u.createdAt, u.deletedAt, u.deleteAt,
+			CASE WHEN u.deleted = 0 THEN u.userName ELSE COALESCE((
+				SELECT h.userName FROM authUsernameHistory AS h
+				WHERE h.userId = u.userId ORDER BY h.changedAt DESC, h.rowid DESC LIMIT 1
+			), '') END
+		FROM authUsers AS u
+		WHERE u.deleted = 1 OR u.deleteAt IS NOT NULL
+		ORDER BY COALESCE(u.deleteAt, u.deletedAt, 0) DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []DeletedUser
+	for rows.Next() {
+		var user DeletedUser
+		var createdAt int64
+		var deletedAt, deleteAt sql.NullInt64
+
+		if err := rows.Scan(&user.UserId, &createdAt, &deletedAt, &deleteAt, &user.Username); err != nil {
+			return nil, err
+		}
+
+		user.CreatedAt = time.Unix(createdAt, 0)
+		user.DeletedAt = optionalUnix(deletedAt)
+		user.DeleteAt = optionalUnix(deleteAt)
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Undeletes a user, giving them the username. Groups they were in when deleted aren't restored.
+func AdminRestoreUser(ctx context.Context, userId string, username string) error {
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deleted bool
+	if err := tx.QueryRow("SELECT deleted FROM authUsers WHERE userId = ?", userId).Scan(&deleted); err != nil || !deleted {
+		return errors.New("invalid user id")
+	}
+
+	if _, err := tx.Exec("UPDATE authUsers SET userName = ?, deleted = 0, deletedAt = NULL WHERE userId = ?", username, userId); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return errors.New("this username is already taken")
+		}
+
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserRestore, userId, map[string]string{"username": username}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("user %s restored as %s", userId, username)
+
+	return bumpRolesVersion(userId)
+}
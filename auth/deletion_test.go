@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lod2/config"
+	"lod2/db"
+)
+
+func TestScheduleAccountDeletion_GracePeriod(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	originalGrace := config.Config.Accounts.DeletionGrace
+	config.Config.Accounts.DeletionGrace = 24 * time.Hour
+	defer func() { config.Config.Accounts.DeletionGrace = originalGrace }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	userId := createLoginTestUser(t, "alice", "alice password")
+
+	if _, err := createUserSession(userId, newRefreshTokenId(), time.Now().Add(time.Hour), r); err != nil {
+		t.Fatalf("createUserSession failed: %v", err)
+	}
+
+	apiToken, err := CreateApiToken(UserInfo{UserId: userId}, "script", nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateApiToken failed: %v", err)
+	}
+
+	if _, err := ScheduleAccountDeletion(context.Background(), userId, "wrong password"); err == nil {
+		t.Fatal("scheduling with the wrong password should fail")
+	}
+
+	if _, err := ScheduleAccountDeletion(context.Background(), userId, "alice password"); err != nil {
+		t.Fatalf("ScheduleAccountDeletion failed: %v", err)
+	}
+
+	if _, err := ScheduleAccountDeletion(context.Background(), userId, "alice password"); !errors.Is(err, ErrDeletionScheduled) {
+		t.Errorf("scheduling twice: got %v, want ErrDeletionScheduled", err)
+	}
+
+	if sessions, _ := GetActiveUserSessions(userId); len(sessions) != 0 {
+		t.Errorf("got %d active sessions, want none", len(sessions))
+	}
+
+	if _, err := VerifyApiToken(apiToken); err == nil {
+		t.Error("API tokens should stop working while the deletion is pending")
+	}
+
+	userInfo, err := UserInfoFromAccessToken(issueTestAccessToken(t, userId))
+	if err != nil || !userInfo.DeletionScheduled {
+		t.Errorf("got %+v, %v; want DeletionScheduled", userInfo, err)
+	}
+
+	if err := CancelAccountDeletion(context.Background(), userId); err != nil {
+		t.Fatalf("CancelAccountDeletion failed: %v", err)
+	}
+
+	if _, err := VerifyApiToken(apiToken); err != nil {
+		t.Errorf("API token after cancelling: %v", err)
+	}
+
+	if _, err := ScheduleAccountDeletion(context.Background(), userId, "alice password"); err != nil {
+		t.Fatalf("ScheduleAccountDeletion failed: %v", err)
+	}
+
+	// Not yet due.
+	finishScheduledDeletions()
+	if _, err := GetUserProfile(userId); err != nil {
+		t.Fatalf("user deleted before the grace period ended: %v", err)
+	}
+
+	if _, err := db.DB.Exec("UPDATE authUsers SET deleteAt = ? WHERE userId = ?", time.Now().Add(-time.Second).Unix(), userId); err != nil {
+		t.Fatalf("failed to end grace period: %v", err)
+	}
+
+	finishScheduledDeletions()
+	if _, err := GetUserProfile(userId); err == nil {
+		t.Error("user still there after the grace period ended")
+	}
+}
+
+func TestAdminRestoreUser_GivesBackName(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createLoginTestUser(t, "alice", "alice password")
+
+	if err := AdminDeleteUser(context.Background(), userId); err != nil {
+		t.Fatalf("AdminDeleteUser failed: %v", err)
+	}
+
+	if _, err := getUserLogin("alice", "alice password"); err == nil {
+		t.Error("logging in as a deleted user should fail")
+	}
+
+	deleted, err := AdminGetDeletedUsers()
+	if err != nil {
+		t.Fatalf("AdminGetDeletedUsers failed: %v", err)
+	}
+
+	if len(deleted) != 1 || deleted[0].UserId != userId || deleted[0].Username != "alice" || deleted[0].DeletedAt.IsZero() {
+		t.Fatalf("got %+v, want alice, deleted", deleted)
+	}
+
+	// Their name is free once they're deleted.
+	if err := AdminRenameUser(context.Background(), createLoginTestUser(t, "bob", "bob password"), "alice"); err != nil {
+		t.Fatalf("AdminRenameUser failed: %v", err)
+	}
+
+	if err := AdminRestoreUser(context.Background(), userId, "alice"); err == nil {
+		t.Error("restoring with a name that's been taken should fail")
+	}
+
+	if err := AdminRestoreUser(context.Background(), userId, "alice2"); err != nil {
+		t.Fatalf("AdminRestoreUser failed: %v", err)
+	}
+
+	if _, err := getUserLogin("alice2", "alice password"); err != nil {
+		t.Errorf("logging in after being restored failed: %v", err)
+	}
+
+	if deleted, _ := AdminGetDeletedUsers(); len(deleted) != 0 {
+		t.Errorf("got %+v, want no deleted users", deleted)
+	}
+}
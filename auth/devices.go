@@ -0,0 +1,58 @@
+package auth
+
+import "strings"
+
+// Turns a User-Agent header into something a person can recognize, like "Firefox on Windows". Only
+// the common cases are covered; anything else is shown as "Unknown device".
+
+// Checked in order, since many user agents mention the ones after them (Edge claims to be Chrome,
+// which claims to be Safari).
+var browserNames = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"CriOS/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var osNames = []struct{ token, name string }{
+	{"Android", "Android"},
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+func deviceLabel(userAgent string) string {
+	browser := ""
+	for _, candidate := range browserNames {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	os := ""
+	for _, candidate := range osNames {
+		if strings.Contains(userAgent, candidate.token) {
+			os = candidate.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
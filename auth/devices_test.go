@@ -0,0 +1,24 @@
+package auth
+
+import "testing"
+
+func TestDeviceLabel(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		label     string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0", "Firefox on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 18_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/129.0.6668.69 Mobile/15E148 Safari/604.1", "Chrome on iPhone"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"curl/8.5.0", "curl"},
+		{"", "Unknown device"},
+	}
+
+	for _, test := range tests {
+		if label := deviceLabel(test.userAgent); label != test.label {
+			t.Errorf("deviceLabel(%q) = %q, want %q", test.userAgent, label, test.label)
+		}
+	}
+}
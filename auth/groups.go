@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+
+	"github.com/mattn/go-sqlite3"
+	"go.jetify.com/typeid"
+)
+
+// Groups let admins give roles (and, through the storage package, file access) to several users at
+// once. A member of a group has its roles as well as their own; their effective level in each scope is
+// the highest any of them grants.
+
+// authGroups table has rows:
+// groupId TEXT
+// name TEXT -- unique
+// description TEXT
+// createdAt INTEGER
+
+// authGroupMembers table has rows:
+// groupId TEXT
+// userId TEXT
+
+// authGroupRoles table has rows:
+// groupId TEXT
+// roleId TEXT
+
+var ErrGroupNotFound = errors.New("group not found")
+
+type Group struct {
+	GroupId     string
+	Name        string
+	Description string
+	CreatedAt   time.Time
+	MemberCount int
+}
+
+type GroupMember struct {
+	UserId   string
+	Username string
+}
+
+const groupColumns = `
+	g.groupId, g.name, g.description, g.createdAt, COUNT(u.userId)`
+
+// Only members whose accounts still exist are counted.
+const groupJoins = `
+	FROM authGroups AS g
+	LEFT JOIN authGroupMembers AS m ON m.groupId = g.groupId
+	LEFT JOIN authUsers AS u ON u.userId = m.userId AND u.deleted = 0`
+
+func scanGroup(row interface{ Scan(...any) error }) (Group, error) {
+	var group Group
+	var createdAt int64
+
+	err := row.Scan(&group.GroupId, &group.Name, &group.Description, &createdAt, &group.MemberCount)
+	group.CreatedAt = time.Unix(createdAt, 0)
+
+	return group, err
+}
+
+func queryGroups(query string, args ...any) ([]Group, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// Returns every group, by name.
+func GetGroups() ([]Group, error) {
+	return queryGroups("SELECT" + groupColumns + groupJoins + " GROUP BY g.groupId ORDER BY g.name COLLATE NOCASE")
+}
+
+// Returns the groups the user is a member of, by name.
+func GetUserGroups(userId string) ([]Group, error) {
+	return queryGroups("SELECT"+groupColumns+groupJoins+`
+		WHERE g.groupId IN (SELECT groupId FROM authGroupMembers WHERE userId = ?)
+		GROUP BY g.groupId
+		ORDER BY g.name COLLATE NOCASE`, userId)
+}
+
+func GetGroup(groupId string) (Group, error) {
+	group, err := scanGroup(db.DB.QueryRow("SELECT"+groupColumns+groupJoins+" WHERE g.groupId = ? GROUP BY g.groupId", groupId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return group, ErrGroupNotFound
+	}
+
+	return group, err
+}
+
+// Returns the group's members, by username.
+func GetGroupMembers(groupId string) ([]GroupMember, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.userId, u.userName
+		FROM authGroupMembers AS m
+		JOIN authUsers AS u ON u.userId = m.userId
+		WHERE m.groupId = ? AND u.deleted = 0
+		ORDER BY u.userName COLLATE NOCASE`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		var member GroupMember
+		if err := rows.Scan(&member.UserId, &member.Username); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// Returns the IDs of the role definitions the group gives its members.
+func GetGroupRoleIds(groupId string) ([]string, error) {
+	rows, err := db.DB.Query("SELECT roleId FROM authGroupRoles WHERE groupId = ?", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIds []string
+	for rows.Next() {
+		var roleId string
+		if err := rows.Scan(&roleId); err != nil {
+			return nil, err
+		}
+		roleIds = append(roleIds, roleId)
+	}
+
+	return roleIds, rows.Err()
+}
+
+func getGroupMemberIds(groupId string) ([]string, error) {
+	members, err := GetGroupMembers(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	userIds := make([]string, 0, len(members))
+	for _, member := range members {
+		userIds = append(userIds, member.UserId)
+	}
+
+	return userIds, nil
+}
+
+func groupNameError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		return errors.New("a group with this name already exists")
+	}
+
+	return err
+}
+
+// Creates an empty group with no roles, returning its ID.
+func AdminCreateGroup(ctx context.Context, name string, description string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("group name is required")
+	}
+
+	groupId, _ := typeid.WithPrefix("group")
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO authGroups (groupId, name, description, createdAt) VALUES (?, ?, ?, ?)",
+		groupId.String(), name, strings.TrimSpace(description), time.Now().Unix()); err != nil {
+		return "", groupNameError(err)
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupCreate, groupId.String(), map[string]string{"name": name}); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	log.Printf("group %s (%s) created", groupId, name)
+
+	return groupId.String(), nil
+}
+
+// Renames a group or changes its description.
+func AdminUpdateGroup(ctx context.Context, groupId string, name string, description string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("group name is required")
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE authGroups SET name = ?, description = ? WHERE groupId = ?",
+		name, strings.TrimSpace(description), groupId)
+	if err != nil {
+		return groupNameError(err)
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrGroupNotFound
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupUpdate, groupId, map[string]string{"name": name}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a group. Its members lose its roles and storage grants straight away.
+func AdminDeleteGroup(ctx context.Context, groupId string) error {
+	group, err := GetGroup(groupId)
+	if err != nil {
+		return err
+	}
+
+	memberIds, err := getGroupMemberIds(groupId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM authGroupMembers WHERE groupId = ?",
+		"DELETE FROM authGroupRoles WHERE groupId = ?",
+		"DELETE FROM storageGroupGrants WHERE groupId = ?",
+		"DELETE FROM authGroups WHERE groupId = ?",
+	} {
+		if _, err := tx.Exec(query, groupId); err != nil {
+			return err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupDelete, groupId, map[string]interface{}{
+		"name":    group.Name,
+		"members": len(memberIds),
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("group %s (%s) deleted", groupId, group.Name)
+
+	return bumpRolesVersions(memberIds)
+}
+
+// Adds the user with this username to the group. Adding someone who's already a member does nothing.
+func AdminAddGroupMember(ctx context.Context, groupId string, username string) error {
+	if _, err := GetGroup(groupId); err != nil {
+		return err
+	}
+
+	var userId string
+	err := db.DB.QueryRow("SELECT userId FROM authUsers WHERE userName = ? AND deleted = 0", strings.TrimSpace(username)).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("no user with this username")
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT OR IGNORE INTO authGroupMembers (groupId, userId) VALUES (?, ?)", groupId, userId)
+	if err != nil {
+		return err
+	}
+
+	if added, _ := result.RowsAffected(); added == 0 {
+		return nil
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupMemberAdd, groupId, map[string]string{"userId": userId, "username": username}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return bumpRolesVersion(userId)
+}
+
+func AdminRemoveGroupMember(ctx context.Context, groupId string, userId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM authGroupMembers WHERE groupId = ? AND userId = ?", groupId, userId)
+	if err != nil {
+		return err
+	}
+
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return nil
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupMemberRemove, groupId, map[string]string{"userId": userId}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return bumpRolesVersion(userId)
+}
+
+// Sets the group to give its members exactly these role definitions.
+func AdminSetGroupRoleIds(ctx context.Context, groupId string, roleIds []string) error {
+	if _, err := GetGroup(groupId); err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names, err := getRoleNames(tx, roleIds)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM authGroupRoles WHERE groupId = ?", groupId); err != nil {
+		return err
+	}
+
+	for _, roleId := range roleIds {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO authGroupRoles (groupId, roleId) VALUES (?, ?)", groupId, roleId); err != nil {
+			return err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GroupRoles, groupId, map[string]interface{}{"roles": names}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	memberIds, err := getGroupMemberIds(groupId)
+	if err != nil {
+		return err
+	}
+
+	return bumpRolesVersions(memberIds)
+}
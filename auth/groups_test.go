@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func createTestGroup(t *testing.T, roles []Role) (string, string) {
+	groupId, err := AdminCreateGroup(context.Background(), t.Name()+" group", "")
+	if err != nil {
+		t.Fatalf("AdminCreateGroup failed: %v", err)
+	}
+
+	roleId, err := AdminCreateRoleDefinition(context.Background(), t.Name()+" group role", "", roles)
+	if err != nil {
+		t.Fatalf("AdminCreateRoleDefinition failed: %v", err)
+	}
+
+	if err := AdminSetGroupRoleIds(context.Background(), groupId, []string{roleId}); err != nil {
+		t.Fatalf("AdminSetGroupRoleIds failed: %v", err)
+	}
+
+	return groupId, roleId
+}
+
+func TestGetUserRoles_IncludesGroupRoles(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createTotpTestUser(t, []Role{{Scope: Storage, Level: Edit}, {Scope: Media, Level: View}})
+	groupId, groupRoleId := createTestGroup(t, []Role{{Scope: Storage, Level: View}, {Scope: Media, Level: Edit}})
+
+	if err := AdminAddGroupMember(context.Background(), groupId, t.Name()); err != nil {
+		t.Fatalf("AdminAddGroupMember failed: %v", err)
+	}
+
+	roles, err := GetUserRoles(userId)
+	if err != nil {
+		t.Fatalf("GetUserRoles failed: %v", err)
+	}
+
+	levels := GetRoleMap(roles)
+	if levels[Storage] != Edit || levels[Media] != Edit {
+		t.Errorf("got roles %+v, want Storage Edit from the user's role and Media Edit from the group's", roles)
+	}
+
+	effectiveRoles, err := GetUserEffectiveRoles(userId)
+	if err != nil {
+		t.Fatalf("GetUserEffectiveRoles failed: %v", err)
+	}
+
+	for _, effectiveRole := range effectiveRoles {
+		if effectiveRole.Scope != Media {
+			continue
+		}
+
+		origin := effectiveRole.Origins[0]
+		if effectiveRole.Level != Edit || origin.RoleId != groupRoleId || origin.GroupId != groupId {
+			t.Errorf("got Media %+v, want Edit from the group's role", effectiveRole)
+		}
+	}
+
+	// The user's own role definitions don't include the group's.
+	if roleIds, _ := GetUserRoleIds(userId); len(roleIds) != 1 {
+		t.Errorf("got role IDs %v, want only the user's own", roleIds)
+	}
+}
+
+func TestGroups_MembershipChangesMakeTokensStale(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, nil)
+	groupId, _ := createTestGroup(t, []Role{{Scope: Storage, Level: Edit}})
+
+	token := issueTestAccessToken(t, userId)
+
+	if err := AdminAddGroupMember(context.Background(), groupId, t.Name()); err != nil {
+		t.Fatalf("AdminAddGroupMember failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before joining: got %v, want ErrStaleAccessToken", err)
+	}
+
+	token = issueTestAccessToken(t, userId)
+
+	if err := AdminSetGroupRoleIds(context.Background(), groupId, nil); err != nil {
+		t.Fatalf("AdminSetGroupRoleIds failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before the group's roles changed: got %v, want ErrStaleAccessToken", err)
+	}
+
+	if roles, _ := GetUserRoles(userId); GetRoleMap(roles)[Storage] != AccessLevelNone {
+		t.Errorf("got roles %+v after the group's roles were removed, want Storage None", roles)
+	}
+}
+
+func TestAdminDeleteGroup_RemovesRolesFromMembers(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, nil)
+	groupId, roleId := createTestGroup(t, []Role{{Scope: Storage, Level: Edit}})
+
+	if err := AdminAddGroupMember(context.Background(), groupId, t.Name()); err != nil {
+		t.Fatalf("AdminAddGroupMember failed: %v", err)
+	}
+
+	token := issueTestAccessToken(t, userId)
+
+	if err := AdminDeleteGroup(context.Background(), groupId); err != nil {
+		t.Fatalf("AdminDeleteGroup failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before the group was deleted: got %v, want ErrStaleAccessToken", err)
+	}
+
+	if roles, _ := GetUserRoles(userId); GetRoleMap(roles)[Storage] != AccessLevelNone {
+		t.Errorf("got roles %+v after the group was deleted, want Storage None", roles)
+	}
+
+	if _, err := GetGroup(groupId); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("GetGroup after deleting: got %v, want ErrGroupNotFound", err)
+	}
+
+	// The role itself is left alone.
+	if _, err := GetRoleDefinition(roleId); err != nil {
+		t.Errorf("GetRoleDefinition after deleting the group failed: %v", err)
+	}
+}
+
+func TestAdminCreateGroup_NamesAreUnique(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	if _, err := AdminCreateGroup(context.Background(), "Team", ""); err != nil {
+		t.Fatalf("AdminCreateGroup failed: %v", err)
+	}
+
+	if _, err := AdminCreateGroup(context.Background(), "team", ""); err == nil {
+		t.Error("creating a group with the same name should fail")
+	}
+
+	if _, err := AdminCreateGroup(context.Background(), " ", ""); err == nil {
+		t.Error("creating a group without a name should fail")
+	}
+}
@@ -1,12 +1,15 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log"
 	"strings"
 	"time"
 
+	"lod2/audit"
+	"lod2/config"
 	"lod2/db"
 
 	"go.jetify.com/typeid"
@@ -18,41 +21,157 @@ import (
 // consumedByUserId TEXT -- the user who used this invite (NULL if unused)
 // createdAt INTEGER -- when the invite was created
 // consumedAt INTEGER -- when the invite was consumed (NULL if unused)
+// expiresAt INTEGER -- when the invite stops working (NULL if it never does)
+// revokedAt INTEGER -- when the invite was revoked (NULL if it wasn't)
+// note TEXT -- who or what the invite is for, for admins
+// inviteQuota INTEGER -- how many invites the new user starts with (NULL for config.Config.Invites.Quota)
 
-// Creates a single new invite for the given user ID
-func AdminCreateInvite(createdByUserId string) (string, error) {
+// authInviteRoles table has rows:
+// inviteId TEXT
+// roleId TEXT -- a role definition the new user gets
+
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// Matches invites that can still be used; takes the current unix time.
+const usableInvite = "consumedByUserId IS NULL AND revokedAt IS NULL AND (expiresAt IS NULL OR expiresAt > ?)"
+
+// What a new invite gives whoever uses it. The zero value is a plain invite that never expires.
+type InviteOptions struct {
+	Note string
+
+	// Zero if the invite never expires.
+	ExpiresAt time.Time
+
+	// Role definitions the new user gets.
+	RoleIds []string
+
+	// How many invites the new user starts with; nil for config.Config.Invites.Quota.
+	InviteQuota *int
+}
+
+func createInvite(tx *sql.Tx, createdByUserId string, options InviteOptions) (string, error) {
 	inviteId, _ := typeid.WithPrefix("inv")
 
-	_, err := db.DB.Exec("INSERT INTO authInvites (inviteId, createdByUserId, createdAt) VALUES (?, ?, ?)",
-		inviteId, createdByUserId, time.Now().Unix())
+	var expiresAt *int64
+	if !options.ExpiresAt.IsZero() {
+		unix := options.ExpiresAt.Unix()
+		expiresAt = &unix
+	}
+
+	_, err := tx.Exec("INSERT INTO authInvites (inviteId, createdByUserId, createdAt, expiresAt, note, inviteQuota) VALUES (?, ?, ?, ?, ?, ?)",
+		inviteId, createdByUserId, time.Now().Unix(), expiresAt, strings.TrimSpace(options.Note), options.InviteQuota)
 
 	if err != nil {
 		log.Println("error creating invite:", err)
 		return "", err
 	}
 
+	for _, roleId := range options.RoleIds {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO authInviteRoles (inviteId, roleId) VALUES (?, ?)", inviteId, roleId); err != nil {
+			return "", err
+		}
+	}
+
 	return inviteId.String(), nil
 }
 
+// Creates a single new invite for the given user ID
+func AdminCreateInvite(createdByUserId string) (string, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	inviteId, err := AdminCreateInviteTx(tx, createdByUserId)
+	if err != nil {
+		return "", err
+	}
+
+	return inviteId, tx.Commit()
+}
+
 // Creates a single new invite for the given user ID within a transaction
 func AdminCreateInviteTx(tx *sql.Tx, createdByUserId string) (string, error) {
-	inviteId, _ := typeid.WithPrefix("inv")
+	return createInvite(tx, createdByUserId, InviteOptions{})
+}
 
-	_, err := tx.Exec("INSERT INTO authInvites (inviteId, createdByUserId, createdAt) VALUES (?, ?, ?)",
-		inviteId, createdByUserId, time.Now().Unix())
+// Creates an invite with a note, expiry, roles or invite quota for the new user. It doesn't count
+// against the creator's remaining invites, so only admins should be able to do this.
+func AdminIssueInvite(ctx context.Context, createdByUserId string, options InviteOptions) (string, error) {
+	if !options.ExpiresAt.IsZero() && !options.ExpiresAt.After(time.Now()) {
+		return "", errors.New("expiry must be in the future")
+	}
 
+	if options.InviteQuota != nil && *options.InviteQuota < 0 {
+		return "", errors.New("invite quota can't be negative")
+	}
+
+	tx, err := db.DB.Begin()
 	if err != nil {
-		log.Println("error creating invite:", err)
 		return "", err
 	}
+	defer tx.Rollback()
 
-	return inviteId.String(), nil
+	roleNames, err := getRoleNames(tx, options.RoleIds)
+	if err != nil {
+		return "", err
+	}
+
+	inviteId, err := createInvite(tx, createdByUserId, options)
+	if err != nil {
+		return "", err
+	}
+
+	details := map[string]interface{}{"note": options.Note, "roles": roleNames}
+	if !options.ExpiresAt.IsZero() {
+		details["expiresAt"] = options.ExpiresAt.Unix()
+	}
+	if options.InviteQuota != nil {
+		details["inviteQuota"] = *options.InviteQuota
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.InviteCreate, inviteId, details); err != nil {
+		return "", err
+	}
+
+	return inviteId, tx.Commit()
+}
+
+// Stops an unused invite from working.
+func AdminRevokeInvite(ctx context.Context, inviteId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE authInvites SET revokedAt = ? WHERE inviteId = ? AND consumedByUserId IS NULL AND revokedAt IS NULL",
+		time.Now().Unix(), inviteId)
+	if err != nil {
+		return err
+	}
+
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return errors.New("this invite has already been used or revoked")
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.InviteRevoke, inviteId, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Sets the user to have exactly this many unused invites
-func AdminSetRemainingInvites(userId string, remainingInvites int) error {
-	// Delete all unused invites for this user
-	_, err := db.DB.Exec("DELETE FROM authInvites WHERE createdByUserId = ? AND consumedByUserId IS NULL", userId)
+func AdminSetRemainingInvites(ctx context.Context, userId string, remainingInvites int) error {
+	// Delete all unused invites for this user; revoked ones are kept to show what happened to them
+	_, err := db.DB.Exec("DELETE FROM authInviteRoles WHERE inviteId IN (SELECT inviteId FROM authInvites WHERE createdByUserId = ? AND consumedByUserId IS NULL AND revokedAt IS NULL)", userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec("DELETE FROM authInvites WHERE createdByUserId = ? AND consumedByUserId IS NULL AND revokedAt IS NULL", userId)
 	if err != nil {
 		return err
 	}
@@ -65,19 +184,19 @@ func AdminSetRemainingInvites(userId string, remainingInvites int) error {
 		}
 	}
 
-	return nil
+	return audit.Record(ctx, audit.UserInvites, userId, map[string]int{"remaining": remainingInvites})
 }
 
-// Returns the first unused invite for the specified user, or error if none found
+// Returns the newest usable invite for the specified user, or error if none found
 func GetUserInviteId(userId string) (string, error) {
 	var inviteId string
 
 	err := db.DB.QueryRow(`
 		SELECT inviteId
 		FROM authInvites
-		WHERE createdByUserId = ? AND consumedByUserId IS NULL
+		WHERE createdByUserId = ? AND `+usableInvite+`
 		ORDER BY inviteId DESC
-		LIMIT 1`, userId).Scan(&inviteId)
+		LIMIT 1`, userId, time.Now().Unix()).Scan(&inviteId)
 
 	if err != nil {
 		log.Println("error selecting unused invite code:", err)
@@ -87,15 +206,15 @@ func GetUserInviteId(userId string) (string, error) {
 	return inviteId, nil
 }
 
-// Returns any unused invite for the specified user within a transaction
+// Returns any usable invite for the specified user within a transaction
 func GetUserInviteIdTx(tx *sql.Tx, userId string) (string, error) {
 	var inviteId string
 
 	err := tx.QueryRow(`
 		SELECT inviteId
 		FROM authInvites
-		WHERE createdByUserId = ? AND consumedByUserId IS NULL
-		LIMIT 1`, userId).Scan(&inviteId)
+		WHERE createdByUserId = ? AND `+usableInvite+`
+		LIMIT 1`, userId, time.Now().Unix()).Scan(&inviteId)
 
 	if err != nil {
 		log.Println("error selecting unused invite code:", err)
@@ -105,24 +224,34 @@ func GetUserInviteIdTx(tx *sql.Tx, userId string) (string, error) {
 	return inviteId, nil
 }
 
-// Marks an invite as consumed by a specific user within a transaction
+// Marks an invite as consumed by a specific user within a transaction. Returns ErrInvalidInvite if it
+// can't be used any more.
 func AdminConsumeInviteTx(tx *sql.Tx, inviteId string, consumedByUserId string) error {
-	_, err := tx.Exec(`
-		UPDATE authInvites 
+	now := time.Now().Unix()
+
+	result, err := tx.Exec(`
+		UPDATE authInvites
 		SET consumedByUserId = ?, consumedAt = ?
-		WHERE inviteId = ? AND consumedByUserId IS NULL`,
-		consumedByUserId, time.Now().Unix(), inviteId)
+		WHERE inviteId = ? AND `+usableInvite,
+		consumedByUserId, now, inviteId, now)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if consumed, _ := result.RowsAffected(); consumed == 0 {
+		return ErrInvalidInvite
+	}
+
+	return nil
 }
 
 func AdminInvitesRemaining(userId string) (int, error) {
-	// Count unused invites for all users
+	// Count usable invites for this user
 	var invitesRemaining int
 	err := db.DB.QueryRow(`
-		SELECT COUNT(*) 
-		FROM authInvites 
-		WHERE createdByUserId = ? AND consumedByUserId IS NULL`, userId).Scan(&invitesRemaining)
+		SELECT COUNT(*)
+		FROM authInvites
+		WHERE createdByUserId = ? AND `+usableInvite, userId, time.Now().Unix()).Scan(&invitesRemaining)
 
 	if err != nil {
 		log.Println("error counting remaining invites:", err)
@@ -137,13 +266,13 @@ func ValidateInviteCode(inviteCode string) (createdByUserId string, err error) {
 	var createdBy string
 
 	err = db.DB.QueryRow(`
-		SELECT createdByUserId 
-		FROM authInvites 
-		WHERE inviteId = ? AND consumedByUserId IS NULL`, inviteCode).Scan(&createdBy)
+		SELECT createdByUserId
+		FROM authInvites
+		WHERE inviteId = ? AND `+usableInvite, inviteCode, time.Now().Unix()).Scan(&createdBy)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", errors.New("invalid or expired invite code")
+			return "", ErrInvalidInvite
 		}
 		return "", err
 	}
@@ -152,7 +281,12 @@ func ValidateInviteCode(inviteCode string) (createdByUserId string, err error) {
 }
 
 // Registers a new user with an invite code
-func RegisterUserWithInvite(inviteCode string, username string, password string) (string, error) {
+func RegisterUserWithInvite(ctx context.Context, inviteCode string, username string, password string) (string, error) {
+	return registerUserWithInvite(ctx, audit.InviteRedeem, inviteCode, username, password)
+}
+
+// Like RegisterUserWithInvite, recording it in the audit log as the given action.
+func registerUserWithInvite(ctx context.Context, action string, inviteCode string, username string, password string) (string, error) {
 	// Validate invite code first
 	_, err := ValidateInviteCode(inviteCode)
 	if err != nil {
@@ -177,14 +311,36 @@ func RegisterUserWithInvite(inviteCode string, username string, password string)
 		return "", err
 	}
 
-	// Give the new user 5 starting invites
-	for i := 0; i < 5; i++ {
+	roleIds, err := getInviteRoleIds(tx, inviteCode)
+	if err != nil {
+		return "", err
+	}
+
+	if err := setUserRoleIds(tx, newUserId, roleIds); err != nil {
+		return "", err
+	}
+
+	// Give the new user their starting invites
+	inviteQuota := config.Config.Invites.Quota
+	var presetQuota sql.NullInt64
+	if err := tx.QueryRow("SELECT inviteQuota FROM authInvites WHERE inviteId = ?", inviteCode).Scan(&presetQuota); err != nil {
+		return "", err
+	}
+	if presetQuota.Valid {
+		inviteQuota = int(presetQuota.Int64)
+	}
+
+	for i := 0; i < inviteQuota; i++ {
 		_, err := AdminCreateInviteTx(tx, newUserId)
 		if err != nil {
 			return "", err
 		}
 	}
 
+	if err := audit.RecordTx(ctx, tx, action, newUserId, map[string]string{"username": username, "inviteId": inviteCode}); err != nil {
+		return "", err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return "", err
 	}
@@ -192,6 +348,207 @@ func RegisterUserWithInvite(inviteCode string, username string, password string)
 	return newUserId, nil
 }
 
+func getInviteRoleIds(tx *sql.Tx, inviteId string) ([]string, error) {
+	rows, err := tx.Query("SELECT roleId FROM authInviteRoles WHERE inviteId = ?", inviteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIds []string
+	for rows.Next() {
+		var roleId string
+		if err := rows.Scan(&roleId); err != nil {
+			return nil, err
+		}
+		roleIds = append(roleIds, roleId)
+	}
+
+	return roleIds, rows.Err()
+}
+
+type Invite struct {
+	InviteId string
+
+	CreatedByUserId   string
+	CreatedByUsername string
+
+	// Empty if the invite hasn't been used.
+	ConsumedByUserId   string
+	ConsumedByUsername string
+
+	CreatedAt time.Time
+
+	// Zero if the invite hasn't been used, doesn't expire, or hasn't been revoked.
+	ConsumedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  time.Time
+
+	Note string
+
+	// Nil for config.Config.Invites.Quota.
+	InviteQuota *int
+
+	// Names of the role definitions the new user gets.
+	RoleNames []string
+}
+
+// One of "used", "revoked", "expired" or "pending".
+func (invite Invite) Status() string {
+	switch {
+	case invite.ConsumedByUserId != "":
+		return "used"
+	case !invite.RevokedAt.IsZero():
+		return "revoked"
+	case !invite.ExpiresAt.IsZero() && !invite.ExpiresAt.After(time.Now()):
+		return "expired"
+	default:
+		return "pending"
+	}
+}
+
+func optionalUnix(unix sql.NullInt64) time.Time {
+	if !unix.Valid {
+		return time.Time{}
+	}
+
+	return time.Unix(unix.Int64, 0)
+}
+
+// Returns every invite, newest first. Those that don't give anything beyond a plain invite are left out
+// unless includePlain is set, since every user has several.
+func GetInvites(includePlain bool) ([]Invite, error) {
+	query := `
+		SELECT
+			i.inviteId, i.createdByUserId, COALESCE(creator.userName, ''), COALESCE(i.consumedByUserId, ''),
+			COALESCE(consumer.userName, ''), i.createdAt, i.consumedAt, i.expiresAt, i.revokedAt, i.note,
+			i.inviteQuota
+		FROM authInvites AS i
+		LEFT JOIN authUsers AS creator ON creator.userId = i.createdByUserId
+		LEFT JOIN authUsers AS consumer ON consumer.userId = i.consumedByUserId`
+	if !includePlain {
+		query += `
+		WHERE i.expiresAt IS NOT NULL OR i.revokedAt IS NOT NULL OR i.note != '' OR i.inviteQuota IS NOT NULL
+			OR i.inviteId IN (SELECT inviteId FROM authInviteRoles)`
+	}
+
+	rows, err := db.DB.Query(query + " ORDER BY i.createdAt DESC, i.inviteId DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	indexes := make(map[string]int)
+	for rows.Next() {
+		var invite Invite
+		var createdAt int64
+		var consumedAt, expiresAt, revokedAt, inviteQuota sql.NullInt64
+
+		if err := rows.Scan(&invite.InviteId, &invite.CreatedByUserId, &invite.CreatedByUsername, &invite.ConsumedByUserId,
+			&invite.ConsumedByUsername, &createdAt, &consumedAt, &expiresAt, &revokedAt, &invite.Note, &inviteQuota); err != nil {
+			return nil, err
+		}
+
+		invite.CreatedAt = time.Unix(createdAt, 0)
+		invite.ConsumedAt = optionalUnix(consumedAt)
+		invite.ExpiresAt = optionalUnix(expiresAt)
+		invite.RevokedAt = optionalUnix(revokedAt)
+
+		if inviteQuota.Valid {
+			quota := int(inviteQuota.Int64)
+			invite.InviteQuota = &quota
+		}
+
+		indexes[invite.InviteId] = len(invites)
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roleRows, err := db.DB.Query(`
+		SELECT r.inviteId, d.name
+		FROM authInviteRoles AS r
+		JOIN authRoleDefinitions AS d ON d.roleId = r.roleId
+		ORDER BY d.name COLLATE NOCASE`)
+	if err != nil {
+		return nil, err
+	}
+	defer roleRows.Close()
+
+	for roleRows.Next() {
+		var inviteId, name string
+		if err := roleRows.Scan(&inviteId, &name); err != nil {
+			return nil, err
+		}
+
+		if index, ok := indexes[inviteId]; ok {
+			invites[index].RoleNames = append(invites[index].RoleNames, name)
+		}
+	}
+
+	return invites, roleRows.Err()
+}
+
+// A user and everyone they invited, and everyone those users invited, and so on.
+type InviteTreeNode struct {
+	UserId    string
+	Username  string
+	Deleted   bool
+	CreatedAt time.Time
+	Invited   []*InviteTreeNode
+}
+
+// Returns everyone who wasn't invited by another user (such as admin), each with who they invited below
+// them. Deleted users are included so those they invited still have a place in the tree.
+func GetInviteTree() ([]*InviteTreeNode, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.userId, u.userName, u.deleted, u.createdAt, COALESCE(i.createdByUserId, '')
+		FROM authUsers AS u
+		LEFT JOIN authInvites AS i ON i.consumedByUserId = u.userId
+		ORDER BY u.createdAt, u.userId`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make(map[string]*InviteTreeNode)
+	var order []*InviteTreeNode
+	invitedBy := make(map[string]string)
+
+	for rows.Next() {
+		var node InviteTreeNode
+		var createdAt int64
+		var inviterId string
+
+		if err := rows.Scan(&node.UserId, &node.Username, &node.Deleted, &createdAt, &inviterId); err != nil {
+			return nil, err
+		}
+
+		node.CreatedAt = time.Unix(createdAt, 0)
+		nodes[node.UserId] = &node
+		order = append(order, &node)
+		invitedBy[node.UserId] = inviterId
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var roots []*InviteTreeNode
+	for _, node := range order {
+		inviter, ok := nodes[invitedBy[node.UserId]]
+		if !ok {
+			roots = append(roots, node)
+			continue
+		}
+
+		inviter.Invited = append(inviter.Invited, node)
+	}
+
+	return roots, nil
+}
+
 // Generates a full invite URL for sharing
 func GenerateInviteURL(hostname string, inviteCode string) string {
 	// Use https for non-localhost hosts, http for localhost
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"lod2/config"
+	"lod2/db"
+	"testing"
+	"time"
+)
+
+func TestInvites_ExpiredAndRevokedCantBeUsed(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	inviterId := createTotpTestUser(t, nil)
+
+	expiringId, err := AdminIssueInvite(context.Background(), inviterId, InviteOptions{ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("AdminIssueInvite failed: %v", err)
+	}
+
+	if _, err := ValidateInviteCode(expiringId); err != nil {
+		t.Errorf("invite before it expires: got %v, want it to be valid", err)
+	}
+
+	if _, err := AdminIssueInvite(context.Background(), inviterId, InviteOptions{ExpiresAt: time.Now().Add(-time.Hour)}); err == nil {
+		t.Error("issuing an invite that has already expired should fail")
+	}
+
+	// Pretend the hour has passed.
+	if _, err := db.DB.Exec("UPDATE authInvites SET expiresAt = ? WHERE inviteId = ?", time.Now().Add(-time.Minute).Unix(), expiringId); err != nil {
+		t.Fatalf("failed to expire invite: %v", err)
+	}
+
+	if _, err := RegisterUserWithInvite(context.Background(), expiringId, "late", "password"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("using an expired invite: got %v, want ErrInvalidInvite", err)
+	}
+
+	revokedId, _ := AdminIssueInvite(context.Background(), inviterId, InviteOptions{Note: "for someone"})
+
+	if err := AdminRevokeInvite(context.Background(), revokedId); err != nil {
+		t.Fatalf("AdminRevokeInvite failed: %v", err)
+	}
+
+	if _, err := RegisterUserWithInvite(context.Background(), revokedId, "revoked", "password"); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("using a revoked invite: got %v, want ErrInvalidInvite", err)
+	}
+
+	if err := AdminRevokeInvite(context.Background(), revokedId); err == nil {
+		t.Error("revoking an invite twice should fail")
+	}
+
+	// Neither counts as one the inviter has left.
+	if remaining, _ := AdminInvitesRemaining(inviterId); remaining != 0 {
+		t.Errorf("got %d invites remaining, want 0", remaining)
+	}
+}
+
+func TestInvites_PresetRolesAndQuota(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	inviterId := createTotpTestUser(t, nil)
+
+	roleId, err := AdminCreateRoleDefinition(context.Background(), "Viewer", "", []Role{{Scope: Storage, Level: View}})
+	if err != nil {
+		t.Fatalf("AdminCreateRoleDefinition failed: %v", err)
+	}
+
+	quota := 2
+	inviteId, err := AdminIssueInvite(context.Background(), inviterId, InviteOptions{RoleIds: []string{roleId}, InviteQuota: &quota})
+	if err != nil {
+		t.Fatalf("AdminIssueInvite failed: %v", err)
+	}
+
+	userId, err := RegisterUserWithInvite(context.Background(), inviteId, "newcomer", "password")
+	if err != nil {
+		t.Fatalf("RegisterUserWithInvite failed: %v", err)
+	}
+
+	if roles, _ := GetUserRoles(userId); GetRoleMap(roles)[Storage] != View {
+		t.Errorf("got roles %+v, want Storage View from the invite", roles)
+	}
+
+	if remaining, _ := AdminInvitesRemaining(userId); remaining != quota {
+		t.Errorf("got %d invites remaining, want %d from the invite", remaining, quota)
+	}
+
+	// Without a quota of its own, an invite gives the configured one.
+	originalQuota := config.Config.Invites.Quota
+	config.Config.Invites.Quota = 3
+	defer func() { config.Config.Invites.Quota = originalQuota }()
+
+	plainId, _ := GetUserInviteId(userId)
+	secondId, err := RegisterUserWithInvite(context.Background(), plainId, "second", "password")
+	if err != nil {
+		t.Fatalf("RegisterUserWithInvite failed: %v", err)
+	}
+
+	if remaining, _ := AdminInvitesRemaining(secondId); remaining != 3 {
+		t.Errorf("got %d invites remaining, want the configured 3", remaining)
+	}
+
+	if roles, _ := GetUserRoles(secondId); GetRoleMap(roles)[Storage] != AccessLevelNone {
+		t.Errorf("got roles %+v from a plain invite, want none", roles)
+	}
+
+	tree, err := GetInviteTree()
+	if err != nil {
+		t.Fatalf("GetInviteTree failed: %v", err)
+	}
+
+	var inviter *InviteTreeNode
+	for _, root := range tree {
+		if root.UserId == inviterId {
+			inviter = root
+		}
+	}
+
+	if inviter == nil || len(inviter.Invited) != 1 || inviter.Invited[0].UserId != userId ||
+		len(inviter.Invited[0].Invited) != 1 || inviter.Invited[0].Invited[0].UserId != secondId {
+		t.Errorf("got tree under the inviter %+v, want newcomer, then second", inviter)
+	}
+}
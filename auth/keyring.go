@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+
+	"lod2/audit"
+	"lod2/config"
+	"lod2/utils"
+)
+
+// The keys used to sign and verify tokens live in keys/auth/ in the config directory:
+//
+//	private.jwk.json          the current key, which signs every new token
+//	previous/<kid>.jwk.json   keys it has replaced, still used to verify tokens signed before then
+//
+// Every key has a key ID ("kid") that is put in the header of the tokens it signs. Previous keys also
+// have a "retiredAt" field (RFC 3339); once every token they could have signed has expired, they're
+// deleted. Rotating the key therefore doesn't log anyone out.
+
+// A previous key's private field recording when it stopped signing tokens.
+const keyRetiredAtField = "retiredAt"
+
+// Refresh tokens are the longest-lived tokens we sign, and are signed again with the current key each
+// time they're used, so a key can't have signed anything still valid after this long.
+const retiredKeyRetention = RefreshTokenExpirationDuration
+
+var keysMu sync.RWMutex
+
+// Held for the whole of a rotation, so two at once can't both retire the same key.
+var rotateMu sync.Mutex
+
+// The key used to sign new tokens.
+var signingKey jwk.Key
+
+// Public keys of the current and previous keys, used to verify tokens.
+var verificationKeys = jwk.NewSet()
+
+// Retirement times of the previous keys, by key ID.
+var retiredKeys map[string]time.Time
+
+type SigningKeyInfo struct {
+	KeyId   string
+	Current bool
+
+	// Zero for the current key.
+	RetiredAt time.Time
+
+	// When a previous key will be deleted.
+	RemoveAt time.Time
+}
+
+func authKeysDir() string {
+	return filepath.Join(config.Config.ConfigPath, "keys/auth")
+}
+
+func currentKeyPath() string {
+	return filepath.Join(authKeysDir(), "private.jwk.json")
+}
+
+func previousKeyPath(keyId string) string {
+	return filepath.Join(authKeysDir(), "previous", keyId+".jwk.json")
+}
+
+// Loads the current and previous keys from disk, deleting previous keys that are no longer needed.
+func loadKeyRing() error {
+	current, err := loadPrivateKey(currentKeyPath())
+	if err != nil {
+		return err
+	}
+
+	if err := prepareSigningKey(current); err != nil {
+		return err
+	}
+
+	set := jwk.NewSet()
+	retired := map[string]time.Time{}
+
+	if err := addVerificationKey(set, current); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(previousKeyPath("*"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		key, err := loadPrivateKey(file)
+		if err != nil {
+			log.Printf("skipping previous auth key %s: %s", file, err)
+			continue
+		}
+
+		var retiredAtText string
+		if err := key.Get(keyRetiredAtField, &retiredAtText); err != nil {
+			log.Printf("skipping previous auth key %s: no %s", file, keyRetiredAtField)
+			continue
+		}
+
+		retiredAt, err := time.Parse(time.RFC3339, retiredAtText)
+		if err != nil {
+			log.Printf("skipping previous auth key %s: %s", file, err)
+			continue
+		}
+
+		if time.Since(retiredAt) > retiredKeyRetention {
+			if err := os.Remove(file); err != nil {
+				log.Printf("unable to delete expired auth key %s: %s", file, err)
+			} else {
+				log.Printf("deleted auth key %s; every token it signed has expired", file)
+			}
+			continue
+		}
+
+		if err := prepareSigningKey(key); err != nil {
+			log.Printf("skipping previous auth key %s: %s", file, err)
+			continue
+		}
+
+		if err := addVerificationKey(set, key); err != nil {
+			log.Printf("skipping previous auth key %s: %s", file, err)
+			continue
+		}
+
+		keyId, _ := key.KeyID()
+		retired[keyId] = retiredAt
+	}
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	signingKey = current
+	verificationKeys = set
+	retiredKeys = retired
+
+	return nil
+}
+
+// Fills in what older key files may be missing: a key ID (the key's RFC 7638 thumbprint), its use and
+// its algorithm.
+func prepareSigningKey(key jwk.Key) error {
+	if keyId, ok := key.KeyID(); !ok || keyId == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return err
+		}
+
+		if err := key.Set(jwk.KeyIDKey, base64.RawURLEncoding.EncodeToString(thumbprint)); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := key.KeyUsage(); !ok {
+		if err := key.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := key.Algorithm(); !ok {
+		if err := key.Set(jwk.AlgorithmKey, jwa.RS256()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds the public half of the key to the set, without anything only we need to know.
+func addVerificationKey(set jwk.Set, key jwk.Key) error {
+	public, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return err
+	}
+
+	if public.Has(keyRetiredAtField) {
+		if err := public.Remove(keyRetiredAtField); err != nil {
+			return err
+		}
+	}
+
+	return set.AddKey(public)
+}
+
+// Generates a new key and makes it the current one. The key it replaces is kept to verify the tokens it
+// has already signed. Returns the new key's ID.
+func RotateSigningKey(ctx context.Context) (string, error) {
+	rotateMu.Lock()
+	defer rotateMu.Unlock()
+
+	previous := getSigningKey()
+
+	if previous == nil {
+		return "", errors.New("no current auth key to replace")
+	}
+
+	key, err := generateSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	retiring, err := previous.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	if err := retiring.Set(keyRetiredAtField, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+
+	// The old key is saved first, so that a failure part way through never loses it.
+	previousKeyId, _ := retiring.KeyID()
+	if err := writeKeyFile(previousKeyPath(previousKeyId), retiring); err != nil {
+		return "", err
+	}
+
+	if err := writeKeyFile(currentKeyPath(), key); err != nil {
+		return "", err
+	}
+
+	if err := loadKeyRing(); err != nil {
+		return "", err
+	}
+
+	keyId, _ := key.KeyID()
+	log.Printf("auth key %s replaced by %s", previousKeyId, keyId)
+
+	return keyId, audit.Record(ctx, audit.SigningKeyRotate, keyId, map[string]string{"previousKeyId": previousKeyId})
+}
+
+func generateSigningKey() (jwk.Key, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwk.Import(rsaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := prepareSigningKey(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Writes the key to a temporary file first and renames it into place, so the file is never half written.
+func writeKeyFile(filename string, key jwk.Key) error {
+	if err := utils.EnsureDirForFile(filename); err != nil {
+		return err
+	}
+
+	bytes, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(filename), ".new-key-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(bytes); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), filename)
+}
+
+// Returns the current key, for signing.
+func getSigningKey() jwk.Key {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	return signingKey
+}
+
+// Returns the public keys that tokens are verified with, current first. This is what other services need
+// to verify tokens we've signed.
+func GetVerificationKeys() jwk.Set {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	return verificationKeys
+}
+
+// Lists the current and previous keys, current first, then the most recently retired.
+func GetSigningKeys() []SigningKeyInfo {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	var keys []SigningKeyInfo
+
+	if signingKey != nil {
+		keyId, _ := signingKey.KeyID()
+		keys = append(keys, SigningKeyInfo{KeyId: keyId, Current: true})
+	}
+
+	var previous []SigningKeyInfo
+	for keyId, retiredAt := range retiredKeys {
+		previous = append(previous, SigningKeyInfo{
+			KeyId:     keyId,
+			RetiredAt: retiredAt,
+			RemoveAt:  retiredAt.Add(retiredKeyRetention),
+		})
+	}
+
+	sort.Slice(previous, func(i, j int) bool {
+		if !previous[i].RetiredAt.Equal(previous[j].RetiredAt) {
+			return previous[i].RetiredAt.After(previous[j].RetiredAt)
+		}
+		return previous[i].KeyId < previous[j].KeyId
+	})
+
+	return append(keys, previous...)
+}
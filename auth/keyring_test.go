@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jwt"
+
+	"lod2/config"
+)
+
+// Points the config directory at a temporary one holding a fresh current key, as config.Init would
+// create, and loads it.
+func setupTestKeyRing(t testing.TB) func() {
+	tempDir, err := os.MkdirTemp("", "auth_keys_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	previousConfigPath := config.Config.ConfigPath
+	config.Config.ConfigPath = tempDir
+
+	key, err := generateSigningKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	// Like keys made before key IDs, and by mkjwk.org.
+	key.Remove(jwk.KeyIDKey)
+
+	if err := writeKeyFile(currentKeyPath(), key); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	if err := loadKeyRing(); err != nil {
+		t.Fatalf("loadKeyRing failed: %v", err)
+	}
+
+	return func() {
+		config.Config.ConfigPath = previousConfigPath
+		os.RemoveAll(tempDir)
+	}
+}
+
+func signTestToken(t *testing.T) string {
+	builder := getTokenBuilder(time.Now().Add(time.Minute))
+	builder.Subject("user_test")
+
+	signed, err := signToken(builder)
+	if err != nil {
+		t.Fatalf("signToken failed: %v", err)
+	}
+
+	return signed
+}
+
+func TestRotateSigningKey_KeepsOldTokensValid(t *testing.T) {
+	defer setupTestKeyRing(t)()
+	defer setupTestDatabase(t)()
+
+	before := signTestToken(t)
+	oldKeyId := GetSigningKeys()[0].KeyId
+
+	newKeyId, err := RotateSigningKey(context.Background())
+	if err != nil {
+		t.Fatalf("RotateSigningKey failed: %v", err)
+	}
+
+	if newKeyId == oldKeyId {
+		t.Fatalf("new key has the same ID as the old one, %s", newKeyId)
+	}
+
+	after := signTestToken(t)
+
+	if _, err := ParseToken(before); err != nil {
+		t.Errorf("token signed before rotating: %v", err)
+	}
+
+	if _, err := ParseToken(after); err != nil {
+		t.Errorf("token signed after rotating: %v", err)
+	}
+
+	// Loading again from disk, as at startup, gives the same keys.
+	if err := loadKeyRing(); err != nil {
+		t.Fatalf("loadKeyRing failed: %v", err)
+	}
+
+	keys := GetSigningKeys()
+	if len(keys) != 2 || !keys[0].Current || keys[0].KeyId != newKeyId || keys[1].KeyId != oldKeyId {
+		t.Errorf("got keys %+v, want %s signing and %s verifying", keys, newKeyId, oldKeyId)
+	}
+
+	if _, err := ParseToken(before); err != nil {
+		t.Errorf("token signed before rotating, after reloading: %v", err)
+	}
+}
+
+func TestParseToken_AcceptsTokensWithoutKeyId(t *testing.T) {
+	defer setupTestKeyRing(t)()
+	defer setupTestDatabase(t)()
+
+	// As signed before keys had IDs.
+	key, err := getSigningKey().Clone()
+	if err != nil {
+		t.Fatalf("failed to clone key: %v", err)
+	}
+	key.Remove(jwk.KeyIDKey)
+
+	token, err := getTokenBuilder(time.Now().Add(time.Minute)).Subject("user_test").Build()
+	if err != nil {
+		t.Fatalf("failed to build token: %v", err)
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256(), key))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	if _, err := RotateSigningKey(context.Background()); err != nil {
+		t.Fatalf("RotateSigningKey failed: %v", err)
+	}
+
+	if _, err := ParseToken(string(signed)); err != nil {
+		t.Errorf("token without a key ID: %v", err)
+	}
+}
+
+func TestGetVerificationKeys_OnlyPublicParts(t *testing.T) {
+	defer setupTestKeyRing(t)()
+	defer setupTestDatabase(t)()
+
+	if _, err := RotateSigningKey(context.Background()); err != nil {
+		t.Fatalf("RotateSigningKey failed: %v", err)
+	}
+
+	bytes, err := json.Marshal(GetVerificationKeys())
+	if err != nil {
+		t.Fatalf("failed to marshal keys: %v", err)
+	}
+
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(bytes, &jwks); err != nil {
+		t.Fatalf("failed to unmarshal keys: %v", err)
+	}
+
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(jwks.Keys))
+	}
+
+	for _, key := range jwks.Keys {
+		for _, private := range []string{"d", "p", "q", "dp", "dq", "qi", keyRetiredAtField} {
+			if _, ok := key[private]; ok {
+				t.Errorf("key %v has %q", key["kid"], private)
+			}
+		}
+
+		if key["kid"] == nil || key["alg"] != "RS256" || key["use"] != "sig" {
+			t.Errorf("key is missing kid, alg or use: %v", key)
+		}
+	}
+}
+
+func TestLoadKeyRing_DeletesKeysPastRetention(t *testing.T) {
+	defer setupTestKeyRing(t)()
+	defer setupTestDatabase(t)()
+
+	oldKeyId := GetSigningKeys()[0].KeyId
+
+	if _, err := RotateSigningKey(context.Background()); err != nil {
+		t.Fatalf("RotateSigningKey failed: %v", err)
+	}
+
+	key, err := loadPrivateKey(previousKeyPath(oldKeyId))
+	if err != nil {
+		t.Fatalf("failed to load previous key: %v", err)
+	}
+
+	retiredAt := time.Now().Add(-retiredKeyRetention - time.Hour)
+	key.Set(keyRetiredAtField, retiredAt.UTC().Format(time.RFC3339))
+
+	if err := writeKeyFile(previousKeyPath(oldKeyId), key); err != nil {
+		t.Fatalf("failed to write previous key: %v", err)
+	}
+
+	if err := loadKeyRing(); err != nil {
+		t.Fatalf("loadKeyRing failed: %v", err)
+	}
+
+	if keys := GetSigningKeys(); len(keys) != 1 {
+		t.Errorf("got keys %+v, want only the current one", keys)
+	}
+
+	if _, err := os.Stat(previousKeyPath(oldKeyId)); !os.IsNotExist(err) {
+		t.Errorf("expired key file still exists: %v", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(authKeysDir(), "previous", "*")); len(files) != 0 {
+		t.Errorf("left behind %v", files)
+	}
+}
@@ -8,6 +8,30 @@ type UserInfo struct {
 	UserId   string
 	Username string
 	Roles    []Role
+
+	// Set when the request is authenticated with an API token: the most the token allows in each scope,
+	// which also limits anything granted outside of roles (such as storage grants).
+	TokenRoles []Role
+
+	// Set when the request is authenticated with an API token: the token's ID.
+	ApiTokenId string
+
+	// Set when the user's roles require two-factor authentication and they haven't enrolled yet. Those
+	// roles are held back until they do.
+	TotpSetupRequired bool
+
+	// Set when an admin has required the user to change their password, until they do.
+	PasswordChangeRequired bool
+
+	// Set when the user has asked for their account to be deleted and the grace period isn't over.
+	DeletionScheduled bool
+
+	// The session the request belongs to. Empty for requests authenticated some other way, such as with
+	// an API token.
+	SessionId string
+
+	// The session's CSRF token, which its state-changing requests must carry. Empty without a session.
+	CsrfToken string
 }
 
 func GetCurrentUserInfo(ctx context.Context) *UserInfo {
@@ -0,0 +1,739 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+
+	"go.jetify.com/typeid"
+)
+
+// lod2 is a minimal OpenID Connect provider, so other self-hosted services can let people log in with
+// their lod2 account. Admins register clients; users log in at /oidc/authorize as usual and agree to
+// share their details with the client once (their consent is remembered); the client then exchanges the
+// code it's sent back with for an ID token and an access token for /oidc/userinfo. Only the authorization
+// code flow is supported, always with PKCE (S256), and there are no refresh tokens.
+//
+// Tokens are signed with the same keys as our own (see keyring.go), so clients can verify them against
+// /.well-known/jwks.json.
+
+// oidcClients table has rows:
+// clientId TEXT
+// name TEXT -- shown to users on the consent screen
+// secretHash TEXT -- hex SHA-256 of the client secret; empty for public clients, which have none
+// createdByUserId TEXT
+// createdAt INTEGER
+
+// oidcClientRedirectUris table has rows:
+// clientId TEXT
+// redirectUri TEXT -- must match the one in the request exactly
+
+// oidcConsents table has rows:
+// userId TEXT
+// clientId TEXT
+// scope TEXT -- space-separated scopes the user agreed to
+// grantedAt INTEGER
+
+// oidcAuthorizationCodes table has rows:
+// codeHash TEXT -- hex SHA-256 of the code
+// clientId TEXT
+// userId TEXT
+// redirectUri TEXT -- the one the code was sent to, which the token request has to repeat
+// scope TEXT
+// nonce TEXT -- from the client, copied into the ID token
+// codeChallenge TEXT -- S256 PKCE challenge
+// createdAt INTEGER
+// expiresAt INTEGER
+// usedAt INTEGER -- NULL until exchanged; codes only work once
+
+// Not "roles", which our own access tokens use for something else (see access.go).
+const oidcRolesClaim = "lod2_roles"
+
+// Client secrets start with this, like API tokens do.
+const OidcClientSecretPrefix = "lod2oidc_"
+
+// The scopes we understand, in the order they're shown on the consent screen. Others are ignored, as the
+// spec asks.
+var OidcScopes = []string{"openid", "profile", "email", "roles"}
+
+var OidcScopeDescriptions = map[string]string{
+	"openid":  "Your user ID",
+	"profile": "Your username and display name",
+	"email":   "Your email address",
+	"roles":   "What you're allowed to do in lod2",
+}
+
+// The errors the token endpoint reports, named after the OAuth error codes they become.
+var ErrOidcInvalidClient = errors.New("invalid client or client secret")
+var ErrOidcInvalidGrant = errors.New("invalid, expired or already used authorization code")
+
+var ErrInvalidOidcToken = errors.New("invalid or expired access token")
+
+type OidcClient struct {
+	ClientId     string
+	Name         string
+	RedirectUris []string
+
+	// Whether the client has a secret. Public clients (such as apps running in the browser) can't keep one,
+	// so they rely on PKCE alone.
+	Confidential bool
+
+	CreatedByUserId string
+	CreatedAt       time.Time
+}
+
+func (client OidcClient) AllowsRedirectUri(redirectUri string) bool {
+	return slices.Contains(client.RedirectUris, redirectUri)
+}
+
+// Returns an error if the URI can't be used to send users back to a client. Plain http is only allowed
+// for clients on the same machine.
+func validateRedirectUri(redirectUri string) error {
+	parsed, err := url.Parse(redirectUri)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return errors.New("redirect URIs must be absolute URLs")
+	}
+
+	if parsed.Fragment != "" {
+		return errors.New("redirect URIs can't have a fragment")
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if host := parsed.Hostname(); host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return nil
+		}
+	}
+
+	return errors.New("redirect URIs must use https, except on localhost")
+}
+
+func newOidcSecret(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return prefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Registers a client, returning it and, for confidential clients, its secret, which isn't stored.
+func AdminCreateOidcClient(ctx context.Context, createdByUserId string, name string, redirectUris []string, confidential bool) (OidcClient, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return OidcClient{}, "", errors.New("client name is required")
+	}
+
+	var uris []string
+	for _, redirectUri := range redirectUris {
+		redirectUri = strings.TrimSpace(redirectUri)
+		if redirectUri == "" || slices.Contains(uris, redirectUri) {
+			continue
+		}
+
+		if err := validateRedirectUri(redirectUri); err != nil {
+			return OidcClient{}, "", err
+		}
+
+		uris = append(uris, redirectUri)
+	}
+
+	if len(uris) == 0 {
+		return OidcClient{}, "", errors.New("at least one redirect URI is required")
+	}
+
+	clientId, _ := typeid.WithPrefix("client")
+	client := OidcClient{
+		ClientId:        clientId.String(),
+		Name:            name,
+		RedirectUris:    uris,
+		Confidential:    confidential,
+		CreatedByUserId: createdByUserId,
+		CreatedAt:       time.Now(),
+	}
+
+	var secret, secretHash string
+	if confidential {
+		var err error
+		if secret, err = newOidcSecret(OidcClientSecretPrefix); err != nil {
+			return OidcClient{}, "", err
+		}
+		secretHash = hashApiToken(secret)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return OidcClient{}, "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO oidcClients (clientId, name, secretHash, createdByUserId, createdAt) VALUES (?, ?, ?, ?, ?)",
+		client.ClientId, client.Name, secretHash, createdByUserId, client.CreatedAt.Unix()); err != nil {
+		return OidcClient{}, "", err
+	}
+
+	for _, redirectUri := range uris {
+		if _, err := tx.Exec("INSERT INTO oidcClientRedirectUris (clientId, redirectUri) VALUES (?, ?)", client.ClientId, redirectUri); err != nil {
+			return OidcClient{}, "", err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.OidcClientCreate, client.ClientId, map[string]interface{}{
+		"name":         name,
+		"redirectUris": uris,
+		"confidential": confidential,
+	}); err != nil {
+		return OidcClient{}, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return OidcClient{}, "", err
+	}
+
+	log.Printf("OIDC client %s (%s) created", client.ClientId, name)
+
+	return client, secret, nil
+}
+
+// Gives a confidential client a new secret, returning it. The old one stops working straight away.
+func AdminResetOidcClientSecret(ctx context.Context, clientId string) (string, error) {
+	secret, err := newOidcSecret(OidcClientSecretPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := db.DB.Exec("UPDATE oidcClients SET secretHash = ? WHERE clientId = ? AND secretHash != ''", hashApiToken(secret), clientId)
+	if err != nil {
+		return "", err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if changed == 0 {
+		return "", errors.New("invalid client id, or the client is public")
+	}
+
+	return secret, audit.Record(ctx, audit.OidcClientSecret, clientId, nil)
+}
+
+// Removes the client, along with every user's consent to it. Tokens it already has stop working at
+// /oidc/userinfo, but ID tokens stay valid until they expire.
+func AdminDeleteOidcClient(ctx context.Context, clientId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	if err := tx.QueryRow("SELECT name FROM oidcClients WHERE clientId = ?", clientId).Scan(&name); err != nil {
+		return errors.New("invalid client id")
+	}
+
+	for _, table := range []string{"oidcAuthorizationCodes", "oidcConsents", "oidcClientRedirectUris", "oidcClients"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE clientId = ?", clientId); err != nil {
+			return err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.OidcClientDelete, clientId, map[string]string{"name": name}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("OIDC client %s (%s) deleted", clientId, name)
+
+	return nil
+}
+
+func scanOidcClients(rows *sql.Rows) ([]OidcClient, error) {
+	defer rows.Close()
+
+	var clients []OidcClient
+	for rows.Next() {
+		var client OidcClient
+		var createdAt int64
+
+		if err := rows.Scan(&client.ClientId, &client.Name, &client.Confidential, &client.CreatedByUserId, &createdAt); err != nil {
+			return nil, err
+		}
+
+		client.CreatedAt = time.Unix(createdAt, 0)
+		clients = append(clients, client)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range clients {
+		uriRows, err := db.DB.Query("SELECT redirectUri FROM oidcClientRedirectUris WHERE clientId = ? ORDER BY redirectUri", clients[i].ClientId)
+		if err != nil {
+			return nil, err
+		}
+
+		for uriRows.Next() {
+			var redirectUri string
+			if err := uriRows.Scan(&redirectUri); err != nil {
+				uriRows.Close()
+				return nil, err
+			}
+			clients[i].RedirectUris = append(clients[i].RedirectUris, redirectUri)
+		}
+		uriRows.Close()
+	}
+
+	return clients, nil
+}
+
+// Returns every client, newest first.
+func AdminGetOidcClients() ([]OidcClient, error) {
+	rows, err := db.DB.Query("SELECT clientId, name, secretHash != '', createdByUserId, createdAt FROM oidcClients ORDER BY createdAt DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOidcClients(rows)
+}
+
+func GetOidcClient(clientId string) (OidcClient, error) {
+	rows, err := db.DB.Query("SELECT clientId, name, secretHash != '', createdByUserId, createdAt FROM oidcClients WHERE clientId = ?", clientId)
+	if err != nil {
+		return OidcClient{}, err
+	}
+
+	clients, err := scanOidcClients(rows)
+	if err != nil {
+		return OidcClient{}, err
+	}
+
+	if len(clients) == 0 {
+		return OidcClient{}, errors.New("invalid client id")
+	}
+
+	return clients[0], nil
+}
+
+// Returns the scopes we understand out of a space-separated list, in our order, or an error if it doesn't
+// ask for openid.
+func ParseOidcScope(scope string) ([]string, error) {
+	requested := strings.Fields(scope)
+
+	if !slices.Contains(requested, "openid") {
+		return nil, errors.New("the openid scope is required")
+	}
+
+	var scopes []string
+	for _, known := range OidcScopes {
+		if slices.Contains(requested, known) {
+			scopes = append(scopes, known)
+		}
+	}
+
+	return scopes, nil
+}
+
+// Whether the user has already agreed to share everything in scopes with the client.
+func HasOidcConsent(userId string, clientId string, scopes []string) (bool, error) {
+	var scope string
+	err := db.DB.QueryRow("SELECT scope FROM oidcConsents WHERE userId = ? AND clientId = ?", userId, clientId).Scan(&scope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	granted := strings.Fields(scope)
+	for _, s := range scopes {
+		if !slices.Contains(granted, s) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Records that the user agreed to share scopes with the client, as well as anything they'd agreed to before.
+func GrantOidcConsent(ctx context.Context, userId string, clientId string, scopes []string) error {
+	var previous string
+	err := db.DB.QueryRow("SELECT scope FROM oidcConsents WHERE userId = ? AND clientId = ?", userId, clientId).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var granted []string
+	for _, known := range OidcScopes {
+		if slices.Contains(scopes, known) || slices.Contains(strings.Fields(previous), known) {
+			granted = append(granted, known)
+		}
+	}
+
+	scope := strings.Join(granted, " ")
+
+	if _, err := db.DB.Exec(`
+		INSERT INTO oidcConsents (userId, clientId, scope, grantedAt) VALUES (?, ?, ?, ?)
+		ON CONFLICT (userId, clientId) DO UPDATE SET scope = excluded.scope, grantedAt = excluded.grantedAt`,
+		userId, clientId, scope, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.OidcConsent, clientId, map[string]string{"scope": scope})
+}
+
+type OidcConsentInfo struct {
+	ClientId   string
+	ClientName string
+	Scopes     []string
+	GrantedAt  time.Time
+}
+
+// Returns the clients the user has agreed to share their details with, most recent first.
+func GetUserOidcConsents(userId string) ([]OidcConsentInfo, error) {
+	rows, err := db.DB.Query(`
+		SELECT c.clientId, c.name, o.scope, o.grantedAt
+		FROM oidcConsents AS o
+		JOIN oidcClients AS c ON c.clientId = o.clientId
+		WHERE o.userId = ?
+		ORDER BY o.grantedAt DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var consents []OidcConsentInfo
+	for rows.Next() {
+		var consent OidcConsentInfo
+		var scope string
+		var grantedAt int64
+
+		if err := rows.Scan(&consent.ClientId, &consent.ClientName, &scope, &grantedAt); err != nil {
+			return nil, err
+		}
+
+		consent.Scopes = strings.Fields(scope)
+		consent.GrantedAt = time.Unix(grantedAt, 0)
+		consents = append(consents, consent)
+	}
+
+	return consents, rows.Err()
+}
+
+// Withdraws the user's consent. The client's access tokens for them stop working at /oidc/userinfo, and
+// the next login asks them again.
+func RevokeOidcConsent(ctx context.Context, userId string, clientId string) error {
+	result, err := db.DB.Exec("DELETE FROM oidcConsents WHERE userId = ? AND clientId = ?", userId, clientId)
+	if err != nil {
+		return err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if changed == 0 {
+		return errors.New("invalid client id")
+	}
+
+	return audit.Record(ctx, audit.OidcConsentRevoke, clientId, nil)
+}
+
+// What a client asked for at /oidc/authorize, once checked.
+type OidcAuthorizationRequest struct {
+	ClientId      string
+	RedirectUri   string
+	Scopes        []string
+	Nonce         string
+	CodeChallenge string
+}
+
+// Returns a code the client can exchange for tokens for the user, once, within OidcCodeExpirationDuration.
+// The user must have consented to the request's scopes already.
+func CreateOidcAuthorizationCode(userId string, request OidcAuthorizationRequest) (string, error) {
+	if consented, err := HasOidcConsent(userId, request.ClientId, request.Scopes); err != nil {
+		return "", err
+	} else if !consented {
+		return "", errors.New("the user hasn't agreed to share this with the client")
+	}
+
+	code, err := newOidcSecret("")
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if _, err := db.DB.Exec(`
+		INSERT INTO oidcAuthorizationCodes (codeHash, clientId, userId, redirectUri, scope, nonce, codeChallenge, createdAt, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashApiToken(code), request.ClientId, userId, request.RedirectUri, strings.Join(request.Scopes, " "),
+		request.Nonce, request.CodeChallenge, now.Unix(), now.Add(OidcCodeExpirationDuration).Unix()); err != nil {
+		return "", err
+	}
+
+	// Old codes are only kept long enough to notice them being reused.
+	if _, err := db.DB.Exec("DELETE FROM oidcAuthorizationCodes WHERE expiresAt < ?", now.Add(-OidcCodeExpirationDuration).Unix()); err != nil {
+		log.Printf("unable to remove expired authorization codes: %v", err)
+	}
+
+	return code, nil
+}
+
+// Checks the client's credentials. Public clients have no secret, and mustn't send one.
+func verifyOidcClient(clientId string, clientSecret string) error {
+	var secretHash string
+	if err := db.DB.QueryRow("SELECT secretHash FROM oidcClients WHERE clientId = ?", clientId).Scan(&secretHash); err != nil {
+		return ErrOidcInvalidClient
+	}
+
+	if secretHash == "" && clientSecret == "" {
+		return nil
+	}
+
+	if secretHash == "" || subtle.ConstantTimeCompare([]byte(hashApiToken(clientSecret)), []byte(secretHash)) != 1 {
+		return ErrOidcInvalidClient
+	}
+
+	return nil
+}
+
+func verifyPkce(codeChallenge string, codeVerifier string) bool {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(codeChallenge)) == 1
+}
+
+type OidcTokens struct {
+	AccessToken string
+	IdToken     string
+	ExpiresIn   time.Duration
+	Scope       string
+}
+
+// Exchanges an authorization code for tokens, for the token endpoint.
+func ExchangeOidcCode(ctx context.Context, clientId string, clientSecret string, code string, redirectUri string, codeVerifier string) (OidcTokens, error) {
+	if err := verifyOidcClient(clientId, clientSecret); err != nil {
+		return OidcTokens{}, err
+	}
+
+	now := time.Now()
+
+	var userId, codeRedirectUri, scope, nonce, codeChallenge string
+	var expiresAt int64
+	var usedAt sql.NullInt64
+
+	err := db.DB.QueryRow(`
+		SELECT userId, redirectUri, scope, nonce, codeChallenge, expiresAt, usedAt
+		FROM oidcAuthorizationCodes WHERE codeHash = ? AND clientId = ?`, hashApiToken(code), clientId).
+		Scan(&userId, &codeRedirectUri, &scope, &nonce, &codeChallenge, &expiresAt, &usedAt)
+	if err != nil {
+		return OidcTokens{}, ErrOidcInvalidGrant
+	}
+
+	if usedAt.Valid {
+		log.Printf("security: authorization code for %s reused by client %s", userId, clientId)
+
+		// Refused either way; an entry that can't be written goes to the server log.
+		audit.Record(ctx, audit.OidcCodeReuse, userId, map[string]string{"clientId": clientId})
+		return OidcTokens{}, ErrOidcInvalidGrant
+	}
+
+	if now.Unix() >= expiresAt || redirectUri != codeRedirectUri || !verifyPkce(codeChallenge, codeVerifier) {
+		return OidcTokens{}, ErrOidcInvalidGrant
+	}
+
+	// Only one request can mark it used, however many race.
+	result, err := db.DB.Exec("UPDATE oidcAuthorizationCodes SET usedAt = ? WHERE codeHash = ? AND usedAt IS NULL", now.Unix(), hashApiToken(code))
+	if err != nil {
+		return OidcTokens{}, err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return OidcTokens{}, err
+	} else if changed == 0 {
+		return OidcTokens{}, ErrOidcInvalidGrant
+	}
+
+	scopes := strings.Fields(scope)
+
+	claims, err := oidcUserClaims(userId, scopes)
+	if err != nil {
+		return OidcTokens{}, ErrOidcInvalidGrant
+	}
+
+	expires := now.Add(OidcTokenExpirationDuration)
+
+	idToken := getTokenBuilder(expires)
+	idToken.Subject(userId)
+	idToken.Audience([]string{clientId})
+	idToken.Claim("azp", clientId)
+	if nonce != "" {
+		idToken.Claim("nonce", nonce)
+	}
+	for name, value := range claims {
+		idToken.Claim(name, value)
+	}
+
+	signedIdToken, err := signToken(idToken)
+	if err != nil {
+		return OidcTokens{}, err
+	}
+
+	accessToken := getTokenBuilder(expires)
+	accessToken.Subject(userId)
+	accessToken.Audience([]string{oidcAccessTokenAudience})
+	accessToken.Claim("client_id", clientId)
+	accessToken.Claim("scope", scope)
+
+	signedAccessToken, err := signToken(accessToken)
+	if err != nil {
+		return OidcTokens{}, err
+	}
+
+	return OidcTokens{
+		AccessToken: signedAccessToken,
+		IdToken:     signedIdToken,
+		ExpiresIn:   OidcTokenExpirationDuration,
+		Scope:       scope,
+	}, nil
+}
+
+// Returns the claims about the user for an access token from ExchangeOidcCode, for the userinfo endpoint.
+// They're looked up again, so they're current; tokens stop working once the user withdraws their consent,
+// the client is deleted or the user can no longer log in.
+func GetOidcUserInfo(signedToken string) (map[string]interface{}, error) {
+	token, err := ParseToken(signedToken)
+	if err != nil {
+		return nil, ErrInvalidOidcToken
+	}
+
+	audience, _ := token.Audience()
+	if !slices.Contains(audience, oidcAccessTokenAudience) {
+		return nil, ErrInvalidOidcToken
+	}
+
+	userId, _ := token.Subject()
+
+	var clientId, scope string
+	if err := token.Get("client_id", &clientId); err != nil {
+		return nil, ErrInvalidOidcToken
+	}
+	if err := token.Get("scope", &scope); err != nil {
+		return nil, ErrInvalidOidcToken
+	}
+
+	scopes := strings.Fields(scope)
+
+	if consented, err := HasOidcConsent(userId, clientId, scopes); err != nil {
+		return nil, err
+	} else if !consented {
+		return nil, ErrInvalidOidcToken
+	}
+
+	claims, err := oidcUserClaims(userId, scopes)
+	if err != nil {
+		return nil, ErrInvalidOidcToken
+	}
+
+	claims["sub"] = userId
+
+	return claims, nil
+}
+
+// Returns the standard claims for the scopes, and for the roles scope an oidcRolesClaim mapping scope names
+// (as in hasRole) to levels, after the two-factor policy, such as {"Storage": "Edit"}. Fails for users who
+// can't log in.
+func oidcUserClaims(userId string, scopes []string) (map[string]interface{}, error) {
+	var username, displayName, email string
+
+	err := db.DB.QueryRow("SELECT userName, displayName, email FROM authUsers WHERE userId = ? AND deleted = 0 AND deleteAt IS NULL", userId).
+		Scan(&username, &displayName, &email)
+	if err != nil {
+		return nil, errors.New("invalid user id")
+	}
+
+	claims := map[string]interface{}{}
+
+	if slices.Contains(scopes, "profile") {
+		claims["preferred_username"] = username
+		claims["name"] = UserProfile{Username: username, DisplayName: displayName}.Name()
+	}
+
+	if slices.Contains(scopes, "email") && email != "" {
+		claims["email"] = email
+		// Users type it in themselves; nothing checks that it's theirs.
+		claims["email_verified"] = false
+	}
+
+	if slices.Contains(scopes, "roles") {
+		userInfo := UserInfo{UserId: userId}
+		if userInfo.Roles, err = GetUserRoles(userId); err != nil {
+			return nil, err
+		}
+
+		if err := ApplyTotpPolicy(&userInfo); err != nil {
+			return nil, err
+		}
+
+		roles := map[string]string{}
+		for _, role := range userInfo.Roles {
+			if role.Level != AccessLevelNone {
+				roles[GetScopeName(role.Scope)] = GetLevelName(role.Level)
+			}
+		}
+		claims[oidcRolesClaim] = roles
+	}
+
+	return claims, nil
+}
+
+type OidcDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Returns the discovery document. Endpoints are under the issuer, which clients check they match.
+func GetOidcDiscovery() OidcDiscovery {
+	return OidcDiscovery{
+		Issuer:                            tokenIssuer,
+		AuthorizationEndpoint:             tokenIssuer + "/oidc/authorize",
+		TokenEndpoint:                     tokenIssuer + "/oidc/token",
+		UserinfoEndpoint:                  tokenIssuer + "/oidc/userinfo",
+		JwksUri:                           tokenIssuer + "/.well-known/jwks.json",
+		ScopesSupported:                   OidcScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "nonce", "azp",
+			"preferred_username", "name", "email", "email_verified", oidcRolesClaim,
+		},
+	}
+}
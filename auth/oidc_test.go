@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+
+	"lod2/audit"
+)
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestOidc_AuthorizationCodeFlow(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	ctx := context.Background()
+	userId := createTotpTestUser(t, []Role{{Scope: Storage, Level: Edit}})
+
+	client, secret, err := AdminCreateOidcClient(ctx, userId, "Wiki", []string{"https://wiki.example.com/callback"}, true)
+	if err != nil {
+		t.Fatalf("AdminCreateOidcClient failed: %v", err)
+	}
+
+	scopes, err := ParseOidcScope("openid roles unknown profile")
+	if err != nil || !slices.Equal(scopes, []string{"openid", "profile", "roles"}) {
+		t.Fatalf("ParseOidcScope: got %v, %v", scopes, err)
+	}
+
+	request := OidcAuthorizationRequest{
+		ClientId:      client.ClientId,
+		RedirectUri:   "https://wiki.example.com/callback",
+		Scopes:        scopes,
+		Nonce:         "n-0S6_WzA2Mj",
+		CodeChallenge: pkceChallenge("verifier"),
+	}
+
+	if _, err := CreateOidcAuthorizationCode(userId, request); err == nil {
+		t.Fatal("a code was issued without the user's consent")
+	}
+
+	if err := GrantOidcConsent(ctx, userId, client.ClientId, scopes); err != nil {
+		t.Fatalf("GrantOidcConsent failed: %v", err)
+	}
+
+	code, err := CreateOidcAuthorizationCode(userId, request)
+	if err != nil {
+		t.Fatalf("CreateOidcAuthorizationCode failed: %v", err)
+	}
+
+	if _, err := ExchangeOidcCode(context.Background(), client.ClientId, "wrong secret", code, request.RedirectUri, "verifier"); !errors.Is(err, ErrOidcInvalidClient) {
+		t.Errorf("wrong secret: got %v, want ErrOidcInvalidClient", err)
+	}
+
+	if _, err := ExchangeOidcCode(context.Background(), client.ClientId, secret, code, request.RedirectUri, "wrong verifier"); !errors.Is(err, ErrOidcInvalidGrant) {
+		t.Errorf("wrong verifier: got %v, want ErrOidcInvalidGrant", err)
+	}
+
+	tokens, err := ExchangeOidcCode(context.Background(), client.ClientId, secret, code, request.RedirectUri, "verifier")
+	if err != nil {
+		t.Fatalf("ExchangeOidcCode failed: %v", err)
+	}
+
+	if _, err := ExchangeOidcCode(context.Background(), client.ClientId, secret, code, request.RedirectUri, "verifier"); !errors.Is(err, ErrOidcInvalidGrant) {
+		t.Errorf("reused code: got %v, want ErrOidcInvalidGrant", err)
+	}
+
+	if entries, err := audit.Query(audit.Filter{Action: audit.OidcCodeReuse}); err != nil || len(entries) != 1 {
+		t.Errorf("expected the reused code in the audit log, got %+v (%v)", entries, err)
+	}
+
+	idToken, err := ParseToken(tokens.IdToken)
+	if err != nil {
+		t.Fatalf("ParseToken failed: %v", err)
+	}
+
+	audience, _ := idToken.Audience()
+	subject, _ := idToken.Subject()
+	var nonce string
+	idToken.Get("nonce", &nonce)
+	if !slices.Equal(audience, []string{client.ClientId}) || subject != userId || nonce != request.Nonce {
+		t.Errorf("ID token has aud %v, sub %q, nonce %q", audience, subject, nonce)
+	}
+
+	// Neither token gets into lod2 itself.
+	if _, err := ParseAccessToken(tokens.IdToken); err == nil {
+		t.Error("the ID token was accepted as a lod2 access token")
+	}
+	if _, err := ParseAccessToken(tokens.AccessToken); err == nil {
+		t.Error("the OIDC access token was accepted as a lod2 access token")
+	}
+
+	claims, err := GetOidcUserInfo(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("GetOidcUserInfo failed: %v", err)
+	}
+
+	roles, _ := claims[oidcRolesClaim].(map[string]string)
+	if claims["sub"] != userId || claims["preferred_username"] != t.Name() || roles["Storage"] != "Edit" {
+		t.Errorf("got claims %v", claims)
+	}
+
+	if _, found := claims["email"]; found {
+		t.Error("email was included without the email scope")
+	}
+
+	if err := RevokeOidcConsent(ctx, userId, client.ClientId); err != nil {
+		t.Fatalf("RevokeOidcConsent failed: %v", err)
+	}
+
+	if _, err := GetOidcUserInfo(tokens.AccessToken); !errors.Is(err, ErrInvalidOidcToken) {
+		t.Errorf("after revoking consent: got %v, want ErrInvalidOidcToken", err)
+	}
+}
+
+func TestOidc_Clients(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	ctx := context.Background()
+
+	for _, redirectUri := range []string{"http://wiki.example.com/callback", "/callback", "https://wiki.example.com/#callback"} {
+		if _, _, err := AdminCreateOidcClient(ctx, "user_admin", "Wiki", []string{redirectUri}, true); err == nil {
+			t.Errorf("redirect URI %q was accepted", redirectUri)
+		}
+	}
+
+	client, secret, err := AdminCreateOidcClient(ctx, "user_admin", "App", []string{"http://localhost:8080/callback"}, false)
+	if err != nil || secret != "" || client.Confidential {
+		t.Fatalf("public client: got %+v, %q, %v", client, secret, err)
+	}
+
+	if err := verifyOidcClient(client.ClientId, ""); err != nil {
+		t.Errorf("public client without a secret: %v", err)
+	}
+
+	if err := verifyOidcClient(client.ClientId, "anything"); !errors.Is(err, ErrOidcInvalidClient) {
+		t.Errorf("public client with a secret: got %v, want ErrOidcInvalidClient", err)
+	}
+
+	if _, err := AdminResetOidcClientSecret(ctx, client.ClientId); err == nil {
+		t.Error("a public client was given a secret")
+	}
+
+	if err := AdminDeleteOidcClient(ctx, client.ClientId); err != nil {
+		t.Fatalf("AdminDeleteOidcClient failed: %v", err)
+	}
+
+	if _, err := GetOidcClient(client.ClientId); err == nil {
+		t.Error("deleted client still found")
+	}
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"lod2/config"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Every new password has to be at least config.Config.Passwords.MinLength characters, have an estimated
+// strength of at least config.Config.Passwords.MinStrength, and not be in the breached password list, if
+// there is one. Setting up the admin user is the only exception.
+
+// The breached password list lives in the config directory. Each line is the uppercase SHA-1 hash of a
+// password, optionally followed by a colon and how often it's been seen, sorted by hash; Have I Been
+// Pwned's downloadable list is in this format. As with their k-anonymity API, only the lines that share
+// the first five characters of the password's hash are read, found with a binary search.
+const breachedPasswordsFilename = "breached-passwords.txt"
+
+// Length of the hash prefix used to find the lines to compare against.
+const breachedPrefixLength = 5
+
+// Passwords (and parts of passwords) people pick so often they're among the first guesses.
+var commonPasswords = []string{
+	"password", "passw0rd", "123456", "12345678", "123456789", "1234567890", "qwerty", "qwertyuiop",
+	"asdfgh", "asdfghjkl", "zxcvbn", "zxcvbnm", "abc123", "111111", "000000", "123123", "iloveyou",
+	"admin", "welcome", "letmein", "monkey", "dragon", "master", "sunshine", "princess", "football",
+	"baseball", "shadow", "superman", "batman", "trustno1", "login", "starwars", "hello", "freedom",
+	"whatever", "qazwsx", "secret", "changeme", "default", "lod2",
+}
+
+// Returns the path to the breached password list.
+func breachedPasswordsPath() string {
+	return filepath.Join(config.Config.ConfigPath, breachedPasswordsFilename)
+}
+
+// Returns an error saying what's wrong with the password, or nil if it can be used. The username is
+// checked against too, since a password containing it is easier to guess.
+func CheckPasswordPolicy(username string, password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+
+	policy := config.Config.Passwords
+
+	if len([]rune(password)) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+
+	if EstimatePasswordStrength(password, username) < policy.MinStrength {
+		return errors.New("password is too easy to guess; try a longer one, or a few unrelated words")
+	}
+
+	breached, err := isPasswordBreached(breachedPasswordsPath(), password)
+	if err != nil {
+		// An unreadable list shouldn't stop everyone from changing their password.
+		log.Printf("unable to check the breached password list: %v", err)
+	} else if breached {
+		return errors.New("this password has appeared in a data breach; choose a different one")
+	}
+
+	return nil
+}
+
+// Estimates how hard the password is to guess, from 0 (among the first few guesses) to 4 (very hard),
+// in the spirit of zxcvbn. Characters that repeat or continue a sequence (such as "aaa" or "123") count
+// for little, as do common passwords and anything in userInputs, such as the username.
+func EstimatePasswordStrength(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	runes := []rune(lower)
+
+	// Which runes are part of something predictable, and how many bits each of those parts is worth.
+	predictable := make([]bool, len(runes))
+	bits := 0.0
+
+	markWords := func(words []string, bitsPerWord float64) {
+		// Longest first, so "123456" inside "123456789" isn't counted again.
+		words = slices.Clone(words)
+		slices.SortFunc(words, func(a, b string) int { return len(b) - len(a) })
+
+		for _, word := range words {
+			word = strings.ToLower(word)
+			if len([]rune(word)) < 3 {
+				continue
+			}
+
+			for offset := 0; ; {
+				index := strings.Index(lower[offset:], word)
+				if index < 0 {
+					break
+				}
+
+				start := len([]rune(lower[:offset+index]))
+				covered := true
+				for i := start; i < start+len([]rune(word)); i++ {
+					covered = covered && predictable[i]
+					predictable[i] = true
+				}
+				if !covered {
+					bits += bitsPerWord
+				}
+				offset += index + len(word)
+			}
+		}
+	}
+
+	markWords(userInputs, 1)
+	markWords(commonPasswords, math.Log2(float64(len(commonPasswords))))
+
+	charsetBits := math.Log2(float64(passwordCharsetSize(password)))
+
+	for i, r := range runes {
+		if predictable[i] {
+			continue
+		}
+
+		if i > 0 && !predictable[i-1] {
+			difference := r - runes[i-1]
+			if difference >= -1 && difference <= 1 {
+				bits += 1
+				continue
+			}
+		}
+
+		bits += charsetBits
+	}
+
+	// Guesses needed, as a power of ten, for each score; the same thresholds as zxcvbn.
+	guessesLog10 := bits * math.Log10(2)
+
+	switch {
+	case guessesLog10 < 3:
+		return 0
+	case guessesLog10 < 6:
+		return 1
+	case guessesLog10 < 8:
+		return 2
+	case guessesLog10 < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Returns how many different characters someone guessing would have to try for each one, judging by the
+// kinds of characters in the password.
+func passwordCharsetSize(password string) int {
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLower = true
+		case r >= 'A' && r <= 'Z':
+			hasUpper = true
+		case r >= '0' && r <= '9':
+			hasDigit = true
+		case r < unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+	}
+
+	size := 0
+	for _, kind := range []struct {
+		present bool
+		size    int
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if kind.present {
+			size += kind.size
+		}
+	}
+
+	return max(size, 2)
+}
+
+// Returns true if the password's hash is in the list at listPath. A missing list means nothing has been
+// breached.
+func isPasswordBreached(listPath string, password string) (bool, error) {
+	file, err := os.Open(listPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix := hash[:breachedPrefixLength]
+
+	// Binary search over byte offsets for the first line whose prefix isn't before the hash's.
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := nextLineStart(file, mid)
+		if err != nil {
+			return false, err
+		}
+
+		line, err := readLineAt(file, start)
+		if err == io.EOF && line == "" {
+			hi = mid
+			continue
+		} else if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		if strings.ToUpper(breachedLinePrefix(line)) < prefix {
+			lo = start + int64(len(line)) + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	start, err := nextLineStart(file, lo)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineHash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		lineHash = strings.ToUpper(lineHash)
+
+		if breachedLinePrefix(lineHash) != prefix {
+			break
+		}
+
+		if lineHash == hash {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func breachedLinePrefix(line string) string {
+	if len(line) < breachedPrefixLength {
+		return line
+	}
+
+	return line[:breachedPrefixLength]
+}
+
+// Returns the offset of the first line that starts at or after offset.
+func nextLineStart(file *os.File, offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	// The byte before offset tells us whether a line starts right at it.
+	line, err := readLineAt(file, offset-1)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	return offset + int64(len(line)), nil
+}
+
+// Returns the line starting at offset, without its newline.
+func readLineAt(file *os.File, offset int64) (string, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+
+	return strings.TrimSuffix(line, "\n"), err
+}
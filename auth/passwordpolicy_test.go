@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"lod2/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		atMost   int
+		atLeast  int
+	}{
+		{"password", 0, 0},
+		{"aaaaaaaaaaaa", 1, 0},
+		{"123456789012", 1, 0},
+		{"Password1", 1, 0},
+		{"alice2024", 2, 0},
+		{"correct horse battery staple", 4, 4},
+		{"k8#Vq2!mZr", 4, 3},
+	}
+
+	for _, test := range tests {
+		strength := EstimatePasswordStrength(test.password, "alice")
+		if strength > test.atMost || strength < test.atLeast {
+			t.Errorf("EstimatePasswordStrength(%q) = %d, want %d to %d", test.password, strength, test.atLeast, test.atMost)
+		}
+	}
+}
+
+// Writes a breached password list with the given passwords and some others, sorted by hash.
+func writeBreachedList(t *testing.T, passwords ...string) string {
+	var lines []string
+	for i := 0; i < 500; i++ {
+		passwords = append(passwords, fmt.Sprintf("filler-%d", i))
+	}
+
+	for i, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+
+	listPath := filepath.Join(t.TempDir(), breachedPasswordsFilename)
+	if err := os.WriteFile(listPath, []byte(strings.Join(lines, "\r\n")), 0o600); err != nil {
+		t.Fatalf("failed to write breached password list: %v", err)
+	}
+
+	return listPath
+}
+
+func TestIsPasswordBreached(t *testing.T) {
+	listPath := writeBreachedList(t, "hunter2", "correct horse battery staple")
+
+	for _, password := range []string{"hunter2", "correct horse battery staple", "filler-0", "filler-499"} {
+		if breached, err := isPasswordBreached(listPath, password); err != nil || !breached {
+			t.Errorf("isPasswordBreached(%q) = %v, %v; want true", password, breached, err)
+		}
+	}
+
+	for _, password := range []string{"hunter3", "", "filler-500"} {
+		if breached, err := isPasswordBreached(listPath, password); err != nil || breached {
+			t.Errorf("isPasswordBreached(%q) = %v, %v; want false", password, breached, err)
+		}
+	}
+
+	if breached, err := isPasswordBreached(filepath.Join(t.TempDir(), "missing.txt"), "hunter2"); err != nil || breached {
+		t.Errorf("with no list: got %v, %v; want false", breached, err)
+	}
+}
+
+func TestPasswordPolicy_EnforcedWhenSettingPasswords(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	originalConfigPath := config.Config.ConfigPath
+	originalPasswords := config.Config.Passwords
+	defer func() {
+		config.Config.ConfigPath = originalConfigPath
+		config.Config.Passwords = originalPasswords
+	}()
+
+	listPath := writeBreachedList(t, "correct horse battery staple")
+	config.Config.ConfigPath = filepath.Dir(listPath)
+	config.Config.Passwords.MinLength = 10
+	config.Config.Passwords.MinStrength = 2
+
+	inviterId := createTotpTestUser(t, nil)
+	inviteId, err := AdminCreateInvite(inviterId)
+	if err != nil {
+		t.Fatalf("AdminCreateInvite failed: %v", err)
+	}
+
+	for _, password := range []string{"short", "aaaaaaaaaaaaaaaa", "newcomer12345", "correct horse battery staple"} {
+		if _, err := RegisterUserWithInvite(context.Background(), inviteId, "newcomer", password); err == nil {
+			t.Errorf("registering with %q should fail", password)
+		}
+	}
+
+	userId, err := RegisterUserWithInvite(context.Background(), inviteId, "newcomer", "lantern orbit velvet")
+	if err != nil {
+		t.Fatalf("registering with a good password failed: %v", err)
+	}
+
+	if err := ChangePassword(userId, "lantern orbit velvet", "password123", "password123"); err == nil {
+		t.Error("changing to a weak password should fail")
+	}
+
+	if err := ChangePassword(userId, "lantern orbit velvet", "copper meadow quiet", "copper meadow quiet"); err != nil {
+		t.Errorf("changing to a good password failed: %v", err)
+	}
+}
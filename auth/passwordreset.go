@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+
+	"go.jetify.com/typeid"
+)
+
+// Admins can give a user a link to set a new password with, for when they've forgotten theirs. A link
+// works once, until PasswordResetExpirationDuration has passed, and creating another replaces it. As with
+// API tokens, only a hash of the token in the link is stored; the link itself is shown once. Using it ends
+// all of the user's sessions, in case someone else had the old password.
+//
+// Admins can also require a user to change their password, such as one the admin chose for them. Until
+// they do, pages take them to the change password form instead (see AccountActionRequiredMiddleware).
+
+// authPasswordResets table has rows:
+// resetId TEXT
+// userId TEXT -- whose password the link resets
+// tokenHash TEXT -- hex SHA-256 of the token in the link
+// createdByUserId TEXT
+// createdAt INTEGER
+// expiresAt INTEGER
+// usedAt INTEGER -- NULL until used
+// revokedAt INTEGER -- NULL unless revoked or replaced by a newer link
+
+var ErrInvalidPasswordReset = errors.New("invalid or expired password reset link")
+
+// Returned to clients that log in with a password but can't be sent to the change password form.
+var ErrPasswordChangeRequired = errors.New("this account has to change its password before it can be used")
+
+// Matches reset links that can still be used; takes the current unix time.
+const usablePasswordReset = "usedAt IS NULL AND revokedAt IS NULL AND expiresAt > ?"
+
+// Creates a reset link for the user, replacing any they already had, and returns the token to put in it.
+func AdminCreatePasswordReset(ctx context.Context, createdByUserId string, userId string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	resetId, _ := typeid.WithPrefix("reset")
+	now := time.Now()
+	expiresAt := now.Add(PasswordResetExpirationDuration)
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM authUsers WHERE userId = ? AND deleted = 0)", userId).Scan(&exists); err != nil {
+		return "", err
+	} else if !exists {
+		return "", errors.New("invalid user id")
+	}
+
+	if _, err := tx.Exec("UPDATE authPasswordResets SET revokedAt = ? WHERE userId = ? AND "+usablePasswordReset,
+		now.Unix(), userId, now.Unix()); err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO authPasswordResets (resetId, userId, tokenHash, createdByUserId, createdAt, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		resetId.String(), userId, hashApiToken(token), createdByUserId, now.Unix(), expiresAt.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserPasswordLink, userId, map[string]interface{}{"expiresAt": expiresAt.Unix()}); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	log.Printf("password reset link %s created for %s", resetId, userId)
+
+	return token, nil
+}
+
+// Revokes the user's reset link, if they have one that can still be used.
+func AdminRevokePasswordReset(ctx context.Context, userId string) error {
+	result, err := db.DB.Exec("UPDATE authPasswordResets SET revokedAt = ? WHERE userId = ? AND "+usablePasswordReset,
+		time.Now().Unix(), userId, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if revoked, err := result.RowsAffected(); err != nil {
+		return err
+	} else if revoked == 0 {
+		return nil
+	}
+
+	return audit.Record(ctx, audit.UserPasswordRevoke, userId, nil)
+}
+
+// Returns the ID and username of the user the reset token is for, or ErrInvalidPasswordReset if it can't
+// be used. Use CheckPasswordResetToken instead, which limits how often this can be tried.
+func ValidatePasswordResetToken(token string) (string, string, error) {
+	var userId, username string
+
+	err := db.DB.QueryRow(`
+		SELECT u.userId, u.userName
+		FROM authPasswordResets AS r
+		JOIN authUsers AS u ON u.userId = r.userId
+		WHERE r.tokenHash = ? AND u.deleted = 0 AND `+usablePasswordReset,
+		hashApiToken(token), time.Now().Unix()).Scan(&userId, &username)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrInvalidPasswordReset
+	} else if err != nil {
+		return "", "", err
+	}
+
+	return userId, username, nil
+}
+
+// Sets a new password with a reset token, which can't be used again, and ends all of the user's sessions.
+// Returns the username, so they can be logged in.
+func ResetPassword(ctx context.Context, token string, newPassword string, newPasswordVerify string) (string, error) {
+	userId, username, err := ValidatePasswordResetToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	if newPassword != newPasswordVerify {
+		return "", errors.New("new passwords do not match")
+	}
+
+	if err := CheckPasswordPolicy(username, newPassword); err != nil {
+		return "", err
+	}
+
+	passwordHash, err := hashPassword(newPassword)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Marked used only if it still can be, so two requests with the same link can't both succeed.
+	result, err := tx.Exec("UPDATE authPasswordResets SET usedAt = ? WHERE tokenHash = ? AND "+usablePasswordReset,
+		now, hashApiToken(token), now)
+	if err != nil {
+		return "", err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if changed == 0 {
+		return "", ErrInvalidPasswordReset
+	}
+
+	if _, err := tx.Exec("UPDATE authUsers SET userPasswordHash = ?, passwordChangeRequired = 0 WHERE userId = ?", passwordHash, userId); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("UPDATE authSessions SET expiresAt = ? WHERE userId = ? AND expiresAt > ?", now, userId, now); err != nil {
+		return "", err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserPasswordReset, userId, nil); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	// So access tokens from the sessions that just ended stop working now, rather than when they expire.
+	if err := bumpRolesVersion(userId); err != nil {
+		log.Printf("unable to bump roles version for %s: %v", userId, err)
+	}
+
+	log.Printf("password reset for %s", userId)
+
+	return username, nil
+}
+
+type PasswordStatus struct {
+	ChangeRequired bool
+
+	// Zero if the user has no reset link that can still be used.
+	ResetExpiresAt time.Time
+}
+
+func GetPasswordStatus(userId string) (PasswordStatus, error) {
+	status := PasswordStatus{}
+
+	var err error
+	if status.ChangeRequired, err = PasswordChangeRequired(userId); err != nil {
+		return status, err
+	}
+
+	var expiresAt int64
+	err = db.DB.QueryRow("SELECT expiresAt FROM authPasswordResets WHERE userId = ? AND "+usablePasswordReset,
+		userId, time.Now().Unix()).Scan(&expiresAt)
+
+	if err == nil {
+		status.ResetExpiresAt = time.Unix(expiresAt, 0)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// Whether the user has to change their password before doing anything else.
+func PasswordChangeRequired(userId string) (bool, error) {
+	var required bool
+	err := db.DB.QueryRow("SELECT passwordChangeRequired FROM authUsers WHERE userId = ?", userId).Scan(&required)
+	return required, err
+}
+
+// Sets whether the user has to change their password the next time they use the site.
+func AdminSetPasswordChangeRequired(ctx context.Context, userId string, required bool) error {
+	result, err := db.DB.Exec("UPDATE authUsers SET passwordChangeRequired = ? WHERE userId = ? AND deleted = 0", required, userId)
+	if err != nil {
+		return err
+	}
+
+	if changed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if changed == 0 {
+		return errors.New("invalid user id")
+	}
+
+	if err := bumpRolesVersion(userId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.UserPasswordChange, userId, map[string]interface{}{"required": required})
+}
+
+func GeneratePasswordResetURL(hostname string, token string) string {
+	scheme := "https"
+	if strings.HasPrefix(hostname, "localhost") {
+		scheme = "http"
+	}
+	return scheme + "://" + hostname + "/auth/reset/" + token
+}
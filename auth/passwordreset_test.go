@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResetPassword_WorksOnceAndEndsSessions(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	adminId := createLoginTestUser(t, "bob", "admin password")
+	userId := createLoginTestUser(t, "alice", "forgotten password")
+
+	sessionId, err := createUserSession(userId, newRefreshTokenId(), time.Now().Add(time.Hour), r)
+	if err != nil {
+		t.Fatalf("createUserSession failed: %v", err)
+	}
+
+	replacedToken, err := AdminCreatePasswordReset(context.Background(), adminId, userId)
+	if err != nil {
+		t.Fatalf("AdminCreatePasswordReset failed: %v", err)
+	}
+
+	token, err := AdminCreatePasswordReset(context.Background(), adminId, userId)
+	if err != nil {
+		t.Fatalf("AdminCreatePasswordReset failed: %v", err)
+	}
+
+	if _, _, err := ValidatePasswordResetToken(replacedToken); !errors.Is(err, ErrInvalidPasswordReset) {
+		t.Errorf("replaced link: got %v, want ErrInvalidPasswordReset", err)
+	}
+
+	if _, err := ResetPassword(context.Background(), token, "new password", "different"); err == nil {
+		t.Error("resetting with passwords that don't match should fail")
+	}
+
+	username, err := ResetPassword(context.Background(), token, "new password", "new password")
+	if err != nil || username != "alice" {
+		t.Fatalf("ResetPassword: got %q, %v; want alice", username, err)
+	}
+
+	if _, err := getUserLogin("alice", "new password"); err != nil {
+		t.Errorf("logging in with the new password failed: %v", err)
+	}
+
+	if sessions, _ := GetActiveUserSessions(userId); len(sessions) != 0 {
+		t.Errorf("got %d active sessions after the reset, want none (had %s)", len(sessions), sessionId)
+	}
+
+	if _, err := ResetPassword(context.Background(), token, "another password", "another password"); !errors.Is(err, ErrInvalidPasswordReset) {
+		t.Errorf("using a link twice: got %v, want ErrInvalidPasswordReset", err)
+	}
+}
+
+func TestPasswordChangeRequired_InTokensUntilChanged(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createLoginTestUser(t, "alice", "temporary password")
+	token := issueTestAccessToken(t, userId)
+
+	if err := AdminSetPasswordChangeRequired(context.Background(), userId, true); err != nil {
+		t.Fatalf("AdminSetPasswordChangeRequired failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before: got %v, want ErrStaleAccessToken", err)
+	}
+
+	userInfo, err := UserInfoFromAccessToken(issueTestAccessToken(t, userId))
+	if err != nil || !userInfo.PasswordChangeRequired {
+		t.Errorf("got %+v, %v; want PasswordChangeRequired", userInfo, err)
+	}
+
+	if err := ChangePassword(userId, "temporary password", "chosen password", "chosen password"); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+
+	userInfo, err = UserInfoFromAccessToken(issueTestAccessToken(t, userId))
+	if err != nil || userInfo.PasswordChangeRequired {
+		t.Errorf("after changing it: got %+v, %v; want no longer required", userInfo, err)
+	}
+}
+
+func TestVerifyUserLogin_PasswordChangeRequired(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createLoginTestUser(t, "alice", "temporary password")
+
+	if err := AdminSetPasswordChangeRequired(context.Background(), userId, true); err != nil {
+		t.Fatalf("AdminSetPasswordChangeRequired failed: %v", err)
+	}
+
+	if _, err := VerifyUserLogin("alice", "temporary password", "192.0.2.1:5000"); !errors.Is(err, ErrPasswordChangeRequired) {
+		t.Errorf("got %v, want ErrPasswordChangeRequired", err)
+	}
+
+	if err := ChangePassword(userId, "temporary password", "chosen password", "chosen password"); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+
+	if _, err := VerifyUserLogin("alice", "chosen password", "192.0.2.1:5000"); err != nil {
+		t.Errorf("after changing it: got %v, want no error", err)
+	}
+}
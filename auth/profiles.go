@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"lod2/audit"
+	"lod2/db"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Users can give themselves a display name, a contact email and an avatar (the image itself is kept by
+// the storage package, which calls SetUserAvatarUpdated). Admins can rename users; every name a user has
+// had is kept in authUsernameHistory, including the one they had when they were deleted, which is what
+// restoring them gives back.
+
+// authUsernameHistory table has rows:
+// userId TEXT
+// userName TEXT -- a name the user used to have
+// changedAt INTEGER -- when they stopped having it
+
+const maxDisplayNameLength = 64
+
+type UserProfile struct {
+	UserId      string
+	Username    string
+	DisplayName string
+	Email       string
+
+	// Zero if the user has no avatar.
+	AvatarUpdatedAt time.Time
+}
+
+// The display name if the user has one, or the username.
+func (profile UserProfile) Name() string {
+	if profile.DisplayName != "" {
+		return profile.DisplayName
+	}
+
+	return profile.Username
+}
+
+func GetUserProfile(userId string) (UserProfile, error) {
+	profile := UserProfile{UserId: userId}
+
+	var avatarUpdatedAt sql.NullInt64
+	err := db.DB.QueryRow("SELECT userName, displayName, email, avatarUpdatedAt FROM authUsers WHERE userId = ? AND deleted = 0", userId).
+		Scan(&profile.Username, &profile.DisplayName, &profile.Email, &avatarUpdatedAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return profile, errors.New("invalid user id")
+	} else if err != nil {
+		return profile, err
+	}
+
+	profile.AvatarUpdatedAt = optionalUnix(avatarUpdatedAt)
+
+	return profile, nil
+}
+
+// Sets the user's display name and contact email; either can be empty.
+func UpdateUserProfile(ctx context.Context, userId string, displayName string, email string) error {
+	displayName = strings.TrimSpace(displayName)
+	email = strings.TrimSpace(email)
+
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return errors.New("display name is too long")
+	}
+
+	if email != "" {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return errors.New("email address is not valid")
+		}
+	}
+
+	if _, err := db.DB.Exec("UPDATE authUsers SET displayName = ?, email = ? WHERE userId = ? AND deleted = 0", displayName, email, userId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.UserProfile, userId, map[string]string{"displayName": displayName, "email": email})
+}
+
+// Records that the user's avatar has just changed, or that they no longer have one.
+func SetUserAvatarUpdated(ctx context.Context, userId string, hasAvatar bool) error {
+	var updatedAt *int64
+	if hasAvatar {
+		now := time.Now().Unix()
+		updatedAt = &now
+	}
+
+	if _, err := db.DB.Exec("UPDATE authUsers SET avatarUpdatedAt = ? WHERE userId = ?", updatedAt, userId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.UserProfile, userId, map[string]bool{"avatar": hasAvatar})
+}
+
+// Returns an error if the name can't be given to a user.
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("username is required")
+	}
+
+	if username != strings.TrimSpace(username) {
+		return errors.New("username can't start or end with a space")
+	}
+
+	// Deleted users have their ID as their name, so that their old one is free.
+	if strings.HasPrefix(username, "user_") {
+		return errors.New("username can't start with user_")
+	}
+
+	return nil
+}
+
+// Gives the user a new username, remembering the old one. Their sessions carry on under the new name.
+func AdminRenameUser(ctx context.Context, userId string, newUsername string) error {
+	if err := validateUsername(newUsername); err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	if err := tx.QueryRow("SELECT userName FROM authUsers WHERE userId = ? AND deleted = 0", userId).Scan(&username); err != nil {
+		return errors.New("invalid user id")
+	}
+
+	if username == newUsername {
+		return nil
+	}
+
+	if err := setUsernameTx(tx, userId, username, newUsername); err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserRename, userId, map[string]string{"from": username, "to": newUsername}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("user %s renamed from %s to %s", userId, username, newUsername)
+
+	// Access tokens carry the username.
+	return bumpRolesVersion(userId)
+}
+
+// Renames the user, adding their current name to their history.
+func setUsernameTx(tx *sql.Tx, userId string, username string, newUsername string) error {
+	if _, err := tx.Exec("UPDATE authUsers SET userName = ? WHERE userId = ?", newUsername, userId); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return errors.New("this username is already taken")
+		}
+
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO authUsernameHistory (userId, userName, changedAt) VALUES (?, ?, ?)", userId, username, time.Now().Unix())
+	return err
+}
+
+type UsernameChange struct {
+	Username  string
+	ChangedAt time.Time
+}
+
+// Returns the names the user used to have, most recent first.
+func GetUsernameHistory(userId string) ([]UsernameChange, error) {
+	rows, err := db.DB.Query("SELECT userName, changedAt FROM authUsernameHistory WHERE userId = ? ORDER BY changedAt DESC, rowid DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []UsernameChange
+	for rows.Next() {
+		var change UsernameChange
+		var changedAt int64
+		if err := rows.Scan(&change.Username, &changedAt); err != nil {
+			return nil, err
+		}
+
+		change.ChangedAt = time.Unix(changedAt, 0)
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminRenameUser_KeepsHistory(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createLoginTestUser(t, "alice", "alice password")
+	createLoginTestUser(t, "bob", "bob password")
+
+	if err := AdminRenameUser(context.Background(), userId, "bob"); err == nil {
+		t.Error("renaming to a name someone else has should fail")
+	}
+
+	if err := AdminRenameUser(context.Background(), userId, "user_bob"); err == nil {
+		t.Error("renaming to a name like a user ID should fail")
+	}
+
+	if err := AdminRenameUser(context.Background(), userId, "carol"); err != nil {
+		t.Fatalf("AdminRenameUser failed: %v", err)
+	}
+
+	if err := AdminRenameUser(context.Background(), userId, "dave"); err != nil {
+		t.Fatalf("AdminRenameUser failed: %v", err)
+	}
+
+	if _, err := getUserLogin("dave", "alice password"); err != nil {
+		t.Errorf("logging in with the new name failed: %v", err)
+	}
+
+	if _, err := getUserLogin("alice", "alice password"); err == nil {
+		t.Error("logging in with the old name should fail")
+	}
+
+	history, err := GetUsernameHistory(userId)
+	if err != nil {
+		t.Fatalf("GetUsernameHistory failed: %v", err)
+	}
+
+	if len(history) != 2 || history[0].Username != "carol" || history[1].Username != "alice" {
+		t.Errorf("got history %+v, want carol then alice", history)
+	}
+}
+
+func TestRefreshSession_UsesNewUsername(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	userId := createLoginTestUser(t, "alice", "alice password")
+
+	tokenId := newRefreshTokenId()
+	sessionId, err := createUserSession(userId, tokenId, time.Now().Add(time.Hour), r)
+	if err != nil {
+		t.Fatalf("createUserSession failed: %v", err)
+	}
+
+	signed, err := signRefreshToken(sessionId, tokenId, "alice", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("signRefreshToken failed: %v", err)
+	}
+
+	refreshToken, err := ParseToken(signed)
+	if err != nil {
+		t.Fatalf("ParseToken failed: %v", err)
+	}
+
+	if err := AdminRenameUser(context.Background(), userId, "carol"); err != nil {
+		t.Fatalf("AdminRenameUser failed: %v", err)
+	}
+
+	_, accessToken, err := RefreshSession(refreshToken, r)
+	if err != nil {
+		t.Fatalf("RefreshSession failed: %v", err)
+	}
+
+	token, err := ParseAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("ParseAccessToken failed: %v", err)
+	}
+
+	userInfo, err := UserInfoFromAccessToken(token)
+	if err != nil || userInfo.Username != "carol" {
+		t.Errorf("got %+v, %v; want carol", userInfo, err)
+	}
+}
+
+func TestUpdateUserProfile_ChecksEmail(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createLoginTestUser(t, "alice", "alice password")
+
+	if err := UpdateUserProfile(context.Background(), userId, "Alice", "not an address"); err == nil {
+		t.Error("an invalid email should be rejected")
+	}
+
+	if err := UpdateUserProfile(context.Background(), userId, " Alice ", "alice@example.com"); err != nil {
+		t.Fatalf("UpdateUserProfile failed: %v", err)
+	}
+
+	profile, err := GetUserProfile(userId)
+	if err != nil {
+		t.Fatalf("GetUserProfile failed: %v", err)
+	}
+
+	if profile.Name() != "Alice" || profile.Email != "alice@example.com" {
+		t.Errorf("got %+v, want Alice <alice@example.com>", profile)
+	}
+}
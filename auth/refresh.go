@@ -2,25 +2,59 @@ package auth
 
 import (
 	"log"
+	"net/http"
 	"time"
+
+	"go.jetify.com/typeid"
 )
 
-func IssueRefreshToken(username string, password string) (string, error) {
-	userId, err := getUserLogin(username, password)
+// Starts a session for a username and password. Users with two-factor authentication enabled need a code
+// too, so for them this fails with ErrTotpRequired; see SetTokenCookies.
+func IssueRefreshToken(username string, password string, r *http.Request) (string, error) {
+	userId, err := checkLogin(username, password, r.RemoteAddr)
 
 	if err != nil {
 		return "", err
 	}
 
-	sessionId, err := createUserSession(userId)
+	enabled, err := TotpEnabled(userId)
 
 	if err != nil {
 		return "", err
 	}
 
-	builder := getTokenBuilder(time.Now().Add(RefreshTokenExpirationDuration))
+	if enabled {
+		return "", ErrTotpRequired
+	}
+
+	return issueRefreshToken(userId, username, r)
+}
+
+// Starts a session for a user whose credentials have already been checked.
+func issueRefreshToken(userId string, username string, r *http.Request) (string, error) {
+	tokenId := newRefreshTokenId()
+	expiresAt := time.Now().Add(RefreshTokenExpirationDuration)
+
+	sessionId, err := createUserSession(userId, tokenId, expiresAt, r)
+
+	if err != nil {
+		return "", err
+	}
+
+	return signRefreshToken(sessionId, tokenId, username, expiresAt)
+}
+
+func newRefreshTokenId() string {
+	tokenId, _ := typeid.WithPrefix("refresh")
+	return tokenId.String()
+}
+
+// Refresh tokens last as long as their session, however many times they're replaced.
+func signRefreshToken(sessionId string, tokenId string, username string, expiresAt time.Time) (string, error) {
+	builder := getTokenBuilder(expiresAt)
 	builder.Audience([]string{"refresh"})
 	builder.Subject(sessionId)
+	builder.JwtID(tokenId)
 	builder.Claim("username", username)
 
 	signed, err := signToken(builder)
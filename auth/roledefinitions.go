@@ -0,0 +1,516 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+
+	"github.com/mattn/go-sqlite3"
+	"go.jetify.com/typeid"
+)
+
+// Role definitions are named sets of scope/level grants, such as "Editor" or "Auditor", that admins can
+// create and change. A user can have any number of them, themselves or through groups (see groups.go),
+// and has the highest level any of them grants in each scope. The built-in Administrator role always
+// grants every scope at Edit; it can be given to users but not changed or deleted.
+
+// authRoleDefinitions table has rows:
+// roleId TEXT
+// name TEXT -- unique
+// description TEXT
+// builtIn INTEGER -- 1 for the Administrator role
+// createdAt INTEGER
+
+// authRoleGrants table has rows (only for levels above None):
+// roleId TEXT
+// scope INTEGER
+// level INTEGER
+
+// authUserRoles table has rows:
+// userId TEXT
+// roleId TEXT
+
+var ErrRoleNotFound = errors.New("role not found")
+
+var ErrBuiltInRole = errors.New("the Administrator role can't be changed")
+
+type RoleDefinition struct {
+	RoleId      string
+	Name        string
+	Description string
+	BuiltIn     bool
+
+	// Every scope, with None for scopes the role doesn't grant.
+	Grants []Role
+
+	// How many users have the role themselves, not counting groups.
+	UserCount int
+}
+
+// Returns every role definition, the built-in one first and the rest by name.
+func GetRoleDefinitions() ([]RoleDefinition, error) {
+	rows, err := db.DB.Query(`
+		SELECT d.roleId, d.name, d.description, d.builtIn, COUNT(u.userId)
+		FROM authRoleDefinitions AS d
+		LEFT JOIN authUserRoles AS u ON u.roleId = d.roleId
+		GROUP BY d.roleId
+		ORDER BY d.builtIn DESC, d.name COLLATE NOCASE`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var definitions []RoleDefinition
+	for rows.Next() {
+		var definition RoleDefinition
+		if err := rows.Scan(&definition.RoleId, &definition.Name, &definition.Description, &definition.BuiltIn,
+			&definition.UserCount); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return definitions, addRoleGrants(definitions)
+}
+
+func GetRoleDefinition(roleId string) (RoleDefinition, error) {
+	var definition RoleDefinition
+
+	err := db.DB.QueryRow(`
+		SELECT d.roleId, d.name, d.description, d.builtIn, COUNT(u.userId)
+		FROM authRoleDefinitions AS d
+		LEFT JOIN authUserRoles AS u ON u.roleId = d.roleId
+		WHERE d.roleId = ?
+		GROUP BY d.roleId`, roleId).
+		Scan(&definition.RoleId, &definition.Name, &definition.Description, &definition.BuiltIn, &definition.UserCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return definition, ErrRoleNotFound
+	} else if err != nil {
+		return definition, err
+	}
+
+	definitions := []RoleDefinition{definition}
+	if err := addRoleGrants(definitions); err != nil {
+		return definition, err
+	}
+
+	return definitions[0], nil
+}
+
+// Fills in the grants of each definition.
+func addRoleGrants(definitions []RoleDefinition) error {
+	rows, err := db.DB.Query("SELECT roleId, scope, level FROM authRoleGrants")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	levels := make(map[string]map[AccessScope]AccessLevel)
+	for rows.Next() {
+		var roleId string
+		var scope int
+		var level int
+		if err := rows.Scan(&roleId, &scope, &level); err != nil {
+			return err
+		}
+		if levels[roleId] == nil {
+			levels[roleId] = make(map[AccessScope]AccessLevel)
+		}
+		levels[roleId][AccessScope(scope)] = AccessLevel(level)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range definitions {
+		definitions[i].Grants = rolesFromLevels(levels[definitions[i].RoleId])
+	}
+
+	return nil
+}
+
+// Returns the IDs of the role definitions the user has.
+func GetUserRoleIds(userId string) ([]string, error) {
+	rows, err := db.DB.Query("SELECT roleId FROM authUserRoles WHERE userId = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIds []string
+	for rows.Next() {
+		var roleId string
+		if err := rows.Scan(&roleId); err != nil {
+			return nil, err
+		}
+		roleIds = append(roleIds, roleId)
+	}
+
+	return roleIds, rows.Err()
+}
+
+// Returns the ID of the built-in Administrator role.
+func getAdministratorRoleId(tx *sql.Tx) (string, error) {
+	var roleId string
+	err := tx.QueryRow("SELECT roleId FROM authRoleDefinitions WHERE builtIn = 1").Scan(&roleId)
+	return roleId, err
+}
+
+// Makes sure the Administrator role grants every scope at Edit, including any added since it was created.
+func updateAdministratorRole(tx *sql.Tx) (string, error) {
+	roleId, err := getAdministratorRoleId(tx)
+	if err != nil {
+		return "", err
+	}
+
+	return roleId, setRoleGrants(tx, roleId, AllRoles)
+}
+
+func validateRoleDefinition(name string, grants []Role) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("role name is required")
+	}
+
+	for _, grant := range grants {
+		if _, ok := AccessScopeToName[grant.Scope]; !ok {
+			return "", errors.New("invalid scope")
+		}
+		if _, ok := AccessLevelToName[grant.Level]; !ok {
+			return "", errors.New("invalid access level")
+		}
+	}
+
+	return name, nil
+}
+
+func roleNameError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		return errors.New("a role with this name already exists")
+	}
+
+	return err
+}
+
+func setRoleGrants(tx *sql.Tx, roleId string, grants []Role) error {
+	if _, err := tx.Exec("DELETE FROM authRoleGrants WHERE roleId = ?", roleId); err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		if grant.Level == AccessLevelNone {
+			continue
+		}
+
+		if _, err := tx.Exec("INSERT INTO authRoleGrants (roleId, scope, level) VALUES (?, ?, ?)",
+			roleId, grant.Scope, grant.Level); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the users who have the role, themselves or through a group, whose access tokens need
+// reissuing when it changes.
+func getRoleUserIds(roleId string) ([]string, error) {
+	rows, err := db.DB.Query(`
+		SELECT userId FROM authUserRoles WHERE roleId = ?
+		UNION
+		SELECT m.userId
+		FROM authGroupRoles AS g
+		JOIN authGroupMembers AS m ON m.groupId = g.groupId
+		WHERE g.roleId = ?`, roleId, roleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, rows.Err()
+}
+
+func bumpRolesVersions(userIds []string) error {
+	for _, userId := range userIds {
+		if err := bumpRolesVersion(userId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Creates a role definition, returning its ID.
+func AdminCreateRoleDefinition(ctx context.Context, name string, description string, grants []Role) (string, error) {
+	name, err := validateRoleDefinition(name, grants)
+	if err != nil {
+		return "", err
+	}
+
+	roleId, _ := typeid.WithPrefix("role")
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO authRoleDefinitions (roleId, name, description, createdAt) VALUES (?, ?, ?, ?)",
+		roleId.String(), name, strings.TrimSpace(description), time.Now().Unix()); err != nil {
+		return "", roleNameError(err)
+	}
+
+	if err := setRoleGrants(tx, roleId.String(), grants); err != nil {
+		return "", err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.RoleCreate, roleId.String(), map[string]interface{}{
+		"name":   name,
+		"grants": GetRoleStrings(grants),
+	}); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	log.Printf("role %s (%s) created", roleId, name)
+
+	return roleId.String(), nil
+}
+
+// Changes a role definition. Everyone who has it gets the new grants straight away.
+func AdminUpdateRoleDefinition(ctx context.Context, roleId string, name string, description string, grants []Role) error {
+	definition, err := GetRoleDefinition(roleId)
+	if err != nil {
+		return err
+	}
+
+	if definition.BuiltIn {
+		return ErrBuiltInRole
+	}
+
+	name, err = validateRoleDefinition(name, grants)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE authRoleDefinitions SET name = ?, description = ? WHERE roleId = ?",
+		name, strings.TrimSpace(description), roleId); err != nil {
+		return roleNameError(err)
+	}
+
+	if err := setRoleGrants(tx, roleId, grants); err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.RoleUpdate, roleId, map[string]interface{}{
+		"name":   name,
+		"grants": GetRoleStrings(grants),
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	userIds, err := getRoleUserIds(roleId)
+	if err != nil {
+		return err
+	}
+
+	return bumpRolesVersions(userIds)
+}
+
+// Deletes a role definition, taking it away from everyone who has it.
+func AdminDeleteRoleDefinition(ctx context.Context, roleId string) error {
+	definition, err := GetRoleDefinition(roleId)
+	if err != nil {
+		return err
+	}
+
+	if definition.BuiltIn {
+		return ErrBuiltInRole
+	}
+
+	userIds, err := getRoleUserIds(roleId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM authUserRoles WHERE roleId = ?",
+		"DELETE FROM authGroupRoles WHERE roleId = ?",
+		"DELETE FROM authInviteRoles WHERE roleId = ?",
+		"DELETE FROM authRoleGrants WHERE roleId = ?",
+		"DELETE FROM authRoleDefinitions WHERE roleId = ?",
+	} {
+		if _, err := tx.Exec(query, roleId); err != nil {
+			return err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.RoleDelete, roleId, map[string]interface{}{
+		"name":  definition.Name,
+		"users": len(userIds),
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("role %s (%s) deleted", roleId, definition.Name)
+
+	return bumpRolesVersions(userIds)
+}
+
+func setUserRoleIds(tx *sql.Tx, userId string, roleIds []string) error {
+	if _, err := tx.Exec("DELETE FROM authUserRoles WHERE userId = ?", userId); err != nil {
+		return err
+	}
+
+	for _, roleId := range roleIds {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO authUserRoles (userId, roleId) VALUES (?, ?)", userId, roleId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the names of the role definitions, for the audit log. Fails with ErrRoleNotFound if any of them
+// don't exist.
+func getRoleNames(tx *sql.Tx, roleIds []string) ([]string, error) {
+	names := make([]string, 0, len(roleIds))
+	for _, roleId := range roleIds {
+		var name string
+		err := tx.QueryRow("SELECT name FROM authRoleDefinitions WHERE roleId = ?", roleId).Scan(&name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoleNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Sets the user to have exactly these role definitions.
+func AdminSetUserRoleIds(ctx context.Context, userId string, roleIds []string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names, err := getRoleNames(tx, roleIds)
+	if err != nil {
+		return err
+	}
+
+	if err := setUserRoleIds(tx, userId, roleIds); err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.UserRoles, userId, map[string]interface{}{"roles": names}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return bumpRolesVersion(userId)
+}
+
+// Where a user's level in a scope comes from.
+type RoleOrigin struct {
+	RoleId   string
+	RoleName string
+	Level    AccessLevel
+
+	// Empty if the user has the role themselves.
+	GroupId   string
+	GroupName string
+}
+
+type EffectiveRole struct {
+	Role
+
+	// Every role definition that grants the user something in this scope, highest level first.
+	Origins []RoleOrigin
+}
+
+// Like GetUserRoles, along with where each level comes from.
+func GetUserEffectiveRoles(userId string) ([]EffectiveRole, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.roleId, d.name, g.scope, g.level, u.groupId, COALESCE(gr.name, '')
+		FROM (`+userRoleIdsQuery+`) AS u
+		JOIN authRoleDefinitions AS d ON d.roleId = u.roleId
+		JOIN authRoleGrants AS g ON g.roleId = u.roleId
+		LEFT JOIN authGroups AS gr ON gr.groupId = u.groupId
+		ORDER BY g.level DESC, d.name COLLATE NOCASE, gr.name COLLATE NOCASE`, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	origins := make(map[AccessScope][]RoleOrigin)
+	for rows.Next() {
+		var origin RoleOrigin
+		var scope int
+		if err := rows.Scan(&origin.RoleId, &origin.RoleName, &scope, &origin.Level, &origin.GroupId, &origin.GroupName); err != nil {
+			return nil, err
+		}
+		origins[AccessScope(scope)] = append(origins[AccessScope(scope)], origin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	effectiveRoles := make([]EffectiveRole, 0, len(AllAccessScopes))
+	for _, scope := range AllAccessScopes {
+		effectiveRole := EffectiveRole{Role: Role{Scope: scope}, Origins: origins[scope]}
+		if len(effectiveRole.Origins) > 0 {
+			effectiveRole.Level = effectiveRole.Origins[0].Level
+		}
+		effectiveRoles = append(effectiveRoles, effectiveRole)
+	}
+
+	return effectiveRoles, nil
+}
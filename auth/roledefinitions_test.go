@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGetUserRoles_HighestLevelOfAllRoles(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	userId := createTotpTestUser(t, []Role{{Scope: Storage, Level: View}, {Scope: Media, Level: Edit}})
+
+	editorId, err := AdminCreateRoleDefinition(context.Background(), "Editor", "", []Role{{Scope: Storage, Level: Edit}})
+	if err != nil {
+		t.Fatalf("AdminCreateRoleDefinition failed: %v", err)
+	}
+
+	roleIds, err := GetUserRoleIds(userId)
+	if err != nil {
+		t.Fatalf("GetUserRoleIds failed: %v", err)
+	}
+
+	if err := AdminSetUserRoleIds(context.Background(), userId, append(roleIds, editorId)); err != nil {
+		t.Fatalf("AdminSetUserRoleIds failed: %v", err)
+	}
+
+	roles, err := GetUserRoles(userId)
+	if err != nil {
+		t.Fatalf("GetUserRoles failed: %v", err)
+	}
+
+	levels := GetRoleMap(roles)
+	if levels[Storage] != Edit || levels[Media] != Edit || levels[UserManagement] != AccessLevelNone {
+		t.Errorf("got roles %+v, want Storage and Media Edit, everything else None", roles)
+	}
+
+	if len(roles) != len(AllAccessScopes) {
+		t.Errorf("got %d roles, want one for each of the %d scopes", len(roles), len(AllAccessScopes))
+	}
+}
+
+func TestAdminUpdateRoleDefinition_AppliesToUsersStraightAway(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, []Role{{Scope: Storage, Level: View}})
+	token := issueTestAccessToken(t, userId)
+
+	roleIds, _ := GetUserRoleIds(userId)
+	if len(roleIds) != 1 {
+		t.Fatalf("got role IDs %v, want one", roleIds)
+	}
+
+	if err := AdminUpdateRoleDefinition(context.Background(), roleIds[0], "Renamed", "", []Role{{Scope: Storage, Level: Edit}}); err != nil {
+		t.Fatalf("AdminUpdateRoleDefinition failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before the change: got %v, want ErrStaleAccessToken", err)
+	}
+
+	roles, _ := GetUserRoles(userId)
+	if GetRoleMap(roles)[Storage] != Edit {
+		t.Errorf("got roles %+v after the change, want Storage Edit", roles)
+	}
+
+	if err := AdminDeleteRoleDefinition(context.Background(), roleIds[0]); err != nil {
+		t.Fatalf("AdminDeleteRoleDefinition failed: %v", err)
+	}
+
+	roles, _ = GetUserRoles(userId)
+	if GetRoleMap(roles)[Storage] != AccessLevelNone {
+		t.Errorf("got roles %+v after deleting the role, want Storage None", roles)
+	}
+}
+
+func TestRoleDefinitions_AdministratorSeededAndBuiltIn(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	PostMigrationSetup()
+
+	definitions, err := GetRoleDefinitions()
+	if err != nil {
+		t.Fatalf("GetRoleDefinitions failed: %v", err)
+	}
+
+	if len(definitions) == 0 || !definitions[0].BuiltIn {
+		t.Fatalf("got %+v, want the built-in role first", definitions)
+	}
+
+	administrator := definitions[0]
+	for _, grant := range administrator.Grants {
+		if grant.Level != Edit {
+			t.Errorf("Administrator grants %+v, want Edit everywhere", administrator.Grants)
+			break
+		}
+	}
+
+	if administrator.UserCount != 1 {
+		t.Errorf("Administrator has %d users, want the admin user", administrator.UserCount)
+	}
+
+	if err := AdminUpdateRoleDefinition(context.Background(), administrator.RoleId, "Nobody", "", nil); !errors.Is(err, ErrBuiltInRole) {
+		t.Errorf("changing the Administrator role: got %v, want ErrBuiltInRole", err)
+	}
+
+	if err := AdminDeleteRoleDefinition(context.Background(), administrator.RoleId); !errors.Is(err, ErrBuiltInRole) {
+		t.Errorf("deleting the Administrator role: got %v, want ErrBuiltInRole", err)
+	}
+
+	if _, err := AdminCreateRoleDefinition(context.Background(), "administrator", "", nil); err == nil {
+		t.Error("created a second role with the same name")
+	}
+}
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"context"
-	"database/sql"
 	"lod2/db"
 )
 
@@ -18,21 +17,23 @@ const (
 	Edit
 )
 
-var NameToAccessLevel = map[string]AccessLevel{
-	"No access": AccessLevelNone,
-	"View":      View,
-	"Edit":      Edit,
-}
-
-var AccessLevelToName = make(map[AccessLevel]string)
-
+// This also defines the order of the levels in the UI.
 var AllAccessLevels = []AccessLevel{
 	AccessLevelNone,
 	View,
 	Edit,
 }
 
-// AccessScope indicates what area the access applies to.
+var AccessLevelToName = map[AccessLevel]string{
+	AccessLevelNone: "No access",
+	View:            "View",
+	Edit:            "Edit",
+}
+
+var NameToAccessLevel = make(map[string]AccessLevel)
+
+// AccessScope indicates what area the access applies to. Scopes are what the code checks, so they're
+// fixed here; which users have which levels in them comes from role definitions (see roledefinitions.go).
 type AccessScope int
 
 const (
@@ -42,51 +43,42 @@ const (
 	Media
 )
 
-// This also defines the order of the scopes in the UI.
-var AllAccessScopes = []AccessScope{
-	DangerousSql,
-	UserManagement,
-	Storage,
-	Media,
-}
+type scopeDefinition struct {
+	Scope AccessScope
 
-// These are the raw names that need to match enum names. Templates will need to be updated if these are changed.
-var NameToAccessScope = map[string]AccessScope{
-	"UserManagement": UserManagement,
-	"DangerousSql":   DangerousSql,
-	"Storage":        Storage,
-	"Media":          Media,
+	// The raw name, used by templates (such as in hasRole). Templates will need to be updated if these
+	// are changed.
+	Name string
+
+	DisplayName string
 }
 
-var AccessScopeToDisplayName = map[AccessScope]string{
-	UserManagement: "User management",
-	DangerousSql:   "Database access",
-	Storage:        "Files",
-	Media:          "Media",
+// This also defines the order of the scopes in the UI.
+var scopeDefinitions = []scopeDefinition{
+	{Scope: DangerousSql, Name: "DangerousSql", DisplayName: "Database access"},
+	{Scope: UserManagement, Name: "UserManagement", DisplayName: "User management"},
+	{Scope: Storage, Name: "Storage", DisplayName: "Files"},
+	{Scope: Media, Name: "Media", DisplayName: "Media"},
 }
 
-var AccessScopeToName = make(map[AccessScope]string)
+var AllAccessScopes = make([]AccessScope, 0, len(scopeDefinitions))
 
-func init() {
-	for name, scope := range NameToAccessScope {
-		AccessScopeToName[scope] = name
-	}
+var NameToAccessScope = make(map[string]AccessScope)
 
-	if len(AccessScopeToName) != len(AllAccessScopes) {
-		panic("AccessScopeToName is not the same length as AllAccessScopes; make sure to add all scopes to NameToAccessScope")
-	}
+var AccessScopeToName = make(map[AccessScope]string)
 
-	if len(AccessScopeToDisplayName) != len(AllAccessScopes) {
-		panic("AccessScopeToDisplayName is not the same length as AllAccessScopes; make sure to add all scopes to AccessScopeToDisplayName")
-	}
+var AccessScopeToDisplayName = make(map[AccessScope]string)
 
-	// Populate the reverse map from the source NameToAccessLevel map.
-	for name, level := range NameToAccessLevel {
-		AccessLevelToName[level] = name
+func init() {
+	for _, definition := range scopeDefinitions {
+		AllAccessScopes = append(AllAccessScopes, definition.Scope)
+		NameToAccessScope[definition.Name] = definition.Scope
+		AccessScopeToName[definition.Scope] = definition.Name
+		AccessScopeToDisplayName[definition.Scope] = definition.DisplayName
 	}
 
-	if len(AccessLevelToName) != len(AllAccessLevels) {
-		panic("AccessLevelToName is not the same length as AllAccessLevels; make sure to add all levels to NameToAccessLevel")
+	for level, name := range AccessLevelToName {
+		NameToAccessLevel[name] = level
 	}
 }
 
@@ -101,6 +93,7 @@ type RoleString struct {
 	Level string
 }
 
+// What the built-in Administrator role grants.
 var AllRoles = []Role{
 	{Level: Edit, Scope: UserManagement},
 	{Level: Edit, Scope: DangerousSql},
@@ -135,58 +128,52 @@ func GetRoleStrings(roles []Role) []RoleString {
 	return roleStrings
 }
 
-// authRoles contains
-// userId - foreign key to authUsers
-// level - the access level
-// scope - the access scope
-func setRoles(tx *sql.Tx, userId string, roles []Role) error {
-	for _, role := range roles {
-		if role.Level == AccessLevelNone {
-			if _, err := tx.Exec(`DELETE FROM authRoles WHERE userId = ? AND scope = ?`, userId, role.Scope); err != nil {
-				return err
-			}
-		} else {
-			if _, err := tx.Exec(`INSERT OR REPLACE INTO authRoles (userId, level, scope) VALUES (?, ?, ?)`, userId, role.Level, role.Scope); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
+// The role definitions a user has, themselves or through groups they're in. Takes the user ID twice.
+const userRoleIdsQuery = `
+	SELECT roleId, '' AS groupId FROM authUserRoles WHERE userId = ?
+	UNION
+	SELECT r.roleId, r.groupId
+	FROM authGroupMembers AS m
+	JOIN authGroupRoles AS r ON r.groupId = m.groupId
+	WHERE m.userId = ?`
 
-// GetUserRoles returns roles for all scopes, with None for scopes not assigned to the user.
+// GetUserRoles returns roles for all scopes: the highest level any of the user's role definitions
+// (their own and their groups') grants in each, with None for scopes none of them grant.
 func GetUserRoles(userId string) ([]Role, error) {
-	rows, err := db.DB.Query(`SELECT level, scope FROM authRoles WHERE userId = ?`, userId)
+	rows, err := db.DB.Query(`
+		SELECT g.scope, MAX(g.level)
+		FROM (`+userRoleIdsQuery+`) AS u
+		JOIN authRoleGrants AS g ON g.roleId = u.roleId
+		GROUP BY g.scope`, userId, userId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// Build a map of existing roles from database
-	existingRoles := make(map[AccessScope]AccessLevel)
+	levels := make(map[AccessScope]AccessLevel)
 	for rows.Next() {
-		var level int
 		var scope int
-		if err := rows.Scan(&level, &scope); err != nil {
+		var level int
+		if err := rows.Scan(&scope, &level); err != nil {
 			return nil, err
 		}
-		existingRoles[AccessScope(scope)] = AccessLevel(level)
+		levels[AccessScope(scope)] = AccessLevel(level)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	// Build result with all scopes, using None for missing ones
+	return rolesFromLevels(levels), nil
+}
+
+// Returns a role for every scope, with None for scopes missing from levels.
+func rolesFromLevels(levels map[AccessScope]AccessLevel) []Role {
 	roles := make([]Role, 0, len(AllAccessScopes))
 	for _, scope := range AllAccessScopes {
-		level, exists := existingRoles[scope]
-		if !exists {
-			level = AccessLevelNone
-		}
-		roles = append(roles, Role{Level: level, Scope: scope})
+		roles = append(roles, Role{Level: levels[scope], Scope: scope})
 	}
 
-	return roles, nil
+	return roles
 }
 
 // UserHasRole returns true if any role for the given scope meets or exceeds the provided minimum level.
@@ -201,17 +188,15 @@ func UserHasRole(roles []Role, scope AccessScope, minimumLevel AccessLevel) bool
 
 // VerifyRole loads the current user from context and checks if they have the specified role requirement.
 // Returns true if authorized, false otherwise. If the user is not logged in, returns false.
+// The roles are the ones on the context, which come from the access token (see UserInfoFromAccessToken)
+// and may be less than the user's own (for example, when limited by an API token).
 func VerifyRole(ctx context.Context, scope AccessScope, minimumLevel AccessLevel) bool {
 	userInfo := GetCurrentUserInfo(ctx)
 	if userInfo == nil {
 		return false
 	}
 
-	roles, err := GetUserRoles(userInfo.UserId)
-	if err != nil {
-		return false
-	}
-	return UserHasRole(roles, scope, minimumLevel)
+	return UserHasRole(userInfo.Roles, scope, minimumLevel)
 }
 
 func GetRoleMap(roles []Role) map[AccessScope]AccessLevel {
@@ -238,24 +223,3 @@ func UserIsAdmin(ctx context.Context) bool {
 
 	return false
 }
-
-func AdminSetUserRoles(userId string, roles []Role) error {
-	tx, err := db.DB.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer tx.Rollback()
-
-	err = setRoles(tx, userId, roles)
-	if err != nil {
-		return err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
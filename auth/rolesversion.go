@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"log"
+	"sync"
+
+	"lod2/db"
+)
+
+// Access tokens carry the user's roles, which are trusted for the token's short life instead of being
+// looked up on every request. So that changes take effect straight away anyway, each user has a roles
+// version that goes up whenever something changes what their tokens should say: their roles, whether
+// two-factor authentication holds some of them back, whether they have to change their password, their
+// username, or their account being (or about to be) deleted. Tokens carry the version they were issued
+// at, and one with an older version is refreshed before it's used.
+//
+// Versions are kept in memory once read, so checking one doesn't touch the database. Everything that
+// changes them has to go through bumpRolesVersion or bumpAllRolesVersions.
+
+var rolesVersionsMu sync.Mutex
+
+// Cached versions, by user ID.
+var rolesVersions = map[string]int64{}
+
+// Goes up each time the whole cache is dropped, so a read from before then isn't cached after it.
+var rolesVersionsGeneration int64
+
+// Returns the user's current roles version. Fails for users that don't exist or have been deleted.
+func GetRolesVersion(userId string) (int64, error) {
+	rolesVersionsMu.Lock()
+	version, ok := rolesVersions[userId]
+	generation := rolesVersionsGeneration
+	rolesVersionsMu.Unlock()
+
+	if ok {
+		return version, nil
+	}
+
+	err := db.DB.QueryRow("SELECT rolesVersion FROM authUsers WHERE userId = ? AND deleted = 0", userId).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	rolesVersionsMu.Lock()
+	defer rolesVersionsMu.Unlock()
+
+	// A bump since the read above has already cached something newer.
+	if _, ok := rolesVersions[userId]; !ok && generation == rolesVersionsGeneration {
+		rolesVersions[userId] = version
+	}
+
+	return version, nil
+}
+
+// Makes the user's existing access tokens out of date, so they're reissued on their next request.
+func bumpRolesVersion(userId string) error {
+	var version int64
+	var deleted bool
+
+	err := db.DB.QueryRow("UPDATE authUsers SET rolesVersion = rolesVersion + 1 WHERE userId = ? RETURNING rolesVersion, deleted", userId).
+		Scan(&version, &deleted)
+	if err != nil {
+		log.Printf("error bumping roles version for %s: %v", userId, err)
+		return err
+	}
+
+	rolesVersionsMu.Lock()
+	defer rolesVersionsMu.Unlock()
+
+	// Deleted users have no version; GetRolesVersion reads the database again and fails.
+	if deleted {
+		delete(rolesVersions, userId)
+	} else {
+		rolesVersions[userId] = version
+	}
+
+	return nil
+}
+
+// Like bumpRolesVersion, for everyone.
+func bumpAllRolesVersions() error {
+	if _, err := db.DB.Exec("UPDATE authUsers SET rolesVersion = rolesVersion + 1"); err != nil {
+		log.Printf("error bumping roles versions: %v", err)
+		return err
+	}
+
+	rolesVersionsMu.Lock()
+	defer rolesVersionsMu.Unlock()
+
+	rolesVersions = map[string]int64{}
+	rolesVersionsGeneration++
+
+	return nil
+}
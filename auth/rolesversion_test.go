@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwt"
+)
+
+func issueTestAccessToken(t testing.TB, userId string) jwt.Token {
+	signed, err := issueAccessToken("session_test", userId, "test", "csrf_test")
+	if err != nil {
+		t.Fatalf("issueAccessToken failed: %v", err)
+	}
+
+	token, err := ParseAccessToken(signed)
+	if err != nil {
+		t.Fatalf("ParseAccessToken failed: %v", err)
+	}
+
+	return token
+}
+
+func TestUserInfoFromAccessToken_StaleAfterRolesChange(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, []Role{{Scope: Storage, Level: Edit}})
+	token := issueTestAccessToken(t, userId)
+
+	userInfo, err := UserInfoFromAccessToken(token)
+	if err != nil {
+		t.Fatalf("UserInfoFromAccessToken failed: %v", err)
+	}
+
+	if levels := GetRoleMap(userInfo.Roles); levels[Storage] != Edit || len(userInfo.Roles) != len(AllAccessScopes) {
+		t.Errorf("got roles %+v, want Storage Edit and every other scope None", userInfo.Roles)
+	}
+
+	viewerRoleId, err := AdminCreateRoleDefinition(context.Background(), "Viewer", "", []Role{{Scope: Storage, Level: View}})
+	if err != nil {
+		t.Fatalf("AdminCreateRoleDefinition failed: %v", err)
+	}
+
+	if err := AdminSetUserRoleIds(context.Background(), userId, []string{viewerRoleId}); err != nil {
+		t.Fatalf("AdminSetUserRoleIds failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before the change: got %v, want ErrStaleAccessToken", err)
+	}
+
+	userInfo, err = UserInfoFromAccessToken(issueTestAccessToken(t, userId))
+	if err != nil {
+		t.Fatalf("UserInfoFromAccessToken failed: %v", err)
+	}
+
+	if levels := GetRoleMap(userInfo.Roles); levels[Storage] != View {
+		t.Errorf("reissued token: got roles %+v, want Storage View", userInfo.Roles)
+	}
+}
+
+func TestUserInfoFromAccessToken_StaleAfterTotpPolicyChange(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, []Role{{Scope: DangerousSql, Level: Edit}})
+	token := issueTestAccessToken(t, userId)
+
+	if err := AdminSetTotpRequiredRoles(context.Background(), []Role{{Scope: DangerousSql, Level: Edit}}); err != nil {
+		t.Fatalf("AdminSetTotpRequiredRoles failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); !errors.Is(err, ErrStaleAccessToken) {
+		t.Errorf("token from before the change: got %v, want ErrStaleAccessToken", err)
+	}
+
+	userInfo, err := UserInfoFromAccessToken(issueTestAccessToken(t, userId))
+	if err != nil {
+		t.Fatalf("UserInfoFromAccessToken failed: %v", err)
+	}
+
+	if levels := GetRoleMap(userInfo.Roles); !userInfo.TotpSetupRequired || levels[DangerousSql] != View {
+		t.Errorf("reissued token: got %+v, want DangerousSql held back to View", userInfo)
+	}
+}
+
+func TestUserInfoFromAccessToken_FailsForDeletedUser(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestKeyRing(t)()
+
+	userId := createTotpTestUser(t, nil)
+	token := issueTestAccessToken(t, userId)
+
+	if err := AdminDeleteUser(context.Background(), userId); err != nil {
+		t.Fatalf("AdminDeleteUser failed: %v", err)
+	}
+
+	if _, err := UserInfoFromAccessToken(token); err == nil {
+		t.Error("token for a deleted user was accepted")
+	}
+
+	if _, err := issueAccessToken("session_test", userId, "test", "csrf_test"); err == nil {
+		t.Error("issued a token for a deleted user")
+	}
+}
+
+// What each request did before access tokens were trusted: look up the roles and the two-factor
+// policy in the database.
+func BenchmarkUserInfo_FromDatabase(b *testing.B) {
+	defer setupTestDatabase(b)()
+	defer setupTestKeyRing(b)()
+
+	userId := createTotpTestUser(b, []Role{{Scope: Storage, Level: Edit}})
+	token := issueTestAccessToken(b, userId)
+
+	b.ResetTimer()
+
+	for range b.N {
+		subject, _ := token.Subject()
+		userInfo := UserInfo{UserId: subject}
+
+		roles, err := GetUserRoles(subject)
+		if err != nil {
+			b.Fatal(err)
+		}
+		userInfo.Roles = roles
+
+		if err := ApplyTotpPolicy(&userInfo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// What each request does now: read the roles from the token and compare the cached roles version.
+func BenchmarkUserInfo_FromAccessToken(b *testing.B) {
+	defer setupTestDatabase(b)()
+	defer setupTestKeyRing(b)()
+
+	userId := createTotpTestUser(b, []Role{{Scope: Storage, Level: Edit}})
+	token := issueTestAccessToken(b, userId)
+
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := UserInfoFromAccessToken(token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
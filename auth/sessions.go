@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net/http"
 	"time"
 
+	"lod2/audit"
 	"lod2/db"
 
 	"go.jetify.com/typeid"
@@ -16,13 +19,36 @@ import (
 // issuedAt INTEGER - when the session was created
 // expiresAt INTEGER - after this time, the session is expired and the user must log in again
 // refreshedAt INTEGER - the most recent time the access token was refreshed based on this session
-
-// Creates a new user session and returns the session ID.
-func createUserSession(userId string) (string, error) {
+// userAgent TEXT - the User-Agent header of the most recent request to create or refresh the session
+// remoteAddr TEXT - the address that request came from, without the port
+// deviceLabel TEXT - a short description of the browser and OS, from the user agent
+// refreshTokenId TEXT - the ID of the only refresh token that can currently be used for the session
+// previousRefreshTokenId TEXT - the one it replaced, briefly still accepted (see rotateRefreshToken)
+// rotatedAt INTEGER - when the refresh token was last replaced
+// csrfToken TEXT - must accompany the session's state-changing requests (see csrf.go)
+
+// How long the refresh token a session has just replaced still works, for requests that were already on
+// their way with it (such as a page loading several things at once).
+const refreshTokenReuseGrace = time.Second * 30
+
+var ErrRefreshTokenReused = errors.New("refresh token was already used; session ended")
+
+// Creates a new user session for the client making the request and returns the session ID.
+func createUserSession(userId string, refreshTokenId string, expiresAt time.Time, r *http.Request) (string, error) {
 	sessionId, _ := typeid.WithPrefix("session")
-	expiresAt := time.Now().Add(RefreshTokenExpirationDuration)
+	userAgent := r.UserAgent()
 
-	_, err := db.DB.Exec("INSERT INTO authSessions (sessionId, userId, issuedAt, refreshedAt, expiresAt) VALUES (?, ?, ?, ?, ?)", sessionId, userId, time.Now().Unix(), time.Now().Unix(), expiresAt.Unix())
+	csrfToken, err := newCsrfToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO authSessions (sessionId, userId, issuedAt, refreshedAt, expiresAt, userAgent, remoteAddr, deviceLabel,
+			refreshTokenId, rotatedAt, csrfToken)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sessionId, userId, time.Now().Unix(), time.Now().Unix(), expiresAt.Unix(),
+		userAgent, clientAddr(r.RemoteAddr), deviceLabel(userAgent), refreshTokenId, time.Now().Unix(), csrfToken)
 
 	if err != nil {
 		log.Println("error creating session:", err)
@@ -32,11 +58,13 @@ func createUserSession(userId string) (string, error) {
 	return sessionId.String(), nil
 }
 
-// Updates the provided session to indicate it has just been refreshed.
-func updateUserSessionRefresh(sessionId string) error {
+// Updates the provided session to indicate it has just been refreshed by the client making the request.
+func updateUserSessionRefresh(sessionId string, r *http.Request) error {
 	refreshedAt := time.Now().Unix()
+	userAgent := r.UserAgent()
 
-	_, err := db.DB.Exec("UPDATE authSessions SET refreshedAt = ? WHERE sessionId = ?", refreshedAt, sessionId)
+	_, err := db.DB.Exec("UPDATE authSessions SET refreshedAt = ?, userAgent = ?, remoteAddr = ?, deviceLabel = ? WHERE sessionId = ?",
+		refreshedAt, userAgent, clientAddr(r.RemoteAddr), deviceLabel(userAgent), sessionId)
 
 	if err != nil {
 		log.Println("error updating session:", err)
@@ -46,23 +74,87 @@ func updateUserSessionRefresh(sessionId string) error {
 	return nil
 }
 
-// Returns true if the session exists and is not expired.
-func getUserSessionId(sessionId string) (string, bool) {
-	var userId string
-	var expiresAt int64
+type rotatedSession struct {
+	userId         string
+	refreshTokenId string
+	expiresAt      time.Time
+	csrfToken      string
+}
 
-	err := db.DB.QueryRow("SELECT userId, expiresAt FROM authSessions WHERE sessionId = ? AND expiresAt > ?", sessionId, time.Now().Unix()).Scan(&userId, &expiresAt)
+// Replaces the session's refresh token, if the one presented is its current one, and returns the ID of
+// the new one. Presenting the one it just replaced also works for refreshTokenReuseGrace, returning the
+// current one again; that's usually the same client with a request that crossed paths with the
+// replacement. Any other refresh token for the session has been used before, which means someone
+// else has a copy of it, so the session is ended.
+func rotateRefreshToken(sessionId string, presentedId string, r *http.Request) (rotatedSession, error) {
+	var session rotatedSession
+	var expiresAt, rotatedAt int64
+	var currentId, previousId string
+
+	err := db.DB.QueryRow(`
+		SELECT userId, expiresAt, refreshTokenId, previousRefreshTokenId, rotatedAt, csrfToken
+		FROM authSessions
+		WHERE sessionId = ? AND expiresAt > ?`, sessionId, time.Now().Unix()).
+		Scan(&session.userId, &expiresAt, &currentId, &previousId, &rotatedAt, &session.csrfToken)
 
 	if err != nil {
 		log.Println("error getting session:", err)
-		return "", false
+		return session, errors.New("invalid session")
 	}
 
-	if expiresAt <= time.Now().Unix() {
-		return "", false
+	session.expiresAt = time.Unix(expiresAt, 0)
+
+	if presentedId == currentId {
+		newId := newRefreshTokenId()
+
+		// Only one of two requests rotating the same token at once gets to; the other falls through to
+		// the grace period below.
+		result, err := db.DB.Exec(`
+			UPDATE authSessions SET refreshTokenId = ?, previousRefreshTokenId = ?, rotatedAt = ?
+			WHERE sessionId = ? AND refreshTokenId = ?`,
+			newId, currentId, time.Now().Unix(), sessionId, currentId)
+
+		if err != nil {
+			return session, err
+		}
+
+		if rotated, _ := result.RowsAffected(); rotated == 1 {
+			updateUserSessionRefresh(sessionId, r)
+			session.refreshTokenId = newId
+			return session, nil
+		}
+
+		err = db.DB.QueryRow("SELECT refreshTokenId, previousRefreshTokenId, rotatedAt FROM authSessions WHERE sessionId = ?", sessionId).
+			Scan(&currentId, &previousId, &rotatedAt)
+
+		if err != nil {
+			return session, err
+		}
+	}
+
+	if presentedId == previousId && time.Since(time.Unix(rotatedAt, 0)) <= refreshTokenReuseGrace {
+		updateUserSessionRefresh(sessionId, r)
+		session.refreshTokenId = currentId
+		return session, nil
 	}
 
-	return userId, true
+	log.Printf("security: refresh token reused for session %s of user %s from %s (%q); ending the session",
+		sessionId, session.userId, clientAddr(r.RemoteAddr), r.UserAgent())
+
+	invalidateSession(sessionId)
+
+	// Whoever presented it may not be the user, so it's recorded against the user rather than by them. The
+	// session is ended either way; an entry that can't be written goes to the server log.
+	audit.Record(audit.WithActor(r.Context(), audit.Actor{RemoteAddr: r.RemoteAddr}), audit.UserSessionReuse, session.userId,
+		map[string]string{"sessionId": sessionId, "userAgent": r.UserAgent()})
+
+	return session, ErrRefreshTokenReused
+}
+
+func getSessionCsrfToken(sessionId string) (string, error) {
+	var csrfToken string
+	err := db.DB.QueryRow("SELECT csrfToken FROM authSessions WHERE sessionId = ?", sessionId).Scan(&csrfToken)
+	return csrfToken, err
 }
 
 // Attempts to invalidate the user session by setting the expiration time to now.
@@ -80,7 +172,7 @@ func invalidateSession(sessionId string) error {
 }
 
 // Attempts to invalidate all sessions for the provided user by setting the expiration time to now.
-func AdminInvalidateAllSessions(userId string) error {
+func AdminInvalidateAllSessions(ctx context.Context, userId string) error {
 	_, err := db.DB.Exec("UPDATE authSessions SET expiresAt = ? WHERE userId = ?", time.Now().Unix(), userId)
 
 	if err != nil {
@@ -90,6 +182,36 @@ func AdminInvalidateAllSessions(userId string) error {
 
 	log.Printf("all sessions for %s invalidated", userId)
 
+	return audit.Record(ctx, audit.UserSessionsEnd, userId, nil)
+}
+
+// Ends one of the user's sessions. The user must log in again on that device.
+func RevokeUserSession(userId string, sessionId string) error {
+	_, err := db.DB.Exec("UPDATE authSessions SET expiresAt = ? WHERE sessionId = ? AND userId = ? AND expiresAt > ?",
+		time.Now().Unix(), sessionId, userId, time.Now().Unix())
+
+	if err != nil {
+		log.Printf("error revoking session %s: %v", sessionId, err)
+		return err
+	}
+
+	log.Printf("session %s revoked", sessionId)
+
+	return nil
+}
+
+// Ends all of the user's sessions except one, usually the one making the request.
+func InvalidateOtherSessions(userId string, keepSessionId string) error {
+	_, err := db.DB.Exec("UPDATE authSessions SET expiresAt = ? WHERE userId = ? AND sessionId != ? AND expiresAt > ?",
+		time.Now().Unix(), userId, keepSessionId, time.Now().Unix())
+
+	if err != nil {
+		log.Printf("error invalidating other sessions for %s: %v", userId, err)
+		return err
+	}
+
+	log.Printf("all sessions for %s except %s invalidated", userId, keepSessionId)
+
 	return nil
 }
 
@@ -99,18 +221,46 @@ type UserSession struct {
 	ExpiresAt   int64
 	RefreshedAt int64
 	Expired     bool
+
+	UserAgent   string
+	RemoteAddr  string
+	DeviceLabel string
+
+	// Whether this is the session making the request.
+	Current bool
 }
 
 func AdminGetUserSessions(userId string) ([]UserSession, error) {
-	rows, err := db.DB.Query(`
+	return getUserSessions(userId, false)
+}
+
+// Returns the user's sessions that haven't ended, most recently used first.
+func GetActiveUserSessions(userId string) ([]UserSession, error) {
+	return getUserSessions(userId, true)
+}
+
+func getUserSessions(userId string, activeOnly bool) ([]UserSession, error) {
+	query := `
 		SELECT
 			sessionId,
 			issuedAt,
 			expiresAt,
-			refreshedAt
+			refreshedAt,
+			userAgent,
+			remoteAddr,
+			deviceLabel
 		FROM authSessions
-		WHERE userId = ?
-		ORDER BY issuedAt DESC`, userId)
+		WHERE userId = ?`
+	args := []interface{}{userId}
+
+	if activeOnly {
+		query += " AND expiresAt > ? ORDER BY refreshedAt DESC"
+		args = append(args, time.Now().Unix())
+	} else {
+		query += " ORDER BY issuedAt DESC"
+	}
+
+	rows, err := db.DB.Query(query, args...)
 
 	if err != nil {
 		return nil, errors.New("invalid user id")
@@ -122,7 +272,8 @@ func AdminGetUserSessions(userId string) ([]UserSession, error) {
 
 	for rows.Next() {
 		var session UserSession
-		err := rows.Scan(&session.SessionId, &session.IssuedAt, &session.ExpiresAt, &session.RefreshedAt)
+		err := rows.Scan(&session.SessionId, &session.IssuedAt, &session.ExpiresAt, &session.RefreshedAt,
+			&session.UserAgent, &session.RemoteAddr, &session.DeviceLabel)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+)
+
+func TestRotateRefreshToken_EndsSessionWhenOldTokenIsReused(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	userId := createLoginTestUser(t, "alice", "correct horse")
+
+	firstId := newRefreshTokenId()
+	sessionId, err := createUserSession(userId, firstId, time.Now().Add(time.Hour), r)
+	if err != nil {
+		t.Fatalf("createUserSession failed: %v", err)
+	}
+
+	session, err := rotateRefreshToken(sessionId, firstId, r)
+	if err != nil {
+		t.Fatalf("first rotation failed: %v", err)
+	}
+
+	secondId := session.refreshTokenId
+	if secondId == firstId || session.userId != userId {
+		t.Fatalf("got %+v, want a new token for %s", session, userId)
+	}
+
+	// A request that raced the rotation still gets in, with the current token.
+	session, err = rotateRefreshToken(sessionId, firstId, r)
+	if err != nil || session.refreshTokenId != secondId {
+		t.Fatalf("replaced token within the grace period: got %+v, %v; want %s", session, err, secondId)
+	}
+
+	if _, err := db.DB.Exec("UPDATE authSessions SET rotatedAt = ? WHERE sessionId = ?",
+		time.Now().Add(-refreshTokenReuseGrace-time.Second).Unix(), sessionId); err != nil {
+		t.Fatalf("failed to age rotation: %v", err)
+	}
+
+	if _, err := rotateRefreshToken(sessionId, firstId, r); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("replaced token after the grace period: got %v, want ErrRefreshTokenReused", err)
+	}
+
+	if entries, err := audit.Query(audit.Filter{Action: audit.UserSessionReuse}); err != nil || len(entries) != 1 || entries[0].Target != userId {
+		t.Errorf("expected the reuse in the audit log, got %+v (%v)", entries, err)
+	}
+
+	// The whole session is gone, including for whoever had the current token.
+	if _, err := rotateRefreshToken(sessionId, secondId, r); err == nil {
+		t.Error("current token still works after reuse was detected")
+	}
+}
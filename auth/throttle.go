@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+)
+
+// Slows down password, share link password, invite code and password reset link guessing. Failures are counted per client address and, for
+// logins, per username (whether or not the user exists, so the limits don't reveal which do). After a
+// few free failures, each one doubles the wait before the next attempt; enough failed logins for one
+// username lock it for a while, until the lock runs out or an admin unlocks it. Counters are kept in the
+// database so they survive restarts.
+
+// authThrottle table has rows:
+// key TEXT -- what's being counted, such as "login-user:<username>"
+// failures INTEGER
+// lastFailedAt INTEGER
+// lockedUntil INTEGER -- NULL unless locked
+
+// authFailedLogins table has rows:
+// username TEXT -- as entered
+// userId TEXT -- NULL if there is no such user
+// remoteAddr TEXT
+// attemptedAt INTEGER
+
+type throttlePolicy struct {
+	// Failures allowed before attempts are slowed down.
+	free int
+
+	// The wait after the first failure past free, doubling with each further failure, up to maxDelay.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	// Failures before locking for lockDuration. Zero to never lock.
+	lockAfter    int
+	lockDuration time.Duration
+}
+
+var loginUserPolicy = throttlePolicy{
+	free:         3,
+	baseDelay:    time.Second,
+	maxDelay:     time.Minute * 5,
+	lockAfter:    10,
+	lockDuration: time.Minute * 30,
+}
+
+// More lenient than per username, since many people can share an address.
+var loginAddrPolicy = throttlePolicy{
+	free:      10,
+	baseDelay: time.Second,
+	maxDelay:  time.Minute * 15,
+}
+
+var inviteAddrPolicy = throttlePolicy{
+	free:      5,
+	baseDelay: time.Second * 2,
+	maxDelay:  time.Minute * 15,
+}
+
+// Password reset links are as hard to guess as invite codes.
+var passwordResetAddrPolicy = inviteAddrPolicy
+
+// Share link passwords are chosen by people, like login passwords, but there's nothing to lock.
+var sharePasswordPolicy = throttlePolicy{
+	free:      3,
+	baseDelay: time.Second,
+	maxDelay:  time.Minute * 5,
+}
+
+var sharePasswordAddrPolicy = loginAddrPolicy
+
+// Counters start over once there have been no failures for this long.
+const throttleForgetAfter = time.Hour * 24
+
+// How long failed logins are kept for admins to look at.
+const failedLoginRetention = time.Hour * 24 * 90
+
+var ErrInvalidLogin = errors.New("invalid username or password")
+var ErrInvalidSharePassword = errors.New("incorrect password")
+
+// Returned instead of checking anything while attempts are being slowed down or locked.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed attempts; try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// The current time, for everything to do with throttling. Replaced in tests.
+var throttleNow = time.Now
+
+func loginUserKey(username string) string {
+	return "login-user:" + username
+}
+
+// Returns the address without its port, so every connection from a client counts together.
+func clientAddr(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+
+	return remoteAddr
+}
+
+// Returns the delay before the next attempt after this many failures.
+func (policy throttlePolicy) delay(failures int) time.Duration {
+	if failures < policy.free {
+		return 0
+	}
+
+	delay := policy.baseDelay
+	for range failures - policy.free {
+		delay *= 2
+		if delay >= policy.maxDelay {
+			return policy.maxDelay
+		}
+	}
+
+	return delay
+}
+
+// Reserves an attempt for the key before anything is checked, counting it as a failure until
+// releaseThrottle or clearThrottle says otherwise. Returns a ThrottledError instead if the key has to
+// wait first. The counter is only moved on from the values that were checked, in a single statement, so
+// attempts made at the same time can't all be let through before any of them is counted.
+func reserveThrottle(key string, policy throttlePolicy) error {
+	for {
+		var failures int
+		var lastFailedAt int64
+		var lockedUntil sql.NullInt64
+
+		err := db.DB.QueryRow("SELECT failures, lastFailedAt, lockedUntil FROM authThrottle WHERE key = ?", key).
+			Scan(&failures, &lastFailedAt, &lockedUntil)
+
+		now := throttleNow()
+
+		if errors.Is(err, sql.ErrNoRows) {
+			result, err := db.DB.Exec("INSERT INTO authThrottle (key, failures, lastFailedAt) VALUES (?, 1, ?) ON CONFLICT (key) DO NOTHING",
+				key, now.Unix())
+			if err != nil {
+				return err
+			}
+			if inserted, _ := result.RowsAffected(); inserted > 0 {
+				return nil
+			}
+			// Another attempt got there first; check again against what it left.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if lockedUntil.Valid && now.Before(time.Unix(lockedUntil.Int64, 0)) {
+			return &ThrottledError{RetryAfter: time.Unix(lockedUntil.Int64, 0).Sub(now)}
+		}
+
+		// Old failures are forgotten rather than added to.
+		reserved := failures + 1
+		if now.Sub(time.Unix(lastFailedAt, 0)) > throttleForgetAfter {
+			reserved = 1
+		} else if retryAt := time.Unix(lastFailedAt, 0).Add(policy.delay(failures)); now.Before(retryAt) {
+			return &ThrottledError{RetryAfter: retryAt.Sub(now)}
+		}
+
+		result, err := db.DB.Exec(`
+			UPDATE authThrottle SET failures = ?, lastFailedAt = ?
+			WHERE key = ? AND failures = ? AND lastFailedAt = ? AND lockedUntil IS ?`,
+			reserved, now.Unix(), key, failures, lastFailedAt, lockedUntil)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated > 0 {
+			return nil
+		}
+	}
+}
+
+// Gives back an attempt reserved with reserveThrottle that turned out not to be a failure.
+func releaseThrottle(key string) error {
+	_, err := db.DB.Exec("UPDATE authThrottle SET failures = MAX(failures - 1, 0) WHERE key = ?", key)
+	return err
+}
+
+// Called when a reserved attempt failed, to lock the key if it's failed too often.
+func lockThrottle(key string, policy throttlePolicy) error {
+	if policy.lockAfter == 0 {
+		return nil
+	}
+
+	result, err := db.DB.Exec("UPDATE authThrottle SET lockedUntil = ?, failures = 0 WHERE key = ? AND failures >= ?",
+		throttleNow().Add(policy.lockDuration).Unix(), key, policy.lockAfter)
+	if err != nil {
+		return err
+	}
+
+	if locked, _ := result.RowsAffected(); locked > 0 {
+		log.Printf("%s locked for %s after too many failures", key, policy.lockDuration)
+	}
+
+	return nil
+}
+
+func clearThrottle(key string) error {
+	_, err := db.DB.Exec("DELETE FROM authThrottle WHERE key = ?", key)
+	return err
+}
+
+// Checks a username and password, subject to the login limits for both the username and the client's
+// address. All wrong usernames and passwords fail with the same error.
+func checkLogin(username string, password string, remoteAddr string) (string, error) {
+	addr := clientAddr(remoteAddr)
+	addrKey := "login-addr:" + addr
+
+	if err := reserveThrottle(addrKey, loginAddrPolicy); err != nil {
+		return "", err
+	}
+
+	if err := reserveThrottle(loginUserKey(username), loginUserPolicy); err != nil {
+		// Nothing was tried, so it doesn't count against the address.
+		releaseLoginAddr(addrKey)
+		return "", err
+	}
+
+	userId, err := getUserLogin(username, password)
+
+	if errors.Is(err, ErrInvalidLogin) {
+		recordFailedLogin(username, addr)
+		return "", err
+	}
+
+	releaseLoginAddr(addrKey)
+
+	if err != nil {
+		if releaseErr := releaseThrottle(loginUserKey(username)); releaseErr != nil {
+			log.Printf("unable to release login attempt for %q: %v", username, releaseErr)
+		}
+		return "", err
+	}
+
+	if err := clearThrottle(loginUserKey(username)); err != nil {
+		log.Printf("unable to clear login failures for %q: %v", username, err)
+	}
+
+	return userId, nil
+}
+
+func releaseLoginAddr(addrKey string) {
+	if err := releaseThrottle(addrKey); err != nil {
+		log.Printf("unable to release login attempt for %s: %v", addrKey, err)
+	}
+}
+
+// Keeps a record of a failed login, already counted by reserveThrottle, for admins, and locks the
+// username if it's failed too often.
+func recordFailedLogin(username string, addr string) {
+	if err := lockThrottle(loginUserKey(username), loginUserPolicy); err != nil {
+		log.Printf("unable to lock logins for %q: %v", username, err)
+	}
+
+	now := throttleNow()
+
+	if _, err := db.DB.Exec(`
+		INSERT INTO authFailedLogins (username, userId, remoteAddr, attemptedAt)
+		VALUES (?, (SELECT userId FROM authUsers WHERE userName = ? AND deleted = 0), ?, ?)`,
+		username, username, addr, now.Unix()); err != nil {
+		log.Printf("unable to record failed login for %q: %v", username, err)
+	}
+
+	if _, err := db.DB.Exec("DELETE FROM authFailedLogins WHERE attemptedAt < ?", now.Add(-failedLoginRetention).Unix()); err != nil {
+		log.Printf("unable to prune failed logins: %v", err)
+	}
+}
+
+// Like ValidateInviteCode, but limits how many wrong codes a client can try.
+func CheckInviteCode(inviteCode string, remoteAddr string) (string, error) {
+	key := "invite-addr:" + clientAddr(remoteAddr)
+
+	if err := reserveThrottle(key, inviteAddrPolicy); err != nil {
+		return "", err
+	}
+
+	createdBy, err := ValidateInviteCode(inviteCode)
+	if err != nil {
+		return "", err
+	}
+
+	if err := releaseThrottle(key); err != nil {
+		log.Printf("unable to release invite code attempt: %v", err)
+	}
+
+	return createdBy, nil
+}
+
+// Like ValidatePasswordResetToken, but slows down whoever keeps trying tokens that don't work.
+func CheckPasswordResetToken(token string, remoteAddr string) (string, string, error) {
+	key := "password-reset-addr:" + clientAddr(remoteAddr)
+
+	if err := reserveThrottle(key, passwordResetAddrPolicy); err != nil {
+		return "", "", err
+	}
+
+	userId, username, err := ValidatePasswordResetToken(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := releaseThrottle(key); err != nil {
+		log.Printf("unable to release password reset attempt: %v", err)
+	}
+
+	return userId, username, nil
+}
+
+// Checks a share link's password with check, limiting how many wrong ones can be tried for the link and
+// from the client's address. The storage package owns shares, so it passes in the check.
+func CheckSharePassword(shareId string, remoteAddr string, check func() bool) error {
+	addrKey := "share-password-addr:" + clientAddr(remoteAddr)
+	shareKey := "share-password:" + shareId
+
+	if err := reserveThrottle(addrKey, sharePasswordAddrPolicy); err != nil {
+		return err
+	}
+
+	if err := reserveThrottle(shareKey, sharePasswordPolicy); err != nil {
+		// Nothing was tried, so it doesn't count against the address.
+		if releaseErr := releaseThrottle(addrKey); releaseErr != nil {
+			log.Printf("unable to release share password attempt for %s: %v", addrKey, releaseErr)
+		}
+		return err
+	}
+
+	if !check() {
+		return ErrInvalidSharePassword
+	}
+
+	if err := releaseThrottle(addrKey); err != nil {
+		log.Printf("unable to release share password attempt for %s: %v", addrKey, err)
+	}
+
+	if err := clearThrottle(shareKey); err != nil {
+		log.Printf("unable to clear share password failures for %s: %v", shareId, err)
+	}
+
+	return nil
+}
+
+type FailedLogin struct {
+	RemoteAddr  string
+	AttemptedAt time.Time
+}
+
+type LoginLockout struct {
+	// Zero if the user isn't locked.
+	LockedUntil time.Time
+
+	// Failures since the last successful login, or since the last lock.
+	Failures int
+}
+
+// Returns the user's most recent failed logins, newest first.
+func AdminGetFailedLogins(userId string, limit int) ([]FailedLogin, error) {
+	rows, err := db.DB.Query(`
+		SELECT remoteAddr, attemptedAt
+		FROM authFailedLogins
+		WHERE userId = ?
+		ORDER BY attemptedAt DESC
+		LIMIT ?`, userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []FailedLogin
+
+	for rows.Next() {
+		var attempt FailedLogin
+		var attemptedAt int64
+
+		if err := rows.Scan(&attempt.RemoteAddr, &attemptedAt); err != nil {
+			return nil, err
+		}
+
+		attempt.AttemptedAt = time.Unix(attemptedAt, 0)
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, rows.Err()
+}
+
+func AdminGetLoginLockout(username string) (LoginLockout, error) {
+	lockout := LoginLockout{}
+
+	var lastFailedAt int64
+	var lockedUntil sql.NullInt64
+
+	err := db.DB.QueryRow("SELECT failures, lastFailedAt, lockedUntil FROM authThrottle WHERE key = ?", loginUserKey(username)).
+		Scan(&lockout.Failures, &lastFailedAt, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return lockout, nil
+	}
+	if err != nil {
+		return lockout, err
+	}
+
+	now := throttleNow()
+
+	if now.Sub(time.Unix(lastFailedAt, 0)) > throttleForgetAfter {
+		lockout.Failures = 0
+	}
+
+	if lockedUntil.Valid && now.Before(time.Unix(lockedUntil.Int64, 0)) {
+		lockout.LockedUntil = time.Unix(lockedUntil.Int64, 0)
+	}
+
+	return lockout, nil
+}
+
+// Lets the user try logging in again straight away, and resets their failure count.
+func AdminUnlockLogin(ctx context.Context, username string) error {
+	if err := clearThrottle(loginUserKey(username)); err != nil {
+		return err
+	}
+
+	log.Printf("logins for %q unlocked", username)
+
+	return audit.Record(ctx, audit.UserUnlock, username, nil)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"lod2/db"
+)
+
+func setupThrottleClock(start time.Time) (*time.Time, func()) {
+	now := start
+	throttleNow = func() time.Time { return now }
+
+	return &now, func() { throttleNow = time.Now }
+}
+
+func createLoginTestUser(t *testing.T, username string, password string) string {
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	userId := "user_" + username
+	if _, err := db.DB.Exec("INSERT INTO authUsers (userId, userName, userPasswordHash, createdAt) VALUES (?, ?, ?, ?)",
+		userId, username, hash, 0); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	return userId
+}
+
+func TestCheckLogin_SameErrorForUnknownUserAndWrongPassword(t *testing.T) {
+	defer setupTestDatabase(t)()
+	_, restore := setupThrottleClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	createLoginTestUser(t, "alice", "correct horse")
+
+	_, wrongPassword := checkLogin("alice", "wrong", "192.0.2.1:1234")
+	_, unknownUser := checkLogin("bob", "wrong", "192.0.2.1:1234")
+
+	if !errors.Is(wrongPassword, ErrInvalidLogin) || !errors.Is(unknownUser, ErrInvalidLogin) {
+		t.Errorf("got %v and %v, want ErrInvalidLogin for both", wrongPassword, unknownUser)
+	}
+}
+
+func TestCheckLogin_BacksOffThenLocksUntilUnlocked(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupThrottleClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	userId := createLoginTestUser(t, "alice", "correct horse")
+
+	// Each from a different address, so only the per-username limit applies.
+	failures := 0
+	var lastWait time.Duration
+
+	for failures < loginUserPolicy.lockAfter {
+		addr := fmt.Sprintf("192.0.2.%d:1234", failures)
+		_, err := checkLogin("alice", "wrong", addr)
+
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			if throttled.RetryAfter <= lastWait {
+				t.Fatalf("after %d failures, wait %s is not longer than %s", failures, throttled.RetryAfter, lastWait)
+			}
+			lastWait = throttled.RetryAfter
+			*now = now.Add(throttled.RetryAfter)
+			continue
+		}
+
+		if !errors.Is(err, ErrInvalidLogin) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidLogin", failures, err)
+		}
+
+		if failures < loginUserPolicy.free && lastWait != 0 {
+			t.Fatalf("throttled during the first %d failures", loginUserPolicy.free)
+		}
+
+		failures++
+	}
+
+	*now = now.Add(loginUserPolicy.maxDelay)
+
+	var throttled *ThrottledError
+	if _, err := checkLogin("alice", "correct horse", "198.51.100.1:1234"); !errors.As(err, &throttled) {
+		t.Fatalf("right password while locked: got %v, want ThrottledError", err)
+	}
+
+	attempts, err := AdminGetFailedLogins(userId, 100)
+	if err != nil {
+		t.Fatalf("AdminGetFailedLogins failed: %v", err)
+	}
+
+	if len(attempts) != loginUserPolicy.lockAfter {
+		t.Errorf("got %d failed logins recorded, want %d", len(attempts), loginUserPolicy.lockAfter)
+	}
+
+	if err := AdminUnlockLogin(context.Background(), "alice"); err != nil {
+		t.Fatalf("AdminUnlockLogin failed: %v", err)
+	}
+
+	if id, err := checkLogin("alice", "correct horse", "198.51.100.1:1234"); err != nil || id != userId {
+		t.Errorf("right password after unlocking: got %q, %v", id, err)
+	}
+}
+
+func TestCheckLogin_AddressLimitCoversAllUsernames(t *testing.T) {
+	defer setupTestDatabase(t)()
+	_, restore := setupThrottleClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	for i := range loginAddrPolicy.free {
+		if _, err := checkLogin(fmt.Sprintf("user%d", i), "wrong", "192.0.2.1:1234"); !errors.Is(err, ErrInvalidLogin) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidLogin", i, err)
+		}
+	}
+
+	var throttled *ThrottledError
+	if _, err := checkLogin("someone-else", "wrong", "192.0.2.1:5678"); !errors.As(err, &throttled) {
+		t.Errorf("new username from the same address: got %v, want ThrottledError", err)
+	}
+
+	if _, err := checkLogin("someone-else", "wrong", "192.0.2.2:1234"); !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("new username from another address: got %v, want ErrInvalidLogin", err)
+	}
+}
+
+func TestCheckLogin_ConcurrentGuessesAreAllCounted(t *testing.T) {
+	defer setupTestDatabase(t)()
+	_, restore := setupThrottleClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	createLoginTestUser(t, "alice", "correct horse")
+
+	const guesses = 20
+	results := make(chan error, guesses)
+
+	for i := range guesses {
+		go func() {
+			_, err := checkLogin("alice", "wrong", fmt.Sprintf("192.0.2.%d:1234", i))
+			results <- err
+		}()
+	}
+
+	checked := 0
+	for range guesses {
+		err := <-results
+
+		var throttled *ThrottledError
+		switch {
+		case errors.Is(err, ErrInvalidLogin):
+			checked++
+		case !errors.As(err, &throttled):
+			t.Fatalf("got %v, want ErrInvalidLogin or ThrottledError", err)
+		}
+	}
+
+	if checked != loginUserPolicy.free {
+		t.Errorf("%d guesses were checked, want only the %d free ones", checked, loginUserPolicy.free)
+	}
+}
+
+func TestCheckSharePassword_BacksOff(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupThrottleClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	wrong := func() bool { return false }
+	right := func() bool { return true }
+
+	for i := range sharePasswordPolicy.free {
+		if err := CheckSharePassword("share_a", fmt.Sprintf("192.0.2.%d:1234", i), wrong); !errors.Is(err, ErrInvalidSharePassword) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidSharePassword", i, err)
+		}
+	}
+
+	// From another address, and even with the right password, the link has to wait.
+	var throttled *ThrottledError
+	if err := CheckSharePassword("share_a", "198.51.100.1:1234", right); !errors.As(err, &throttled) {
+		t.Errorf("after %d failures: got %v, want ThrottledError", sharePasswordPolicy.free, err)
+	}
+
+	if err := CheckSharePassword("share_b", "198.51.100.1:1234", right); err != nil {
+		t.Errorf("another link: got %v, want no error", err)
+	}
+
+	*now = now.Add(sharePasswordPolicy.maxDelay)
+	if err := CheckSharePassword("share_a", "198.51.100.1:1234", right); err != nil {
+		t.Errorf("after waiting: got %v, want no error", err)
+	}
+}
@@ -3,47 +3,22 @@ package auth
 import (
 	"log"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
 	"github.com/lestrrat-go/jwx/v3/jwt"
-
-	"lod2/config"
 )
 
 // Responsible for managing tokens used for user authentication.
-// Primarily, this includes the private/public key pair used to sign and verify JWTs.
-// The private key is loaded from disk and used to sign JWTs, while the public key is derived from the private key and used to verify JWTs.
-
-// The global private key used to sign JWTs.
-var privkey jwk.Key
-
-// The global public key used to verify JWTs.
-var pubkey jwk.Key
+// Tokens are signed with the current key from the key ring (see keyring.go) and verified against any key
+// in it, so tokens signed before a key rotation stay valid until they expire.
 
 // Needs to be called before using any of the functions in this package.
 func initTokens() {
-	initAuthTokenKeys()
-}
-
-// Loads the private and public keys used for JWT signing and verification.
-func initAuthTokenKeys() {
-	// First, read public/private keys from disk.
-	privkeyPath := filepath.Join(config.Config.ConfigPath, "keys/auth/private.jwk.json")
-
-	var err error
-	privkey, err = loadPrivateKey(privkeyPath)
-
-	if err != nil {
-		log.Printf("unable to load private key: %s\n", err)
-	}
-
-	pubkey, err = jwk.PublicKeyOf(privkey)
-
-	if err != nil {
-		log.Printf("unable to derive public key from private key: %s\n", err)
+	if err := loadKeyRing(); err != nil {
+		log.Printf("unable to load auth keys: %s\n", err)
 	}
 }
 
@@ -82,7 +57,7 @@ func signToken(builder *jwt.Builder) (string, error) {
 	}
 
 	// Sign the JWT.
-	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256(), privkey))
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256(), getSigningKey()))
 	if err != nil {
 		log.Printf("unable to sign token: %s", err)
 		return "", err
@@ -93,7 +68,8 @@ func signToken(builder *jwt.Builder) (string, error) {
 
 // Returns the token if the token is valid and issued by us. Does not validate anything about the token's claims.
 func _verifyTokenIsValid(signedToken string) (jwt.Token, error) {
-	token, err := jwt.Parse([]byte(signedToken), jwt.WithKey(jwa.RS256(), pubkey))
+	// Tokens signed before keys had IDs don't say which key signed them, so every key is tried for those.
+	token, err := jwt.Parse([]byte(signedToken), jwt.WithKeySet(GetVerificationKeys(), jws.WithRequireKid(false)))
 
 	if err != nil {
 		log.Printf("unable to verify JWT was signed by us: %s", err)
@@ -0,0 +1,600 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"lod2/audit"
+	"lod2/db"
+)
+
+// Time-based one-time passwords (RFC 6238) as a second login step. A user enrolls by scanning a secret
+// into an authenticator app and confirming a code from it; from then on, logging in takes a code as well
+// as their password. Recovery codes stand in for the app if it's lost, each working once.
+//
+// Admins can require two-factor authentication for roles. Until a user with such a role enrolls, the
+// role is held back (see ApplyTotpPolicy).
+
+// authTotp table has rows:
+// userId TEXT
+// secret TEXT -- base32, as shown to the user
+// createdAt INTEGER
+// enabledAt INTEGER -- NULL until the user confirms a code during enrollment
+// lastUsedStep INTEGER -- the time step of the last accepted code, so a code can't be used twice
+// failedAttempts INTEGER -- wrong codes since the last right one
+// lastFailedAt INTEGER -- NULL if there are none
+
+// authRecoveryCodes table has rows:
+// userId TEXT
+// codeHash TEXT -- bcrypt, like passwords
+// createdAt INTEGER
+// usedAt INTEGER -- NULL until used
+
+// authTotpRequiredRoles table has rows:
+// scope INTEGER
+// level INTEGER -- users with at least this level in the scope must use two-factor authentication
+
+const totpPeriod = 30
+const totpDigits = 6
+
+// How many periods either side of now a code is accepted for, to allow for clock drift.
+const totpSkew = 1
+
+// Wrong codes in a row before codes stop being checked for totpLockDuration.
+const maxTotpFailures = 5
+const totpLockDuration = time.Minute * 5
+
+const recoveryCodeCount = 10
+
+// The name shown in authenticator apps.
+const totpIssuer = "lod2.zip"
+
+var ErrInvalidTotpCode = errors.New("invalid code")
+var ErrTotpLocked = errors.New("too many invalid codes; try again in a few minutes")
+var ErrTotpRequired = errors.New("two-factor authentication code required")
+
+// The current time, for everything to do with codes. Replaced in tests.
+var totpNow = time.Now
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TotpStatus struct {
+	Enabled   bool
+	EnabledAt time.Time
+
+	// Unused recovery codes.
+	RecoveryCodesLeft int
+
+	// Whether the user's roles require two-factor authentication, so it can't be turned off.
+	Required bool
+}
+
+// A secret waiting for the user to confirm a code from it.
+type TotpEnrollment struct {
+	Secret string
+
+	// The otpauth:// URI authenticator apps import, usually from a QR code.
+	Uri string
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// Returns the code for a time step, as in RFC 4226 (HOTP) with the step as the counter.
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Returns the time step the code is valid for, if it's valid for any step near now after lastUsedStep.
+func checkTotpCode(secret string, code string, lastUsedStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpUri(secret string, username string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Returns whether the user has finished enrolling.
+func TotpEnabled(userId string) (bool, error) {
+	var enabledAt sql.NullInt64
+
+	err := db.DB.QueryRow("SELECT enabledAt FROM authTotp WHERE userId = ?", userId).Scan(&enabledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return enabledAt.Valid, nil
+}
+
+func GetTotpStatus(userId string) (TotpStatus, error) {
+	status := TotpStatus{}
+
+	var enabledAt sql.NullInt64
+	err := db.DB.QueryRow("SELECT enabledAt FROM authTotp WHERE userId = ?", userId).Scan(&enabledAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return status, err
+	}
+
+	if enabledAt.Valid {
+		status.Enabled = true
+		status.EnabledAt = time.Unix(enabledAt.Int64, 0)
+	}
+
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM authRecoveryCodes WHERE userId = ? AND usedAt IS NULL", userId).
+		Scan(&status.RecoveryCodesLeft)
+	if err != nil {
+		return status, err
+	}
+
+	roles, err := GetUserRoles(userId)
+	if err != nil {
+		return status, err
+	}
+
+	required, err := GetTotpRequiredRoles()
+	if err != nil {
+		return status, err
+	}
+
+	status.Required = totpRequiredFor(roles, required)
+
+	return status, nil
+}
+
+// Starts enrollment with a new secret, replacing any earlier unfinished one.
+func BeginTotpEnrollment(userId string, username string) (TotpEnrollment, error) {
+	enabled, err := TotpEnabled(userId)
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+
+	if enabled {
+		return TotpEnrollment{}, errors.New("two-factor authentication is already enabled")
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return TotpEnrollment{}, err
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+
+	_, err = db.DB.Exec(`
+		INSERT INTO authTotp (userId, secret, createdAt) VALUES (?, ?, ?)
+		ON CONFLICT (userId) DO UPDATE SET secret = excluded.secret, createdAt = excluded.createdAt,
+			lastUsedStep = 0, failedAttempts = 0, lastFailedAt = NULL`,
+		userId, secret, totpNow().Unix())
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+
+	return TotpEnrollment{Secret: secret, Uri: totpUri(secret, username)}, nil
+}
+
+// Returns the unfinished enrollment, if there is one.
+func GetTotpEnrollment(userId string, username string) (TotpEnrollment, bool, error) {
+	var secret string
+
+	err := db.DB.QueryRow("SELECT secret FROM authTotp WHERE userId = ? AND enabledAt IS NULL", userId).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TotpEnrollment{}, false, nil
+	}
+	if err != nil {
+		return TotpEnrollment{}, false, err
+	}
+
+	return TotpEnrollment{Secret: secret, Uri: totpUri(secret, username)}, true, nil
+}
+
+// Finishes enrollment if the code matches the new secret, returning the user's recovery codes.
+func EnableTotp(userId string, code string) ([]string, error) {
+	var secret string
+	var lastUsedStep int64
+
+	err := db.DB.QueryRow("SELECT secret, lastUsedStep FROM authTotp WHERE userId = ? AND enabledAt IS NULL", userId).
+		Scan(&secret, &lastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("start setting up two-factor authentication first")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := checkTotpCode(secret, code, lastUsedStep, totpNow())
+	if !ok {
+		return nil, ErrInvalidTotpCode
+	}
+
+	if _, err := db.DB.Exec("UPDATE authTotp SET enabledAt = ?, lastUsedStep = ? WHERE userId = ?",
+		totpNow().Unix(), step, userId); err != nil {
+		return nil, err
+	}
+
+	log.Printf("two-factor authentication enabled for %s", userId)
+
+	// Roles held back until now are given back.
+	if err := bumpRolesVersion(userId); err != nil {
+		return nil, err
+	}
+
+	return replaceRecoveryCodes(userId)
+}
+
+// Replaces a user's recovery codes with new ones, returning them. Only their hashes are kept.
+func replaceRecoveryCodes(userId string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM authRecoveryCodes WHERE userId = ?", userId); err != nil {
+		return nil, err
+	}
+
+	for range recoveryCodeCount {
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:5] + "-" + encoded[5:]
+
+		hash, err := hashPassword(code)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("INSERT INTO authRecoveryCodes (userId, codeHash, createdAt) VALUES (?, ?, ?)",
+			userId, hash, totpNow().Unix()); err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Marks a matching unused recovery code as used, returning whether there was one.
+func useRecoveryCode(userId string, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	rows, err := db.DB.Query("SELECT rowid, codeHash FROM authRecoveryCodes WHERE userId = ? AND usedAt IS NULL", userId)
+	if err != nil {
+		return false, err
+	}
+
+	var matched int64
+	for rows.Next() {
+		var rowId int64
+		var hash string
+		if err := rows.Scan(&rowId, &hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		if matched == 0 && verifyPassword(hash, code) {
+			matched = rowId
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if matched == 0 {
+		return false, nil
+	}
+
+	result, err := db.DB.Exec("UPDATE authRecoveryCodes SET usedAt = ? WHERE rowid = ? AND usedAt IS NULL",
+		totpNow().Unix(), matched)
+	if err != nil {
+		return false, err
+	}
+
+	// Someone else used it first.
+	if changed, _ := result.RowsAffected(); changed == 0 {
+		return false, nil
+	}
+
+	log.Printf("recovery code used by %s", userId)
+
+	return true, nil
+}
+
+// Checks a code from the user's authenticator app, or one of their recovery codes. Each code only
+// works once, and checking stops for a while after too many wrong ones.
+func VerifyTotp(userId string, code string) error {
+	var secret string
+	var lastUsedStep int64
+	var failedAttempts int
+	var lastFailedAt sql.NullInt64
+
+	err := db.DB.QueryRow(`
+		SELECT secret, lastUsedStep, failedAttempts, lastFailedAt
+		FROM authTotp
+		WHERE userId = ? AND enabledAt IS NOT NULL`, userId).Scan(&secret, &lastUsedStep, &failedAttempts, &lastFailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return err
+	}
+
+	now := totpNow()
+
+	if failedAttempts >= maxTotpFailures && lastFailedAt.Valid &&
+		now.Before(time.Unix(lastFailedAt.Int64, 0).Add(totpLockDuration)) {
+		return ErrTotpLocked
+	}
+
+	if step, ok := checkTotpCode(secret, code, lastUsedStep, now); ok {
+		// Only the first of two concurrent logins with the same code gets through.
+		result, err := db.DB.Exec(`
+			UPDATE authTotp SET lastUsedStep = ?, failedAttempts = 0, lastFailedAt = NULL
+			WHERE userId = ? AND lastUsedStep < ?`, step, userId, step)
+		if err != nil {
+			return err
+		}
+
+		if changed, _ := result.RowsAffected(); changed == 1 {
+			return nil
+		}
+	} else {
+		used, err := useRecoveryCode(userId, code)
+		if err != nil {
+			return err
+		}
+
+		if used {
+			_, err := db.DB.Exec("UPDATE authTotp SET failedAttempts = 0, lastFailedAt = NULL WHERE userId = ?", userId)
+			return err
+		}
+	}
+
+	if _, err := db.DB.Exec("UPDATE authTotp SET failedAttempts = failedAttempts + 1, lastFailedAt = ? WHERE userId = ?",
+		now.Unix(), userId); err != nil {
+		return err
+	}
+
+	return ErrInvalidTotpCode
+}
+
+// Replaces a user's recovery codes, after checking a code to make sure it's really them.
+func RegenerateRecoveryCodes(userId string, code string) ([]string, error) {
+	if err := VerifyTotp(userId, code); err != nil {
+		return nil, err
+	}
+
+	return replaceRecoveryCodes(userId)
+}
+
+// Turns off two-factor authentication for the user, after checking a code. Users whose roles require it
+// have to ask an admin instead.
+func DisableTotp(userId string, code string) error {
+	status, err := GetTotpStatus(userId)
+	if err != nil {
+		return err
+	}
+
+	if status.Required {
+		return errors.New("two-factor authentication is required for your roles")
+	}
+
+	if err := VerifyTotp(userId, code); err != nil {
+		return err
+	}
+
+	return deleteTotp(userId)
+}
+
+func deleteTotp(userId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM authTotp WHERE userId = ?", userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM authRecoveryCodes WHERE userId = ?", userId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("two-factor authentication removed for %s", userId)
+
+	return bumpRolesVersion(userId)
+}
+
+// Removes a user's two-factor authentication, for when they've lost both their app and their recovery
+// codes. They can log in with just their password until they enroll again.
+func AdminResetTotp(ctx context.Context, userId string) error {
+	if err := deleteTotp(userId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.UserTwoFactorReset, userId, nil)
+}
+
+// Returns the minimum level in each scope that requires two-factor authentication, with None for
+// scopes that never do.
+func GetTotpRequiredRoles() ([]Role, error) {
+	rows, err := db.DB.Query("SELECT scope, level FROM authTotpRequiredRoles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := make(map[AccessScope]AccessLevel)
+	for rows.Next() {
+		var scope, level int
+		if err := rows.Scan(&scope, &level); err != nil {
+			return nil, err
+		}
+		levels[AccessScope(scope)] = AccessLevel(level)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roles := make([]Role, 0, len(AllAccessScopes))
+	for _, scope := range AllAccessScopes {
+		roles = append(roles, Role{Scope: scope, Level: levels[scope]})
+	}
+
+	return roles, nil
+}
+
+func AdminSetTotpRequiredRoles(ctx context.Context, roles []Role) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM authTotpRequiredRoles"); err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if role.Level == AccessLevelNone {
+			continue
+		}
+
+		if _, err := tx.Exec("INSERT INTO authTotpRequiredRoles (scope, level) VALUES (?, ?)", role.Scope, role.Level); err != nil {
+			return err
+		}
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.TwoFactorPolicy, "", map[string]interface{}{"requiredRoles": GetRoleStrings(roles)}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return bumpAllRolesVersions()
+}
+
+func totpRequiredFor(roles []Role, required []Role) bool {
+	requiredLevels := GetRoleMap(required)
+
+	for _, role := range roles {
+		minimum := requiredLevels[role.Scope]
+		if minimum != AccessLevelNone && role.Level >= minimum {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Holds back the roles that require two-factor authentication if the user hasn't enrolled, lowering
+// each to just below the required level, and marks the user as needing to enroll.
+func ApplyTotpPolicy(userInfo *UserInfo) error {
+	required, err := GetTotpRequiredRoles()
+	if err != nil {
+		return err
+	}
+
+	if !totpRequiredFor(userInfo.Roles, required) {
+		return nil
+	}
+
+	enabled, err := TotpEnabled(userInfo.UserId)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		return nil
+	}
+
+	requiredLevels := GetRoleMap(required)
+	roles := make([]Role, 0, len(userInfo.Roles))
+
+	for _, role := range userInfo.Roles {
+		minimum := requiredLevels[role.Scope]
+		if minimum != AccessLevelNone && role.Level >= minimum {
+			role.Level = minimum - 1
+		}
+		roles = append(roles, role)
+	}
+
+	userInfo.Roles = roles
+	userInfo.TotpSetupRequired = true
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lod2/db"
+)
+
+func setupTestDatabase(t testing.TB) func() {
+	tempDir, err := os.MkdirTemp("", "auth_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	if err := db.Open(filepath.Join(tempDir, "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	if err := db.RunMigrations(); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	// Cached from an earlier test's database.
+	rolesVersions = map[string]int64{}
+
+	return func() {
+		db.DB.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+// Replaces the clock used for codes until the returned function is called. Move the clock by changing
+// the time pointed to.
+func setupFakeClock(start time.Time) (*time.Time, func()) {
+	now := start
+	totpNow = func() time.Time { return now }
+
+	return &now, func() { totpNow = time.Now }
+}
+
+func createTotpTestUser(t testing.TB, roles []Role) string {
+	userId := "user_" + t.Name()
+
+	if _, err := db.DB.Exec("INSERT INTO authUsers (userId, userName, userPasswordHash, createdAt) VALUES (?, ?, ?, ?)",
+		userId, t.Name(), "unused", 0); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if len(roles) > 0 {
+		roleId, err := AdminCreateRoleDefinition(context.Background(), t.Name(), "", roles)
+		if err != nil {
+			t.Fatalf("failed to create role: %v", err)
+		}
+
+		if err := AdminSetUserRoleIds(context.Background(), userId, []string{roleId}); err != nil {
+			t.Fatalf("failed to add role: %v", err)
+		}
+	}
+
+	return userId
+}
+
+// Enrolls the user, returning their secret and recovery codes.
+func enrollTotpTestUser(t *testing.T, userId string, now time.Time) ([]byte, []string) {
+	enrollment, err := BeginTotpEnrollment(userId, "test")
+	if err != nil {
+		t.Fatalf("BeginTotpEnrollment failed: %v", err)
+	}
+
+	secret, err := totpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatalf("secret is not base32: %v", err)
+	}
+
+	recoveryCodes, err := EnableTotp(userId, totpCode(secret, totpStep(now)))
+	if err != nil {
+		t.Fatalf("EnableTotp failed: %v", err)
+	}
+
+	return secret, recoveryCodes
+}
+
+// The SHA-1 test vectors from RFC 6238, appendix B, truncated to six digits.
+func TestTotpCode_MatchesRfc6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		if code := totpCode(secret, totpStep(time.Unix(test.unix, 0))); code != test.code {
+			t.Errorf("code at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTotp_AcceptsEachCodeOnceWithinSkew(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupFakeClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	userId := createTotpTestUser(t, nil)
+	secret, _ := enrollTotpTestUser(t, userId, *now)
+
+	// The code used to enroll can't be used again.
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now))); !errors.Is(err, ErrInvalidTotpCode) {
+		t.Errorf("reused code: got %v, want ErrInvalidTotpCode", err)
+	}
+
+	*now = now.Add(totpPeriod * time.Second)
+
+	// A code from one period ahead is accepted, for clocks that run fast...
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now)+1)); err != nil {
+		t.Errorf("code from the next period: %v", err)
+	}
+
+	// ...but then codes from before it aren't, even though they're within the skew.
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now))); !errors.Is(err, ErrInvalidTotpCode) {
+		t.Errorf("code older than the last used one: got %v, want ErrInvalidTotpCode", err)
+	}
+
+	*now = now.Add(5 * totpPeriod * time.Second)
+
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now)+2)); !errors.Is(err, ErrInvalidTotpCode) {
+		t.Errorf("code from two periods ahead: got %v, want ErrInvalidTotpCode", err)
+	}
+
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now)-1)); err != nil {
+		t.Errorf("code from the previous period: %v", err)
+	}
+}
+
+func TestVerifyTotp_RecoveryCodesWorkOnce(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupFakeClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	userId := createTotpTestUser(t, nil)
+	_, recoveryCodes := enrollTotpTestUser(t, userId, *now)
+
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+	}
+
+	if err := VerifyTotp(userId, recoveryCodes[3]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+
+	if err := VerifyTotp(userId, recoveryCodes[3]); !errors.Is(err, ErrInvalidTotpCode) {
+		t.Errorf("reused recovery code: got %v, want ErrInvalidTotpCode", err)
+	}
+
+	status, err := GetTotpStatus(userId)
+	if err != nil {
+		t.Fatalf("GetTotpStatus failed: %v", err)
+	}
+
+	if status.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("RecoveryCodesLeft = %d, want %d", status.RecoveryCodesLeft, recoveryCodeCount-1)
+	}
+}
+
+func TestVerifyTotp_LocksAfterTooManyFailures(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupFakeClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	userId := createTotpTestUser(t, nil)
+	secret, _ := enrollTotpTestUser(t, userId, *now)
+
+	for range maxTotpFailures {
+		if err := VerifyTotp(userId, "000000"); !errors.Is(err, ErrInvalidTotpCode) {
+			t.Fatalf("wrong code: got %v, want ErrInvalidTotpCode", err)
+		}
+	}
+
+	*now = now.Add(totpPeriod * time.Second)
+
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now))); !errors.Is(err, ErrTotpLocked) {
+		t.Errorf("right code while locked: got %v, want ErrTotpLocked", err)
+	}
+
+	*now = now.Add(totpLockDuration)
+
+	if err := VerifyTotp(userId, totpCode(secret, totpStep(*now))); err != nil {
+		t.Errorf("right code after the lock: %v", err)
+	}
+}
+
+func TestApplyTotpPolicy_HoldsBackRolesUntilEnrolled(t *testing.T) {
+	defer setupTestDatabase(t)()
+	now, restore := setupFakeClock(time.Unix(1700000000, 0))
+	defer restore()
+
+	if err := AdminSetTotpRequiredRoles(context.Background(), []Role{{Scope: DangerousSql, Level: Edit}}); err != nil {
+		t.Fatalf("AdminSetTotpRequiredRoles failed: %v", err)
+	}
+
+	roles := []Role{{Scope: DangerousSql, Level: Edit}, {Scope: Storage, Level: Edit}}
+	userId := createTotpTestUser(t, roles)
+
+	userInfo := UserInfo{UserId: userId, Roles: roles}
+	if err := ApplyTotpPolicy(&userInfo); err != nil {
+		t.Fatalf("ApplyTotpPolicy failed: %v", err)
+	}
+
+	levels := GetRoleMap(userInfo.Roles)
+	if !userInfo.TotpSetupRequired || levels[DangerousSql] != View || levels[Storage] != Edit {
+		t.Errorf("before enrolling: got %+v, want DangerousSql held back to View", userInfo)
+	}
+
+	enrollTotpTestUser(t, userId, *now)
+
+	userInfo = UserInfo{UserId: userId, Roles: roles}
+	if err := ApplyTotpPolicy(&userInfo); err != nil {
+		t.Fatalf("ApplyTotpPolicy failed: %v", err)
+	}
+
+	levels = GetRoleMap(userInfo.Roles)
+	if userInfo.TotpSetupRequired || levels[DangerousSql] != Edit {
+		t.Errorf("after enrolling: got %+v, want roles unchanged", userInfo)
+	}
+
+	if err := DisableTotp(userId, "000000"); err == nil {
+		t.Error("DisableTotp succeeded for a user whose roles require it")
+	}
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"sync"
 	"time"
 
+	"lod2/audit"
 	"lod2/db"
 
 	"github.com/mattn/go-sqlite3"
@@ -17,9 +20,11 @@ import (
 // userPasswordHash TEXT
 // inviteId TEXT -- the unique invite code this user used to register
 // createdAt INTEGER -- when the user was created, unix time
+// passwordChangeRequired INTEGER -- 1 if they have to change their password (see passwordreset.go)
 
-// Creates a user with the provided username and password (used for migrations/system users)
-func createUser(tx *sql.Tx, username string, password string, roles []Role) (string, error) {
+// Creates a user with the provided username, password and role definitions (used for migrations/system users).
+// The password policy isn't checked, so the admin user can start with a known password.
+func createUser(tx *sql.Tx, username string, password string, roleIds []string) (string, error) {
 	userId, _ := typeid.WithPrefix("user")
 	passwordHash, err := hashPassword(password)
 
@@ -40,7 +45,7 @@ func createUser(tx *sql.Tx, username string, password string, roles []Role) (str
 		return "", err
 	}
 
-	err = setRoles(tx, userId.String(), roles)
+	err = setUserRoleIds(tx, userId.String(), roleIds)
 
 	if err != nil {
 		return "", err
@@ -54,6 +59,10 @@ func createUser(tx *sql.Tx, username string, password string, roles []Role) (str
 
 // Creates a user with an invite code (for invited users)
 func createUserWithInvite(tx *sql.Tx, username string, password string, inviteId string) (string, error) {
+	if err := CheckPasswordPolicy(username, password); err != nil {
+		return "", err
+	}
+
 	userId, _ := typeid.WithPrefix("user")
 	passwordHash, err := hashPassword(password)
 
@@ -75,20 +84,28 @@ func createUserWithInvite(tx *sql.Tx, username string, password string, inviteId
 		return "", err
 	}
 
-	// No roles for invited users (they start with none)
+	// Roles preset on the invite are given by the caller, once the invite is consumed.
 	return userId.String(), nil
 }
 
-// Returns the user ID, or an error if the user does not exist or the password is incorrect.
+// Compared against when there's no such user, so that takes as long as a wrong password.
+var unknownUserPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("")
+	return hash
+})
+
+// Returns the user ID, or ErrInvalidLogin if the user does not exist or the password is incorrect. Use
+// checkLogin instead, which limits how often this can be tried.
 func getUserLogin(username string, password string) (string, error) {
 	var userId string
 	var passwordHash string
 
-	err := db.DB.QueryRow("SELECT userId, userPasswordHash FROM authUsers WHERE userName = ?", username).Scan(&userId, &passwordHash)
+	err := db.DB.QueryRow("SELECT userId, userPasswordHash FROM authUsers WHERE userName = ? AND deleted = 0", username).Scan(&userId, &passwordHash)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", errors.New("invalid username")
+			verifyPassword(unknownUserPasswordHash(), password)
+			return "", ErrInvalidLogin
 		}
 
 		return "", err
@@ -97,12 +114,61 @@ func getUserLogin(username string, password string) (string, error) {
 	passwordValid := verifyPassword(passwordHash, password)
 
 	if !passwordValid {
-		return "", errors.New("invalid password")
+		return "", ErrInvalidLogin
 	}
 
 	return string(userId), nil
 }
 
+// Checks a username and password without starting a session, for clients that send credentials with
+// every request (such as WebDAV clients using HTTP Basic auth). There's nowhere for these clients to
+// enter a code, so users with two-factor authentication have to use an API token instead. Nor is there
+// anywhere to send them to change their password, so users who have to are turned away until they do.
+func VerifyUserLogin(username string, password string, remoteAddr string) (UserInfo, error) {
+	userId, err := checkLogin(username, password, remoteAddr)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	enabled, err := TotpEnabled(userId)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	if enabled {
+		return UserInfo{}, errors.New("two-factor authentication is enabled; use an API token instead of a password")
+	}
+
+	if deleteAt, err := GetDeletionScheduled(userId); err != nil {
+		return UserInfo{}, err
+	} else if !deleteAt.IsZero() {
+		return UserInfo{}, ErrDeletionScheduled
+	}
+
+	if changeRequired, err := PasswordChangeRequired(userId); err != nil {
+		return UserInfo{}, err
+	} else if changeRequired {
+		return UserInfo{}, ErrPasswordChangeRequired
+	}
+
+	roles, err := GetUserRoles(userId)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	userInfo := UserInfo{
+		UserId:   userId,
+		Username: username,
+		Roles:    roles,
+	}
+
+	if err := ApplyTotpPolicy(&userInfo); err != nil {
+		return UserInfo{}, err
+	}
+
+	return userInfo, nil
+}
+
 // Returns an error if the userId does not exist or their password is incorrect.
 func verifyUserPassword(userId string, password string) error {
 	var passwordHash string
@@ -138,18 +204,38 @@ func ChangePassword(userId string, currentPassword string, newPassword string, n
 		return errors.New("new passwords do not match")
 	}
 
+	var username string
+	if err := db.DB.QueryRow("SELECT userName FROM authUsers WHERE userId = ?", userId).Scan(&username); err != nil {
+		return err
+	}
+
+	if err := CheckPasswordPolicy(username, newPassword); err != nil {
+		return err
+	}
+
 	newPasswordHash, err := hashPassword(newPassword)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = db.DB.Exec("UPDATE authUsers SET userPasswordHash = ? WHERE userId = ?", newPasswordHash, userId)
+	changeRequired, err := PasswordChangeRequired(userId)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec("UPDATE authUsers SET userPasswordHash = ?, passwordChangeRequired = 0 WHERE userId = ?", newPasswordHash, userId)
 
 	if err != nil {
 		return err
 	}
 
+	// So their tokens stop saying they have to change it.
+	if changeRequired {
+		return bumpRolesVersion(userId)
+	}
+
 	return nil
 }
 
@@ -325,7 +411,12 @@ func AdminGetUserById(userId string) (UserSessionInfo, error) {
 	}, nil
 }
 
-func AdminInviteUser(asUserId string, newUsername string, newPassword string) (string, error) {
+func AdminInviteUser(ctx context.Context, asUserId string, newUsername string, newPassword string) (string, error) {
+	// Checked here too, so a rejected password doesn't leave an on-demand invite behind.
+	if err := CheckPasswordPolicy(newUsername, newPassword); err != nil {
+		return "", err
+	}
+
 	// Check if user has UserManagement Edit permission (can create users on-demand)
 	roles, err := GetUserRoles(asUserId)
 	if err == nil {
@@ -336,7 +427,7 @@ func AdminInviteUser(asUserId string, newUsername string, newPassword string) (s
 			if err != nil {
 				return "", err
 			}
-			return RegisterUserWithInvite(inviteId, newUsername, newPassword)
+			return registerUserWithInvite(ctx, audit.UserCreate, inviteId, newUsername, newPassword)
 		}
 	}
 
@@ -357,17 +448,5 @@ func AdminInviteUser(asUserId string, newUsername string, newPassword string) (s
 	}
 
 	// Use the existing registration function
-	return RegisterUserWithInvite(inviteId, newUsername, newPassword)
-}
-
-func AdminDeleteUser(userId string) error {
-	// Invalidate all sessions for this user first
-	err := AdminInvalidateAllSessions(userId)
-	if err != nil {
-		return err
-	}
-
-	// Then mark the user as deleted
-	_, err = db.DB.Exec("UPDATE authUsers SET deleted = 1, userName = ? WHERE userId = ?", userId, userId)
-	return err
+	return registerUserWithInvite(ctx, audit.UserCreate, inviteId, newUsername, newPassword)
 }
@@ -8,8 +8,11 @@ import (
 	"flag"
 	"lod2/utils"
 	"log"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
@@ -19,6 +22,10 @@ var Config struct {
 	Http struct {
 		Host string
 		Port int
+
+		// Only requests from these addresses are believed when their X-Real-IP or X-Forwarded-For headers
+		// say who the client is; anyone else could claim to be anyone.
+		TrustedProxies []netip.Prefix
 	}
 
 	// configuration directory used for relatively long-term persistent configuration. read-only.
@@ -28,22 +35,81 @@ var Config struct {
 	DataPath string
 
 	StoragePath string
+
+	Trash struct {
+		// Trashed items older than this are permanently deleted. Zero keeps them forever.
+		Retention time.Duration
+
+		// When the trash grows beyond this many bytes, the oldest items are permanently deleted. Zero means no limit.
+		MaxSize int64
+	}
+
+	Invites struct {
+		// How many invites a new user starts with, unless their invite says otherwise.
+		Quota int
+	}
+
+	Accounts struct {
+		// How long after a user asks for their account to be deleted it actually is; until then, they can
+		// log in and cancel it.
+		DeletionGrace time.Duration
+	}
+
+	Passwords struct {
+		// New passwords shorter than this are refused.
+		MinLength int
+
+		// New passwords estimated to be weaker than this are refused; from 0 (allow anything) to 4.
+		MinStrength int
+	}
+
+	Sql struct {
+		// Queries in the SQL console are interrupted after running this long.
+		Timeout time.Duration
+
+		// The SQL console shows at most this many rows of a result.
+		MaxRows int
+	}
+
+	// Generate a new auth signing key, keeping the current one for verification, and exit instead of
+	// starting the server.
+	RotateAuthKey bool
 }
 
 func Init(autocreate bool) {
 	flag.StringVar(&Config.Http.Host, "host", "localhost", "host to listen on")
 	flag.IntVar(&Config.Http.Port, "port", 10800, "port to listen on")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.0/8,::1/128", "comma-separated addresses or CIDR ranges of reverse proxies whose X-Real-IP and X-Forwarded-For headers are believed")
 
 	flag.StringVar(&Config.ConfigPath, "config", "~/.config/lod2/", "path to configuration directory")
 	flag.StringVar(&Config.DataPath, "data", "~/.local/share/lod2/", "path to data directory")
 	flag.StringVar(&Config.StoragePath, "storage", "~/storage/", "path to huge storage directory")
 
+	flag.DurationVar(&Config.Trash.Retention, "trash-retention", 30*24*time.Hour, "how long deleted files are kept in the trash")
+	flag.Int64Var(&Config.Trash.MaxSize, "trash-max-size", 0, "maximum size of the trash in bytes; 0 for no limit")
+
+	flag.IntVar(&Config.Invites.Quota, "invite-quota", 5, "how many invites each new user starts with")
+
+	flag.DurationVar(&Config.Accounts.DeletionGrace, "account-deletion-grace", 30*24*time.Hour, "how long a user can cancel deleting their own account")
+
+	flag.IntVar(&Config.Passwords.MinLength, "password-min-length", 10, "minimum length of new passwords")
+	flag.IntVar(&Config.Passwords.MinStrength, "password-min-strength", 2, "minimum estimated strength of new passwords, from 0 to 4")
+
+	flag.DurationVar(&Config.Sql.Timeout, "sql-timeout", 10*time.Second, "how long a query in the SQL console may run")
+	flag.IntVar(&Config.Sql.MaxRows, "sql-max-rows", 1000, "maximum number of rows the SQL console shows")
+
+	flag.BoolVar(&Config.RotateAuthKey, "rotate-auth-key", false, "generate and switch to a new auth signing key, then exit")
+
 	Config.ConfigPath = utils.ExpandHomePath(Config.ConfigPath)
 	Config.DataPath = utils.ExpandHomePath(Config.DataPath)
 	Config.StoragePath = utils.ExpandHomePath(Config.StoragePath)
 
 	flag.Parse()
 
+	if err := parseTrustedProxies(*trustedProxies); err != nil {
+		log.Fatalf("invalid -trusted-proxies: %v", err)
+	}
+
 	if autocreate {
 		if err := ensureBaseDirs(); err != nil {
 			log.Fatalf("failed to create base dirs: %v", err)
@@ -54,6 +120,33 @@ func Init(autocreate bool) {
 	}
 }
 
+func parseTrustedProxies(proxies string) error {
+	Config.Http.TrustedProxies = nil
+
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return err
+			}
+			proxy = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return err
+		}
+		Config.Http.TrustedProxies = append(Config.Http.TrustedProxies, prefix.Masked())
+	}
+
+	return nil
+}
+
 // Kickstart initializes the local installation by creating required directories
 // and generating a private JWK for JWT signing if it does not already exist.
 // Previously public; now internalized into Init(autocreate).
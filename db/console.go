@@ -0,0 +1,370 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"lod2/config"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// How a query from the SQL console is run.
+type ConsoleMode string
+
+const (
+	// Run through ReadOnlyDB, so SQLite refuses anything that writes.
+	ConsoleReadOnly ConsoleMode = "read-only"
+	// Run in a transaction that's always rolled back, to see what a query would change.
+	ConsolePreview ConsoleMode = "preview"
+	// Run in a transaction that's committed.
+	ConsoleCommit ConsoleMode = "commit"
+)
+
+var ErrConsoleTimeout = errors.New("query took too long and was interrupted")
+var ErrMissingParameter = errors.New("no value given for parameter")
+var ErrConsoleTransaction = errors.New("the console runs each query in its own transaction; queries can't begin, commit or roll back one themselves")
+
+type ConsoleResult struct {
+	Mode    ConsoleMode
+	Columns []string
+	Rows    []map[string]interface{}
+
+	// The query returned more rows than config.Config.Sql.MaxRows, and only those are in Rows.
+	Truncated bool
+
+	// Rows the query inserted, updated or deleted. Always zero in read-only mode.
+	RowsAffected int64
+}
+
+func ParseConsoleMode(mode string) (ConsoleMode, bool) {
+	switch ConsoleMode(mode) {
+	case ConsoleReadOnly, ConsolePreview, ConsoleCommit:
+		return ConsoleMode(mode), true
+	}
+	return "", false
+}
+
+// Returns the names of the named parameters (:name, @name or $name) in a console query, in the order they
+// first appear, skipping anything in strings, quoted identifiers and comments.
+func ConsoleQueryParameters(query string) []string {
+	parameters := []string{}
+
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			if end := strings.IndexByte(query[i+1:], c); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case c == '[':
+			if end := strings.IndexByte(query[i+1:], ']'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(query)
+			}
+		case c == ':' || c == '@' || c == '$':
+			end := i + 1
+			for end < len(query) && isParameterCharacter(query[end], end == i+1) {
+				end++
+			}
+			if name := query[i+1 : end]; name != "" && !slices.Contains(parameters, name) {
+				parameters = append(parameters, name)
+			}
+			i = end - 1
+		}
+	}
+
+	return parameters
+}
+
+func isParameterCharacter(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// Binds the query's parameters to the values given for them. An empty string is a value; a parameter with
+// none at all is an error rather than quietly matching empty strings.
+func consoleQueryArguments(query string, values map[string]string) ([]any, error) {
+	arguments := []any{}
+	for _, name := range ConsoleQueryParameters(query) {
+		value, ok := values[name]
+		if !ok {
+			return nil, fmt.Errorf("%w :%s", ErrMissingParameter, name)
+		}
+		arguments = append(arguments, sql.Named(name, value))
+	}
+	return arguments, nil
+}
+
+type consoleQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// A connection that refuses to prepare any statement that begins, commits or rolls back a transaction or
+// savepoint, which could end the console's transaction early and commit a preview. SQLite asks its
+// authorizer about each statement as it compiles it, so however the query is written (comments, odd
+// spacing, several statements) none of them slip through.
+type consoleConn struct {
+	*sql.Conn
+
+	// Cleared to let the console end its own transaction. Atomic because database/sql rolls back a
+	// transaction whose context has ended from another goroutine.
+	guarding atomic.Bool
+	refused  atomic.Bool
+}
+
+func openConsoleConn(ctx context.Context, database *sql.DB) (*consoleConn, error) {
+	conn, err := database.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &consoleConn{Conn: conn}
+	c.guarding.Store(true)
+	err = conn.Raw(func(driverConn any) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(func(action int, _ string, _ string, _ string) int {
+			if c.guarding.Load() && (action == sqlite3.SQLITE_TRANSACTION || action == sqlite3.SQLITE_SAVEPOINT) {
+				c.refused.Store(true)
+				return sqlite3.SQLITE_DENY
+			}
+			return sqlite3.SQLITE_OK
+		})
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Returns ErrConsoleTransaction in place of the error SQLite gives for a statement the authorizer refused.
+func (c *consoleConn) check(err error) error {
+	if err != nil && c.refused.Load() {
+		return ErrConsoleTransaction
+	}
+	return err
+}
+
+// The connection is thrown away rather than going back to the pool: go-sqlite3 only frees what it keeps
+// for the authorizer once the connection is closed.
+func (c *consoleConn) close() {
+	c.Conn.Raw(func(driverConn any) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(nil)
+		return driver.ErrBadConn
+	})
+	c.Conn.Close()
+}
+
+// Runs a query typed into the SQL console, giving up after config.Config.Sql.Timeout. Parameters are
+// given as a map from their names to their values.
+func RunConsoleQuery(ctx context.Context, query string, parameters map[string]string, mode ConsoleMode) (ConsoleResult, error) {
+	arguments, err := consoleQueryArguments(query, parameters)
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Config.Sql.Timeout)
+	defer cancel()
+
+	result, err := runConsoleQuery(ctx, query, arguments, mode)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ConsoleResult{}, ErrConsoleTimeout
+	}
+
+	return result, err
+}
+
+func runConsoleQuery(ctx context.Context, query string, arguments []any, mode ConsoleMode) (ConsoleResult, error) {
+	if mode == ConsoleReadOnly {
+		conn, err := openConsoleConn(ctx, ReadOnlyDB)
+		if err != nil {
+			return ConsoleResult{}, err
+		}
+		defer conn.close()
+
+		result, err := scanConsoleRows(ctx, conn, query, arguments, mode)
+		return result, conn.check(err)
+	}
+
+	conn, err := openConsoleConn(ctx, DB)
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+	defer conn.close()
+
+	conn.guarding.Store(false)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+	conn.guarding.Store(true)
+	defer func() {
+		conn.guarding.Store(false)
+		tx.Rollback()
+	}()
+
+	// total_changes() counts every change made on the connection, which the transaction holds on to.
+	var changesBefore int64
+	if err := tx.QueryRowContext(ctx, "SELECT total_changes()").Scan(&changesBefore); err != nil {
+		return ConsoleResult{}, err
+	}
+
+	result, err := scanConsoleRows(ctx, tx, query, arguments, mode)
+	if err != nil {
+		return ConsoleResult{}, conn.check(err)
+	}
+
+	var changesAfter int64
+	if err := tx.QueryRowContext(ctx, "SELECT total_changes()").Scan(&changesAfter); err != nil {
+		return ConsoleResult{}, err
+	}
+	result.RowsAffected = changesAfter - changesBefore
+
+	conn.guarding.Store(false)
+	if mode == ConsoleCommit {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+
+	return result, nil
+}
+
+func scanConsoleRows(ctx context.Context, querier consoleQuerier, query string, arguments []any, mode ConsoleMode) (ConsoleResult, error) {
+	rows, err := querier.QueryContext(ctx, query, arguments...)
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return ConsoleResult{}, err
+	}
+
+	result := ConsoleResult{
+		Mode:    mode,
+		Columns: columns,
+		Rows:    []map[string]interface{}{},
+	}
+
+	for rows.Next() {
+		// Only ever one row past the limit is read, just to know there are more.
+		if len(result.Rows) >= config.Config.Sql.MaxRows {
+			result.Truncated = true
+			break
+		}
+
+		columnMap := make(map[string]interface{})
+		columnPointers := make([]interface{}, len(columns))
+		for i := range columnPointers {
+			columnPointers[i] = new(interface{})
+		}
+
+		if err := rows.Scan(columnPointers...); err != nil {
+			return ConsoleResult{}, err
+		}
+
+		for i, colName := range columns {
+			if val, ok := (*(columnPointers[i].(*interface{}))).(interface{ Valid() bool }); ok && !val.Valid() {
+				columnMap[colName] = ""
+			} else {
+				columnMap[colName] = *(columnPointers[i].(*interface{}))
+			}
+		}
+		result.Rows = append(result.Rows, columnMap)
+	}
+
+	if err := rows.Err(); err != nil {
+		return ConsoleResult{}, err
+	}
+
+	// Closed now rather than deferred so the statement has finished before its changes are counted.
+	return result, rows.Close()
+}
+
+// Runs a console query read-only for an export, calling columns once with the column names and then row
+// for each row as it's read, so results of any size never have to be held in memory. Stops at the first
+// error, from the query or either function.
+func EachConsoleRow(ctx context.Context, query string, parameters map[string]string, columns func([]string) error, row func([]interface{}) error) error {
+	arguments, err := consoleQueryArguments(query, parameters)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Config.Sql.Timeout)
+	defer cancel()
+
+	err = eachConsoleRow(ctx, query, arguments, columns, row)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrConsoleTimeout
+	}
+
+	return err
+}
+
+func eachConsoleRow(ctx context.Context, query string, arguments []any, columns func([]string) error, row func([]interface{}) error) error {
+	conn, err := openConsoleConn(ctx, ReadOnlyDB)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	rows, err := conn.QueryContext(ctx, query, arguments...)
+	if err != nil {
+		return conn.check(err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	if err := columns(names); err != nil {
+		return err
+	}
+
+	// Reused for every row; row mustn't keep it.
+	values := make([]interface{}, len(names))
+	pointers := make([]interface{}, len(names))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+
+		if err := row(values); err != nil {
+			return err
+		}
+	}
+
+	return conn.check(rows.Err())
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"go.jetify.com/typeid"
+)
+
+// Each user's most recent console queries are kept, up to this many; older ones are forgotten.
+const ConsoleHistoryLength = 100
+
+var ErrHistoryEntryNotFound = errors.New("history entry not found")
+var ErrSavedQueryNotFound = errors.New("saved query not found")
+var ErrSavedQueryNameRequired = errors.New("saved queries need a name")
+
+type ConsoleHistoryEntry struct {
+	Id    int64
+	Query string
+	Mode  ConsoleMode
+	RanAt time.Time
+}
+
+// Saved queries are shared by everyone who can use the SQL console.
+type SavedConsoleQuery struct {
+	QueryId           string
+	Name              string
+	Query             string
+	CreatedByUserId   string
+	CreatedByUsername string
+	CreatedAt         time.Time
+}
+
+// Remembers that the user ran a query, forgetting their oldest beyond ConsoleHistoryLength.
+func AddConsoleHistory(userId string, query string, mode ConsoleMode) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO sqlHistory (userId, query, mode, ranAt) VALUES (?, ?, ?, ?)",
+		userId, query, mode, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM sqlHistory WHERE userId = ? AND id NOT IN (
+			SELECT id FROM sqlHistory WHERE userId = ? ORDER BY id DESC LIMIT ?
+		)`, userId, userId, ConsoleHistoryLength); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the user's most recent queries first, leaving out repeats of the same query in the same mode.
+func GetConsoleHistory(userId string, limit int) ([]ConsoleHistoryEntry, error) {
+	rows, err := DB.Query(`
+		SELECT MAX(id), query, mode, MAX(ranAt) FROM sqlHistory WHERE userId = ?
+		GROUP BY query, mode ORDER BY MAX(id) DESC LIMIT ?`, userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []ConsoleHistoryEntry{}
+	for rows.Next() {
+		var entry ConsoleHistoryEntry
+		var ranAt int64
+		if err := rows.Scan(&entry.Id, &entry.Query, &entry.Mode, &ranAt); err != nil {
+			return nil, err
+		}
+		entry.RanAt = time.Unix(ranAt, 0)
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// Returns one of the user's own history entries.
+func GetConsoleHistoryEntry(userId string, id int64) (ConsoleHistoryEntry, error) {
+	var entry ConsoleHistoryEntry
+	var ranAt int64
+	err := DB.QueryRow("SELECT id, query, mode, ranAt FROM sqlHistory WHERE userId = ? AND id = ?", userId, id).
+		Scan(&entry.Id, &entry.Query, &entry.Mode, &ranAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, ErrHistoryEntryNotFound
+	}
+	entry.RanAt = time.Unix(ranAt, 0)
+	return entry, err
+}
+
+func SaveConsoleQuery(userId string, name string, query string) (SavedConsoleQuery, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return SavedConsoleQuery{}, ErrSavedQueryNameRequired
+	}
+
+	queryId, _ := typeid.WithPrefix("sqlquery")
+	saved := SavedConsoleQuery{
+		QueryId:         queryId.String(),
+		Name:            name,
+		Query:           query,
+		CreatedByUserId: userId,
+		CreatedAt:       time.Unix(time.Now().Unix(), 0),
+	}
+
+	if _, err := DB.Exec("INSERT INTO sqlSavedQueries (queryId, name, query, createdByUserId, createdAt) VALUES (?, ?, ?, ?, ?)",
+		saved.QueryId, saved.Name, saved.Query, saved.CreatedByUserId, saved.CreatedAt.Unix()); err != nil {
+		return SavedConsoleQuery{}, err
+	}
+
+	return saved, nil
+}
+
+const savedConsoleQueryColumns = `
+	SELECT q.queryId, q.name, q.query, q.createdByUserId, COALESCE(u.username, ''), q.createdAt
+	FROM sqlSavedQueries q LEFT JOIN authUsers u ON u.userId = q.createdByUserId`
+
+func scanSavedConsoleQuery(scan func(...any) error) (SavedConsoleQuery, error) {
+	var saved SavedConsoleQuery
+	var createdAt int64
+	err := scan(&saved.QueryId, &saved.Name, &saved.Query, &saved.CreatedByUserId, &saved.CreatedByUsername, &createdAt)
+	saved.CreatedAt = time.Unix(createdAt, 0)
+	return saved, err
+}
+
+// Returns every saved query, sorted by name.
+func GetSavedConsoleQueries() ([]SavedConsoleQuery, error) {
+	rows, err := DB.Query(savedConsoleQueryColumns + " ORDER BY q.name COLLATE NOCASE, q.createdAt")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := []SavedConsoleQuery{}
+	for rows.Next() {
+		saved, err := scanSavedConsoleQuery(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, saved)
+	}
+
+	return queries, rows.Err()
+}
+
+func GetSavedConsoleQuery(queryId string) (SavedConsoleQuery, error) {
+	saved, err := scanSavedConsoleQuery(DB.QueryRow(savedConsoleQueryColumns+" WHERE q.queryId = ?", queryId).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return saved, ErrSavedQueryNotFound
+	}
+	return saved, err
+}
+
+func DeleteSavedConsoleQuery(queryId string) error {
+	result, err := DB.Exec("DELETE FROM sqlSavedQueries WHERE queryId = ?", queryId)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrSavedQueryNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lod2/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupTestConsole(t *testing.T) func() {
+	tempDir, err := os.MkdirTemp("", "db_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	if err := Open(filepath.Join(tempDir, "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	if err := RunMigrations(); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	if _, err := DB.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT); INSERT INTO notes (body) VALUES ('a'), ('b'), ('c')"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	previous := config.Config.Sql
+	config.Config.Sql.Timeout = 5 * time.Second
+	config.Config.Sql.MaxRows = 2
+
+	return func() {
+		config.Config.Sql = previous
+		ReadOnlyDB.Close()
+		DB.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func countNotes(t *testing.T) int {
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM notes").Scan(&count); err != nil {
+		t.Fatalf("failed to count notes: %v", err)
+	}
+	return count
+}
+
+func TestRunConsoleQuery(t *testing.T) {
+	defer setupTestConsole(t)()
+	ctx := context.Background()
+
+	result, err := RunConsoleQuery(ctx, "SELECT * FROM notes", nil, ConsoleReadOnly)
+	if err != nil {
+		t.Fatalf("select failed: %v", err)
+	}
+	if len(result.Rows) != 2 || !result.Truncated {
+		t.Errorf("expected 2 rows and truncation, got %d rows, truncated %v", len(result.Rows), result.Truncated)
+	}
+
+	if _, err := RunConsoleQuery(ctx, "DELETE FROM notes", nil, ConsoleReadOnly); err == nil {
+		t.Error("expected read-only mode to refuse writes")
+	}
+
+	result, err = RunConsoleQuery(ctx, "DELETE FROM notes WHERE body != 'a'", nil, ConsolePreview)
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	if result.RowsAffected != 2 {
+		t.Errorf("expected preview to affect 2 rows, got %d", result.RowsAffected)
+	}
+	if countNotes(t) != 3 {
+		t.Error("expected preview to be rolled back")
+	}
+
+	result, err = RunConsoleQuery(ctx, "DELETE FROM notes WHERE body != 'a'", nil, ConsoleCommit)
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if result.RowsAffected != 2 || countNotes(t) != 1 {
+		t.Errorf("expected 2 rows to be deleted, got %d affected and %d left", result.RowsAffected, countNotes(t))
+	}
+
+	if _, err := RunConsoleQuery(ctx, "DELETE FROM notes; COMMIT", nil, ConsolePreview); !errors.Is(err, ErrConsoleTransaction) {
+		t.Errorf("expected ErrConsoleTransaction, got %v", err)
+	}
+	if countNotes(t) != 1 {
+		t.Error("expected a query that commits itself not to run")
+	}
+
+	// Statements are checked as SQLite sees them, not by looking at the text.
+	for _, query := range []string{
+		"-- a comment\nCOMMIT; DELETE FROM notes",
+		"/* a comment */ END; DELETE FROM notes",
+		"SELECT 1; ROLLBACK; DELETE FROM notes",
+		"SAVEPOINT s; RELEASE s; DELETE FROM notes",
+	} {
+		if _, err := RunConsoleQuery(ctx, query, nil, ConsolePreview); !errors.Is(err, ErrConsoleTransaction) {
+			t.Errorf("%q: expected ErrConsoleTransaction, got %v", query, err)
+		}
+	}
+	if countNotes(t) != 1 {
+		t.Error("expected queries that end the transaction not to change anything")
+	}
+
+	if _, err := RunConsoleQuery(ctx, "-- a comment\nBEGIN", nil, ConsoleReadOnly); !errors.Is(err, ErrConsoleTransaction) {
+		t.Errorf("read-only: expected ErrConsoleTransaction, got %v", err)
+	}
+
+	// The console can still end its own transactions afterwards.
+	if _, err := RunConsoleQuery(ctx, "SELECT * FROM notes", nil, ConsolePreview); err != nil {
+		t.Errorf("preview after a refused query failed: %v", err)
+	}
+}
+
+func TestRunConsoleQuery_Timeout(t *testing.T) {
+	defer setupTestConsole(t)()
+	config.Config.Sql.Timeout = 50 * time.Millisecond
+
+	query := "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n) SELECT COUNT(*) FROM n"
+	if _, err := RunConsoleQuery(context.Background(), query, nil, ConsoleReadOnly); !errors.Is(err, ErrConsoleTimeout) {
+		t.Errorf("expected ErrConsoleTimeout, got %v", err)
+	}
+}
+
+func TestConsoleQueryParameters(t *testing.T) {
+	query := "SELECT * FROM notes WHERE body = :body OR id = @id -- or :commented\n AND ':quoted' != $body /* :also */ AND x = :id2"
+	expected := []string{"body", "id", "id2"}
+
+	parameters := ConsoleQueryParameters(query)
+	if len(parameters) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, parameters)
+	}
+	for i := range expected {
+		if parameters[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, parameters)
+		}
+	}
+}
+
+func TestRunConsoleQuery_Parameters(t *testing.T) {
+	defer setupTestConsole(t)()
+
+	result, err := RunConsoleQuery(context.Background(), "SELECT body FROM notes WHERE body = :body OR id = :id", map[string]string{"body": "a", "id": "3"}, ConsoleReadOnly)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(result.Rows) != 2 {
+		t.Errorf("expected 2 rows, got %d", len(result.Rows))
+	}
+
+	if _, err := RunConsoleQuery(context.Background(), "SELECT body FROM notes WHERE body = :body OR id = :id", map[string]string{"body": "a"}, ConsoleReadOnly); !errors.Is(err, ErrMissingParameter) {
+		t.Errorf("expected ErrMissingParameter, got %v", err)
+	}
+
+	result, err = RunConsoleQuery(context.Background(), "SELECT body FROM notes WHERE body = :body", map[string]string{"body": ""}, ConsoleReadOnly)
+	if err != nil || len(result.Rows) != 0 {
+		t.Errorf("expected an empty value to be allowed, got %d rows and %v", len(result.Rows), err)
+	}
+}
+
+func TestEachConsoleRow(t *testing.T) {
+	defer setupTestConsole(t)()
+
+	var columns []string
+	bodies := []string{}
+	err := EachConsoleRow(context.Background(), "SELECT id, body FROM notes ORDER BY id", nil,
+		func(names []string) error {
+			columns = names
+			return nil
+		},
+		func(values []interface{}) error {
+			bodies = append(bodies, values[1].(string))
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("EachConsoleRow failed: %v", err)
+	}
+
+	// Exports aren't limited to config.Config.Sql.MaxRows.
+	if len(columns) != 2 || len(bodies) != 3 || bodies[2] != "c" {
+		t.Errorf("expected 2 columns and 3 rows, got %v and %v", columns, bodies)
+	}
+
+	if err := EachConsoleRow(context.Background(), "DELETE FROM notes", nil, func([]string) error { return nil }, func([]interface{}) error { return nil }); err == nil {
+		t.Error("expected exports to be read-only")
+	}
+
+	if err := EachConsoleRow(context.Background(), "/**/BEGIN; SELECT 1", nil, func([]string) error { return nil }, func([]interface{}) error { return nil }); !errors.Is(err, ErrConsoleTransaction) {
+		t.Errorf("expected ErrConsoleTransaction, got %v", err)
+	}
+}
+
+func TestConsoleHistory(t *testing.T) {
+	defer setupTestConsole(t)()
+
+	for i := 0; i < ConsoleHistoryLength+5; i++ {
+		if err := AddConsoleHistory("user_alice", fmt.Sprintf("SELECT %d", i), ConsoleReadOnly); err != nil {
+			t.Fatalf("AddConsoleHistory failed: %v", err)
+		}
+	}
+	if err := AddConsoleHistory("user_bob", "SELECT 'bob'", ConsoleReadOnly); err != nil {
+		t.Fatalf("AddConsoleHistory failed: %v", err)
+	}
+
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM sqlHistory WHERE userId = 'user_alice'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != ConsoleHistoryLength {
+		t.Errorf("expected history to be pruned to %d, got %d", ConsoleHistoryLength, count)
+	}
+
+	history, err := GetConsoleHistory("user_alice", 10)
+	if err != nil {
+		t.Fatalf("GetConsoleHistory failed: %v", err)
+	}
+	if len(history) != 10 || history[0].Query != fmt.Sprintf("SELECT %d", ConsoleHistoryLength+4) {
+		t.Errorf("expected the 10 most recent queries, got %v", history)
+	}
+
+	if _, err := GetConsoleHistoryEntry("user_bob", history[0].Id); !errors.Is(err, ErrHistoryEntryNotFound) {
+		t.Errorf("expected other users' history to be hidden, got %v", err)
+	}
+}
+
+func TestSavedConsoleQueries(t *testing.T) {
+	defer setupTestConsole(t)()
+
+	if _, err := SaveConsoleQuery("user_alice", " ", "SELECT 1"); !errors.Is(err, ErrSavedQueryNameRequired) {
+		t.Errorf("expected ErrSavedQueryNameRequired, got %v", err)
+	}
+
+	saved, err := SaveConsoleQuery("user_alice", "Notes by body", "SELECT * FROM notes WHERE body = :body")
+	if err != nil {
+		t.Fatalf("SaveConsoleQuery failed: %v", err)
+	}
+
+	queries, err := GetSavedConsoleQueries()
+	if err != nil {
+		t.Fatalf("GetSavedConsoleQueries failed: %v", err)
+	}
+	if len(queries) != 1 || queries[0].QueryId != saved.QueryId || queries[0].Query != saved.Query {
+		t.Errorf("expected the saved query, got %v", queries)
+	}
+
+	if err := DeleteSavedConsoleQuery(saved.QueryId); err != nil {
+		t.Fatalf("DeleteSavedConsoleQuery failed: %v", err)
+	}
+	if _, err := GetSavedConsoleQuery(saved.QueryId); !errors.Is(err, ErrSavedQueryNotFound) {
+		t.Errorf("expected ErrSavedQueryNotFound, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"lod2/config"
 	"lod2/utils"
 	"log"
@@ -13,26 +14,46 @@ import (
 var db *sql.DB
 var DB *sql.DB
 
+// A separate connection to the same database that SQLite itself refuses to write through, for the SQL
+// console's read-only mode.
+var ReadOnlyDB *sql.DB
+
 func Init() {
 	dbPath := filepath.Join(config.Config.DataPath, "lod2.db")
 	utils.EnsureDirForFile(dbPath)
 
+	if err := Open(dbPath); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("db opened at '%s'", dbPath)
+}
+
+// Opens the database at dbPath and makes it the global database.
+func Open(dbPath string) error {
 	var err error
 	db, err = sql.Open("sqlite3", dbPath)
 
 	if err != nil {
-		log.Fatal("unable to open db: ", err)
+		return fmt.Errorf("unable to open db: %w", err)
 	}
 
 	// Ping the db to make sure it works
 	err = db.Ping()
 
 	if err != nil {
-		log.Fatal("unable to ping db: ", err)
+		return fmt.Errorf("unable to ping db: %w", err)
 	}
 
-	log.Printf("db opened at '%s'", dbPath)
+	// Opened lazily, so this doesn't touch the file until it's first used.
+	readOnly, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+
+	if err != nil {
+		return fmt.Errorf("unable to open read-only db: %w", err)
+	}
 
 	DB = db
-}
+	ReadOnlyDB = readOnly
 
+	return nil
+}
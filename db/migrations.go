@@ -210,6 +210,516 @@ func migrate(tx *sql.Tx, version int) (int, error) {
 		version = 10
 	}
 
+	// STORAGE MIGRATIONS
+	// 11: record where trashed files came from so they can be restored
+	if version < 11 {
+		if _, err := tx.Exec(`
+			CREATE TABLE storageTrash (
+				trashId TEXT PRIMARY KEY NOT NULL UNIQUE,
+				originalPath TEXT NOT NULL,
+				deletedAt INTEGER NOT NULL,
+				deletedByUserId TEXT DEFAULT NULL,
+				size INTEGER NOT NULL DEFAULT 0,
+				isDirectory INTEGER NOT NULL DEFAULT 0
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		version = 11
+	}
+
+	// 12: per-path storage access grants
+	if version < 12 {
+		if _, err := tx.Exec(`
+			CREATE TABLE storageGrants (
+				grantId TEXT PRIMARY KEY NOT NULL UNIQUE,
+				userId TEXT NOT NULL,
+				path TEXT NOT NULL,
+				level INTEGER NOT NULL,
+				createdAt INTEGER NOT NULL,
+				UNIQUE (userId, path)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		version = 12
+	}
+
+	// 13: public share links and a record of who opened them
+	if version < 13 {
+		if _, err := tx.Exec(`
+			CREATE TABLE storageShares (
+				shareId TEXT PRIMARY KEY NOT NULL UNIQUE,
+				path TEXT NOT NULL,
+				createdByUserId TEXT NOT NULL,
+				createdAt INTEGER NOT NULL,
+				expiresAt INTEGER DEFAULT NULL,
+				passwordHash TEXT DEFAULT NULL,
+				maxDownloads INTEGER NOT NULL DEFAULT 0,
+				downloads INTEGER NOT NULL DEFAULT 0,
+				allowListing INTEGER NOT NULL DEFAULT 0
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`CREATE INDEX storageSharesPath ON storageShares (path)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE storageShareAccesses (
+				shareId TEXT NOT NULL,
+				path TEXT NOT NULL,
+				accessedAt INTEGER NOT NULL,
+				remoteAddr TEXT NOT NULL,
+				userAgent TEXT NOT NULL DEFAULT ''
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`CREATE INDEX storageShareAccessesShareId ON storageShareAccesses (shareId)`); err != nil {
+			return version, err
+		}
+		version = 13
+	}
+
+	// 14: personal API tokens
+	if version < 14 {
+		if _, err := tx.Exec(`
+			CREATE TABLE authApiTokens (
+				tokenId TEXT PRIMARY KEY NOT NULL UNIQUE,
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				name TEXT NOT NULL,
+				tokenHash TEXT NOT NULL UNIQUE,
+				createdAt INTEGER NOT NULL,
+				expiresAt INTEGER NOT NULL,
+				lastUsedAt INTEGER DEFAULT NULL,
+				revokedAt INTEGER DEFAULT NULL
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authApiTokenRoles (
+				tokenId TEXT NOT NULL REFERENCES authApiTokens(tokenId),
+				level INTEGER NOT NULL,
+				scope INTEGER NOT NULL,
+				PRIMARY KEY (tokenId, scope)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		version = 14
+	}
+
+	// 15: two-factor authentication
+	if version < 15 {
+		if _, err := tx.Exec(`
+			CREATE TABLE authTotp (
+				userId TEXT PRIMARY KEY NOT NULL UNIQUE REFERENCES authUsers(userId),
+				secret TEXT NOT NULL,
+				createdAt INTEGER NOT NULL,
+				enabledAt INTEGER DEFAULT NULL,
+				lastUsedStep INTEGER NOT NULL DEFAULT 0,
+				failedAttempts INTEGER NOT NULL DEFAULT 0,
+				lastFailedAt INTEGER DEFAULT NULL
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authRecoveryCodes (
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				codeHash TEXT NOT NULL,
+				createdAt INTEGER NOT NULL,
+				usedAt INTEGER DEFAULT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`CREATE INDEX authRecoveryCodesUserId ON authRecoveryCodes (userId)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authTotpRequiredRoles (
+				scope INTEGER PRIMARY KEY NOT NULL,
+				level INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		version = 15
+	}
+
+	// 16: login and invite code throttling
+	if version < 16 {
+		if _, err := tx.Exec(`
+			CREATE TABLE authThrottle (
+				key TEXT PRIMARY KEY NOT NULL UNIQUE,
+				failures INTEGER NOT NULL,
+				lastFailedAt INTEGER NOT NULL,
+				lockedUntil INTEGER DEFAULT NULL
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authFailedLogins (
+				username TEXT NOT NULL,
+				userId TEXT DEFAULT NULL,
+				remoteAddr TEXT NOT NULL,
+				attemptedAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`CREATE INDEX authFailedLoginsUserId ON authFailedLogins (userId, attemptedAt)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`CREATE INDEX authFailedLoginsAttemptedAt ON authFailedLogins (attemptedAt)`); err != nil {
+			return version, err
+		}
+		version = 16
+	}
+
+	// 17: what each session was last used from
+	if version < 17 {
+		for _, column := range []string{"userAgent", "remoteAddr", "deviceLabel"} {
+			if _, err := tx.Exec("ALTER TABLE authSessions ADD COLUMN " + column + " TEXT NOT NULL DEFAULT ''"); err != nil {
+				return version, err
+			}
+		}
+		version = 17
+	}
+
+	// 18: refresh token rotation
+	if version < 18 {
+		for _, column := range []string{"refreshTokenId", "previousRefreshTokenId"} {
+			if _, err := tx.Exec("ALTER TABLE authSessions ADD COLUMN " + column + " TEXT NOT NULL DEFAULT ''"); err != nil {
+				return version, err
+			}
+		}
+		if _, err := tx.Exec("ALTER TABLE authSessions ADD COLUMN rotatedAt INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return version, err
+		}
+		version = 18
+	}
+
+	// 19: roles version, for noticing when an access token's roles are out of date
+	if version < 19 {
+		if _, err := tx.Exec("ALTER TABLE authUsers ADD COLUMN rolesVersion INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return version, err
+		}
+		version = 19
+	}
+
+	// 20: a CSRF token for each session
+	if version < 20 {
+		if _, err := tx.Exec("ALTER TABLE authSessions ADD COLUMN csrfToken TEXT NOT NULL DEFAULT ''"); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("UPDATE authSessions SET csrfToken = lower(hex(randomblob(32)))"); err != nil {
+			return version, err
+		}
+		version = 20
+	}
+
+	// 21: audit log, which can only be added to
+	if version < 21 {
+		if _, err := tx.Exec(`
+			CREATE TABLE auditLog (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				at INTEGER NOT NULL,
+				actorId TEXT NOT NULL,
+				actorName TEXT NOT NULL,
+				action TEXT NOT NULL,
+				target TEXT NOT NULL,
+				requestId TEXT NOT NULL,
+				remoteAddr TEXT NOT NULL,
+				details TEXT NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX auditLogActor ON auditLog (actorName, id)"); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX auditLogAt ON auditLog (at)"); err != nil {
+			return version, err
+		}
+		for name, event := range map[string]string{"auditLogNoUpdate": "UPDATE", "auditLogNoDelete": "DELETE"} {
+			if _, err := tx.Exec(`
+				CREATE TRIGGER ` + name + ` BEFORE ` + event + ` ON auditLog
+				BEGIN
+					SELECT RAISE(ABORT, 'the audit log is append-only');
+				END`); err != nil {
+				return version, err
+			}
+		}
+		version = 21
+	}
+
+	// 22: named role definitions, replacing roles set directly on each user
+	if version < 22 {
+		if _, err := tx.Exec(`
+			CREATE TABLE authRoleDefinitions (
+				roleId TEXT PRIMARY KEY,
+				name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+				description TEXT NOT NULL DEFAULT '',
+				builtIn INTEGER NOT NULL DEFAULT 0,
+				createdAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authRoleGrants (
+				roleId TEXT NOT NULL REFERENCES authRoleDefinitions(roleId),
+				scope INTEGER NOT NULL,
+				level INTEGER NOT NULL,
+				PRIMARY KEY (roleId, scope)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authUserRoles (
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				roleId TEXT NOT NULL REFERENCES authRoleDefinitions(roleId),
+				PRIMARY KEY (userId, roleId)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX authUserRolesRole ON authUserRoles (roleId)"); err != nil {
+			return version, err
+		}
+
+		createdAt := time.Now().Unix()
+
+		// Every scope at Edit; the auth package keeps it that way as scopes are added.
+		administratorId, _ := typeid.WithPrefix("role")
+		if _, err := tx.Exec("INSERT INTO authRoleDefinitions (roleId, name, description, builtIn, createdAt) VALUES (?, ?, ?, 1, ?)",
+			administratorId.String(), "Administrator", "Full access to everything", createdAt); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("INSERT INTO authRoleGrants (roleId, scope, level) VALUES (?, 0, 2), (?, 1, 2), (?, 2, 2), (?, 3, 2)",
+			administratorId.String(), administratorId.String(), administratorId.String(), administratorId.String()); err != nil {
+			return version, err
+		}
+
+		// One role for each scope and level that could be set before, given to the users who had it.
+		scopes := []struct {
+			scope int
+			name  string
+		}{{1, "Database access"}, {0, "User management"}, {2, "Files"}, {3, "Media"}}
+		levels := []struct {
+			level int
+			name  string
+		}{{1, "View"}, {2, "Edit"}}
+
+		for _, scope := range scopes {
+			for _, level := range levels {
+				roleId, _ := typeid.WithPrefix("role")
+				if _, err := tx.Exec("INSERT INTO authRoleDefinitions (roleId, name, createdAt) VALUES (?, ?, ?)",
+					roleId.String(), scope.name+" ("+level.name+")", createdAt); err != nil {
+					return version, err
+				}
+				if _, err := tx.Exec("INSERT INTO authRoleGrants (roleId, scope, level) VALUES (?, ?, ?)",
+					roleId.String(), scope.scope, level.level); err != nil {
+					return version, err
+				}
+				if _, err := tx.Exec("INSERT INTO authUserRoles (userId, roleId) SELECT userId, ? FROM authRoles WHERE scope = ? AND level = ?",
+					roleId.String(), scope.scope, level.level); err != nil {
+					return version, err
+				}
+			}
+		}
+
+		if _, err := tx.Exec("DROP TABLE authRoles"); err != nil {
+			return version, err
+		}
+		version = 22
+	}
+
+	// 23: groups of users, with their own roles and storage grants
+	if version < 23 {
+		if _, err := tx.Exec(`
+			CREATE TABLE authGroups (
+				groupId TEXT PRIMARY KEY,
+				name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+				description TEXT NOT NULL DEFAULT '',
+				createdAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authGroupMembers (
+				groupId TEXT NOT NULL REFERENCES authGroups(groupId),
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				PRIMARY KEY (groupId, userId)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX authGroupMembersUser ON authGroupMembers (userId)"); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authGroupRoles (
+				groupId TEXT NOT NULL REFERENCES authGroups(groupId),
+				roleId TEXT NOT NULL REFERENCES authRoleDefinitions(roleId),
+				PRIMARY KEY (groupId, roleId)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE storageGroupGrants (
+				grantId TEXT PRIMARY KEY,
+				groupId TEXT NOT NULL REFERENCES authGroups(groupId),
+				path TEXT NOT NULL,
+				level INTEGER NOT NULL,
+				createdAt INTEGER NOT NULL,
+				UNIQUE (groupId, path)
+			)`); err != nil {
+			return version, err
+		}
+		version = 23
+	}
+
+	// 24: invites that expire, can be revoked, and carry a note, roles and an invite quota for the new user
+	if version < 24 {
+		for _, column := range []string{
+			"expiresAt INTEGER DEFAULT NULL",
+			"revokedAt INTEGER DEFAULT NULL",
+			"note TEXT NOT NULL DEFAULT ''",
+			"inviteQuota INTEGER DEFAULT NULL",
+		} {
+			if _, err := tx.Exec("ALTER TABLE authInvites ADD COLUMN " + column); err != nil {
+				return version, err
+			}
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authInviteRoles (
+				inviteId TEXT NOT NULL REFERENCES authInvites(inviteId),
+				roleId TEXT NOT NULL REFERENCES authRoleDefinitions(roleId),
+				PRIMARY KEY (inviteId, roleId)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		version = 24
+	}
+
+	// 25: password reset links, and requiring a password change
+	if version < 25 {
+		if _, err := tx.Exec("ALTER TABLE authUsers ADD COLUMN passwordChangeRequired INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authPasswordResets (
+				resetId TEXT PRIMARY KEY NOT NULL UNIQUE,
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				tokenHash TEXT NOT NULL UNIQUE,
+				createdByUserId TEXT NOT NULL REFERENCES authUsers(userId),
+				createdAt INTEGER NOT NULL,
+				expiresAt INTEGER NOT NULL,
+				usedAt INTEGER DEFAULT NULL,
+				revokedAt INTEGER DEFAULT NULL
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX authPasswordResetsUser ON authPasswordResets (userId)"); err != nil {
+			return version, err
+		}
+		version = 25
+	}
+
+	// 26: profiles, username history, and scheduled and undoable deletion
+	if version < 26 {
+		for _, column := range []string{
+			"displayName TEXT NOT NULL DEFAULT ''",
+			"email TEXT NOT NULL DEFAULT ''",
+			"avatarUpdatedAt INTEGER DEFAULT NULL",
+			"deleteAt INTEGER DEFAULT NULL",
+			"deletedAt INTEGER DEFAULT NULL",
+		} {
+			if _, err := tx.Exec("ALTER TABLE authUsers ADD COLUMN " + column); err != nil {
+				return version, err
+			}
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE authUsernameHistory (
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				userName TEXT NOT NULL,
+				changedAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX authUsernameHistoryUser ON authUsernameHistory (userId)"); err != nil {
+			return version, err
+		}
+		version = 26
+	}
+
+	// 27: OpenID Connect clients, their redirect URIs, users' consents and authorization codes
+	if version < 27 {
+		if _, err := tx.Exec(`
+			CREATE TABLE oidcClients (
+				clientId TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				secretHash TEXT NOT NULL DEFAULT '',
+				createdByUserId TEXT NOT NULL,
+				createdAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE oidcClientRedirectUris (
+				clientId TEXT NOT NULL REFERENCES oidcClients(clientId),
+				redirectUri TEXT NOT NULL,
+				PRIMARY KEY (clientId, redirectUri)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE oidcConsents (
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				clientId TEXT NOT NULL REFERENCES oidcClients(clientId),
+				scope TEXT NOT NULL,
+				grantedAt INTEGER NOT NULL,
+				PRIMARY KEY (userId, clientId)
+			) WITHOUT ROWID`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE oidcAuthorizationCodes (
+				codeHash TEXT PRIMARY KEY,
+				clientId TEXT NOT NULL REFERENCES oidcClients(clientId),
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				redirectUri TEXT NOT NULL,
+				scope TEXT NOT NULL,
+				nonce TEXT NOT NULL DEFAULT '',
+				codeChallenge TEXT NOT NULL,
+				createdAt INTEGER NOT NULL,
+				expiresAt INTEGER NOT NULL,
+				usedAt INTEGER DEFAULT NULL
+			)`); err != nil {
+			return version, err
+		}
+		version = 27
+	}
+
+	// 28: SQL console history and saved queries
+	if version < 28 {
+		if _, err := tx.Exec(`
+			CREATE TABLE sqlHistory (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				userId TEXT NOT NULL REFERENCES authUsers(userId),
+				query TEXT NOT NULL,
+				mode TEXT NOT NULL,
+				ranAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec("CREATE INDEX sqlHistoryUser ON sqlHistory (userId, id)"); err != nil {
+			return version, err
+		}
+		if _, err := tx.Exec(`
+			CREATE TABLE sqlSavedQueries (
+				queryId TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				query TEXT NOT NULL,
+				createdByUserId TEXT NOT NULL REFERENCES authUsers(userId),
+				createdAt INTEGER NOT NULL
+			)`); err != nil {
+			return version, err
+		}
+		version = 28
+	}
+
 	// Additional admin setup and invite management is handled by the auth package after migration
 	return version, nil
 }
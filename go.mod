@@ -11,8 +11,10 @@ require (
 	github.com/lestrrat-go/jwx/v2 v2.1.6
 	github.com/lestrrat-go/jwx/v3 v3.0.0-alpha1
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	go.jetify.com/typeid v1.3.0
 	golang.org/x/crypto v0.34.0
+	golang.org/x/net v0.35.0
 )
 
 require (
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -31,13 +32,23 @@ func main() {
 	db.RunMigrations()
 
 	auth.Init()
+
+	if config.Config.RotateAuthKey {
+		keyId, err := auth.RotateSigningKey(context.Background())
+		if err != nil {
+			log.Fatalf("failed to rotate auth key: %v", err)
+		}
+		log.Printf("new auth key %s; restart lod2 to start signing with it", keyId)
+		return
+	}
+
 	storage.Init()
 
 	// The primary router.
 	r := chi.NewRouter()
 
 	r.Use(chiMiddleware.RequestID)
-	r.Use(chiMiddleware.RealIP)
+	r.Use(middleware.RealIPMiddleware())
 	r.Use(chiMiddleware.Logger)
 	r.Use(chiMiddleware.Recoverer)
 	r.Use(chiMiddleware.StripSlashes)
@@ -2,15 +2,29 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"lod2/audit"
 	"lod2/auth"
 	"lod2/page"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/lestrrat-go/jwx/v3/jwt"
 )
 
 func validateAuth(w http.ResponseWriter, r *http.Request) context.Context {
+	// Requests carrying an API token are authenticated by it alone, even if they also have cookies.
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		userInfo, err := auth.VerifyApiToken(strings.TrimSpace(token))
+		if err != nil {
+			log.Printf("rejected API token: %v", err)
+			return r.Context()
+		}
+
+		return context.WithValue(r.Context(), auth.UserInfoContextKey, userInfo)
+	}
+
 	refreshTokenCookie, refreshErr := r.Cookie(auth.RefreshTokenCookieName)
 	accessTokenCookie, accessErr := r.Cookie(auth.AccessTokenCookieName)
 
@@ -31,51 +45,54 @@ func validateAuth(w http.ResponseWriter, r *http.Request) context.Context {
 		accessTokenString = accessTokenCookie.Value
 	}
 
-	refreshToken, _ := auth.ParseToken(refreshTokenCookie.Value)
 	var accessToken jwt.Token
+	var userInfo auth.UserInfo
+	var err error
 
 	if accessTokenString != "" {
-		accessToken, _ = auth.ParseToken(accessTokenString)
+		accessToken, _ = auth.ParseAccessToken(accessTokenString)
 	}
 
-	// at this point, an expired access token is not a problem and means we need to refresh it
+	// The access token's roles are trusted unless something has changed them since it was issued.
+	if accessToken != nil {
+		userInfo, err = auth.UserInfoFromAccessToken(accessToken)
+
+		if err != nil {
+			if !errors.Is(err, auth.ErrStaleAccessToken) {
+				log.Println("error reading access token:", err)
+			}
+			accessToken = nil
+		}
+	}
+
+	// at this point, an expired or out of date access token is not a problem and means we need to
+	// refresh it. The refresh token is replaced at the same time.
 	if accessToken == nil {
-		accessTokenString, err := auth.IssueAccessToken(refreshToken)
+		refreshToken, _ := auth.ParseToken(refreshTokenCookie.Value)
+		refreshTokenString, accessTokenString, err := auth.RefreshSession(refreshToken, r)
 
 		if err != nil {
-			log.Println("error reissuing access token:", err)
+			log.Println("error refreshing session:", err)
 			auth.SignOut(w, r)
 			return r.Context()
 		}
 
-		accessToken, _ = auth.ParseToken(accessTokenString)
-		log.Println("access token was expired; refreshed")
+		log.Println("access token was expired or out of date; refreshed")
+		auth.SetCookie(w, auth.RefreshTokenCookieName, refreshTokenString, auth.RefreshTokenExpirationDuration)
 		auth.SetCookie(w, auth.AccessTokenCookieName, accessTokenString, auth.AccessTokenExpirationDuration)
-	}
 
-	// Create the user info object that lives on the context
-	userInfo := auth.UserInfo{}
-
-	accessToken.Get("username", &userInfo.Username)
-
-	subject, valid := accessToken.Subject()
-
-	if !valid {
-		log.Println("error getting subject from access token")
-		auth.SignOut(w, r)
-		return r.Context()
-	}
-	userInfo.UserId = subject
-	roles, err := auth.GetUserRoles(subject)
+		accessToken, err = auth.ParseAccessToken(accessTokenString)
+		if err == nil {
+			userInfo, err = auth.UserInfoFromAccessToken(accessToken)
+		}
 
-	if err != nil {
-		log.Printf("error getting roles for user %s: %v", subject, err)
-		auth.SignOut(w, r)
-		return r.Context()
+		if err != nil {
+			log.Println("error reading refreshed access token:", err)
+			auth.SignOut(w, r)
+			return r.Context()
+		}
 	}
 
-	userInfo.Roles = roles
-
 	ctx := context.WithValue(r.Context(), auth.UserInfoContextKey, userInfo)
 
 	return ctx
@@ -85,6 +102,15 @@ func AuthRefreshMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := validateAuth(w, r)
+
+			// So the audit log knows who did whatever this request does.
+			actor := audit.Actor{RemoteAddr: r.RemoteAddr}
+			if userInfo := auth.GetCurrentUserInfo(ctx); userInfo != nil {
+				actor.UserId = userInfo.UserId
+				actor.Username = userInfo.Username
+			}
+			ctx = audit.WithActor(ctx, actor)
+
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -104,6 +130,30 @@ func AuthRequiredMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
+// Refuses requests that aren't made with a session, such as those with an API token. Tokens are given to
+// scripts and other services to act within their roles, not to manage the account itself (its tokens,
+// sessions, password, two-factor authentication and so on) or to act as the person elsewhere.
+func SessionRequiredMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfo := auth.GetCurrentUserInfo(r.Context())
+
+			if userInfo == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				page.Render401(w, r)
+				return
+			}
+
+			if userInfo.ApiTokenId != "" || userInfo.SessionId == "" {
+				page.RenderStatus(w, r, http.StatusForbidden, "this can't be done with an API token; log in instead")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Will reject requests from users without the given role. GET requests will require View or above, while
 // any other method will require Edit level.
 func AuthRoleRequiredMiddleware(scope auth.AccessScope) func(http.Handler) http.Handler {
@@ -125,3 +175,51 @@ func AuthRoleRequiredMiddleware(scope auth.AccessScope) func(http.Handler) http.
 		})
 	}
 }
+
+// Where users are sent when they have something to do before they can use the site.
+const changePasswordPath = "/account/change-password"
+const deleteAccountPath = "/account/delete"
+
+// Returns where the user has to go before they can do anything else, and why, or "" if nowhere.
+func requiredAccountAction(userInfo *auth.UserInfo) (string, string) {
+	switch {
+	case userInfo == nil || userInfo.SessionId == "":
+		return "", ""
+	case userInfo.DeletionScheduled:
+		return deleteAccountPath, "your account is scheduled for deletion; cancel it first"
+	case userInfo.PasswordChangeRequired:
+		return changePasswordPath, "you have to change your password first"
+	}
+
+	return "", ""
+}
+
+// Sends users who have to change their password to the change password form until they do, and users whose
+// account is about to be deleted to the page where they can cancel it. Pages under those, logging in and out
+// still work, as do requests made without a session (such as with an API token).
+func AccountActionRequiredMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actionPath, message := requiredAccountAction(auth.GetCurrentUserInfo(r.Context()))
+
+			if actionPath == "" || r.URL.Path == actionPath || strings.HasPrefix(r.URL.Path, actionPath+"/") || strings.HasPrefix(r.URL.Path, "/auth/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Method != http.MethodGet {
+				page.RenderStatus(w, r, http.StatusForbidden, message)
+				return
+			}
+
+			// htmx would otherwise put the page wherever the response was meant to go.
+			if r.Header.Get("HX-Request") != "" {
+				w.Header().Set("HX-Redirect", actionPath)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			http.Redirect(w, r, actionPath, http.StatusSeeOther)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lod2/auth"
+)
+
+func TestSessionRequiredMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		userInfo auth.UserInfo
+		want     int
+	}{
+		{"session", auth.UserInfo{UserId: "user_test", SessionId: "session_test"}, http.StatusNoContent},
+		{"API token", auth.UserInfo{UserId: "user_test", ApiTokenId: "token_test"}, http.StatusForbidden},
+		{"password without a session", auth.UserInfo{UserId: "user_test"}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), auth.UserInfoContextKey, test.userInfo))
+
+		w := httptest.NewRecorder()
+		SessionRequiredMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})).ServeHTTP(w, r)
+
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"encoding/json"
+	"lod2/auth"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Rejects state-changing requests made with a session cookie unless they carry the session's CSRF token
+// (see auth/csrf.go). Requests authenticated some other way, such as with an API token or a WebDAV
+// password, or not at all, have nothing another site could borrow, so they're let through; so is anything
+// on a router that doesn't use this middleware, such as the GitHub webhook.
+func CsrfMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfo := auth.GetCurrentUserInfo(r.Context())
+
+			if isSafeMethod(r.Method) || userInfo == nil || userInfo.SessionId == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !auth.CheckCsrfToken(userInfo, presentedCsrfToken(r)) {
+				log.Printf("rejected %s %s from %s: missing or wrong CSRF token", r.Method, r.URL.Path, userInfo.Username)
+				rejectCsrf(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// The JSON API (see routes/api) promises JSON errors, so it gets one in the same shape.
+func rejectCsrf(w http.ResponseWriter, r *http.Request) {
+	const message = "missing or invalid CSRF token; reload the page and try again"
+
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]map[string]string{
+		"error": {"code": "invalid_csrf_token", "message": message},
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// Returns the token from the header or, for plain form posts, the form field. Other bodies aren't read
+// looking for it: multipart ones can be whole uploads, which would all have to be read (and spooled to
+// disk) before the handler sees them. Multipart forms must send the header instead, as htmx does.
+func presentedCsrfToken(r *http.Request) string {
+	if token := r.Header.Get(auth.CsrfHeaderName); token != "" {
+		return token
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(auth.CsrfFormField)
+	}
+
+	return ""
+}
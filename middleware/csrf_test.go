@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"lod2/auth"
+)
+
+func serveWithCsrfMiddleware(r *http.Request, userInfo *auth.UserInfo) int {
+	if userInfo != nil {
+		r = r.WithContext(context.WithValue(r.Context(), auth.UserInfoContextKey, *userInfo))
+	}
+
+	handler := CsrfMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestCsrfMiddleware(t *testing.T) {
+	session := &auth.UserInfo{UserId: "user_test", SessionId: "session_test", CsrfToken: "right"}
+	apiToken := &auth.UserInfo{UserId: "user_test"}
+
+	form := func(token string) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	withHeader := func(method string, token string) *http.Request {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set(auth.CsrfHeaderName, token)
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		request  *http.Request
+		userInfo *auth.UserInfo
+		want     int
+	}{
+		{"GET without a token", httptest.NewRequest("GET", "/", nil), session, http.StatusNoContent},
+		{"DELETE without a token", httptest.NewRequest("DELETE", "/", nil), session, http.StatusForbidden},
+		{"DELETE with the wrong header", withHeader("DELETE", "wrong"), session, http.StatusForbidden},
+		{"DELETE with the right header", withHeader("DELETE", "right"), session, http.StatusNoContent},
+		{"form with the wrong field", form("wrong"), session, http.StatusForbidden},
+		{"form with the right field", form("right"), session, http.StatusNoContent},
+		{"API token without a token", httptest.NewRequest("DELETE", "/", nil), apiToken, http.StatusNoContent},
+		{"logged out without a token", httptest.NewRequest("POST", "/", nil), nil, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		if code := serveWithCsrfMiddleware(test.request, test.userInfo); code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.want)
+		}
+	}
+}
+
+func TestCsrfMiddleware_APIErrorsAreJSON(t *testing.T) {
+	session := auth.UserInfo{UserId: "user_test", SessionId: "session_test", CsrfToken: "right"}
+
+	r := httptest.NewRequest("DELETE", "/api/v1/files/notes.txt", nil)
+	r = r.WithContext(context.WithValue(r.Context(), auth.UserInfoContextKey, session))
+
+	w := httptest.NewRecorder()
+	CsrfMiddleware()(http.NotFoundHandler()).ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q, want a JSON 403", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `"code":"invalid_csrf_token"`) {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"lod2/config"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Replaces r.RemoteAddr with the client's address from X-Real-IP or X-Forwarded-For, but only for
+// requests from one of config.Config.Http.TrustedProxies. Anyone else could set those headers to
+// whatever they like, such as a new address for every password guess, so they're ignored.
+func RealIPMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if clientAddr := forwardedClientAddr(r); clientAddr != "" {
+				r.RemoteAddr = clientAddr
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range config.Config.Http.TrustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address the trusted proxy says the request is from, or "" if it isn't from one or doesn't say.
+func forwardedClientAddr(r *http.Request) string {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(peer.Addr()) {
+		return ""
+	}
+
+	if realIp, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIp.Unmap().String()
+	}
+
+	// Each proxy appends the address it got the request from, so the client is the last one that isn't
+	// another trusted proxy; anything before that came from the client and can't be believed.
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return ""
+		}
+
+		if !isTrustedProxy(addr) {
+			return addr.Unmap().String()
+		}
+	}
+
+	return ""
+}
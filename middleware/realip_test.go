@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"lod2/config"
+)
+
+func TestRealIPMiddleware(t *testing.T) {
+	previous := config.Config.Http.TrustedProxies
+	config.Config.Http.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")}
+	defer func() { config.Config.Http.TrustedProxies = previous }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "192.0.2.1:5000", nil, "192.0.2.1:5000"},
+		{"direct client claiming another address", "192.0.2.1:5000", map[string]string{"X-Real-IP": "198.51.100.7", "X-Forwarded-For": "198.51.100.7"}, "192.0.2.1:5000"},
+		{"proxy with X-Real-IP", "127.0.0.1:5000", map[string]string{"X-Real-IP": "192.0.2.1"}, "192.0.2.1"},
+		{"proxy with X-Forwarded-For", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.7, 192.0.2.1, 10.0.0.2"}, "192.0.2.1"},
+		{"proxy without headers", "127.0.0.1:5000", nil, "127.0.0.1:5000"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+
+		var got string
+		RealIPMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		})).ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
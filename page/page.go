@@ -3,6 +3,7 @@ package page
 import (
 	"html/template"
 	"lod2/auth"
+	"lod2/config"
 	"lod2/utils"
 	"log"
 	"net/http"
@@ -153,6 +154,9 @@ type MetaData struct {
 	AllAccessScopes []auth.AccessScope
 	AllAccessLevels []auth.AccessLevel
 	Version         string
+
+	// For state-changing requests; see auth/csrf.go. Empty when not logged in with a session.
+	CsrfToken string
 }
 
 // renders a single template
@@ -182,13 +186,15 @@ func Render(w http.ResponseWriter, r *http.Request, path string, data map[string
 	meta.User = auth.GetCurrentUserInfo(r.Context())
 	if meta.User != nil {
 		meta.Roles = meta.User.Roles
+		meta.CsrfToken = meta.User.CsrfToken
 	}
 
 	pageData["Meta"] = meta
 
 	pageData["Const"] = map[string]interface{}{
-		"AllAccessScopes": auth.AllAccessScopes,
-		"AllAccessLevels": auth.AllAccessLevels,
+		"AllAccessScopes":   auth.AllAccessScopes,
+		"AllAccessLevels":   auth.AllAccessLevels,
+		"PasswordMinLength": config.Config.Passwords.MinLength,
 	}
 
 	err = templ.ExecuteTemplate(w, path, pageData)
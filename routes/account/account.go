@@ -12,17 +12,53 @@ import (
 func Router() chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.AuthRequiredMiddleware())
+	r.Use(middleware.SessionRequiredMiddleware())
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		userInfo := auth.GetCurrentUserInfo(r.Context())
+
+		profile, err := auth.GetUserProfile(userInfo.UserId)
+		if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+
 		page.Render(w, r, "account/index.html", map[string]interface{}{
-			"User": userInfo,
+			"User":    userInfo,
+			"Profile": profile,
 		})
 	})
 
 	r.Get("/invite-link", getInviteLinkFragment)
+	r.Get("/profile", getProfile)
+	r.Post("/profile", postProfile)
+	r.Get("/avatar", getAvatar)
+	r.Post("/avatar", postAvatar)
+	r.Delete("/avatar", deleteAvatar)
+
 	r.Get("/change-password", getChangePassword)
 	r.Post("/change-password", postChangePassword)
 
+	r.Get("/tokens", getApiTokens)
+	r.Post("/tokens", postApiToken)
+	r.Delete("/tokens/{tokenId}", deleteApiToken)
+
+	r.Get("/sessions", getSessions)
+	r.Delete("/sessions", deleteOtherSessions)
+	r.Delete("/sessions/{sessionId}", deleteSession)
+
+	r.Get("/apps", getApps)
+	r.Delete("/apps/{clientId}", deleteApp)
+
+	r.Get("/two-factor", getTwoFactor)
+	r.Post("/two-factor/setup", postTwoFactorSetup)
+	r.Post("/two-factor/enable", postTwoFactorEnable)
+	r.Post("/two-factor/recovery-codes", postTwoFactorRecoveryCodes)
+	r.Delete("/two-factor", deleteTwoFactor)
+
+	r.Get("/delete", getDeleteAccount)
+	r.Post("/delete", postDeleteAccount)
+	r.Post("/delete/cancel", postCancelDeleteAccount)
+
 	return r
 }
@@ -0,0 +1,46 @@
+package account
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"lod2/auth"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var urlParameter = regexp.MustCompile(`\{[^}]+\}`)
+
+// Every account route, including enrolling two-factor authentication, ending sessions and scheduling the
+// account's deletion, is for someone logged in, not an API token.
+func TestRouter_RefusesApiTokens(t *testing.T) {
+	router := Router()
+	userInfo := auth.UserInfo{UserId: "user_test", Username: "test", ApiTokenId: "token_test"}
+
+	routes := 0
+	err := chi.Walk(router, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes++
+
+		r := httptest.NewRequest(method, urlParameter.ReplaceAllString(route, "x"), nil)
+		r.Header.Set("Authorization", "Bearer lod2_test")
+		r = r.WithContext(context.WithValue(r.Context(), auth.UserInfoContextKey, userInfo))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with an API token: got %d, want %d", method, route, w.Code, http.StatusForbidden)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking routes failed: %v", err)
+	}
+
+	if routes < 20 {
+		t.Errorf("expected to check every account route, only found %d", routes)
+	}
+}
@@ -0,0 +1,40 @@
+package account
+
+import (
+	"lod2/auth"
+	"lod2/page"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func renderAppsWithTemplate(w http.ResponseWriter, r *http.Request, template string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	consents, err := auth.GetUserOidcConsents(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"Consents":          consents,
+		"ScopeDescriptions": auth.OidcScopeDescriptions,
+		"Message":           message,
+	})
+}
+
+func getApps(w http.ResponseWriter, r *http.Request) {
+	renderAppsWithTemplate(w, r, "account/apps.html", "")
+}
+
+func deleteApp(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	if err := auth.RevokeOidcConsent(r.Context(), userInfo.UserId, chi.URLParam(r, "clientId")); err != nil {
+		renderAppsWithTemplate(w, r, "account/fragment-apps.html", err.Error())
+		return
+	}
+
+	renderAppsWithTemplate(w, r, "account/fragment-apps.html", "Stopped sharing")
+}
@@ -0,0 +1,70 @@
+package account
+
+import (
+	"errors"
+	"lod2/auth"
+	"lod2/config"
+	"lod2/page"
+	"net/http"
+	"time"
+)
+
+func renderDeleteAccount(w http.ResponseWriter, r *http.Request, status int, password string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	deleteAt, err := auth.GetDeletionScheduled(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(status)
+	page.Render(w, r, "account/delete.html", map[string]interface{}{
+		"DeleteAt":  deleteAt,
+		"GraceDays": int(config.Config.Accounts.DeletionGrace / (24 * time.Hour)),
+		"Password":  password,
+		"Error":     message,
+	})
+}
+
+func getDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	renderDeleteAccount(w, r, http.StatusOK, "", "")
+}
+
+func postDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	password := r.Form.Get("password")
+
+	deleteAt, err := auth.ScheduleAccountDeletion(r.Context(), userInfo.UserId, password)
+	if errors.Is(err, auth.ErrDeletionScheduled) {
+		renderDeleteAccount(w, r, http.StatusConflict, "", err.Error())
+		return
+	} else if err != nil {
+		renderDeleteAccount(w, r, http.StatusUnauthorized, password, err.Error())
+		return
+	}
+
+	// Their sessions have all ended; this clears the cookies of this one.
+	auth.SignOut(w, r)
+
+	page.Render(w, r, "account/delete-scheduled.html", map[string]interface{}{
+		"DeleteAt": deleteAt,
+	})
+}
+
+// Cancels the deletion, from the page users with a scheduled deletion are sent to when they log in.
+func postCancelDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	if err := auth.CancelAccountDeletion(r.Context(), userInfo.UserId); err != nil {
+		renderDeleteAccount(w, r, http.StatusConflict, "", err.Error())
+		return
+	}
+
+	// The access token still says the deletion is scheduled until it's refreshed, which the bumped roles
+	// version makes happen on the next request.
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
@@ -0,0 +1,80 @@
+package account
+
+import (
+	"errors"
+	"lod2/auth"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+)
+
+func renderProfileWithTemplate(w http.ResponseWriter, r *http.Request, template string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	profile, err := auth.GetUserProfile(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"Profile":   profile,
+		"AvatarUrl": "/account/avatar",
+		"Message":   message,
+	})
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	renderProfileWithTemplate(w, r, "account/profile.html", "")
+}
+
+func postProfile(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	if err := auth.UpdateUserProfile(r.Context(), userInfo.UserId, r.Form.Get("displayName"), r.Form.Get("email")); err != nil {
+		renderProfileWithTemplate(w, r, "account/fragment-profile.html", err.Error())
+		return
+	}
+
+	renderProfileWithTemplate(w, r, "account/fragment-profile.html", "Saved")
+}
+
+func postAvatar(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, storage.MaxAvatarSize+(64<<10))
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		renderProfileWithTemplate(w, r, "account/fragment-profile.html", storage.ErrInvalidAvatar.Error())
+		return
+	}
+	defer file.Close()
+
+	if err := storage.SetAvatar(r.Context(), userInfo.UserId, file); errors.Is(err, storage.ErrInvalidAvatar) {
+		renderProfileWithTemplate(w, r, "account/fragment-profile.html", err.Error())
+		return
+	} else if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderProfileWithTemplate(w, r, "account/fragment-profile.html", "")
+}
+
+func deleteAvatar(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	if err := storage.RemoveAvatar(r.Context(), userInfo.UserId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderProfileWithTemplate(w, r, "account/fragment-profile.html", "")
+}
+
+func getAvatar(w http.ResponseWriter, r *http.Request) {
+	storage.ServeAvatar(w, r, auth.GetCurrentUserInfo(r.Context()).UserId)
+}
@@ -0,0 +1,79 @@
+package account
+
+import (
+	"lod2/auth"
+	"lod2/page"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func renderSessionsWithTemplate(w http.ResponseWriter, r *http.Request, template string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	sessions, err := auth.GetActiveUserSessions(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	hasOtherSessions := false
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SessionId == userInfo.SessionId
+		if !sessions[i].Current {
+			hasOtherSessions = true
+		}
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"Sessions":         sessions,
+		"HasOtherSessions": hasOtherSessions,
+		"Message":          message,
+	})
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	renderSessionsWithTemplate(w, r, "account/sessions.html", "")
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+	sessionId := chi.URLParam(r, "sessionId")
+
+	// Only someone logged in can end their other sessions; an API token can't sign its owner out.
+	if userInfo.SessionId == "" {
+		renderSessionsWithTemplate(w, r, "account/fragment-sessions.html", "Log in again to do this")
+		return
+	}
+
+	// Ending the current session is what logging out is for.
+	if sessionId == userInfo.SessionId {
+		renderSessionsWithTemplate(w, r, "account/fragment-sessions.html", "Use Logout to end this session")
+		return
+	}
+
+	if err := auth.RevokeUserSession(userInfo.UserId, sessionId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderSessionsWithTemplate(w, r, "account/fragment-sessions.html", "Session ended")
+}
+
+// Ends every session but the one making the request.
+func deleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	// Without knowing the current session, this would sign the user out here too.
+	if userInfo.SessionId == "" {
+		renderSessionsWithTemplate(w, r, "account/fragment-sessions.html", "Log in again to do this")
+		return
+	}
+
+	if err := auth.InvalidateOtherSessions(userInfo.UserId, userInfo.SessionId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderSessionsWithTemplate(w, r, "account/fragment-sessions.html", "Signed out everywhere else")
+}
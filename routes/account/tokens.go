@@ -0,0 +1,80 @@
+package account
+
+import (
+	"lod2/auth"
+	"lod2/page"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How long a new token can last, in days, as offered in the UI.
+var apiTokenExpiryDays = []int{7, 30, 90, 365}
+
+func renderApiTokensWithTemplate(w http.ResponseWriter, r *http.Request, template string, newToken string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	tokens, err := auth.GetUserApiTokens(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"ApiTokens":  tokens,
+		"RevokeUrl":  "/account/tokens",
+		"CanRevoke":  true,
+		"Roles":      userInfo.Roles,
+		"ExpiryDays": apiTokenExpiryDays,
+		"NewToken":   newToken,
+		"Message":    message,
+	})
+}
+
+func getApiTokens(w http.ResponseWriter, r *http.Request) {
+	renderApiTokensWithTemplate(w, r, "account/tokens.html", "", "")
+}
+
+func postApiToken(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	days, err := strconv.Atoi(r.Form.Get("expiresInDays"))
+	if err != nil || days <= 0 {
+		renderApiTokensWithTemplate(w, r, "account/fragment-tokens.html", "", "Choose when the token expires")
+		return
+	}
+
+	roles := []auth.Role{}
+
+	for _, scope := range auth.AllAccessScopes {
+		level, err := strconv.Atoi(r.Form.Get(strconv.Itoa(int(scope))))
+		if err != nil {
+			// Scopes the user has no role in aren't offered.
+			continue
+		}
+		roles = append(roles, auth.Role{Scope: scope, Level: auth.AccessLevel(level)})
+	}
+
+	token, err := auth.CreateApiToken(*userInfo, r.Form.Get("name"), roles, time.Now().AddDate(0, 0, days))
+	if err != nil {
+		renderApiTokensWithTemplate(w, r, "account/fragment-tokens.html", "", err.Error())
+		return
+	}
+
+	renderApiTokensWithTemplate(w, r, "account/fragment-tokens.html", token, "")
+}
+
+func deleteApiToken(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	if err := auth.RevokeApiToken(userInfo.UserId, chi.URLParam(r, "tokenId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderApiTokensWithTemplate(w, r, "account/fragment-tokens.html", "", "")
+}
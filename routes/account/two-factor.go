@@ -0,0 +1,116 @@
+package account
+
+import (
+	"encoding/base64"
+	"html/template"
+	"lod2/auth"
+	"lod2/page"
+	"net/http"
+
+	"github.com/skip2/go-qrcode"
+)
+
+func renderTwoFactorWithTemplate(w http.ResponseWriter, r *http.Request, template string, recoveryCodes []string, message string) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	status, err := auth.GetTotpStatus(userInfo.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Status":        status,
+		"RecoveryCodes": recoveryCodes,
+		"Message":       message,
+	}
+
+	if !status.Enabled {
+		enrollment, found, err := auth.GetTotpEnrollment(userInfo.UserId, userInfo.Username)
+		if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+
+		if found {
+			if err := addEnrollment(data, enrollment); err != nil {
+				page.RenderError(w, r, err)
+				return
+			}
+		}
+	}
+
+	page.Render(w, r, template, data)
+}
+
+// Adds what's needed to show a new secret to the user: the secret itself, and its URI as a link and as
+// a QR code image.
+func addEnrollment(data map[string]interface{}, enrollment auth.TotpEnrollment) error {
+	png, err := qrcode.Encode(enrollment.Uri, qrcode.Medium, 256)
+	if err != nil {
+		return err
+	}
+
+	// Both are URLs html/template won't allow in attributes unless told they're safe; we built them.
+	data["Secret"] = enrollment.Secret
+	data["Uri"] = template.URL(enrollment.Uri)
+	data["QrCode"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+
+	return nil
+}
+
+func getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactorWithTemplate(w, r, "account/two-factor.html", nil, "")
+}
+
+func postTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	if _, err := auth.BeginTotpEnrollment(userInfo.UserId, userInfo.Username); err != nil {
+		renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, err.Error())
+		return
+	}
+
+	renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, "")
+}
+
+func postTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	recoveryCodes, err := auth.EnableTotp(userInfo.UserId, r.Form.Get("code"))
+	if err != nil {
+		renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, err.Error())
+		return
+	}
+
+	renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", recoveryCodes, "")
+}
+
+func postTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	recoveryCodes, err := auth.RegenerateRecoveryCodes(userInfo.UserId, r.Form.Get("code"))
+	if err != nil {
+		renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, err.Error())
+		return
+	}
+
+	renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", recoveryCodes, "")
+}
+
+func deleteTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	r.ParseForm()
+
+	if err := auth.DisableTotp(userInfo.UserId, r.Form.Get("code")); err != nil {
+		renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, err.Error())
+		return
+	}
+
+	renderTwoFactorWithTemplate(w, r, "account/fragment-two-factor.html", nil, "Two-factor authentication turned off")
+}
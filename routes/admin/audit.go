@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const auditPageSize = 100
+
+const auditDateFormat = "2006-01-02"
+
+// Reads the filter from the query string. Dates are whole days; "until" includes the day given.
+func auditFilterFromRequest(r *http.Request) (audit.Filter, error) {
+	query := r.URL.Query()
+
+	filter := audit.Filter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+	}
+
+	if since := query.Get("since"); since != "" {
+		at, err := time.ParseInLocation(auditDateFormat, since, time.Local)
+		if err != nil {
+			return filter, errors.New("invalid start date")
+		}
+		filter.Since = at
+	}
+
+	if until := query.Get("until"); until != "" {
+		at, err := time.ParseInLocation(auditDateFormat, until, time.Local)
+		if err != nil {
+			return filter, errors.New("invalid end date")
+		}
+		filter.Until = at.AddDate(0, 0, 1)
+	}
+
+	if before := query.Get("before"); before != "" {
+		beforeId, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return filter, errors.New("invalid page")
+		}
+		filter.BeforeId = beforeId
+	}
+
+	return filter, nil
+}
+
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// One extra, to know whether there's another page.
+	filter.Limit = auditPageSize + 1
+
+	entries, err := audit.Query(filter)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	var nextBeforeId int64
+	if len(entries) > auditPageSize {
+		entries = entries[:auditPageSize]
+		nextBeforeId = entries[len(entries)-1].Id
+	}
+
+	query := r.URL.Query()
+	query.Del("before")
+
+	page.Render(w, r, "admin/audit/index.html", map[string]interface{}{
+		"Entries":      entries,
+		"Actions":      audit.AllActions,
+		"Filter":       query,
+		"FilterQuery":  query.Encode(),
+		"NextBeforeId": nextBeforeId,
+	})
+}
+
+// Exports every entry matching the filter, as CSV or JSON depending on the format parameter.
+func getAuditExport(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "csv" && format != "json" {
+		page.RenderStatus(w, r, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+
+	entries, err := audit.Query(filter)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().Format("20060102-150405"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if format == "json" {
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "at", "actorId", "actorName", "action", "target", "requestId", "remoteAddr", "details"})
+
+	for _, entry := range entries {
+		writer.Write([]string{
+			strconv.FormatInt(entry.Id, 10),
+			entry.At.UTC().Format(time.RFC3339),
+			entry.ActorId,
+			entry.ActorName,
+			entry.Action,
+			entry.Target,
+			entry.RequestId,
+			entry.RemoteAddr,
+			string(entry.Details),
+		})
+	}
+
+	writer.Flush()
+}
+
+func auditRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getAudit)
+	r.Get("/export", getAuditExport)
+
+	return r
+}
@@ -0,0 +1,281 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func groupCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, err := auth.GetGroup(chi.URLParam(r, "groupId"))
+		if errors.Is(err, auth.ErrGroupNotFound) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		} else if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "group", group)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func renderGroups(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	groups, err := auth.GetGroups()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["Groups"] = groups
+
+	page.Render(w, r, "admin/groups/index.html", data)
+}
+
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	renderGroups(w, r, map[string]interface{}{})
+}
+
+func postCreateGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	name := r.Form.Get("name")
+	description := r.Form.Get("description")
+
+	groupId, err := auth.AdminCreateGroup(r.Context(), name, description)
+	if err != nil {
+		renderGroups(w, r, map[string]interface{}{
+			"Name":        name,
+			"Description": description,
+			"Error":       err.Error(),
+		})
+		return
+	}
+
+	http.Redirect(w, r, "/admin/groups/"+groupId, http.StatusSeeOther)
+}
+
+// Adds the group's members, roles and storage grants.
+func addGroupDetails(data map[string]interface{}, group auth.Group) error {
+	members, err := auth.GetGroupMembers(group.GroupId)
+	if err != nil {
+		return err
+	}
+
+	data["Group"] = group
+	data["Members"] = members
+
+	if err := addGroupRoles(data, group); err != nil {
+		return err
+	}
+
+	storageGrants, err := storage.GetGroupGrants(group.GroupId)
+	if err != nil {
+		return err
+	}
+
+	data["StorageGrants"] = storageGrants
+	data["GrantsUrl"] = "/admin/groups/" + group.GroupId + "/storage-grants"
+	data["GrantsFor"] = group.Name
+
+	return nil
+}
+
+func addGroupRoles(data map[string]interface{}, group auth.Group) error {
+	roleDefinitions, err := auth.GetRoleDefinitions()
+	if err != nil {
+		return err
+	}
+
+	groupRoleIds, err := auth.GetGroupRoleIds(group.GroupId)
+	if err != nil {
+		return err
+	}
+
+	data["RoleDefinitions"] = roleDefinitions
+	data["SelectedRoleIds"] = groupRoleIds
+	data["RolesUrl"] = "/admin/groups/" + group.GroupId + "/roles"
+
+	return nil
+}
+
+func renderGroup(w http.ResponseWriter, r *http.Request, group auth.Group, data map[string]interface{}) {
+	if err := addGroupDetails(data, group); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/groups/group.html", data)
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	renderGroup(w, r, group, map[string]interface{}{})
+}
+
+func postGroup(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	r.ParseForm()
+
+	err := auth.AdminUpdateGroup(r.Context(), group.GroupId, r.Form.Get("name"), r.Form.Get("description"))
+	if err != nil {
+		renderGroup(w, r, group, map[string]interface{}{"GroupError": err.Error()})
+		return
+	}
+
+	group, err = auth.GetGroup(group.GroupId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderGroup(w, r, group, map[string]interface{}{"GroupMessage": "Group updated"})
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	if err := auth.AdminDeleteGroup(r.Context(), group.GroupId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Hx-Location", "/admin/groups")
+	w.WriteHeader(http.StatusOK)
+}
+
+func renderGroupMembers(w http.ResponseWriter, r *http.Request, group auth.Group, message string) {
+	members, err := auth.GetGroupMembers(group.GroupId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/groups/fragment-members.html", map[string]interface{}{
+		"Group":   group,
+		"Members": members,
+		"Message": message,
+	})
+}
+
+func postGroupMember(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	r.ParseForm()
+
+	if err := auth.AdminAddGroupMember(r.Context(), group.GroupId, r.Form.Get("username")); err != nil {
+		renderGroupMembers(w, r, group, err.Error())
+		return
+	}
+
+	renderGroupMembers(w, r, group, "")
+}
+
+func deleteGroupMember(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	if err := auth.AdminRemoveGroupMember(r.Context(), group.GroupId, chi.URLParam(r, "userId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderGroupMembers(w, r, group, "")
+}
+
+func putGroupRoles(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	r.ParseForm()
+
+	if err := auth.AdminSetGroupRoleIds(r.Context(), group.GroupId, r.Form["role"]); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data := map[string]interface{}{"Message": "Group roles updated"}
+
+	if err := addGroupRoles(data, group); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/groups/fragment-roles-table.html", data)
+}
+
+func renderGroupStorageGrants(w http.ResponseWriter, r *http.Request, group auth.Group, message string) {
+	storageGrants, err := storage.GetGroupGrants(group.GroupId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/groups/fragment-storage-grants.html", map[string]interface{}{
+		"StorageGrants": storageGrants,
+		"GrantsUrl":     "/admin/groups/" + group.GroupId + "/storage-grants",
+		"GrantsFor":     group.Name,
+		"Message":       message,
+	})
+}
+
+func postGroupStorageGrant(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	r.ParseForm()
+
+	level, err := strconv.Atoi(r.Form.Get("level"))
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, "invalid access level")
+		return
+	}
+
+	err = storage.AdminSetGroupGrant(r.Context(), group.GroupId, r.Form.Get("path"), auth.AccessLevel(level))
+	if err != nil {
+		renderGroupStorageGrants(w, r, group, err.Error())
+		return
+	}
+
+	renderGroupStorageGrants(w, r, group, "")
+}
+
+func deleteGroupStorageGrant(w http.ResponseWriter, r *http.Request) {
+	group := r.Context().Value("group").(auth.Group)
+
+	if err := storage.AdminDeleteGroupGrant(r.Context(), group.GroupId, chi.URLParam(r, "grantId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderGroupStorageGrants(w, r, group, "")
+}
+
+func groupRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getGroups)
+	r.Post("/create", postCreateGroup)
+
+	r.Route("/{groupId}", func(r chi.Router) {
+		r.Use(groupCtx)
+		r.Get("/", getGroup)
+		r.Post("/", postGroup)
+		r.Delete("/", deleteGroup)
+		r.Post("/members", postGroupMember)
+		r.Delete("/members/{userId}", deleteGroupMember)
+		r.Put("/roles", putGroupRoles)
+		r.Post("/storage-grants", postGroupStorageGrant)
+		r.Delete("/storage-grants/{grantId}", deleteGroupStorageGrant)
+	})
+
+	return r
+}
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"lod2/auth"
+	"lod2/config"
+	"lod2/middleware"
+	"lod2/page"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How long a new invite can last, for the expiry select.
+var inviteExpiryOptions = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"Never", 0},
+	{"1 day", 24 * time.Hour},
+	{"1 week", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+}
+
+func renderInvites(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	showAll := r.URL.Query().Get("all") != ""
+
+	invites, err := auth.GetInvites(showAll)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	roleDefinitions, err := auth.GetRoleDefinitions()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["Invites"] = invites
+	data["ShowAll"] = showAll
+	data["RoleDefinitions"] = roleDefinitions
+	data["ExpiryOptions"] = inviteExpiryOptions
+	data["DefaultInviteQuota"] = config.Config.Invites.Quota
+
+	page.Render(w, r, "admin/invites/index.html", data)
+}
+
+func getInvites(w http.ResponseWriter, r *http.Request) {
+	renderInvites(w, r, map[string]interface{}{})
+}
+
+func postInvite(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.GetCurrentUserInfo(r.Context())
+	if currentUser == nil {
+		page.Render401(w, r)
+		return
+	}
+
+	r.ParseForm()
+
+	options := auth.InviteOptions{
+		Note:    r.Form.Get("note"),
+		RoleIds: r.Form["role"],
+	}
+
+	if expiresIn := r.Form.Get("expires_in"); expiresIn != "" {
+		duration, err := time.ParseDuration(expiresIn)
+		if err != nil {
+			page.RenderStatus(w, r, http.StatusBadRequest, "invalid expiry")
+			return
+		}
+		if duration > 0 {
+			options.ExpiresAt = time.Now().Add(duration)
+		}
+	}
+
+	if quota := r.Form.Get("invite_quota"); quota != "" {
+		inviteQuota, err := strconv.Atoi(quota)
+		if err != nil {
+			renderInvites(w, r, map[string]interface{}{"Error": "invite quota must be a number"})
+			return
+		}
+		options.InviteQuota = &inviteQuota
+	}
+
+	inviteId, err := auth.AdminIssueInvite(r.Context(), currentUser.UserId, options)
+	if err != nil {
+		renderInvites(w, r, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	renderInvites(w, r, map[string]interface{}{
+		"InviteUrl": auth.GenerateInviteURL(r.Host, inviteId),
+	})
+}
+
+func deleteInvite(w http.ResponseWriter, r *http.Request) {
+	if err := auth.AdminRevokeInvite(r.Context(), chi.URLParam(r, "inviteId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Hx-Location", "/admin/invites")
+	w.WriteHeader(http.StatusOK)
+}
+
+func getInviteTree(w http.ResponseWriter, r *http.Request) {
+	tree, err := auth.GetInviteTree()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/invites/tree.html", map[string]interface{}{
+		"Tree": tree,
+	})
+}
+
+func inviteRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getInvites)
+	r.Post("/", postInvite)
+	r.Get("/tree", getInviteTree)
+	r.Delete("/{inviteId}", deleteInvite)
+
+	return r
+}
@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func getKeys(w http.ResponseWriter, r *http.Request) {
+	page.Render(w, r, "admin/keys/index.html", map[string]interface{}{
+		"Keys": auth.GetSigningKeys(),
+	})
+}
+
+func postKeysRotate(w http.ResponseWriter, r *http.Request) {
+	keyId, err := auth.RotateSigningKey(r.Context())
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/keys/fragment-signing-keys.html", map[string]interface{}{
+		"Keys":    auth.GetSigningKeys(),
+		"Message": "New tokens are now signed with " + keyId,
+	})
+}
+
+func keyRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getKeys)
+	r.Post("/rotate", postKeysRotate)
+
+	return r
+}
@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func renderOidcClients(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	clients, err := auth.AdminGetOidcClients()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["Clients"] = clients
+	data["Discovery"] = auth.GetOidcDiscovery()
+
+	page.Render(w, r, "admin/oidc/index.html", data)
+}
+
+func getOidcClients(w http.ResponseWriter, r *http.Request) {
+	renderOidcClients(w, r, map[string]interface{}{})
+}
+
+func postOidcClient(w http.ResponseWriter, r *http.Request) {
+	currentUser := auth.GetCurrentUserInfo(r.Context())
+	if currentUser == nil {
+		page.Render401(w, r)
+		return
+	}
+
+	r.ParseForm()
+
+	name := r.Form.Get("name")
+	redirectUris := r.Form.Get("redirect_uris")
+	confidential := r.Form.Get("confidential") != ""
+
+	client, secret, err := auth.AdminCreateOidcClient(r.Context(), currentUser.UserId, name, strings.Split(redirectUris, "\n"), confidential)
+	if err != nil {
+		renderOidcClients(w, r, map[string]interface{}{
+			"Error":        err.Error(),
+			"Name":         name,
+			"RedirectUris": redirectUris,
+			"Confidential": confidential,
+		})
+		return
+	}
+
+	renderOidcClients(w, r, map[string]interface{}{
+		"NewClient": client,
+		"Secret":    secret,
+	})
+}
+
+func postOidcClientSecret(w http.ResponseWriter, r *http.Request) {
+	clientId := chi.URLParam(r, "clientId")
+
+	secret, err := auth.AdminResetOidcClientSecret(r.Context(), clientId)
+	if err != nil {
+		page.Render(w, r, "admin/oidc/fragment-client-secret.html", map[string]interface{}{"SecretError": err.Error()})
+		return
+	}
+
+	client, err := auth.GetOidcClient(clientId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/oidc/fragment-client-secret.html", map[string]interface{}{
+		"NewClient": client,
+		"Secret":    secret,
+	})
+}
+
+func deleteOidcClient(w http.ResponseWriter, r *http.Request) {
+	if err := auth.AdminDeleteOidcClient(r.Context(), chi.URLParam(r, "clientId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Hx-Location", "/admin/oidc")
+	w.WriteHeader(http.StatusOK)
+}
+
+func oidcRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getOidcClients)
+	r.Post("/", postOidcClient)
+	r.Post("/{clientId}/secret", postOidcClientSecret)
+	r.Delete("/{clientId}", deleteOidcClient)
+
+	return r
+}
@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"lod2/auth"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Adds the user's profile, the names they used to have and when they'll be deleted, if they asked to be.
+func addUserProfile(data map[string]interface{}, user auth.UserSessionInfo) error {
+	profile, err := auth.GetUserProfile(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	history, err := auth.GetUsernameHistory(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	deleteAt, err := auth.GetDeletionScheduled(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	data["Profile"] = profile
+	data["AvatarUrl"] = "/admin/users/" + user.UserId + "/avatar"
+	data["UsernameHistory"] = history
+	data["DeleteAt"] = deleteAt
+
+	return nil
+}
+
+func renderUserProfile(w http.ResponseWriter, r *http.Request, user auth.UserSessionInfo, message string) {
+	data := map[string]interface{}{
+		"User":    user,
+		"Message": message,
+	}
+
+	if err := addUserProfile(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-profile.html", data)
+}
+
+func getUserAvatar(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+	storage.ServeAvatar(w, r, user.UserId)
+}
+
+func putUserUsername(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	r.ParseForm()
+
+	if err := auth.AdminRenameUser(r.Context(), user.UserId, r.Form.Get("username")); err != nil {
+		renderUserProfile(w, r, user, err.Error())
+		return
+	}
+
+	// The rest of the page still has the old name.
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteUserDeletion(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	if err := auth.CancelAccountDeletion(r.Context(), user.UserId); err != nil {
+		renderUserProfile(w, r, user, err.Error())
+		return
+	}
+
+	renderUserProfile(w, r, user, "Deletion cancelled")
+}
+
+func renderDeletedUsersWithTemplate(w http.ResponseWriter, r *http.Request, template string, message string) {
+	users, err := auth.AdminGetDeletedUsers()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"DeletedUsers": users,
+		"Message":      message,
+	})
+}
+
+func getDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	renderDeletedUsersWithTemplate(w, r, "admin/users/deleted.html", "")
+}
+
+func postRestoreUser(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userId := chi.URLParam(r, "userId")
+	username := r.Form.Get("username")
+
+	if err := auth.AdminRestoreUser(r.Context(), userId, username); err != nil {
+		renderDeletedUsersWithTemplate(w, r, "admin/users/fragment-deleted.html", err.Error())
+		return
+	}
+
+	renderDeletedUsersWithTemplate(w, r, "admin/users/fragment-deleted.html", "Restored "+username)
+}
+
+func deleteDeletedUserDeletion(w http.ResponseWriter, r *http.Request) {
+	if err := auth.CancelAccountDeletion(r.Context(), chi.URLParam(r, "userId")); err != nil {
+		renderDeletedUsersWithTemplate(w, r, "admin/users/fragment-deleted.html", err.Error())
+		return
+	}
+
+	renderDeletedUsersWithTemplate(w, r, "admin/users/fragment-deleted.html", "Deletion cancelled")
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func roleCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, err := auth.GetRoleDefinition(chi.URLParam(r, "roleId"))
+		if errors.Is(err, auth.ErrRoleNotFound) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		} else if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "role", role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := auth.GetRoleDefinitions()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/roles/index.html", map[string]interface{}{
+		"RoleDefinitions": roles,
+	})
+}
+
+func getCreateRole(w http.ResponseWriter, r *http.Request) {
+	role := auth.RoleDefinition{}
+	for _, scope := range auth.AllAccessScopes {
+		role.Grants = append(role.Grants, auth.Role{Scope: scope, Level: auth.AccessLevelNone})
+	}
+
+	page.Render(w, r, "admin/roles/role.html", map[string]interface{}{
+		"Role": role,
+	})
+}
+
+// Reads the name, description and grants from the role form.
+func roleFromForm(r *http.Request) (auth.RoleDefinition, error) {
+	r.ParseForm()
+
+	grants, err := rolesFromForm(r)
+
+	return auth.RoleDefinition{
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		Grants:      grants,
+	}, err
+}
+
+func postCreateRole(w http.ResponseWriter, r *http.Request) {
+	role, err := roleFromForm(r)
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, "invalid access level")
+		return
+	}
+
+	roleId, err := auth.AdminCreateRoleDefinition(r.Context(), role.Name, role.Description, role.Grants)
+	if err != nil {
+		page.Render(w, r, "admin/roles/role.html", map[string]interface{}{
+			"Role":  role,
+			"Error": err.Error(),
+		})
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles/"+roleId, http.StatusSeeOther)
+}
+
+func getRole(w http.ResponseWriter, r *http.Request) {
+	role := r.Context().Value("role").(auth.RoleDefinition)
+
+	page.Render(w, r, "admin/roles/role.html", map[string]interface{}{
+		"Role": role,
+	})
+}
+
+func postRole(w http.ResponseWriter, r *http.Request) {
+	role := r.Context().Value("role").(auth.RoleDefinition)
+
+	changed, err := roleFromForm(r)
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, "invalid access level")
+		return
+	}
+
+	changed.RoleId = role.RoleId
+	changed.UserCount = role.UserCount
+
+	if err := auth.AdminUpdateRoleDefinition(r.Context(), role.RoleId, changed.Name, changed.Description, changed.Grants); err != nil {
+		page.Render(w, r, "admin/roles/role.html", map[string]interface{}{
+			"Role":  changed,
+			"Error": err.Error(),
+		})
+		return
+	}
+
+	page.Render(w, r, "admin/roles/role.html", map[string]interface{}{
+		"Role":    changed,
+		"Message": "Role updated",
+	})
+}
+
+func deleteRole(w http.ResponseWriter, r *http.Request) {
+	role := r.Context().Value("role").(auth.RoleDefinition)
+
+	if err := auth.AdminDeleteRoleDefinition(r.Context(), role.RoleId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Hx-Location", "/admin/roles")
+	w.WriteHeader(http.StatusOK)
+}
+
+func roleRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
+
+	r.Get("/", getRoles)
+	r.Get("/create", getCreateRole)
+	r.Post("/create", postCreateRole)
+
+	r.Route("/{roleId}", func(r chi.Router) {
+		r.Use(roleCtx)
+		r.Get("/", getRole)
+		r.Post("/", postRole)
+		r.Delete("/", deleteRole)
+	})
+
+	return r
+}
@@ -0,0 +1,391 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/config"
+	"lod2/db"
+	"lod2/page"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How many of the user's recent queries are listed beside the console.
+const sqlHistoryShown = 20
+
+const sqlDefaultQuery = "SELECT * FROM authUsers;"
+
+// Reads the values of the query's parameters, which the form sends as "parameter-<name>". Parameters the
+// form didn't send are left out, rather than given empty values, so running the query fails.
+func sqlParametersFromRequest(r *http.Request, query string) map[string]string {
+	parameters := map[string]string{}
+	for _, name := range db.ConsoleQueryParameters(query) {
+		if r.Form.Has("parameter-" + name) {
+			parameters[name] = r.Form.Get("parameter-" + name)
+		}
+	}
+	return parameters
+}
+
+func canWriteSql(r *http.Request) bool {
+	return auth.VerifyRole(r.Context(), auth.DangerousSql, auth.Edit)
+}
+
+func renderSavedSqlQueries(w http.ResponseWriter, r *http.Request, message string) {
+	saved, err := db.GetSavedConsoleQueries()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/db/fragment-saved-queries.html", map[string]interface{}{
+		"SavedQueries": saved,
+		"CanWrite":     canWriteSql(r),
+		"Message":      message,
+	})
+}
+
+// Shows the console, with a saved query (?saved=<queryId>) or one from the user's history (?history=<id>)
+// ready to run if one is given.
+func getSql(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	query := sqlDefaultQuery
+	mode := db.ConsolePreview
+	savedName := ""
+
+	if queryId := r.URL.Query().Get("saved"); queryId != "" {
+		saved, err := db.GetSavedConsoleQuery(queryId)
+		if errors.Is(err, db.ErrSavedQueryNotFound) {
+			page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+		query = saved.Query
+		savedName = saved.Name
+	} else if historyId := r.URL.Query().Get("history"); historyId != "" {
+		id, _ := strconv.ParseInt(historyId, 10, 64)
+		entry, err := db.GetConsoleHistoryEntry(userInfo.UserId, id)
+		if errors.Is(err, db.ErrHistoryEntryNotFound) {
+			page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+		query = entry.Query
+		mode = entry.Mode
+	}
+
+	saved, err := db.GetSavedConsoleQueries()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	history, err := db.GetConsoleHistory(userInfo.UserId, sqlHistoryShown)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/sql.html", map[string]interface{}{
+		"CanWrite":     canWriteSql(r),
+		"MaxRows":      config.Config.Sql.MaxRows,
+		"Timeout":      config.Config.Sql.Timeout,
+		"Query":        query,
+		"Mode":         mode,
+		"SavedName":    savedName,
+		"Parameters":   db.ConsoleQueryParameters(query),
+		"Values":       map[string]string{},
+		"SavedQueries": saved,
+		"History":      history,
+	})
+}
+
+// Renders inputs for the parameters of the query being typed, keeping any values already filled in.
+func postSqlParameters(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	query := r.Form.Get("query")
+
+	page.Render(w, r, "admin/db/fragment-parameters.html", map[string]interface{}{
+		"Parameters": db.ConsoleQueryParameters(query),
+		"Values":     sqlParametersFromRequest(r, query),
+	})
+}
+
+func postSqlExecute(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	query := r.Form.Get("query")
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		page.Render(w, r, "admin/db/fragment-execute.html", map[string]interface{}{"Error": "query required"})
+		return
+	}
+
+	mode, ok := db.ParseConsoleMode(r.Form.Get("mode"))
+	if !ok {
+		mode = db.ConsoleReadOnly
+	}
+
+	// Only those who can edit the database may write to it, even in a transaction that's rolled back.
+	if mode != db.ConsoleReadOnly && !canWriteSql(r) {
+		page.Render401(w, r)
+		return
+	}
+
+	parameters := sqlParametersFromRequest(r, query)
+
+	// Recorded before running, so a query that changes something can't go unrecorded.
+	if err := audit.Record(r.Context(), audit.SqlExecute, "", map[string]interface{}{"query": query, "mode": mode, "parameters": parameters}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		page.Render(w, r, "admin/db/fragment-execute.html", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	// Losing a history entry isn't worth failing the query over.
+	if err := db.AddConsoleHistory(auth.GetCurrentUserInfo(r.Context()).UserId, query, mode); err != nil {
+		log.Printf("failed to record sql history: %v", err)
+	}
+
+	result, err := db.RunConsoleQuery(r.Context(), query, parameters, mode)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		page.Render(w, r, "admin/db/fragment-execute.html", map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	page.Render(w, r, "admin/db/fragment-execute.html", map[string]interface{}{
+		"Query":      query,
+		"Parameters": parameters,
+		"Result":     result,
+		"MaxRows":    config.Config.Sql.MaxRows,
+	})
+}
+
+// Converts a value from a row into something that can be written to CSV or JSON.
+func sqlExportValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return value
+}
+
+// Exports every row a query returns as CSV, JSON or NDJSON, depending on the format field. Exports always
+// run read-only and write each row as it's read.
+func postSqlExport(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	query := r.Form.Get("query")
+	if query == "" {
+		page.RenderStatus(w, r, http.StatusBadRequest, "query required")
+		return
+	}
+
+	format := r.Form.Get("format")
+	if format != "csv" && format != "json" && format != "ndjson" {
+		page.RenderStatus(w, r, http.StatusBadRequest, "format must be csv, json or ndjson")
+		return
+	}
+
+	parameters := sqlParametersFromRequest(r, query)
+
+	if err := audit.Record(r.Context(), audit.SqlExecute, "", map[string]interface{}{"query": query, "mode": db.ConsoleReadOnly, "parameters": parameters, "format": format}); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	var columns []string
+	var csvWriter *csv.Writer
+	rowCount := 0
+
+	writeColumns := func(names []string) error {
+		columns = names
+
+		filename := fmt.Sprintf("query-%s.%s", time.Now().Format("20060102-150405"), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.Header().Set("Cache-Control", "no-store")
+
+		switch format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			csvWriter = csv.NewWriter(w)
+			return csvWriter.Write(columns)
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			_, err := w.Write([]byte("["))
+			return err
+		default:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			return nil
+		}
+	}
+
+	writeRow := func(values []interface{}) error {
+		rowCount++
+
+		if format == "csv" {
+			record := make([]string, len(values))
+			for i, value := range values {
+				if value != nil {
+					record[i] = fmt.Sprint(sqlExportValue(value))
+				}
+			}
+			return csvWriter.Write(record)
+		}
+
+		// Written a column at a time rather than through a map, to keep the columns in order.
+		object := []byte("{")
+		for i, value := range values {
+			if i > 0 {
+				object = append(object, ',')
+			}
+			name, _ := json.Marshal(columns[i])
+			encoded, err := json.Marshal(sqlExportValue(value))
+			if err != nil {
+				return err
+			}
+			object = append(append(append(object, name...), ':'), encoded...)
+		}
+		object = append(object, '}')
+
+		if format == "json" && rowCount > 1 {
+			object = append([]byte(","), object...)
+		} else if format == "ndjson" {
+			object = append(object, '\n')
+		}
+
+		_, err := w.Write(object)
+		return err
+	}
+
+	err := db.EachConsoleRow(r.Context(), query, parameters, writeColumns, writeRow)
+
+	if columns == nil {
+		// Nothing has been sent yet, so the error can still be shown properly.
+		if err == nil {
+			err = errors.New("query returned no columns")
+		}
+		page.RenderStatus(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if format == "json" {
+		w.Write([]byte("]"))
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+
+	// Too late to tell the user; the export just ends early.
+	if err != nil {
+		log.Printf("sql export failed after %d rows: %v", rowCount, err)
+	}
+}
+
+// Saved queries are listed for everyone with Database access, including those who can write, so only they
+// can save them; otherwise someone with View could leave a query for them to run.
+func postSavedSqlQuery(w http.ResponseWriter, r *http.Request) {
+	if !canWriteSql(r) {
+		page.Render401(w, r)
+		return
+	}
+
+	r.ParseForm()
+	query := r.Form.Get("query")
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderSavedSqlQueries(w, r, "query required")
+		return
+	}
+
+	saved, err := db.SaveConsoleQuery(auth.GetCurrentUserInfo(r.Context()).UserId, r.Form.Get("name"), query)
+	if errors.Is(err, db.ErrSavedQueryNameRequired) {
+		w.WriteHeader(http.StatusBadRequest)
+		renderSavedSqlQueries(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if err := audit.Record(r.Context(), audit.SqlQuerySave, saved.QueryId, map[string]string{"name": saved.Name, "query": saved.Query}); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderSavedSqlQueries(w, r, fmt.Sprintf("Saved '%s'", saved.Name))
+}
+
+// Saved queries can be deleted by whoever saved them, or anyone who can edit the database.
+func deleteSavedSqlQuery(w http.ResponseWriter, r *http.Request) {
+	saved, err := db.GetSavedConsoleQuery(chi.URLParam(r, "queryId"))
+	if errors.Is(err, db.ErrSavedQueryNotFound) {
+		page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if saved.CreatedByUserId != auth.GetCurrentUserInfo(r.Context()).UserId && !canWriteSql(r) {
+		page.Render401(w, r)
+		return
+	}
+
+	if err := db.DeleteSavedConsoleQuery(saved.QueryId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if err := audit.Record(r.Context(), audit.SqlQueryDelete, saved.QueryId, map[string]string{"name": saved.Name}); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderSavedSqlQueries(w, r, fmt.Sprintf("Deleted '%s'", saved.Name))
+}
+
+// Everything here needs at least Database access View, even to change something; whether the user may
+// write is decided by each handler.
+func sqlRoleRequiredMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.VerifyRole(r.Context(), auth.DangerousSql, auth.View) {
+			w.WriteHeader(http.StatusUnauthorized)
+			page.Render401(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sqlRoutes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(sqlRoleRequiredMiddleware)
+
+		r.Get("/sql", getSql)
+		r.Post("/sql/saved", postSavedSqlQuery)
+		r.Delete("/sql/saved/{queryId}", deleteSavedSqlQuery)
+
+		r.Post("/db/execute", postSqlExecute)
+		r.Post("/db/parameters", postSqlParameters)
+		r.Post("/db/export", postSqlExport)
+	})
+}
@@ -3,8 +3,11 @@ package admin
 import (
 	"context"
 	"lod2/auth"
+	"lod2/config"
 	"lod2/middleware"
 	"lod2/page"
+	"lod2/storage"
+	"log"
 	"net/http"
 	"strconv"
 
@@ -46,9 +49,17 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	totpRequiredRoles, err := auth.GetTotpRequiredRoles()
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
 	page.Render(w, r, "admin/users/index.html", map[string]interface{}{
-		"Users":          users,
-		"CanCreateUsers": canCreateUsers,
+		"Users":              users,
+		"CanCreateUsers":     canCreateUsers,
+		"TotpRequiredRoles":  totpRequiredRoles,
+		"DefaultInviteQuota": config.Config.Invites.Quota,
 	})
 }
 
@@ -76,14 +87,240 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data["Roles"] = user.Roles
+	if err := addRoleDefinitions(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	groups, err := auth.GetUserGroups(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["Groups"] = groups
+
+	storageGrants, err := storage.GetUserGrants(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["StorageGrants"] = storageGrants
+	data["GrantsUrl"] = "/admin/users/" + user.UserId + "/storage-grants"
+	data["GrantsFor"] = user.Username
+	data["ShowGrantGroups"] = true
+
+	apiTokens, err := auth.GetUserApiTokens(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	totpStatus, err := auth.GetTotpStatus(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["TotpStatus"] = totpStatus
+
+	passwordStatus, err := auth.GetPasswordStatus(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["PasswordStatus"] = passwordStatus
+
+	if err := addUserProfile(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if err := addFailedLogins(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["ApiTokens"] = apiTokens
+	data["RevokeUrl"] = "/admin/users/" + user.UserId + "/api-tokens"
+	data["CanRevoke"] = auth.VerifyRole(r.Context(), auth.UserManagement, auth.Edit)
 
 	page.Render(w, r, "admin/users/user/index.html", data)
 }
 
+func deleteUserApiToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	if err := auth.RevokeApiToken(user.UserId, chi.URLParam(r, "tokenId")); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	apiTokens, err := auth.GetUserApiTokens(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-api-tokens.html", map[string]interface{}{
+		"ApiTokens": apiTokens,
+		"RevokeUrl": "/admin/users/" + user.UserId + "/api-tokens",
+		"CanRevoke": true,
+	})
+}
+
+// How many failed logins to show on a user's page.
+const failedLoginsShown = 20
+
+func addFailedLogins(data map[string]interface{}, user auth.UserSessionInfo) error {
+	failedLogins, err := auth.AdminGetFailedLogins(user.UserId, failedLoginsShown)
+	if err != nil {
+		return err
+	}
+
+	lockout, err := auth.AdminGetLoginLockout(user.Username)
+	if err != nil {
+		return err
+	}
+
+	data["FailedLogins"] = failedLogins
+	data["LoginLockout"] = lockout
+
+	return nil
+}
+
+func deleteUserLockout(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	if err := auth.AdminUnlockLogin(r.Context(), user.Username); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data := map[string]interface{}{"User": user}
+
+	if err := addFailedLogins(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-failed-logins.html", data)
+}
+
+func deleteUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	if err := auth.AdminResetTotp(r.Context(), user.UserId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	totpStatus, err := auth.GetTotpStatus(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-two-factor.html", map[string]interface{}{
+		"User":       user,
+		"TotpStatus": totpStatus,
+	})
+}
+
+func renderPasswordStatus(w http.ResponseWriter, r *http.Request, user auth.UserSessionInfo, resetUrl string) {
+	passwordStatus, err := auth.GetPasswordStatus(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-password.html", map[string]interface{}{
+		"User":           user,
+		"PasswordStatus": passwordStatus,
+		"ResetUrl":       resetUrl,
+	})
+}
+
+func postUserPasswordReset(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+	currentUser := auth.GetCurrentUserInfo(r.Context())
+	if currentUser == nil {
+		page.Render401(w, r)
+		return
+	}
+
+	token, err := auth.AdminCreatePasswordReset(r.Context(), currentUser.UserId, user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderPasswordStatus(w, r, user, auth.GeneratePasswordResetURL(r.Host, token))
+}
+
+func deleteUserPasswordReset(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	if err := auth.AdminRevokePasswordReset(r.Context(), user.UserId); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderPasswordStatus(w, r, user, "")
+}
+
+func putUserPasswordChangeRequired(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+	r.ParseForm()
+
+	if err := auth.AdminSetPasswordChangeRequired(r.Context(), user.UserId, r.Form.Get("required") != ""); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderPasswordStatus(w, r, user, "")
+}
+
+// Reads a level for every scope from a form with a select named after each scope.
+func rolesFromForm(r *http.Request) ([]auth.Role, error) {
+	roles := []auth.Role{}
+
+	for _, scope := range auth.AllAccessScopes {
+		level, err := strconv.Atoi(r.Form.Get(strconv.Itoa(int(scope))))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, auth.Role{Scope: scope, Level: auth.AccessLevel(level)})
+	}
+
+	return roles, nil
+}
+
+func putTotpRequiredRoles(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	roles, err := rolesFromForm(r)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if err := auth.AdminSetTotpRequiredRoles(r.Context(), roles); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/fragment-totp-required-roles.html", map[string]interface{}{
+		"TotpRequiredRoles": roles,
+		"Message":           "Requirements updated",
+	})
+}
+
 func deleteUserSessions(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(auth.UserSessionInfo)
-	err := auth.AdminInvalidateAllSessions(user.UserId)
+	err := auth.AdminInvalidateAllSessions(r.Context(), user.UserId)
 
 	if err != nil {
 		page.RenderError(w, r, err)
@@ -108,7 +345,7 @@ func putUserResetInvites(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := r.Context().Value("user").(auth.UserSessionInfo)
-	err = auth.AdminSetRemainingInvites(user.UserId, invitesLeft)
+	err = auth.AdminSetRemainingInvites(r.Context(), user.UserId, invitesLeft)
 
 	if err != nil {
 		page.RenderError(w, r, err)
@@ -129,7 +366,7 @@ func deleteUserDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := auth.AdminDeleteUser(user.UserId)
+	err := auth.AdminDeleteUser(r.Context(), user.UserId)
 	if err != nil {
 		page.RenderError(w, r, err)
 		return
@@ -180,45 +417,124 @@ func postCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId, err := auth.AdminInviteUser(currentUser.UserId, username, password)
+	userId, err := auth.AdminInviteUser(r.Context(), currentUser.UserId, username, password)
 	if err != nil {
 		renderError(err.Error())
 		return
 	}
 
+	if err := storage.CreateHomeDirectory(userId, username); err != nil {
+		log.Printf("unable to create home directory for %s: %v", username, err)
+	}
+
 	http.Redirect(w, r, "/admin/users/"+userId, http.StatusSeeOther)
 }
 
+// Adds the role definitions, which of them the user has and what they add up to along with their
+// groups' roles.
+func addRoleDefinitions(data map[string]interface{}, user auth.UserSessionInfo) error {
+	roleDefinitions, err := auth.GetRoleDefinitions()
+	if err != nil {
+		return err
+	}
+
+	userRoleIds, err := auth.GetUserRoleIds(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	effectiveRoles, err := auth.GetUserEffectiveRoles(user.UserId)
+	if err != nil {
+		return err
+	}
+
+	data["RoleDefinitions"] = roleDefinitions
+	data["SelectedRoleIds"] = userRoleIds
+	data["RolesUrl"] = "/admin/users/" + user.UserId + "/roles"
+	data["EffectiveRoles"] = effectiveRoles
+
+	return nil
+}
+
 func putUserRoles(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(auth.UserSessionInfo)
 
 	r.ParseForm()
 
-	roles := []auth.Role{}
-
-	for _, scope := range auth.AllAccessScopes {
-		levelStr := r.Form.Get(strconv.Itoa(int(scope)))
-		level, err := strconv.Atoi(levelStr)
-		if err != nil {
-			page.RenderError(w, r, err)
-			return
-		}
-		roles = append(roles, auth.Role{Scope: scope, Level: auth.AccessLevel(level)})
+	err := auth.AdminSetUserRoleIds(r.Context(), user.UserId, r.Form["role"])
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
 	}
 
-	err := auth.AdminSetUserRoles(user.UserId, roles)
+	// Reloaded for the roles they add up to now.
+	user, err = auth.AdminGetUserById(user.UserId)
 	if err != nil {
 		page.RenderError(w, r, err)
 		return
 	}
 
-	page.Render(w, r, "admin/users/user/fragment-roles-table.html", map[string]interface{}{
+	data := map[string]interface{}{
 		"User":    user,
-		"Roles":   roles,
 		"Message": "User roles updated",
+	}
+
+	if err := addRoleDefinitions(data, user); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-roles-table.html", data)
+}
+
+func renderStorageGrants(w http.ResponseWriter, r *http.Request, user auth.UserSessionInfo, message string) {
+	storageGrants, err := storage.GetUserGrants(user.UserId)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "admin/users/user/fragment-storage-grants.html", map[string]interface{}{
+		"StorageGrants":   storageGrants,
+		"GrantsUrl":       "/admin/users/" + user.UserId + "/storage-grants",
+		"GrantsFor":       user.Username,
+		"ShowGrantGroups": true,
+		"Message":         message,
 	})
 }
 
+func postUserStorageGrant(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	r.ParseForm()
+
+	level, err := strconv.Atoi(r.Form.Get("level"))
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, "invalid access level")
+		return
+	}
+
+	err = storage.AdminSetGrant(r.Context(), user.UserId, r.Form.Get("path"), auth.AccessLevel(level))
+	if err != nil {
+		renderStorageGrants(w, r, user, err.Error())
+		return
+	}
+
+	renderStorageGrants(w, r, user, "")
+}
+
+func deleteUserStorageGrant(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(auth.UserSessionInfo)
+
+	err := storage.AdminDeleteGrant(r.Context(), user.UserId, chi.URLParam(r, "grantId"))
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderStorageGrants(w, r, user, "")
+}
+
 func userRouter() chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.AuthRoleRequiredMiddleware(auth.UserManagement))
@@ -226,13 +542,28 @@ func userRouter() chi.Router {
 	r.Get("/", getUsers)
 	r.Get("/create", getCreateUser)
 	r.Post("/create", postCreateUser)
+	r.Put("/two-factor-policy", putTotpRequiredRoles)
+	r.Get("/deleted", getDeletedUsers)
+	r.Post("/deleted/{userId}/restore", postRestoreUser)
+	r.Delete("/deleted/{userId}/deletion", deleteDeletedUserDeletion)
 
 	r.Route("/{userId}", func(r chi.Router) {
 		r.Use(userCtx)
 		r.Get("/", getUser)
+		r.Get("/avatar", getUserAvatar)
+		r.Put("/username", putUserUsername)
+		r.Delete("/deletion", deleteUserDeletion)
 		r.Delete("/sessions", deleteUserSessions)
+		r.Delete("/api-tokens/{tokenId}", deleteUserApiToken)
+		r.Delete("/two-factor", deleteUserTwoFactor)
+		r.Post("/password-reset", postUserPasswordReset)
+		r.Delete("/password-reset", deleteUserPasswordReset)
+		r.Put("/password-change-required", putUserPasswordChangeRequired)
+		r.Delete("/lockout", deleteUserLockout)
 		r.Put("/invites", putUserResetInvites)
 		r.Put("/roles", putUserRoles)
+		r.Post("/storage-grants", postUserStorageGrant)
+		r.Delete("/storage-grants/{grantId}", deleteUserStorageGrant)
 		r.Delete("/delete", deleteUserDelete)
 	})
 
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"lod2/auth"
+	"lod2/storage"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// A versioned JSON API for scripts and other programs. Everything the HTML routes can do is available
+// here, with the same access checks. Responses are JSON; failures look like:
+//
+//	{"error": {"code": "not_found", "message": "this path does not exist"}}
+
+const Prefix = "/api"
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func Router() chi.Router {
+	r := chi.NewRouter()
+
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(authRequired)
+
+		r.Mount("/files", filesRouter())
+		r.Get("/search", getSearch)
+	})
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	})
+
+	return r
+}
+
+// Like middleware.AuthRequiredMiddleware, but responds with JSON.
+func authRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsUserLoggedIn(r.Context()) {
+			writeError(w, http.StatusUnauthorized, "unauthenticated", "you must be logged in")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("unable to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]apiError{
+		"error": {Code: code, Message: message},
+	})
+}
+
+// Writes an error returned by the storage package with a matching status and code.
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrAccessDenied):
+		writeError(w, http.StatusForbidden, "access_denied", err.Error())
+	case errors.Is(err, storage.ErrExists):
+		writeError(w, http.StatusConflict, "already_exists", err.Error())
+	case errors.Is(err, storage.ErrCopyIntoItself):
+		writeError(w, http.StatusBadRequest, "invalid_destination", err.Error())
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, storage.ErrInternalPath):
+		writeError(w, http.StatusNotFound, "not_found", "this path does not exist")
+	default:
+		log.Printf("API request failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "something went wrong")
+	}
+}
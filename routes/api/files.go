@@ -0,0 +1,334 @@
+package api
+
+import (
+	"io"
+	"lod2/auth"
+	"lod2/storage"
+	"lod2/utils"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Files, by their path within storage:
+//
+//	GET    /api/v1/files/{path}                        metadata of a file or directory
+//	GET    /api/v1/files/{path}?list=true              the contents of a directory, a page at a time;
+//	                                                   takes `offset` and `limit` (at most maxListLimit)
+//	GET    /api/v1/files/{path}?raw=true               the contents of a file
+//	PUT    /api/v1/files/{path}                        uploads the request body as a new file
+//	POST   /api/v1/files/{path}?op=mkdir               creates a directory
+//	POST   /api/v1/files/{path}?op=move&dest={path}    moves a file or directory to dest
+//	POST   /api/v1/files/{path}?op=copy&dest={path}    copies a file or directory to dest
+//	DELETE /api/v1/files/{path}                        moves a file or directory to the trash
+//
+// Nothing is ever replaced: creating, moving or copying onto an existing path fails with
+// `already_exists`. Large files should use the resumable uploads at /files/.uploads instead of PUT.
+
+const defaultListLimit = 1000
+const maxListLimit = 10000
+
+// A file or directory, along with its path.
+type file struct {
+	Path string `json:"path"`
+
+	storage.Entry
+}
+
+type listResponse struct {
+	Path    string          `json:"path"`
+	Entries []storage.Entry `json:"entries"`
+
+	// The number of entries in the directory, across all pages.
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+func filesRouter() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/", getFile)
+	r.Get("/*", getFile)
+	r.Put("/*", putFile)
+	r.Post("/", postFile)
+	r.Post("/*", postFile)
+	r.Delete("/*", deleteFile)
+
+	return r
+}
+
+// Returns the verified path from a URL or query parameter, writing an error if it isn't valid.
+func verifiedPath(w http.ResponseWriter, rawPath string) (string, bool) {
+	decodedPath, err := utils.UrlDecode(rawPath)
+	if err == nil {
+		decodedPath, err = storage.VerifyPath(decodedPath)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_path", err.Error())
+		return "", false
+	}
+
+	return decodedPath, true
+}
+
+// Returns an integer query parameter, or fallback if it's missing.
+func intQuery(w http.ResponseWriter, r *http.Request, name string, fallback int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, true
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", name+" must be a non-negative integer")
+		return 0, false
+	}
+
+	return number, true
+}
+
+// Writes the metadata of a path. Paths the user can't see don't exist, as in the HTML routes.
+func writeFile(w http.ResponseWriter, r *http.Request, status int, path string) {
+	exists, err := storage.Exists(r.Context(), path)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "not_found", "this path does not exist")
+		return
+	}
+
+	entry, err := storage.GetMetadata(r.Context(), path)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeJSON(w, status, file{Path: path, Entry: entry})
+}
+
+func getFile(w http.ResponseWriter, r *http.Request) {
+	path, ok := verifiedPath(w, chi.URLParam(r, "*"))
+	if !ok {
+		return
+	}
+
+	switch {
+	case r.URL.Query().Get("list") == "true":
+		listDirectory(w, r, path)
+	case r.URL.Query().Get("raw") == "true":
+		storage.ServeFile(w, r, path)
+	default:
+		writeFile(w, r, http.StatusOK, path)
+	}
+}
+
+func listDirectory(w http.ResponseWriter, r *http.Request, path string) {
+	offset, ok := intQuery(w, r, "offset", 0)
+	if !ok {
+		return
+	}
+
+	limit, ok := intQuery(w, r, "limit", defaultListLimit)
+	if !ok {
+		return
+	}
+
+	if limit == 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	isDirectory, err := storage.IsDirectory(r.Context(), path)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if !isDirectory {
+		writeError(w, http.StatusBadRequest, "not_a_directory", "only directories can be listed")
+		return
+	}
+
+	entries, total, err := storage.ListContentsPage(r.Context(), path, offset, limit)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	response := listResponse{
+		Path:    path,
+		Entries: entries,
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func putFile(w http.ResponseWriter, r *http.Request) {
+	path, ok := verifiedPath(w, chi.URLParam(r, "*"))
+	if !ok {
+		return
+	}
+
+	// Check before receiving the whole body, so a doomed upload fails quickly.
+	level, err := storage.GetAccessLevel(r.Context(), path)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if level < auth.Edit {
+		writeStorageError(w, storage.ErrAccessDenied)
+		return
+	}
+
+	if exists, err := storage.Exists(r.Context(), path); err != nil || exists {
+		writeError(w, http.StatusConflict, "already_exists", storage.ErrExists.Error())
+		return
+	}
+
+	tempFile, err := os.CreateTemp("", "upload-*.part")
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, r.Body)
+	tempFile.Close()
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "upload_failed", "could not read the request body")
+		return
+	}
+
+	// ImportFile refuses to overwrite, so a file that appeared while we were receiving this one is safe.
+	if err := storage.ImportFile(r.Context(), tempFile.Name(), path); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeFile(w, r, http.StatusCreated, path)
+}
+
+func postFile(w http.ResponseWriter, r *http.Request) {
+	path, ok := verifiedPath(w, chi.URLParam(r, "*"))
+	if !ok {
+		return
+	}
+
+	op := r.URL.Query().Get("op")
+
+	if op == "mkdir" {
+		if exists, err := storage.Exists(r.Context(), path); err != nil || exists {
+			writeError(w, http.StatusConflict, "already_exists", storage.ErrExists.Error())
+			return
+		}
+
+		if err := storage.CreateDirectory(r.Context(), path); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+
+		writeFile(w, r, http.StatusCreated, path)
+		return
+	}
+
+	if op != "move" && op != "copy" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "op must be mkdir, move or copy")
+		return
+	}
+
+	if r.URL.Query().Get("dest") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "dest parameter required")
+		return
+	}
+
+	dest, ok := verifiedPath(w, r.URL.Query().Get("dest"))
+	if !ok {
+		return
+	}
+
+	if exists, err := storage.Exists(r.Context(), path); err != nil || !exists {
+		writeError(w, http.StatusNotFound, "not_found", "this path does not exist")
+		return
+	}
+
+	var err error
+	if op == "move" {
+		err = storage.MoveFile(r.Context(), path, dest)
+	} else {
+		err = storage.CopyFile(r.Context(), path, dest)
+	}
+
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeFile(w, r, http.StatusOK, dest)
+}
+
+func deleteFile(w http.ResponseWriter, r *http.Request) {
+	path, ok := verifiedPath(w, chi.URLParam(r, "*"))
+	if !ok {
+		return
+	}
+
+	if exists, err := storage.Exists(r.Context(), path); err != nil || !exists {
+		writeError(w, http.StatusNotFound, "not_found", "this path does not exist")
+		return
+	}
+
+	if err := storage.DeleteFile(r.Context(), path); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/search?q={query}&path={path}&limit={n} finds files and directories by name below path
+// (the whole storage by default).
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "q parameter required")
+		return
+	}
+
+	path, ok := verifiedPath(w, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+
+	limit, ok := intQuery(w, r, "limit", defaultListLimit)
+	if !ok {
+		return
+	}
+
+	if limit == 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	results, err := storage.Search(r.Context(), path, query, limit)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":    path,
+		"query":   query,
+		"results": results,
+	})
+}
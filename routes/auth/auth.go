@@ -10,6 +10,8 @@ func Router() chi.Router {
 
 	r.Get("/login", getLogin)
 	r.Post("/login", postLogin)
+	r.Get("/login/totp", getLoginTotp)
+	r.Post("/login/totp", postLoginTotp)
 
 	r.Get("/logout", getLogout)
 	r.Post("/logout/confirm", postLogoutConfirm)
@@ -17,5 +19,8 @@ func Router() chi.Router {
 	r.Get("/invite/{inviteCode}", getInvite)
 	r.Post("/invite/{inviteCode}", postInvite)
 
+	r.Get("/reset/{token}", getPasswordReset)
+	r.Post("/reset/{token}", postPasswordReset)
+
 	return r
 }
@@ -3,7 +3,9 @@ package auth
 import (
 	"lod2/auth"
 	"lod2/page"
+	"lod2/storage"
 	"lod2/utils"
+	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -11,7 +13,7 @@ import (
 
 func getInviteAndUsername(w http.ResponseWriter, r *http.Request) (string, string, error) {
 	inviteCode := chi.URLParam(r, "inviteCode")
-	userId, err := auth.ValidateInviteCode(inviteCode)
+	userId, err := auth.CheckInviteCode(inviteCode, r.RemoteAddr)
 	if err != nil {
 		return "", "", err
 	}
@@ -107,12 +109,16 @@ func postInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = auth.RegisterUserWithInvite(inviteCode, username, password)
+	userId, err := auth.RegisterUserWithInvite(r.Context(), inviteCode, username, password)
 	if err != nil {
 		renderError(err.Error())
 		return
 	}
 
+	if err := storage.CreateHomeDirectory(userId, username); err != nil {
+		log.Printf("unable to create home directory for %s: %v", username, err)
+	}
+
 	err = auth.SetTokenCookies(w, r, username, password)
 
 	if err != nil {
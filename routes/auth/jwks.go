@@ -0,0 +1,19 @@
+package auth
+
+import (
+	"encoding/json"
+	"lod2/auth"
+	"log"
+	"net/http"
+)
+
+// Serves the public keys that lod2's tokens are signed with, so other services can verify access tokens
+// themselves. Previous keys are included until the tokens they signed have expired.
+func GetJwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if err := json.NewEncoder(w).Encode(auth.GetVerificationKeys()); err != nil {
+		log.Printf("unable to encode JWKS: %v", err)
+	}
+}
@@ -1,15 +1,42 @@
 package auth
 
 import (
+	"errors"
 	"lod2/auth"
 	"lod2/page"
 	"lod2/utils"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// Writes 429 with a Retry-After header if the error is from throttling, or 401 otherwise.
+func writeLoginErrorStatus(w http.ResponseWriter, err error) {
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// Where to go after logging in: a path on this site given as ?next= (such as by /oidc/authorize), or else
+// the page the user came from.
+func loginNextUrl(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+
+	return utils.GetNextUrl(r, "/account")
+}
+
 func getLogin(w http.ResponseWriter, r *http.Request) {
-	nextUrl := utils.GetNextUrl(r, "/account")
+	nextUrl := loginNextUrl(r)
 
 	// check if the user is already logged in
 	if auth.IsUserLoggedIn(r.Context()) {
@@ -39,8 +66,15 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 
 	err := auth.SetTokenCookies(w, r, username, password)
 
+	if errors.Is(err, auth.ErrTotpRequired) {
+		page.Render(w, r, "auth/login-totp.html", map[string]interface{}{
+			"Redirect": next,
+		})
+		return
+	}
+
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeLoginErrorStatus(w, err)
 
 		page.Render(w, r, "auth/login.html", map[string]interface{}{
 			"Username": username,
@@ -55,3 +89,39 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, next, http.StatusSeeOther)
 	return
 }
+
+func getLoginTotp(w http.ResponseWriter, r *http.Request) {
+	if !auth.HasPendingTotpLogin(r) {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	page.Render(w, r, "auth/login-totp.html", map[string]interface{}{
+		"Redirect": utils.GetNextUrl(r, "/account"),
+	})
+}
+
+func postLoginTotp(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	next := r.Form.Get("nextRedirectUrl")
+
+	if next == "" {
+		next = "/"
+	}
+
+	err := auth.FinishTotpLogin(w, r, r.Form.Get("code"))
+
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+
+		page.Render(w, r, "auth/login-totp.html", map[string]interface{}{
+			"Redirect": next,
+			"Error":    err.Error(),
+		})
+		return
+	}
+
+	log.Printf("two-factor sign-in successful, redirecting to %s", next)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"lod2/auth"
+	"lod2/page"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func renderResetInvalid(w http.ResponseWriter, r *http.Request, title string, message string) {
+	page.Render(w, r, "auth/invite-invalid.html", map[string]interface{}{
+		"Title": title,
+		"Error": message,
+	})
+}
+
+func getPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if auth.IsUserLoggedIn(r.Context()) {
+		renderResetInvalid(w, r, "You are already logged in", "You cannot use a password reset link while logged in. Please log out and try again.")
+		return
+	}
+
+	_, username, err := auth.CheckPasswordResetToken(chi.URLParam(r, "token"), r.RemoteAddr)
+	if err != nil {
+		renderResetInvalid(w, r, "Invalid or expired link", err.Error())
+		return
+	}
+
+	page.Render(w, r, "auth/reset-password.html", map[string]interface{}{
+		"Username": username,
+	})
+}
+
+func postPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if auth.IsUserLoggedIn(r.Context()) {
+		renderResetInvalid(w, r, "You are already logged in", "You cannot use a password reset link while logged in. Please log out and try again.")
+		return
+	}
+
+	r.ParseForm()
+
+	token := chi.URLParam(r, "token")
+
+	_, username, err := auth.CheckPasswordResetToken(token, r.RemoteAddr)
+	if err != nil {
+		renderResetInvalid(w, r, "Invalid or expired link", err.Error())
+		return
+	}
+
+	password := r.Form.Get("password")
+	confirmPassword := r.Form.Get("confirm_password")
+
+	if _, err := auth.ResetPassword(r.Context(), token, password, confirmPassword); err != nil {
+		page.Render(w, r, "auth/reset-password.html", map[string]interface{}{
+			"Username":        username,
+			"Password":        password,
+			"ConfirmPassword": confirmPassword,
+			"Error":           err.Error(),
+		})
+		return
+	}
+
+	page.Render(w, r, "account/change-password-success.html", map[string]interface{}{
+		"Redirect": "/auth/login",
+	})
+}
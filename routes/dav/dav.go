@@ -0,0 +1,102 @@
+package dav
+
+import (
+	"context"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/storage"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV access to storage, for mounting it as a network drive or syncing with tools like rclone.
+// WebDAV clients can't follow our cookie login flow, so every request carries credentials with HTTP
+// Basic auth (or an API token) instead. Access to each path is checked by the storage package, the
+// same as in the browser.
+
+const Prefix = "/dav"
+
+// Shared by every request so locks taken by one request are seen by the next.
+var lockSystem = webdav.NewMemLS()
+
+func init() {
+	// chi rejects methods it doesn't know about, so these must be registered before any routes are.
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chi.RegisterMethod(method)
+	}
+}
+
+func Handler() http.Handler {
+	handler := &webdav.Handler{
+		Prefix:     Prefix,
+		FileSystem: storage.WebdavFileSystem{},
+		LockSystem: lockSystem,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userInfo, ok := authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lod2", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// The storage package checks every path against this user's access.
+		ctx := context.WithValue(r.Context(), auth.UserInfoContextKey, userInfo)
+		ctx = audit.WithActor(ctx, audit.Actor{UserId: userInfo.UserId, Username: userInfo.Username, RemoteAddr: r.RemoteAddr})
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the user making the request. A browser that is already signed in can use its session;
+// anything else must send a username and password.
+func authenticate(r *http.Request) (auth.UserInfo, bool) {
+	if userInfo := auth.GetCurrentUserInfo(r.Context()); userInfo != nil {
+		return *userInfo, true
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return auth.UserInfo{}, false
+	}
+
+	// Clients that can only send a username and password can use an API token as the password.
+	var userInfo auth.UserInfo
+	var err error
+	if strings.HasPrefix(password, auth.ApiTokenPrefix) {
+		userInfo, err = verifyApiTokenLogin(username, password)
+	} else {
+		userInfo, err = auth.VerifyUserLogin(username, password, r.RemoteAddr)
+	}
+
+	if err != nil {
+		log.Printf("webdav login failed for %q: %v", username, err)
+		return auth.UserInfo{}, false
+	}
+
+	return userInfo, true
+}
+
+// Like auth.VerifyUserLogin, but with an API token in place of the password.
+func verifyApiTokenLogin(username string, token string) (auth.UserInfo, error) {
+	userInfo, err := auth.VerifyApiToken(token)
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+
+	if userInfo.Username != username {
+		return auth.UserInfo{}, auth.ErrInvalidApiToken
+	}
+
+	return userInfo, nil
+}
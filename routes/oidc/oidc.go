@@ -0,0 +1,319 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The OpenID Connect provider endpoints (see auth/oidc.go). /oidc/authorize is a page for people; the
+// token and userinfo endpoints are called by clients, and answer in JSON as OAuth expects:
+//
+//	{"error": "invalid_grant", "error_description": "..."}
+
+const Prefix = "/oidc"
+
+func Router() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/authorize", getAuthorize)
+	r.With(middleware.SessionRequiredMiddleware()).Post("/authorize", postAuthorize)
+	r.Post("/token", postToken)
+	r.Get("/userinfo", getUserInfo)
+	r.Post("/userinfo", getUserInfo)
+
+	return r
+}
+
+func GetDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if err := json.NewEncoder(w).Encode(auth.GetOidcDiscovery()); err != nil {
+		log.Printf("unable to encode OIDC discovery document: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("unable to write OIDC response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// An authorization request that has been checked far enough to know where to send the user back to.
+type authorization struct {
+	client  auth.OidcClient
+	request auth.OidcAuthorizationRequest
+	state   string
+	prompt  string
+}
+
+// Sends the user back to the client with the values added to the redirect URI's query.
+func (a authorization) redirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	if a.state != "" {
+		values.Set("state", a.state)
+	}
+
+	separator := "?"
+	if strings.Contains(a.request.RedirectUri, "?") {
+		separator = "&"
+	}
+
+	http.Redirect(w, r, a.request.RedirectUri+separator+values.Encode(), http.StatusSeeOther)
+}
+
+func (a authorization) redirectError(w http.ResponseWriter, r *http.Request, code string, description string) {
+	a.redirect(w, r, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// Issues a code for the user and sends them back to the client with it.
+func (a authorization) redirectCode(w http.ResponseWriter, r *http.Request, userId string) {
+	code, err := auth.CreateOidcAuthorizationCode(userId, a.request)
+	if err != nil {
+		log.Printf("unable to create authorization code: %v", err)
+		a.redirectError(w, r, "server_error", "unable to create an authorization code")
+		return
+	}
+
+	a.redirect(w, r, url.Values{"code": {code}})
+}
+
+func renderAuthorizeError(w http.ResponseWriter, r *http.Request, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	page.Render(w, r, "oidc/error.html", map[string]interface{}{
+		"Error": message,
+	})
+}
+
+// Reads an authorization request from the query or the consent form. Problems with the client or the
+// redirect URI are shown to the user, since there's nowhere safe to send them; anything else is sent back
+// to the client. Returns false if either has been done.
+func readAuthorization(w http.ResponseWriter, r *http.Request) (authorization, bool) {
+	r.ParseForm()
+
+	a := authorization{
+		state:  r.Form.Get("state"),
+		prompt: r.Form.Get("prompt"),
+	}
+
+	client, err := auth.GetOidcClient(r.Form.Get("client_id"))
+	if err != nil {
+		renderAuthorizeError(w, r, "The application asking you to log in isn't registered with lod2.")
+		return a, false
+	}
+
+	redirectUri := r.Form.Get("redirect_uri")
+	if !client.AllowsRedirectUri(redirectUri) {
+		renderAuthorizeError(w, r, "The application asking you to log in gave an address to return to that isn't registered for it.")
+		return a, false
+	}
+
+	a.client = client
+	a.request = auth.OidcAuthorizationRequest{
+		ClientId:      client.ClientId,
+		RedirectUri:   redirectUri,
+		Nonce:         r.Form.Get("nonce"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		a.redirectError(w, r, "unsupported_response_type", "only the code response type is supported")
+		return a, false
+	}
+
+	if a.request.Scopes, err = auth.ParseOidcScope(r.Form.Get("scope")); err != nil {
+		a.redirectError(w, r, "invalid_scope", err.Error())
+		return a, false
+	}
+
+	if a.request.CodeChallenge == "" || r.Form.Get("code_challenge_method") != "S256" {
+		a.redirectError(w, r, "invalid_request", "PKCE with the S256 method is required")
+		return a, false
+	}
+
+	return a, true
+}
+
+func getAuthorize(w http.ResponseWriter, r *http.Request) {
+	a, ok := readAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	// Only people log in here; an API token isn't someone at a browser.
+	if userInfo == nil || userInfo.SessionId == "" {
+		if a.prompt == "none" {
+			a.redirectError(w, r, "login_required", "the user isn't logged in")
+			return
+		}
+
+		http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	consented, err := auth.HasOidcConsent(userInfo.UserId, a.client.ClientId, a.request.Scopes)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if consented && a.prompt != "consent" {
+		a.redirectCode(w, r, userInfo.UserId)
+		return
+	}
+
+	if a.prompt == "none" {
+		a.redirectError(w, r, "consent_required", "the user hasn't agreed to share this with the client")
+		return
+	}
+
+	scopes := make([]map[string]string, 0, len(a.request.Scopes))
+	for _, scope := range a.request.Scopes {
+		scopes = append(scopes, map[string]string{
+			"Scope":       scope,
+			"Description": auth.OidcScopeDescriptions[scope],
+		})
+	}
+
+	page.Render(w, r, "oidc/consent.html", map[string]interface{}{
+		"Client": a.client,
+		"Scopes": scopes,
+		"Host":   redirectHost(a.request.RedirectUri),
+		"Fields": map[string]string{
+			"client_id":             a.client.ClientId,
+			"redirect_uri":          a.request.RedirectUri,
+			"response_type":         "code",
+			"scope":                 strings.Join(a.request.Scopes, " "),
+			"state":                 a.state,
+			"nonce":                 a.request.Nonce,
+			"code_challenge":        a.request.CodeChallenge,
+			"code_challenge_method": "S256",
+		},
+	})
+}
+
+// Where the user will be sent, to show on the consent screen.
+func redirectHost(redirectUri string) string {
+	parsed, err := url.Parse(redirectUri)
+	if err != nil {
+		return redirectUri
+	}
+
+	return parsed.Host
+}
+
+// The consent form. Only for someone logged in at a browser (see middleware.SessionRequiredMiddleware).
+func postAuthorize(w http.ResponseWriter, r *http.Request) {
+	userInfo := auth.GetCurrentUserInfo(r.Context())
+
+	a, ok := readAuthorization(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Form.Get("decision") != "allow" {
+		a.redirectError(w, r, "access_denied", "the user declined")
+		return
+	}
+
+	if err := auth.GrantOidcConsent(r.Context(), userInfo.UserId, a.client.ClientId, a.request.Scopes); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	a.redirectCode(w, r, userInfo.UserId)
+}
+
+// Reads the client's credentials from HTTP Basic auth, or failing that the form.
+func clientCredentials(r *http.Request) (string, string, bool) {
+	if clientId, clientSecret, ok := r.BasicAuth(); ok {
+		// Both are form-encoded before going into the header.
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		return clientId, clientSecret, true
+	}
+
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), false
+}
+
+func postToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "the request body must be a form")
+		return
+	}
+
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant is supported")
+		return
+	}
+
+	clientId, clientSecret, basic := clientCredentials(r)
+
+	tokens, err := auth.ExchangeOidcCode(r.Context(), clientId, clientSecret, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	switch {
+	case errors.Is(err, auth.ErrOidcInvalidClient):
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lod2"`)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	case errors.Is(err, auth.ErrOidcInvalidGrant):
+		writeError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	case err != nil:
+		log.Printf("unable to issue OIDC tokens: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "unable to issue tokens")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": tokens.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokens.ExpiresIn.Seconds()),
+		"id_token":     tokens.IdToken,
+		"scope":        tokens.Scope,
+	})
+}
+
+func getUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lod2"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", "an access token is required")
+		return
+	}
+
+	claims, err := auth.GetOidcUserInfo(strings.TrimSpace(token))
+	if errors.Is(err, auth.ErrInvalidOidcToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lod2", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	} else if err != nil {
+		log.Printf("unable to look up OIDC user info: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "unable to look up the user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, claims)
+}
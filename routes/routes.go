@@ -1,10 +1,15 @@
 package routes
 
 import (
+	"lod2/middleware"
 	"lod2/page"
 	accountRoutes "lod2/routes/account"
 	adminRoutes "lod2/routes/admin"
+	apiRoutes "lod2/routes/api"
 	authRoutes "lod2/routes/auth"
+	davRoutes "lod2/routes/dav"
+	oidcRoutes "lod2/routes/oidc"
+	shareRoutes "lod2/routes/share"
 	storageRoutes "lod2/routes/storage"
 	"net/http"
 
@@ -13,11 +18,20 @@ import (
 
 func Router() chi.Router {
 	r := chi.NewRouter()
+	r.Use(middleware.CsrfMiddleware())
+	r.Use(middleware.AccountActionRequiredMiddleware())
 
 	r.Mount("/admin", adminRoutes.Router())
 	r.Mount("/account", accountRoutes.Router())
 	r.Mount("/auth", authRoutes.Router())
 	r.Mount("/files", storageRoutes.Router())
+	r.Mount(apiRoutes.Prefix, apiRoutes.Router())
+	r.Mount(davRoutes.Prefix, davRoutes.Handler())
+	r.Mount(shareRoutes.Prefix, shareRoutes.Router())
+	r.Mount(oidcRoutes.Prefix, oidcRoutes.Router())
+
+	r.Get("/.well-known/jwks.json", authRoutes.GetJwks)
+	r.Get("/.well-known/openid-configuration", oidcRoutes.GetDiscovery)
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		page.Render(w, r, "index.html", nil)
@@ -0,0 +1,215 @@
+package share
+
+import (
+	"errors"
+	"lod2/auth"
+	"lod2/page"
+	"lod2/storage"
+	"lod2/utils"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Public share links. Nobody needs to be logged in to follow one; the storage package limits what each
+// request can reach to the shared path.
+
+const Prefix = "/s"
+
+func Router() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/{shareId}", getShare)
+	r.Get("/{shareId}/*", getShare)
+	r.Post("/{shareId}", postSharePassword)
+
+	return r
+}
+
+func unlockCookieName(share storage.Share) string {
+	return "share_" + share.ShareId
+}
+
+// Looks up the share named in the URL, rendering an error page if it doesn't work.
+func openShare(w http.ResponseWriter, r *http.Request) (storage.Share, bool) {
+	share, err := storage.OpenShare(chi.URLParam(r, "shareId"))
+	if errors.Is(err, storage.ErrShareNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		page.Render(w, r, "share/invalid.html", map[string]interface{}{
+			"Error": err.Error(),
+		})
+		return storage.Share{}, false
+	}
+	if err != nil {
+		page.RenderError(w, r, err)
+		return storage.Share{}, false
+	}
+
+	return share, true
+}
+
+func renderPassword(w http.ResponseWriter, r *http.Request, share storage.Share, message string) {
+	page.Render(w, r, "share/password.html", map[string]interface{}{
+		"ShareId": share.ShareId,
+		"Name":    path.Base(share.Path),
+		"Error":   message,
+	})
+}
+
+func getShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := openShare(w, r)
+	if !ok {
+		return
+	}
+
+	if share.HasPassword {
+		cookie, err := r.Cookie(unlockCookieName(share))
+		if err != nil || !share.CheckUnlockToken(cookie.Value) {
+			renderPassword(w, r, share, "")
+			return
+		}
+	}
+
+	relativePath, err := utils.UrlDecode(chi.URLParam(r, "*"))
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	verifiedPath, err := storage.SharePath(share, relativePath)
+	if err != nil {
+		page.NotFound(w, r)
+		return
+	}
+
+	ctx := storage.WithShare(r.Context(), share)
+
+	exists, err := storage.Exists(ctx, verifiedPath)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	if !exists {
+		page.NotFound(w, r)
+		return
+	}
+
+	isDirectory, err := storage.IsDirectory(ctx, verifiedPath)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	storage.RecordShareAccess(share, verifiedPath, r.RemoteAddr, r.UserAgent())
+
+	// The path of this page relative to the share; "" at the top.
+	relativePath = strings.TrimPrefix(strings.TrimPrefix(verifiedPath, share.Path), "/")
+
+	baseUrl := Prefix + "/" + share.ShareId
+	url := baseUrl
+	if relativePath != "" {
+		url += "/" + relativePath
+	}
+
+	data := map[string]interface{}{
+		"Share":        share,
+		"BaseUrl":      baseUrl,
+		"Url":          url,
+		"RelativePath": relativePath,
+		"Name":         path.Base(verifiedPath),
+		"IsDirectory":  isDirectory,
+	}
+
+	if isDirectory {
+		if share.AllowListing {
+			entries, err := storage.ListContents(ctx, verifiedPath)
+			if err != nil {
+				page.RenderError(w, r, err)
+				return
+			}
+
+			data["Entries"] = entries
+		}
+
+		page.Render(w, r, "share/index.html", data)
+		return
+	}
+
+	if r.URL.Query().Get("raw") == "true" {
+		metadata, err := storage.GetMetadata(ctx, verifiedPath)
+		if err != nil {
+			page.RenderError(w, r, err)
+			return
+		}
+
+		// Resuming a download doesn't count as another one, but anything that gets the start of the file does.
+		if storage.ServesFileStart(r, metadata.Size, metadata.LastModified) {
+			if err := storage.CountShareDownload(share); errors.Is(err, storage.ErrShareDownloadLimit) {
+				page.RenderStatus(w, r, http.StatusGone, err.Error())
+				return
+			} else if err != nil {
+				page.RenderError(w, r, err)
+				return
+			}
+		}
+
+		storage.ServeFile(w, r.WithContext(ctx), verifiedPath)
+		return
+	}
+
+	metadata, err := storage.GetMetadata(ctx, verifiedPath)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	data["Size"] = metadata.Size
+	data["LastModified"] = metadata.LastModified
+	data["Type"] = mime.TypeByExtension(path.Ext(verifiedPath))
+
+	page.Render(w, r, "share/index.html", data)
+}
+
+func postSharePassword(w http.ResponseWriter, r *http.Request) {
+	share, ok := openShare(w, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+
+	err := auth.CheckSharePassword(share.ShareId, r.RemoteAddr, func() bool {
+		return share.CheckPassword(r.Form.Get("password"))
+	})
+
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderPassword(w, r, share, err.Error())
+		return
+	} else if errors.Is(err, auth.ErrInvalidSharePassword) {
+		w.WriteHeader(http.StatusUnauthorized)
+		renderPassword(w, r, share, "Incorrect password")
+		return
+	} else if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(share),
+		Value:    share.UnlockToken(),
+		Path:     Prefix + "/" + share.ShareId,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, Prefix+"/"+share.ShareId, http.StatusSeeOther)
+}
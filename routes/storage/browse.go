@@ -2,9 +2,11 @@ package storage
 
 import (
 	"fmt"
+	"lod2/auth"
 	"lod2/page"
 	"lod2/storage"
 	"lod2/utils"
+	"log"
 	"mime"
 	"net/http"
 	"path/filepath"
@@ -48,7 +50,7 @@ func renderBrowseWithTemplate(w http.ResponseWriter, r *http.Request, path strin
 		})
 	}
 
-	exists, err := storage.Exists(path)
+	exists, err := storage.Exists(r.Context(), path)
 	if err != nil {
 		page.RenderError(w, r, err)
 		return
@@ -59,21 +61,36 @@ func renderBrowseWithTemplate(w http.ResponseWriter, r *http.Request, path strin
 		return
 	}
 
-	isDirectory, err := storage.IsDirectory(path)
+	isDirectory, err := storage.IsDirectory(r.Context(), path)
 	if err != nil {
 		renderError("failed to check if this is a directory")
 		return
 	}
 
+	accessLevel, err := storage.GetAccessLevel(r.Context(), path)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
 	data := map[string]interface{}{
 		"Path":            path,
 		"Name":            displayName,
 		"PathBreadcrumbs": storage.GetPathBreadcrumbs(path),
 		"IsDirectory":     isDirectory,
+		"CanEdit":         accessLevel >= auth.Edit,
+	}
+
+	shares, err := getShareItems(r, path)
+	if err != nil {
+		renderError("failed to list share links")
+		return
 	}
 
+	data["Shares"] = shares
+
 	if isDirectory {
-		entries, err := storage.ListContents(path)
+		entries, err := storage.ListContents(r.Context(), path)
 		if err != nil {
 			renderError("failed to list contents")
 			return
@@ -81,7 +98,7 @@ func renderBrowseWithTemplate(w http.ResponseWriter, r *http.Request, path strin
 
 		data["Entries"] = entries
 	} else {
-		metadata, err := storage.GetMetadata(path)
+		metadata, err := storage.GetMetadata(r.Context(), path)
 		if err != nil {
 			renderError("failed to get file metadata")
 			return
@@ -107,6 +124,11 @@ func renderFileTable(w http.ResponseWriter, r *http.Request, path string) {
 }
 
 func getBrowsePath(w http.ResponseWriter, r *http.Request) {
+	// Users registered before home directories existed get one the first time they look.
+	if err := storage.EnsureHomeDirectory(r.Context()); err != nil {
+		log.Printf("unable to create home directory: %v", err)
+	}
+
 	path := chi.URLParam(r, "*")
 	renderBrowsePath(w, r, path)
 }
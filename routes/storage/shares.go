@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"errors"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// A share link along with its full URL.
+type shareItem struct {
+	storage.Share
+	Url string
+}
+
+func sharesRouter() chi.Router {
+	r := chi.NewRouter()
+
+	r.Post("/", postCreateShare)
+	r.Delete("/{shareId}", deleteRevokeShare)
+
+	return r
+}
+
+// Returns the full URL of a share link, the same way auth.GenerateInviteURL does for invites.
+func shareURL(r *http.Request, shareId string) string {
+	scheme := "https"
+	if strings.HasPrefix(r.Host, "localhost") {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + "/s/" + shareId
+}
+
+// Returns the links to a path, ready to be rendered.
+func getShareItems(r *http.Request, path string) ([]shareItem, error) {
+	shares, err := storage.ListShares(r.Context(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]shareItem, 0, len(shares))
+	for _, share := range shares {
+		items = append(items, shareItem{Share: share, Url: shareURL(r, share.ShareId)})
+	}
+
+	return items, nil
+}
+
+func renderShares(w http.ResponseWriter, r *http.Request, path string, message string) {
+	shares, err := getShareItems(r, path)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+
+	isDirectory, err := storage.IsDirectory(r.Context(), path)
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	page.Render(w, r, "storage/fragment-shares.html", map[string]interface{}{
+		"Path":         path,
+		"IsDirectory":  isDirectory,
+		"Shares":       shares,
+		"ShareMessage": message,
+	})
+}
+
+func postCreateShare(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	path := r.Form.Get("path")
+	options := storage.ShareOptions{
+		Password:     r.Form.Get("password"),
+		AllowListing: r.Form.Get("allowListing") == "on",
+	}
+
+	if expiresIn := r.Form.Get("expiresIn"); expiresIn != "" {
+		duration, err := time.ParseDuration(expiresIn)
+		if err != nil {
+			page.RenderStatus(w, r, http.StatusBadRequest, "invalid expiry")
+			return
+		}
+		options.ExpiresAt = time.Now().Add(duration)
+	}
+
+	if maxDownloads := r.Form.Get("maxDownloads"); maxDownloads != "" {
+		count, err := strconv.Atoi(maxDownloads)
+		if err != nil {
+			renderShares(w, r, path, "The download limit must be a number.")
+			return
+		}
+		options.MaxDownloads = count
+	}
+
+	_, err := storage.CreateShare(r.Context(), path, options)
+	if errors.Is(err, storage.ErrAccessDenied) {
+		renderStorageError(w, r, err)
+		return
+	}
+	if err != nil {
+		renderShares(w, r, path, err.Error())
+		return
+	}
+
+	renderShares(w, r, path, "")
+}
+
+func deleteRevokeShare(w http.ResponseWriter, r *http.Request) {
+	err := storage.RevokeShare(r.Context(), chi.URLParam(r, "shareId"))
+
+	switch {
+	case errors.Is(err, storage.ErrShareNotFound):
+		page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrAccessDenied):
+		renderShares(w, r, r.URL.Query().Get("path"), "Only the person who created this link, or someone who can edit this path, can revoke it.")
+	case err != nil:
+		page.RenderError(w, r, err)
+	default:
+		renderShares(w, r, r.URL.Query().Get("path"), "")
+	}
+}
@@ -1,15 +1,23 @@
 package storage
 
 import (
-	"lod2/auth"
+	"errors"
 	"lod2/middleware"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
 
 	"github.com/go-chi/chi/v5"
 )
 
 func Router() chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.AuthRoleRequiredMiddleware(auth.Storage))
+	// Access to each path is checked by the storage package.
+	r.Use(middleware.AuthRequiredMiddleware())
+
+	r.Mount("/.uploads", uploadsRouter())
+	r.Mount("/.trash", trashRouter())
+	r.Mount("/.shares", sharesRouter())
 
 	r.Get("/*", getBrowsePath)
 	r.Post("/*", postUploadPath)
@@ -19,3 +27,15 @@ func Router() chi.Router {
 
 	return r
 }
+
+// Renders an error returned by the storage package with a matching status.
+func renderStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrAccessDenied):
+		page.RenderStatus(w, r, http.StatusForbidden, err.Error())
+	case errors.Is(err, storage.ErrExists):
+		page.RenderStatus(w, r, http.StatusConflict, err.Error())
+	default:
+		page.RenderError(w, r, err)
+	}
+}
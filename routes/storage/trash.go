@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"lod2/auth"
+	"lod2/middleware"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// A trash item along with the name of the user who deleted it.
+type trashItem struct {
+	storage.TrashEntry
+	DeletedByUsername string
+}
+
+func trashRouter() chi.Router {
+	r := chi.NewRouter()
+	// Users only see trashed items from paths they can edit.
+	r.Use(middleware.AuthRequiredMiddleware())
+
+	r.Get("/", getTrash)
+	r.Delete("/", deleteEmptyTrash)
+	r.Post("/{trashId}/restore", postRestoreTrashItem)
+	r.Delete("/{trashId}", deleteTrashItem)
+
+	return r
+}
+
+func renderTrashWithTemplate(w http.ResponseWriter, r *http.Request, template string, message string) {
+	entries, err := storage.ListTrash(r.Context())
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	var totalSize int64
+	usernames := map[string]string{}
+	items := make([]trashItem, 0, len(entries))
+
+	for _, entry := range entries {
+		item := trashItem{TrashEntry: entry}
+
+		if entry.DeletedByUserId != "" {
+			username, found := usernames[entry.DeletedByUserId]
+			if !found {
+				// Deleted users can't be looked up, and are shown as unknown.
+				if user, err := auth.AdminGetUserById(entry.DeletedByUserId); err == nil {
+					username = user.Username
+				}
+				usernames[entry.DeletedByUserId] = username
+			}
+			item.DeletedByUsername = username
+		}
+
+		items = append(items, item)
+		totalSize += entry.Size
+	}
+
+	page.Render(w, r, template, map[string]interface{}{
+		"Entries":   items,
+		"TotalSize": totalSize,
+		"Message":   message,
+	})
+}
+
+func renderTrashTable(w http.ResponseWriter, r *http.Request, message string) {
+	renderTrashWithTemplate(w, r, "storage/trash-table.html", message)
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	renderTrashWithTemplate(w, r, "storage/trash.html", "")
+}
+
+func postRestoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	restoredPath, err := storage.RestoreTrashEntry(r.Context(), chi.URLParam(r, "trashId"), r.Form.Get("dest"))
+
+	switch {
+	case errors.Is(err, storage.ErrTrashEntryNotFound):
+		page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrExists):
+		renderTrashTable(w, r, "Something already exists at that path. Choose another path to restore to.")
+	case errors.Is(err, storage.ErrAccessDenied):
+		renderTrashTable(w, r, "You do not have access to that path. Choose another path to restore to.")
+	case err != nil:
+		page.RenderError(w, r, err)
+	default:
+		renderTrashTable(w, r, "Restored to "+restoredPath)
+	}
+}
+
+func deleteTrashItem(w http.ResponseWriter, r *http.Request) {
+	err := storage.PurgeTrashEntry(r.Context(), chi.URLParam(r, "trashId"))
+
+	if errors.Is(err, storage.ErrTrashEntryNotFound) {
+		page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderTrashTable(w, r, "")
+}
+
+func deleteEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	if err := storage.EmptyTrash(r.Context()); err != nil {
+		page.RenderError(w, r, err)
+		return
+	}
+
+	renderTrashTable(w, r, "")
+}
@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"errors"
 	"io"
 	"lod2/page"
 	"lod2/storage"
@@ -32,7 +31,7 @@ func postUploadPath(w http.ResponseWriter, r *http.Request) {
 
 	uploadPath := filepath.Join(uploadDirectory, fileHeader.Filename)
 
-	exists, err := storage.Exists(uploadPath)
+	exists, err := storage.Exists(r.Context(), uploadPath)
 
 	if err != nil || exists {
 		page.RenderStatus(w, r, http.StatusConflict, "file already exists")
@@ -46,27 +45,21 @@ func postUploadPath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, file)
+	tempFile.Close()
 
-	fileBytes, err := io.ReadAll(file)
 	if err != nil {
 		page.RenderError(w, r, err)
-	}
-
-	tempFile.Write(fileBytes)
-
-	// TODO: this isn't atomic, but it's good enough for now. it'd be hard to maliciously exploit.
-	exists, err = storage.Exists(uploadPath)
-
-	if err != nil || exists {
-		page.RenderError(w, r, errors.New("file already exists"))
 		return
 	}
 
-	err = storage.ImportFile(tempFile.Name(), uploadPath)
+	// ImportFile refuses to overwrite, so a file that appeared while we were receiving this one is safe.
+	err = storage.ImportFile(r.Context(), tempFile.Name(), uploadPath)
 
 	if err != nil {
-		page.RenderError(w, r, err)
+		renderStorageError(w, r, err)
 		return
 	}
 
@@ -82,10 +75,10 @@ func putCreateDirectory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = storage.CreateDirectory(createDirectory)
+	err = storage.CreateDirectory(r.Context(), createDirectory)
 
 	if err != nil {
-		page.RenderError(w, r, err)
+		renderStorageError(w, r, err)
 		return
 	}
 
@@ -117,14 +110,14 @@ func patchMovePath(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If destPath is a directory, append the filename
-	destExists, err := storage.Exists(destPath)
+	destExists, err := storage.Exists(r.Context(), destPath)
 	if err != nil {
 		page.RenderError(w, r, err)
 		return
 	}
 
 	if destExists {
-		destIsDir, err := storage.IsDirectory(destPath)
+		destIsDir, err := storage.IsDirectory(r.Context(), destPath)
 		if err != nil {
 			page.RenderError(w, r, err)
 			return
@@ -140,9 +133,10 @@ func patchMovePath(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = storage.MoveFile(sourcePath, destPath)
+	err = storage.MoveFile(r.Context(), sourcePath, destPath)
+
 	if err != nil {
-		page.RenderError(w, r, err)
+		renderStorageError(w, r, err)
 		return
 	}
 
@@ -159,10 +153,10 @@ func deletePath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = storage.DeleteFile(deletePath)
+	err = storage.DeleteFile(r.Context(), deletePath)
 
 	if err != nil {
-		page.RenderError(w, r, err)
+		renderStorageError(w, r, err)
 		return
 	}
 
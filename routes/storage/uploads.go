@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"lod2/page"
+	"lod2/storage"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads, loosely modeled on the tus protocol (https://tus.io):
+//
+//	POST   /files/.uploads?path=<directory>&name=<filename>&size=<bytes>
+//	       starts an upload; the Location header points at the new upload.
+//	HEAD   /files/.uploads/{uploadId}
+//	       returns the current Upload-Offset and Upload-Length.
+//	PATCH  /files/.uploads/{uploadId}
+//	       appends the body at Upload-Offset. An optional `Upload-Checksum: sha256 <base64>` header
+//	       verifies the chunk; mismatched chunks are discarded so they can be retried.
+//	DELETE /files/.uploads/{uploadId}
+//	       cancels the upload.
+//
+// Once the final chunk is received the file appears in storage.
+
+// The largest single chunk we'll accept; clients split files into chunks smaller than this.
+const maxUploadChunkSize = 64 << 20
+
+// Matches the tus "checksum mismatch" status.
+const statusChecksumMismatch = 460
+
+func uploadsRouter() chi.Router {
+	r := chi.NewRouter()
+
+	r.Post("/", postCreateUpload)
+	r.Head("/{uploadId}", headUpload)
+	r.Patch("/{uploadId}", patchUpload)
+	r.Delete("/{uploadId}", deleteUpload)
+
+	return r
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload storage.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func renderUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, storage.ErrUploadNotFound):
+		page.RenderStatus(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrAccessDenied):
+		page.RenderStatus(w, r, http.StatusForbidden, err.Error())
+	case errors.Is(err, storage.ErrUploadOffsetMismatch), errors.Is(err, storage.ErrExists):
+		page.RenderStatus(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, storage.ErrUploadChecksumMismatch):
+		page.RenderStatus(w, r, statusChecksumMismatch, err.Error())
+	case errors.Is(err, storage.ErrUploadTooLarge), errors.As(err, &maxBytesErr):
+		page.RenderStatus(w, r, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		page.RenderError(w, r, err)
+	}
+}
+
+func postCreateUpload(w http.ResponseWriter, r *http.Request) {
+	directory := r.FormValue("path")
+	name := r.FormValue("name")
+
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		page.RenderStatus(w, r, http.StatusBadRequest, "size parameter required")
+		return
+	}
+
+	if name == "" || name != filepath.Base(name) {
+		page.RenderStatus(w, r, http.StatusBadRequest, "invalid file name")
+		return
+	}
+
+	uploadPath := filepath.Join(directory, name)
+
+	exists, err := storage.Exists(r.Context(), uploadPath)
+	if err != nil || exists {
+		page.RenderStatus(w, r, http.StatusConflict, "file already exists")
+		return
+	}
+
+	upload, err := storage.CreateUpload(r.Context(), uploadPath, size)
+	if err != nil {
+		renderUploadError(w, r, err)
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.Header().Set("Location", "/files/.uploads/"+upload.UploadId)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(upload.UploadId))
+}
+
+func headUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := storage.GetUpload(r.Context(), chi.URLParam(r, "uploadId"))
+	if err != nil {
+		if errors.Is(err, storage.ErrUploadNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Parses an `Upload-Checksum` header. Returns a nil digest if the header is absent.
+func parseUploadChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	algorithm, encoded, found := strings.Cut(header, " ")
+	if !found || algorithm != "sha256" {
+		return nil, errors.New("unsupported checksum algorithm")
+	}
+
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, "Upload-Offset header required")
+		return
+	}
+
+	checksum, err := parseUploadChecksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		page.RenderStatus(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxUploadChunkSize)
+
+	upload, err := storage.WriteUploadChunk(r.Context(), chi.URLParam(r, "uploadId"), offset, body, checksum)
+	if err != nil {
+		if upload.UploadId != "" {
+			setUploadHeaders(w, upload)
+		}
+		renderUploadError(w, r, err)
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	err := storage.CancelUpload(r.Context(), chi.URLParam(r, "uploadId"))
+	if err != nil {
+		renderUploadError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -19,6 +19,15 @@ function sendToast(message) {
   }, 2000);
 }
 
+// The session's CSRF token, which has to be sent with anything other than a GET; see auth/csrf.go.
+function csrfToken() {
+  return q('meta[name="csrf-token"]')?.content ?? "";
+}
+
+function csrfHeaders() {
+  return { "X-CSRF-Token": csrfToken() };
+}
+
 function copyToClipboard(text, message) {
   navigator.clipboard.writeText(text);
   sendToast(message ?? "Copied to clipboard");
@@ -34,64 +34,52 @@ function initDragAndDrop(path) {
       eLastModified.textContent = "uploading...";
     }
 
-    const formData = new FormData();
-    formData.append("file", file);
-
-    const xhr = new XMLHttpRequest();
-    xhr.open("POST", `/files${targetPath}`, true);
-
-    xhr.upload.addEventListener("progress", (e) => {
-      if (e.lengthComputable && eSize) {
-        const progress = e.loaded / e.total;
-        const bytes = e.loaded;
-        const total = e.total;
-        const percentage = Math.round(progress * 100);
+    function setProgress(bytes, total) {
+      if (eSize) {
+        const percentage = total > 0 ? Math.round((bytes / total) * 100) : 100;
         eSize.textContent = `${humanizeBytes(bytes)} / ${humanizeBytes(total)} (${percentage}%)`;
       }
-    });
+    }
 
-    xhr.addEventListener("load", () => {
-      if (xhr.status >= 200 && xhr.status < 300) {
-        if (eName && eSize && eLastModified) {
-          eName.innerHTML = "";
-          const eLink = e(eName, "a", "link file-link");
-          // Properly encode the URL path
-          const encodedPath = path
-            .split("/")
-            .map((p) => (p ? encodeURIComponent(p) : ""))
-            .join("/");
-          eLink.href = `/files${encodedPath}/${encodeURIComponent(file.name)}`;
-          eLink.textContent = file.name;
-
-          eSize.textContent = humanizeBytes(file.size);
-          eLastModified.textContent = "just now";
-        }
-      } else {
-        sendToast(`Upload failed: ${xhr.statusText}`);
-        if (eSize && eLastModified) {
-          eSize.textContent = `failed (${xhr.statusText})`;
-          eLastModified.textContent = "just now";
-        }
+    function onSuccess() {
+      if (eName && eSize && eLastModified) {
+        eName.innerHTML = "";
+        const eLink = e(eName, "a", "link file-link");
+        // Properly encode the URL path
+        const encodedPath = path
+          .split("/")
+          .map((p) => (p ? encodeURIComponent(p) : ""))
+          .join("/");
+        eLink.href = `/files${encodedPath}/${encodeURIComponent(file.name)}`;
+        eLink.textContent = file.name;
+
+        eSize.textContent = humanizeBytes(file.size);
+        eLastModified.textContent = "just now";
       }
-      window.removeEventListener("beforeunload", warnWhenLeaving);
-    });
+    }
 
-    xhr.addEventListener("error", () => {
-      sendToast(`Upload failed: Network error`);
+    function onFailure(reason) {
+      sendToast(`Upload failed: ${reason}`);
       if (eSize && eLastModified) {
-        eSize.textContent = `failed (network error)`;
+        eSize.textContent = `failed (${reason})`;
         eLastModified.textContent = "just now";
       }
-      window.removeEventListener("beforeunload", warnWhenLeaving);
-    });
+    }
 
     window.addEventListener("beforeunload", warnWhenLeaving);
-    xhr.send(formData);
+
+    resumableUpload(file, targetPath, setProgress)
+      .then(onSuccess)
+      .catch((error) => onFailure(error.message))
+      .finally(() => {
+        window.removeEventListener("beforeunload", warnWhenLeaving);
+      });
   }
 
   async function deleteFile(path) {
     const response = await fetch(path, {
       method: "DELETE",
+      headers: csrfHeaders(),
     });
 
     if (response.ok) {
@@ -114,6 +102,7 @@ function initDragAndDrop(path) {
 
     const response = await fetch(patchUrl.toString(), {
       method: "PATCH",
+      headers: csrfHeaders(),
     });
 
     console.log("Move response status:", response.status, response.statusText);
@@ -347,6 +336,7 @@ function initDragAndDrop(path) {
     try {
       const response = await fetch(`/files${path}/${directoryName}`, {
         method: "PUT",
+        headers: csrfHeaders(),
       });
 
       updateFileTable(await response.text());
@@ -356,3 +346,138 @@ function initDragAndDrop(path) {
     }
   });
 }
+
+// Resumable, chunked uploads; see routes/storage/uploads.go for the protocol.
+const UPLOAD_CHUNK_SIZE = 8 << 20;
+const UPLOAD_MAX_RETRIES = 5;
+
+class UploadError extends Error {}
+
+// Uploads `file` into the directory `targetPath`, resuming a previous attempt at the same file
+// if one exists. Calls `onProgress(bytesSent, totalBytes)` as data is sent.
+async function resumableUpload(file, targetPath, onProgress) {
+  const resumeKey = `upload:${targetPath}/${file.name}:${file.size}:${file.lastModified}`;
+
+  let uploadUrl = localStorage.getItem(resumeKey);
+  let offset = uploadUrl ? await getUploadOffset(uploadUrl) : null;
+
+  if (offset == null) {
+    const params = new URLSearchParams({
+      path: targetPath,
+      name: file.name,
+      size: file.size,
+    });
+
+    const response = await fetch(`/files/.uploads?${params}`, {
+      method: "POST",
+      headers: csrfHeaders(),
+    });
+
+    if (!response.ok) {
+      throw new UploadError((await response.text()) || response.statusText);
+    }
+
+    uploadUrl = response.headers.get("Location");
+    offset = 0;
+    localStorage.setItem(resumeKey, uploadUrl);
+  }
+
+  let retries = 0;
+
+  onProgress(offset, file.size);
+
+  while (offset < file.size) {
+    const chunk = file.slice(offset, offset + UPLOAD_CHUNK_SIZE);
+
+    try {
+      offset = await sendUploadChunk(uploadUrl, offset, chunk, (sent) =>
+        onProgress(offset + sent, file.size),
+      );
+      retries = 0;
+    } catch (error) {
+      if (error instanceof UploadError) {
+        localStorage.removeItem(resumeKey);
+        throw error;
+      }
+
+      // Keep the resume key around so dropping the same file again picks up where we left off.
+      if (retries >= UPLOAD_MAX_RETRIES) {
+        throw error;
+      }
+
+      // Wait a bit, then ask the server where to pick up from.
+      retries++;
+      await new Promise((resolve) => setTimeout(resolve, 1000 * 2 ** retries));
+
+      const serverOffset = await getUploadOffset(uploadUrl).catch(() => null);
+      if (serverOffset != null) {
+        offset = serverOffset;
+      }
+    }
+  }
+
+  localStorage.removeItem(resumeKey);
+}
+
+// Returns the offset of an in-progress upload, or null if the server doesn't know about it.
+async function getUploadOffset(uploadUrl) {
+  const response = await fetch(uploadUrl, { method: "HEAD" });
+
+  if (!response.ok) {
+    return null;
+  }
+
+  return parseInt(response.headers.get("Upload-Offset"), 10);
+}
+
+async function uploadChecksum(chunk) {
+  // crypto.subtle is only available in secure contexts; checksums are optional.
+  if (!window.crypto?.subtle) {
+    return null;
+  }
+
+  const digest = await crypto.subtle.digest(
+    "SHA-256",
+    await chunk.arrayBuffer(),
+  );
+  return btoa(String.fromCharCode(...new Uint8Array(digest)));
+}
+
+// Sends a single chunk and resolves to the new upload offset. Rejects with an UploadError if
+// retrying won't help, or a plain Error for transient failures.
+async function sendUploadChunk(uploadUrl, offset, chunk, onProgress) {
+  const checksum = await uploadChecksum(chunk);
+
+  return new Promise((resolve, reject) => {
+    const xhr = new XMLHttpRequest();
+    xhr.open("PATCH", uploadUrl, true);
+    xhr.setRequestHeader("Content-Type", "application/offset+octet-stream");
+    xhr.setRequestHeader("Upload-Offset", offset);
+    xhr.setRequestHeader("X-CSRF-Token", csrfToken());
+
+    if (checksum) {
+      xhr.setRequestHeader("Upload-Checksum", `sha256 ${checksum}`);
+    }
+
+    xhr.upload.addEventListener("progress", (e) => {
+      if (e.lengthComputable) {
+        onProgress(e.loaded);
+      }
+    });
+
+    xhr.addEventListener("load", () => {
+      if (xhr.status >= 200 && xhr.status < 300) {
+        resolve(parseInt(xhr.getResponseHeader("Upload-Offset"), 10));
+      } else if (xhr.status >= 500 || xhr.status === 409 || xhr.status === 460) {
+        // Server hiccup, offset mismatch or corrupted chunk; worth retrying.
+        reject(new Error(xhr.statusText));
+      } else {
+        reject(new UploadError(xhr.responseText || xhr.statusText));
+      }
+    });
+
+    xhr.addEventListener("error", () => reject(new Error("network error")));
+
+    xhr.send(chunk);
+  });
+}
@@ -1,20 +1,42 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/config"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 )
 
 // All public functions operate on _unsafe paths_ provided by the user. All functions
-// here are expected to verify paths and return errors if appropriate.
-func Exists(path string) (bool, error) {
-	filesystemPath, err := DangerousFilesystemPath(path)
+// here are expected to verify paths and return errors if appropriate. The current user is taken from
+// ctx, and every function checks their access to the path (see grants.go).
+func Exists(ctx context.Context, path string) (bool, error) {
+	filesystemPath, err := userFilesystemPath(path)
+	if errors.Is(err, ErrInternalPath) {
+		// As far as users are concerned, internal directories don't exist.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	access, err := loadPathAccess(ctx)
 	if err != nil {
 		return false, err
 	}
 
+	verifiedPath, _ := VerifyPath(path)
+
+	// Nor do paths they can't see.
+	if !access.canSee(verifiedPath) {
+		return false, nil
+	}
+
 	// good case - check if it actually exists
 	if _, err := os.Stat(filesystemPath); os.IsNotExist(err) {
 		return false, nil
@@ -23,13 +45,13 @@ func Exists(path string) (bool, error) {
 	return true, nil
 }
 
-func IsDirectory(path string) (bool, error) {
-	filesystemPath, err := DangerousFilesystemPath(path)
+func IsDirectory(ctx context.Context, path string) (bool, error) {
+	filesystemPath, err := userFilesystemPath(path)
 	if err != nil {
 		return false, err
 	}
 
-	exists, err := Exists(path)
+	exists, err := Exists(ctx, path)
 	if err != nil {
 		return false, err
 	}
@@ -53,47 +75,95 @@ func IsDirectory(path string) (bool, error) {
 	}
 }
 
+// Directories at the storage root that are used internally and never listed.
+var hiddenRootEntries = map[string]bool{
+	".trash":   true,
+	".staging": true,
+}
+
 type Entry struct {
 	// The name of this entry.
-	Name string
+	Name string `json:"name"`
 
-	IsDirectory bool
+	IsDirectory bool `json:"isDirectory"`
 
 	// Size, in bytes; 0 if not a file.
-	Size int64
+	Size int64 `json:"size"`
 
 	// Last modified time.
-	LastModified time.Time
+	LastModified time.Time `json:"lastModified"`
 }
 
-func ListContents(path string) ([]Entry, error) {
-	filesystemPath, err := DangerousFilesystemPath(path)
+// Lists a directory. Users who can't view the directory itself, but have been granted access to
+// something inside it, only see the entries leading there.
+func ListContents(ctx context.Context, path string) ([]Entry, error) {
+	entries, _, err := ListContentsPage(ctx, path, 0, -1)
+	return entries, err
+}
+
+// Like ListContents, but returns only limit entries (or all of them, if limit is negative) starting at
+// offset, along with how many there are in total. Only the entries returned are stat'd, so a page of a
+// huge directory costs little more than reading its names.
+func ListContentsPage(ctx context.Context, path string, offset int, limit int) ([]Entry, int, error) {
+	filesystemPath, err := userFilesystemPath(path)
+
+	if err != nil {
+		return nil, 0, err
+	}
 
+	access, err := loadPathAccess(ctx)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	verifiedPath, _ := VerifyPath(path)
+	canView := access.level(verifiedPath) >= auth.View
+
+	if !canView && !access.leadsToGrant(verifiedPath) {
+		return nil, 0, ErrAccessDenied
 	}
 
 	entries, err := os.ReadDir(filesystemPath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	// Filter out .trash directory only at root level
+	isRoot := filesystemPath == filepath.Clean(config.Config.StoragePath)
+
+	// Filter out internal directories only at root level
 	var filteredEntries []os.DirEntry
 	for _, entry := range entries {
-		// Hide .trash only when we're at the root directory
-		if path == "/" && entry.Name() == ".trash" {
+		// Hide these only when we're at the root directory
+		if isRoot && hiddenRootEntries[entry.Name()] {
+			continue
+		}
+
+		if !canView && !access.canSee(filepath.Join(verifiedPath, entry.Name())) {
 			continue
 		}
 		filteredEntries = append(filteredEntries, entry)
 	}
 
-	results := make([]Entry, len(filteredEntries))
+	// Sort: directories first, then files, both alphabetically
+	sort.Slice(filteredEntries, func(i, j int) bool {
+		if filteredEntries[i].IsDir() != filteredEntries[j].IsDir() {
+			return filteredEntries[i].IsDir() // directories first
+		}
+		return strings.ToLower(filteredEntries[i].Name()) < strings.ToLower(filteredEntries[j].Name())
+	})
+
+	total := len(filteredEntries)
+	page := filteredEntries[min(offset, total):]
+	if limit >= 0 && limit < len(page) {
+		page = page[:limit]
+	}
+
+	results := make([]Entry, len(page))
 
-	for i, entry := range filteredEntries {
+	for i, entry := range page {
 		info, err := entry.Info()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		results[i] = Entry{
@@ -104,23 +174,25 @@ func ListContents(path string) ([]Entry, error) {
 		}
 	}
 
-	// Sort: directories first, then files, both alphabetically
-	sort.Slice(results, func(i, j int) bool {
-		if results[i].IsDirectory != results[j].IsDirectory {
-			return results[i].IsDirectory // directories first
-		}
-		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
-	})
-
-	return results, nil
+	return results, total, nil
 }
 
-func GetMetadata(path string) (Entry, error) {
-	filesystemPath, err := DangerousFilesystemPath(path)
+func GetMetadata(ctx context.Context, path string) (Entry, error) {
+	filesystemPath, err := userFilesystemPath(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	access, err := loadPathAccess(ctx)
 	if err != nil {
 		return Entry{}, err
 	}
 
+	verifiedPath, _ := VerifyPath(path)
+	if !access.canSee(verifiedPath) {
+		return Entry{}, ErrAccessDenied
+	}
+
 	fi, err := os.Stat(filesystemPath)
 	if err != nil {
 		return Entry{}, err
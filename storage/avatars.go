@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"lod2/auth"
+	"lod2/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go.jetify.com/typeid"
+)
+
+// Avatars are kept in the data directory, one file per user named after their ID, rather than in storage
+// where they'd show up in someone's files. The user's avatarUpdatedAt (see auth.SetUserAvatarUpdated) says
+// whether they have one.
+
+// Larger avatars are refused.
+const MaxAvatarSize = 1 << 20
+
+var avatarContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+var ErrInvalidAvatar = errors.New("avatar must be a PNG, JPEG, GIF or WebP image of at most 1 MB")
+var ErrNoAvatar = errors.New("no avatar")
+
+func avatarsDirectory() string {
+	return filepath.Join(config.Config.DataPath, "avatars")
+}
+
+// Returns where the user's avatar is kept, rejecting anything that isn't a user ID so that IDs from
+// requests can never be used to escape the avatars directory.
+func avatarFilesystemPath(userId string) (string, error) {
+	id, err := typeid.FromString(userId)
+	if err != nil || id.Prefix() != "user" {
+		return "", ErrNoAvatar
+	}
+
+	return filepath.Join(avatarsDirectory(), id.String()), nil
+}
+
+// Replaces the user's avatar with the image read from r.
+func SetAvatar(ctx context.Context, userId string, r io.Reader) error {
+	avatarPath, err := avatarFilesystemPath(userId)
+	if err != nil {
+		return err
+	}
+
+	image, err := io.ReadAll(io.LimitReader(r, MaxAvatarSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(image) > MaxAvatarSize || !slices.Contains(avatarContentTypes, http.DetectContentType(image)) {
+		return ErrInvalidAvatar
+	}
+
+	if err := os.MkdirAll(avatarsDirectory(), 0755); err != nil {
+		return err
+	}
+
+	// Written beside it first, so nobody is ever served half an image.
+	temporary, err := os.CreateTemp(avatarsDirectory(), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(image); err != nil {
+		temporary.Close()
+		return err
+	}
+
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temporary.Name(), avatarPath); err != nil {
+		return err
+	}
+
+	return auth.SetUserAvatarUpdated(ctx, userId, true)
+}
+
+// Removes the user's avatar, if they have one.
+func RemoveAvatar(ctx context.Context, userId string) error {
+	avatarPath, err := avatarFilesystemPath(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(avatarPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return auth.SetUserAvatarUpdated(ctx, userId, false)
+}
+
+// Opens the user's avatar, or fails with ErrNoAvatar. The caller must close it.
+func OpenAvatar(userId string) (*os.File, error) {
+	avatarPath, err := avatarFilesystemPath(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(avatarPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoAvatar
+	}
+
+	return file, err
+}
+
+// Responds with the user's avatar, or a 404 if they don't have one.
+func ServeAvatar(w http.ResponseWriter, r *http.Request, userId string) {
+	file, err := OpenAvatar(userId)
+	if errors.Is(err, ErrNoAvatar) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only ever images we've checked, but browsers shouldn't guess otherwise.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/db"
+	"testing"
+
+	"go.jetify.com/typeid"
+)
+
+func TestAvatar_OnlyImagesAreKept(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestDataPath(t)()
+
+	id, _ := typeid.WithPrefix("user")
+	userId := id.String()
+	if _, err := db.DB.Exec("INSERT INTO authUsers (userId, userName, userPasswordHash, createdAt) VALUES (?, ?, '', 0)", userId, "alice"); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	ctx := context.Background()
+
+	if err := SetAvatar(ctx, userId, bytes.NewReader([]byte("<html>not an image</html>"))); !errors.Is(err, ErrInvalidAvatar) {
+		t.Errorf("HTML avatar: got %v, want ErrInvalidAvatar", err)
+	}
+
+	if err := SetAvatar(ctx, "../"+userId, bytes.NewReader([]byte("\x89PNG\r\n\x1a\n"))); err == nil {
+		t.Error("an avatar for something that isn't a user ID should be refused")
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	if err := SetAvatar(ctx, userId, bytes.NewReader(png)); err != nil {
+		t.Fatalf("SetAvatar failed: %v", err)
+	}
+
+	if profile, _ := auth.GetUserProfile(userId); profile.AvatarUpdatedAt.IsZero() {
+		t.Error("AvatarUpdatedAt not set")
+	}
+
+	file, err := OpenAvatar(userId)
+	if err != nil {
+		t.Fatalf("OpenAvatar failed: %v", err)
+	}
+	file.Close()
+
+	if err := RemoveAvatar(ctx, userId); err != nil {
+		t.Fatalf("RemoveAvatar failed: %v", err)
+	}
+
+	if _, err := OpenAvatar(userId); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("after removing: got %v, want ErrNoAvatar", err)
+	}
+}
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"context"
+	"lod2/auth"
 	"log"
 	"os"
 )
 
-func CreateDirectory(path string) error {
-	filesystemPath, err := DangerousFilesystemPath(path)
+func CreateDirectory(ctx context.Context, path string) error {
+	filesystemPath, err := authorizedFilesystemPath(ctx, path, auth.Edit)
 
 	if err != nil {
 		return err
@@ -1,87 +1,349 @@
 package storage
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
+	"io/fs"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/config"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-
-	"go.jetify.com/typeid"
+	"strings"
+	"syscall"
 )
 
-// Given a source path (on the filesystem) and a dest path (within storage), copies it in.
-func ImportFile(sourcePath, destPath string) error {
-	destPath, err := DangerousFilesystemPath(destPath)
+var ErrExists = errors.New("file already exists")
+var ErrCopyIntoItself = errors.New("cannot copy a directory into itself")
+
+// Files being imported are first written here, inside the storage volume, so they can be linked into
+// place atomically. Hidden from listings.
+const stagingDirectory = "/.staging"
+
+// Given a source path (on the filesystem) and a dest path (within storage), moves it in. Never replaces
+// an existing file: if destPath already exists, ErrExists is returned and the source is left in place.
+func ImportFile(ctx context.Context, sourcePath, destPath string) error {
+	destPath, err := authorizedFilesystemPath(ctx, destPath, auth.Edit)
 	if err != nil {
 		return err
 	}
 
+	// Sources are usually temp files, which are private, but stored files aren't.
+	if err := os.Chmod(sourcePath, 0644); err != nil {
+		return err
+	}
+
+	// If the source is on the same filesystem, link it into place directly; no copy needed.
+	err = linkNoClobber(sourcePath, destPath)
+	if err != nil && !errors.Is(err, syscall.EXDEV) && !linkUnsupported(err) {
+		return err
+	}
+
+	if err != nil {
+		// The source is on another filesystem, or this one can't link it. Copy into the storage volume first.
+		stagingPath, err := stageFile(sourcePath)
+		if err != nil {
+			return err
+		}
+
+		err = placeNoClobber(stagingPath, destPath)
+		os.Remove(stagingPath)
+
+		if err != nil {
+			if !errors.Is(err, ErrExists) {
+				log.Printf("Couldn't link staged file into place: %s", err)
+			}
+			return err
+		}
+	}
+
+	syncDirectory(filepath.Dir(destPath))
+
+	// The file is in place, so now delete the original file
+	err = os.Remove(sourcePath)
+	if err != nil {
+		log.Printf("Failed removing original file: %s", err)
+		return err
+	}
+	return nil
+}
+
+// Copies sourcePath into a new file in the staging directory and flushes it to disk.
+// Returns the filesystem path of the staged copy.
+func stageFile(sourcePath string) (string, error) {
+	stagingPath, err := DangerousFilesystemPath(stagingDirectory)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return "", err
+	}
+
 	inputFile, err := os.Open(sourcePath)
 	if err != nil {
 		log.Printf("Couldn't open source file: %s", err)
+		return "", err
+	}
+	defer inputFile.Close()
+
+	stagingFile, err := os.CreateTemp(stagingPath, "import-*.part")
+	if err != nil {
+		log.Printf("Couldn't create staging file: %s", err)
+		return "", err
+	}
+
+	// Only the error from writing matters; close and sync failures are reported together below.
+	err = stagingFile.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(stagingFile, inputFile)
+	}
+	if err == nil {
+		err = stagingFile.Sync()
+	}
+	if closeErr := stagingFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Printf("Writing to staging file failed: %s", err)
+		os.Remove(stagingFile.Name())
+		return "", err
+	}
+
+	return stagingFile.Name(), nil
+}
+
+// Creates a hard link at newPath pointing to oldPath, failing with ErrExists instead of replacing
+// anything already at newPath. Unlike a rename, this can't clobber a file created concurrently.
+func linkNoClobber(oldPath, newPath string) error {
+	err := os.Link(oldPath, newPath)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	return err
+}
+
+// Whether a link failed because the filesystem doesn't do hard links at all (such as FAT, and some network
+// and FUSE mounts), rather than because of anything about this file.
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// Moves a staged file (on the filesystem) to newPath without replacing anything there. Linked where the
+// filesystem allows it; stagedPath is left in place then, so callers should remove it either way.
+func placeNoClobber(stagedPath, newPath string) error {
+	err := linkNoClobber(stagedPath, newPath)
+	if err == nil || !linkUnsupported(err) {
+		return err
+	}
+
+	return renameOverReserved(stagedPath, newPath)
+}
+
+// Claims newPath with an empty file, which fails if anything is already there, and then renames stagedPath
+// over it. Readers may briefly see the empty file, but nothing else can be replaced.
+func renameOverReserved(stagedPath, newPath string) error {
+	reserved, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	} else if err != nil {
+		return err
+	}
+	reserved.Close()
+
+	if err := os.Rename(stagedPath, newPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+
+	return nil
+}
+
+// Flushes directory entries so a newly linked file survives a crash. Best effort.
+func syncDirectory(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	dir.Sync()
+}
+
+// Renames oldPath to newPath (both on the filesystem) without replacing anything already at newPath.
+// Files are linked and then unlinked so the check is atomic. Directories can't be hard linked, so for
+// those we check and then rename, which leaves a small window for a race.
+func renameNoClobber(oldPath, newPath string) error {
+	fi, err := os.Lstat(oldPath)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		if err := linkNoClobber(oldPath, newPath); err != nil {
+			return err
+		}
+		return os.Remove(oldPath)
+	}
+
+	if _, err := os.Lstat(newPath); err == nil {
+		return ErrExists
+	} else if !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
-	outputFile, err := os.Create(destPath)
+
+	return os.Rename(oldPath, newPath)
+}
+
+// Moves a file or directory within storage. Returns ErrExists if something is already at destPath.
+// The current user needs Edit access on both sides.
+func MoveFile(ctx context.Context, sourcePath, destPath string) error {
+	sourceFilesystemPath, err := authorizedFilesystemPath(ctx, sourcePath, auth.Edit)
 	if err != nil {
-		inputFile.Close()
-		log.Printf("Couldn't open dest file: %s", err)
 		return err
 	}
-	defer outputFile.Close()
-	_, err = io.Copy(outputFile, inputFile)
-	inputFile.Close()
+
+	destFilesystemPath, err := authorizedFilesystemPath(ctx, destPath, auth.Edit)
 	if err != nil {
-		log.Printf("Writing to output file failed: %s", err)
 		return err
 	}
-	// The copy was successful, so now delete the original file
-	err = os.Remove(sourcePath)
+
+	if sourceFilesystemPath == filepath.Clean(config.Config.StoragePath) {
+		return errors.New("cannot move the storage root")
+	}
+
+	err = renameNoClobber(sourceFilesystemPath, destFilesystemPath)
 	if err != nil {
-		log.Printf("Failed removing original file: %s", err)
+		log.Printf("Failed moving file: %s", err)
 		return err
 	}
-	return nil
+
+	verifiedSourcePath, _ := VerifyPath(sourcePath)
+	verifiedDestPath, _ := VerifyPath(destPath)
+
+	return audit.Record(ctx, audit.FileMove, verifiedSourcePath, map[string]string{"to": verifiedDestPath})
 }
 
-func MoveFile(sourcePath, destPath string) error {
-	sourcePath, err := DangerousFilesystemPath(sourcePath)
+// Copies a file or directory within storage. Returns ErrExists if something is already at destPath.
+// The current user needs View access to sourcePath and Edit access to destPath. The copy is built in
+// the staging directory and moved into place once complete, so a partial copy is never visible.
+func CopyFile(ctx context.Context, sourcePath, destPath string) error {
+	sourcePath, err := authorizedFilesystemPath(ctx, sourcePath, auth.View)
 	if err != nil {
 		return err
 	}
 
-	destPath, err = DangerousFilesystemPath(destPath)
+	destPath, err = authorizedFilesystemPath(ctx, destPath, auth.Edit)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(sourcePath, destPath)
+	if destPath == sourcePath || strings.HasPrefix(destPath, sourcePath+string(filepath.Separator)) {
+		return ErrCopyIntoItself
+	}
+
+	if _, err := os.Lstat(destPath); err == nil {
+		return ErrExists
+	}
+
+	stagingPath, err := DangerousFilesystemPath(stagingDirectory)
 	if err != nil {
-		log.Printf("Failed moving file: %s", err)
 		return err
 	}
 
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return err
+	}
+
+	copyDirectory, err := os.MkdirTemp(stagingPath, "copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(copyDirectory)
+
+	stagedPath := filepath.Join(copyDirectory, filepath.Base(destPath))
+
+	if err := copyTree(ctx, sourcePath, stagedPath); err != nil {
+		log.Printf("Failed copying file: %s", err)
+		return err
+	}
+
+	if err := renameNoClobber(stagedPath, destPath); err != nil {
+		if !errors.Is(err, ErrExists) {
+			log.Printf("Couldn't move copy into place: %s", err)
+		}
+		return err
+	}
+
+	syncDirectory(filepath.Dir(destPath))
+
 	return nil
 }
 
-func DeleteFile(path string) error {
-	// Generate ISO 8601 timestamp + random suffix for unique trash filename
-	trashId, _ := typeid.WithPrefix("trash")
-	trashPath := fmt.Sprintf("/.trash/%s/%s", trashId.String(), path)
+// Copies the file or directory at sourcePath (on the filesystem) to destPath, which must not exist.
+// Anything that isn't a regular file or directory, such as a symlink, is skipped.
+func copyTree(ctx context.Context, sourcePath, destPath string) error {
+	return filepath.WalkDir(sourcePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-	dir := filepath.Dir(trashPath)
-	log.Printf("creating directory %s (moving file %s to %s)", dir, path, trashPath)
+		// Large copies can take a while; stop if the request that started it has gone away.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	CreateDirectory(dir)
+		relativePath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return err
+		}
 
-	log.Printf("moving file %s to %s", path, trashPath)
+		target := filepath.Join(destPath, relativePath)
 
-	return MoveFile(path, trashPath)
+		switch {
+		case entry.IsDir():
+			return os.Mkdir(target, 0755)
+		case entry.Type().IsRegular():
+			return copyRegularFile(path, target)
+		default:
+			return nil
+		}
+	})
+}
+
+func copyRegularFile(sourcePath, destPath string) error {
+	inputFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(outputFile, inputFile)
+	if err == nil {
+		err = outputFile.Sync()
+	}
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
 }
 
 func ServeFile(w http.ResponseWriter, r *http.Request, path string) {
-	filesystemPath, err := DangerousFilesystemPath(path)
+	filesystemPath, err := authorizedFilesystemPath(r.Context(), path, auth.View)
+	if errors.Is(err, ErrAccessDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"lod2/auth"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempSource(t *testing.T, dir string, content string) string {
+	source, err := os.CreateTemp(dir, "source-*")
+	if err != nil {
+		t.Fatalf("failed to create source file: %v", err)
+	}
+	source.WriteString(content)
+	source.Close()
+	return source.Name()
+}
+
+func TestImportFile_MovesSourceIntoPlace(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+
+	// Same filesystem as the storage root, so this takes the link fast path.
+	source := writeTempSource(t, storageRoot, "fresh")
+
+	if err := ImportFile(testContext("user_a", auth.Edit), source, "/imported.txt"); err != nil {
+		t.Fatalf("ImportFile failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(storageRoot, "imported.txt"))
+	if err != nil || string(content) != "fresh" {
+		t.Errorf("imported content = %q (%v), want %q", content, err, "fresh")
+	}
+
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("source file should be removed after import, stat returned %v", err)
+	}
+
+	// Temp files are created private; stored files shouldn't be.
+	if info, err := os.Stat(filepath.Join(storageRoot, "imported.txt")); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("imported file mode = %v (%v), want 0644", info.Mode().Perm(), err)
+	}
+}
+
+// The fallback for filesystems without hard links.
+func TestRenameOverReserved(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+
+	existing := filepath.Join(storageRoot, "taken.txt")
+	os.WriteFile(existing, []byte("original"), 0o644)
+
+	staged := writeTempSource(t, storageRoot, "staged")
+	if err := renameOverReserved(staged, existing); !errors.Is(err, ErrExists) {
+		t.Errorf("renaming over an existing file = %v, want ErrExists", err)
+	}
+	if content, _ := os.ReadFile(existing); string(content) != "original" {
+		t.Errorf("existing file was modified: %q", content)
+	}
+
+	dest := filepath.Join(storageRoot, "placed.txt")
+	if err := renameOverReserved(staged, dest); err != nil {
+		t.Fatalf("renameOverReserved failed: %v", err)
+	}
+	if content, _ := os.ReadFile(dest); string(content) != "staged" {
+		t.Errorf("placed content = %q, want %q", content, "staged")
+	}
+}
+
+func TestImportFile_NeverOverwrites(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+
+	existing := filepath.Join(storageRoot, "taken.txt")
+	os.WriteFile(existing, []byte("original"), 0o644)
+
+	source := writeTempSource(t, storageRoot, "intruder")
+
+	err := ImportFile(testContext("user_a", auth.Edit), source, "/taken.txt")
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("ImportFile over an existing file = %v, want ErrExists", err)
+	}
+
+	content, _ := os.ReadFile(existing)
+	if string(content) != "original" {
+		t.Errorf("existing file was modified: %q", content)
+	}
+
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("source should be left alone when the import fails: %v", err)
+	}
+}
+
+func TestStageFile_StaysInsideStorageAndHidden(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+
+	source := writeTempSource(t, "", "elsewhere")
+	defer os.Remove(source)
+
+	stagingPath, err := stageFile(source)
+	if err != nil {
+		t.Fatalf("stageFile failed: %v", err)
+	}
+
+	if filepath.Dir(stagingPath) != filepath.Join(storageRoot, stagingDirectory) {
+		t.Errorf("staged file %q should be inside the storage staging directory", stagingPath)
+	}
+
+	content, err := os.ReadFile(stagingPath)
+	if err != nil || string(content) != "elsewhere" {
+		t.Errorf("staged content = %q (%v), want %q", content, err, "elsewhere")
+	}
+
+	listed, err := ListContents(testContext("user_a", auth.Edit), "/")
+	if err != nil {
+		t.Fatalf("ListContents failed: %v", err)
+	}
+
+	for _, entry := range listed {
+		if entry.Name == ".staging" {
+			t.Errorf("the staging directory should not be listed")
+		}
+	}
+}
+
+func TestCopyFile_CopiesTreesWithoutOverwriting(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "src", "inner"), 0755)
+	os.WriteFile(filepath.Join(storageRoot, "src", "inner", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(storageRoot, "other.txt"), []byte("other"), 0644)
+
+	ctx := testContext("user_a", auth.Edit)
+
+	if err := CopyFile(ctx, "/src", "/dest"); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(storageRoot, "dest", "inner", "a.txt")); err != nil || string(content) != "a" {
+		t.Errorf("copied content = %q (%v), want %q", content, err, "a")
+	}
+
+	if _, err := os.Stat(filepath.Join(storageRoot, "src", "inner", "a.txt")); err != nil {
+		t.Errorf("the source should be left in place: %v", err)
+	}
+
+	if err := CopyFile(ctx, "/src/inner/a.txt", "/other.txt"); !errors.Is(err, ErrExists) {
+		t.Errorf("copying onto an existing file = %v, want ErrExists", err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(storageRoot, "other.txt")); string(content) != "other" {
+		t.Errorf("existing file was modified: %q", content)
+	}
+
+	if err := CopyFile(ctx, "/src", "/src/inner/copy"); !errors.Is(err, ErrCopyIntoItself) {
+		t.Errorf("copying a directory into itself = %v, want ErrCopyIntoItself", err)
+	}
+
+	if err := CopyFile(testContext("user_b", auth.View), "/src", "/viewer-copy"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("copying without Edit access = %v, want ErrAccessDenied", err)
+	}
+}
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/db"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.jetify.com/typeid"
+)
+
+// Path-level access control. A user's access to a path is the greater of:
+//   - their Storage role, which applies to the whole storage root
+//   - the grant with the longest path containing it, so a grant deeper in the tree overrides one above it
+//
+// Grants can be given to a user or to a group, in which case every member has them. Where a user has
+// more than one grant for the same path, the highest level applies.
+//
+// Users can also see (but not open) the directories above anything they've been granted, so they can
+// navigate to it; those listings only show the way to their grants.
+
+// storageGrants table has rows:
+// grantId TEXT
+// userId TEXT
+// path TEXT -- a verified path; applies to everything inside it
+// level INTEGER -- an auth.AccessLevel
+// createdAt INTEGER -- unix time
+
+// storageGroupGrants table has the same rows, with groupId TEXT instead of userId.
+
+// Every user gets a home directory at /home/<username> that they can edit.
+const homeDirectory = "/home"
+
+var ErrAccessDenied = errors.New("you do not have access to this path")
+
+type Grant struct {
+	GrantId string
+
+	// Empty for a group's grants.
+	UserId string
+
+	// Set for grants a user has through a group.
+	GroupId   string
+	GroupName string
+
+	// Applies to this path and everything inside it.
+	Path string
+
+	Level auth.AccessLevel
+
+	CreatedAt time.Time
+}
+
+func queryGrants(query string, args ...any) ([]Grant, error) {
+	rows, err := db.DB.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var grants []Grant
+
+	for rows.Next() {
+		var grant Grant
+		var createdAt int64
+
+		if err := rows.Scan(&grant.GrantId, &grant.UserId, &grant.GroupId, &grant.GroupName, &grant.Path, &grant.Level, &createdAt); err != nil {
+			return nil, err
+		}
+
+		grant.CreatedAt = time.Unix(createdAt, 0)
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+// Returns all grants for a user, their own and those of the groups they're in, sorted by path.
+func GetUserGrants(userId string) ([]Grant, error) {
+	return queryGrants(`
+		SELECT grantId, userId, '', '', path, level, createdAt
+		FROM storageGrants
+		WHERE userId = ?
+		UNION ALL
+		SELECT g.grantId, '', g.groupId, gr.name, g.path, g.level, g.createdAt
+		FROM storageGroupGrants AS g
+		JOIN authGroupMembers AS m ON m.groupId = g.groupId
+		JOIN authGroups AS gr ON gr.groupId = g.groupId
+		WHERE m.userId = ?
+		ORDER BY path`, userId, userId)
+}
+
+// Returns all grants for a group, sorted by path.
+func GetGroupGrants(groupId string) ([]Grant, error) {
+	return queryGrants(`
+		SELECT g.grantId, '', g.groupId, gr.name, g.path, g.level, g.createdAt
+		FROM storageGroupGrants AS g
+		JOIN authGroups AS gr ON gr.groupId = g.groupId
+		WHERE g.groupId = ?
+		ORDER BY g.path`, groupId)
+}
+
+// Returns the verified path to grant access to.
+func validateGrant(grantPath string, level auth.AccessLevel) (string, error) {
+	verifiedPath, err := VerifyPath(grantPath)
+	if err != nil {
+		return "", err
+	}
+
+	if isInternalPath(verifiedPath) {
+		return "", ErrInternalPath
+	}
+
+	if level != auth.View && level != auth.Edit {
+		return "", errors.New("invalid access level")
+	}
+
+	return verifiedPath, nil
+}
+
+// Grants a user access to a path, replacing any existing grant for exactly that path.
+func AdminSetGrant(ctx context.Context, userId string, grantPath string, level auth.AccessLevel) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	verifiedPath, err := setGrant(tx, userId, grantPath, level)
+	if err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GrantSet, userId, map[string]interface{}{"path": verifiedPath, "level": level}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the verified path the grant was set on. Takes the database or a transaction.
+func setGrant(exec interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, userId string, grantPath string, level auth.AccessLevel) (string, error) {
+	verifiedPath, err := validateGrant(grantPath, level)
+	if err != nil {
+		return "", err
+	}
+
+	grantId, _ := typeid.WithPrefix("grant")
+
+	_, err = exec.Exec(`
+		INSERT INTO storageGrants (grantId, userId, path, level, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (userId, path) DO UPDATE SET level = excluded.level`,
+		grantId.String(), userId, verifiedPath, level, time.Now().Unix())
+
+	return verifiedPath, err
+}
+
+func AdminDeleteGrant(ctx context.Context, userId string, grantId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var grantPath string
+	err = tx.QueryRow("SELECT path FROM storageGrants WHERE grantId = ? AND userId = ?", grantId, userId).Scan(&grantPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM storageGrants WHERE grantId = ? AND userId = ?", grantId, userId); err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GrantDelete, userId, map[string]string{"grantId": grantId, "path": grantPath}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Grants every member of a group access to a path, replacing any existing grant to the group for exactly
+// that path.
+func AdminSetGroupGrant(ctx context.Context, groupId string, grantPath string, level auth.AccessLevel) error {
+	if _, err := auth.GetGroup(groupId); err != nil {
+		return err
+	}
+
+	verifiedPath, err := validateGrant(grantPath, level)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	grantId, _ := typeid.WithPrefix("grant")
+
+	_, err = tx.Exec(`
+		INSERT INTO storageGroupGrants (grantId, groupId, path, level, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (groupId, path) DO UPDATE SET level = excluded.level`,
+		grantId.String(), groupId, verifiedPath, level, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GrantSet, groupId, map[string]interface{}{"path": verifiedPath, "level": level}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func AdminDeleteGroupGrant(ctx context.Context, groupId string, grantId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var grantPath string
+	err = tx.QueryRow("SELECT path FROM storageGroupGrants WHERE grantId = ? AND groupId = ?", grantId, groupId).Scan(&grantPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM storageGroupGrants WHERE grantId = ? AND groupId = ?", grantId, groupId); err != nil {
+		return err
+	}
+
+	if err := audit.RecordTx(ctx, tx, audit.GrantDelete, groupId, map[string]string{"grantId": grantId, "path": grantPath}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the path of a user's home directory.
+func HomeDirectoryPath(username string) (string, error) {
+	if username == "" || username != path.Base(username) || strings.HasPrefix(username, ".") {
+		return "", errors.New("username can't be used as a directory name")
+	}
+
+	return VerifyPath(path.Join(homeDirectory, username))
+}
+
+// Creates the home directory for the current user if it doesn't exist yet, and grants them Edit access
+// to it. A home directory that already exists is left alone, so a grant an admin has removed stays
+// removed.
+func EnsureHomeDirectory(ctx context.Context) error {
+	userInfo := auth.GetCurrentUserInfo(ctx)
+	if userInfo == nil {
+		return ErrAccessDenied
+	}
+
+	return CreateHomeDirectory(userInfo.UserId, userInfo.Username)
+}
+
+// Creates a user's home directory if it doesn't exist yet, and grants them Edit access to it.
+func CreateHomeDirectory(userId string, username string) error {
+	homePath, err := HomeDirectoryPath(username)
+	if err != nil {
+		return err
+	}
+
+	filesystemPath, err := DangerousFilesystemPath(homePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filesystemPath); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	log.Printf("creating home directory %s", homePath)
+
+	if err := os.MkdirAll(filesystemPath, 0755); err != nil {
+		return err
+	}
+
+	_, err = setGrant(db.DB, userId, homePath, auth.Edit)
+	return err
+}
+
+// Returns true if child is parent or anything inside it. Both must be verified paths.
+func pathContains(parent string, child string) bool {
+	return parent == "/" || child == parent || strings.HasPrefix(child, parent+"/")
+}
+
+// Everything needed to decide what the current user can do.
+type pathAccess struct {
+	roleLevel auth.AccessLevel
+	grants    []Grant
+}
+
+func loadPathAccess(ctx context.Context) (pathAccess, error) {
+	// Someone following a share link can view what was shared and nothing else, whoever they are.
+	if share, ok := ctx.Value(shareContextKey).(Share); ok {
+		return pathAccess{grants: []Grant{{Path: share.Path, Level: auth.View}}}, nil
+	}
+
+	userInfo := auth.GetCurrentUserInfo(ctx)
+	if userInfo == nil {
+		return pathAccess{}, nil
+	}
+
+	access, err := userPathAccess(userInfo.UserId, userInfo.Roles)
+	if err != nil {
+		return pathAccess{}, err
+	}
+
+	// An API token can't reach further through grants than its Storage role allows.
+	if userInfo.TokenRoles != nil {
+		tokenLevel := auth.GetRoleMap(userInfo.TokenRoles)[auth.Storage]
+
+		limitedGrants := make([]Grant, 0, len(access.grants))
+		for _, grant := range access.grants {
+			grant.Level = min(grant.Level, tokenLevel)
+			limitedGrants = append(limitedGrants, grant)
+		}
+		access.grants = limitedGrants
+	}
+
+	return access, nil
+}
+
+func userPathAccess(userId string, roles []auth.Role) (pathAccess, error) {
+	access := pathAccess{
+		roleLevel: auth.GetRoleMap(roles)[auth.Storage],
+	}
+
+	// Grants can't add anything to full access.
+	if access.roleLevel >= auth.Edit {
+		return access, nil
+	}
+
+	grants, err := GetUserGrants(userId)
+	if err != nil {
+		return pathAccess{}, err
+	}
+
+	access.grants = grants
+
+	return access, nil
+}
+
+// Returns the level of access to a verified path.
+func (access pathAccess) level(verifiedPath string) auth.AccessLevel {
+	var closest *Grant
+
+	for i, grant := range access.grants {
+		if !pathContains(grant.Path, verifiedPath) {
+			continue
+		}
+
+		if closest == nil || len(grant.Path) > len(closest.Path) || (grant.Path == closest.Path && grant.Level > closest.Level) {
+			closest = &access.grants[i]
+		}
+	}
+
+	if closest != nil && closest.Level > access.roleLevel {
+		return closest.Level
+	}
+
+	return access.roleLevel
+}
+
+// Returns true if the verified path is a directory above something the user can view.
+func (access pathAccess) leadsToGrant(verifiedPath string) bool {
+	for _, grant := range access.grants {
+		if grant.Level >= auth.View && pathContains(verifiedPath, grant.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the user may know the verified path exists.
+func (access pathAccess) canSee(verifiedPath string) bool {
+	return access.level(verifiedPath) >= auth.View || access.leadsToGrant(verifiedPath)
+}
+
+// Returns ErrAccessDenied unless the current user has at least `level` access to the path.
+func checkAccess(ctx context.Context, verifiedPath string, level auth.AccessLevel) error {
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return err
+	}
+
+	if access.level(verifiedPath) < level {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+// Like userFilesystemPath, but also requires the current user to have `level` access to the path.
+func authorizedFilesystemPath(ctx context.Context, userPath string, level auth.AccessLevel) (string, error) {
+	filesystemPath, err := userFilesystemPath(userPath)
+	if err != nil {
+		return "", err
+	}
+
+	verifiedPath, _ := VerifyPath(userPath)
+
+	if err := checkAccess(ctx, verifiedPath, level); err != nil {
+		return "", err
+	}
+
+	return filesystemPath, nil
+}
+
+// Returns the current user's level of access to a path.
+func GetAccessLevel(ctx context.Context, userPath string) (auth.AccessLevel, error) {
+	verifiedPath, err := VerifyPath(userPath)
+	if err != nil {
+		return auth.AccessLevelNone, err
+	}
+
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return auth.AccessLevelNone, err
+	}
+
+	return access.level(verifiedPath), nil
+}
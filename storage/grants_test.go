@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a context for a user with the given Storage role level.
+func testContext(userId string, storageLevel auth.AccessLevel) context.Context {
+	return context.WithValue(context.Background(), auth.UserInfoContextKey, auth.UserInfo{
+		UserId:   userId,
+		Username: userId,
+		Roles:    []auth.Role{{Scope: auth.Storage, Level: storageLevel}},
+	})
+}
+
+func entryNames(entries []Entry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestGrants_LongestPrefixWins(t *testing.T) {
+	access := pathAccess{
+		roleLevel: auth.AccessLevelNone,
+		grants: []Grant{
+			{Path: "/projects", Level: auth.View},
+			{Path: "/projects/foo", Level: auth.Edit},
+			{Path: "/projects/foo/archive", Level: auth.View},
+		},
+	}
+
+	tests := []struct {
+		path  string
+		level auth.AccessLevel
+	}{
+		{"/", auth.AccessLevelNone},
+		{"/projectsfoo", auth.AccessLevelNone},
+		{"/projects", auth.View},
+		{"/projects/bar", auth.View},
+		{"/projects/foo", auth.Edit},
+		{"/projects/foo/src/main.go", auth.Edit},
+		{"/projects/foo/archive/old.zip", auth.View},
+	}
+
+	for _, test := range tests {
+		if level := access.level(test.path); level != test.level {
+			t.Errorf("level(%q) = %v, want %v", test.path, level, test.level)
+		}
+	}
+
+	// The Storage role applies everywhere, and grants only ever add to it.
+	access.roleLevel = auth.View
+	if level := access.level("/elsewhere"); level != auth.View {
+		t.Errorf("role level should apply outside grants, got %v", level)
+	}
+}
+
+func TestGrants_EnforcedOnOperations(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	for _, dir := range []string{"projects/foo", "projects/secret", "shared", "private"} {
+		os.MkdirAll(filepath.Join(storageRoot, dir), 0755)
+	}
+	os.WriteFile(filepath.Join(storageRoot, "shared", "readme.txt"), []byte("hi"), 0644)
+	os.WriteFile(filepath.Join(storageRoot, "projects", "foo", "plan.txt"), []byte("plan"), 0644)
+
+	AdminSetGrant(context.Background(), "user_x", "/projects/foo", auth.Edit)
+	AdminSetGrant(context.Background(), "user_x", "/shared", auth.View)
+
+	ctx := testContext("user_x", auth.AccessLevelNone)
+
+	// The root and /projects only show the way to the grants.
+	root, err := ListContents(ctx, "/")
+	if err != nil {
+		t.Fatalf("ListContents(/) failed: %v", err)
+	}
+	if names := entryNames(root); len(names) != 2 || names[0] != "projects" || names[1] != "shared" {
+		t.Errorf("root listing = %v, want [projects shared]", names)
+	}
+
+	projects, err := ListContents(ctx, "/projects")
+	if err != nil {
+		t.Fatalf("ListContents(/projects) failed: %v", err)
+	}
+	if names := entryNames(projects); len(names) != 1 || names[0] != "foo" {
+		t.Errorf("/projects listing = %v, want [foo]", names)
+	}
+
+	if _, err := ListContents(ctx, "/private"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("listing an ungranted directory = %v, want ErrAccessDenied", err)
+	}
+
+	if exists, _ := Exists(ctx, "/projects/secret"); exists {
+		t.Errorf("ungranted paths should not appear to exist")
+	}
+
+	// View allows reading but not changing.
+	if _, err := ListContents(ctx, "/shared"); err != nil {
+		t.Errorf("listing a viewable directory failed: %v", err)
+	}
+
+	if err := CreateDirectory(ctx, "/shared/new"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("creating in a view-only directory = %v, want ErrAccessDenied", err)
+	}
+
+	if err := DeleteFile(ctx, "/shared/readme.txt"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("deleting from a view-only directory = %v, want ErrAccessDenied", err)
+	}
+
+	// Moves need Edit on both sides.
+	if err := MoveFile(ctx, "/shared/readme.txt", "/projects/foo/readme.txt"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("moving out of a view-only directory = %v, want ErrAccessDenied", err)
+	}
+
+	if err := MoveFile(ctx, "/projects/foo/plan.txt", "/shared/plan.txt"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("moving into a view-only directory = %v, want ErrAccessDenied", err)
+	}
+
+	if err := MoveFile(ctx, "/projects/foo/plan.txt", "/projects/foo/plan-v2.txt"); err != nil {
+		t.Errorf("moving within an editable directory failed: %v", err)
+	}
+}
+
+func TestGrants_HomeDirectory(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	if err := CreateHomeDirectory("user_alice", "alice"); err != nil {
+		t.Fatalf("CreateHomeDirectory failed: %v", err)
+	}
+
+	if fi, err := os.Stat(filepath.Join(storageRoot, "home", "alice")); err != nil || !fi.IsDir() {
+		t.Fatalf("home directory should exist: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), auth.UserInfoContextKey, auth.UserInfo{UserId: "user_alice", Username: "alice"})
+
+	if err := CreateDirectory(ctx, "/home/alice/notes"); err != nil {
+		t.Errorf("creating inside your home directory failed: %v", err)
+	}
+
+	if err := CreateDirectory(ctx, "/home/bob"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("creating outside your home directory = %v, want ErrAccessDenied", err)
+	}
+
+	// Once removed, a grant isn't recreated just because the directory is visited again.
+	grants, _ := GetUserGrants("user_alice")
+	AdminDeleteGrant(context.Background(), "user_alice", grants[0].GrantId)
+
+	if err := EnsureHomeDirectory(ctx); err != nil {
+		t.Fatalf("EnsureHomeDirectory failed: %v", err)
+	}
+
+	if grants, _ := GetUserGrants("user_alice"); len(grants) != 0 {
+		t.Errorf("removed home grant was recreated: %+v", grants)
+	}
+
+	for _, username := range []string{"", "..", ".trash", "a/b"} {
+		if err := CreateHomeDirectory("user_bad", username); err == nil {
+			t.Errorf("CreateHomeDirectory(%q) should fail", username)
+		}
+	}
+}
+
+func TestGrants_TrashOnlyShowsEditablePaths(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "mine"), 0755)
+	os.WriteFile(filepath.Join(storageRoot, "mine", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(storageRoot, "theirs.txt"), []byte("b"), 0644)
+
+	AdminSetGrant(context.Background(), "user_x", "/mine", auth.Edit)
+	ctx := testContext("user_x", auth.AccessLevelNone)
+
+	DeleteFile(ctx, "/mine/a.txt")
+	DeleteFile(fullAccess, "/theirs.txt")
+
+	entries, err := ListTrash(ctx)
+	if err != nil || len(entries) != 1 || entries[0].OriginalPath != "/mine/a.txt" {
+		t.Fatalf("ListTrash = %+v (%v), want only /mine/a.txt", entries, err)
+	}
+
+	all, _ := ListTrash(fullAccess)
+	for _, entry := range all {
+		if entry.OriginalPath == "/theirs.txt" {
+			if err := PurgeTrashEntry(ctx, entry.TrashId); !errors.Is(err, ErrTrashEntryNotFound) {
+				t.Errorf("purging someone else's item = %v, want ErrTrashEntryNotFound", err)
+			}
+
+			if _, err := RestoreTrashEntry(ctx, entry.TrashId, "/mine/theirs.txt"); !errors.Is(err, ErrTrashEntryNotFound) {
+				t.Errorf("restoring someone else's item = %v, want ErrTrashEntryNotFound", err)
+			}
+		}
+	}
+}
+
+func TestGrants_LimitedByApiToken(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "projects"), 0755)
+	AdminSetGrant(context.Background(), "user_a", "/projects", auth.Edit)
+
+	ctx := context.WithValue(context.Background(), auth.UserInfoContextKey, auth.UserInfo{
+		UserId:     "user_a",
+		Username:   "user_a",
+		Roles:      []auth.Role{{Scope: auth.Storage, Level: auth.AccessLevelNone}},
+		TokenRoles: []auth.Role{{Scope: auth.Storage, Level: auth.View}},
+	})
+
+	if level, _ := GetAccessLevel(ctx, "/projects"); level != auth.View {
+		t.Errorf("access through a View token = %v, want View", level)
+	}
+
+	if err := CreateDirectory(ctx, "/projects/new"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("creating a directory with a View token = %v, want ErrAccessDenied", err)
+	}
+}
+
+func TestGrants_FromGroups(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "projects", "foo"), 0755)
+
+	if _, err := db.DB.Exec("INSERT INTO authUsers (userId, userName, userPasswordHash) VALUES ('user_a', 'a', '')"); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	groupId, err := auth.AdminCreateGroup(context.Background(), "Team", "")
+	if err != nil {
+		t.Fatalf("AdminCreateGroup failed: %v", err)
+	}
+
+	if err := AdminSetGroupGrant(context.Background(), groupId, "/projects", auth.Edit); err != nil {
+		t.Fatalf("AdminSetGroupGrant failed: %v", err)
+	}
+	AdminSetGrant(context.Background(), "user_a", "/projects", auth.View)
+
+	ctx := testContext("user_a", auth.AccessLevelNone)
+
+	// Until they're a member, only their own grant counts.
+	if level, _ := GetAccessLevel(ctx, "/projects/foo"); level != auth.View {
+		t.Errorf("access before joining the group = %v, want View", level)
+	}
+
+	if err := auth.AdminAddGroupMember(context.Background(), groupId, "a"); err != nil {
+		t.Fatalf("AdminAddGroupMember failed: %v", err)
+	}
+
+	// The group's grant is for the same path, and the higher level wins.
+	if level, _ := GetAccessLevel(ctx, "/projects/foo"); level != auth.Edit {
+		t.Errorf("access as a member = %v, want Edit", level)
+	}
+
+	grants, _ := GetUserGrants("user_a")
+	if len(grants) != 2 {
+		t.Fatalf("got grants %+v, want the user's own and the group's", grants)
+	}
+
+	if err := auth.AdminDeleteGroup(context.Background(), groupId); err != nil {
+		t.Fatalf("AdminDeleteGroup failed: %v", err)
+	}
+
+	if level, _ := GetAccessLevel(ctx, "/projects/foo"); level != auth.View {
+		t.Errorf("access after the group was deleted = %v, want View", level)
+	}
+}
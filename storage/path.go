@@ -98,6 +98,30 @@ func DangerousFilesystemPath(path string) (string, error) {
 	return filepath.Join(config.Config.StoragePath, verifiedPath), nil
 }
 
+var ErrInternalPath = errors.New("path is reserved for internal use")
+
+// Returns true if the verified path is one of the internal directories at the storage root (see
+// hiddenRootEntries), or anything inside one.
+func isInternalPath(verifiedPath string) bool {
+	firstComponent, _, _ := strings.Cut(strings.TrimPrefix(verifiedPath, "/"), "/")
+	return hiddenRootEntries[firstComponent]
+}
+
+// Like DangerousFilesystemPath, but also rejects the internal directories. Every function that acts on
+// a path provided by a user should use this.
+func userFilesystemPath(path string) (string, error) {
+	verifiedPath, err := VerifyPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	if isInternalPath(verifiedPath) {
+		return "", ErrInternalPath
+	}
+
+	return filepath.Join(config.Config.StoragePath, verifiedPath), nil
+}
+
 type PathBreadcrumb struct {
 	// The relative path up to (and including) this point
 	Path string
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"lod2/auth"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A search match, along with where it was found.
+type SearchResult struct {
+	// The verified path of the match.
+	Path string `json:"path"`
+
+	Entry
+}
+
+// Returns up to `limit` (0 for no limit) files and directories below userPath whose names contain
+// query, ignoring case. Only paths the current user can see are searched.
+func Search(ctx context.Context, userPath string, query string, limit int) ([]SearchResult, error) {
+	filesystemPath, err := userFilesystemPath(userPath)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPath, _ := VerifyPath(userPath)
+	if !access.canSee(rootPath) {
+		return nil, ErrAccessDenied
+	}
+
+	query = strings.ToLower(query)
+	if query == "" {
+		return nil, errors.New("search query is empty")
+	}
+
+	results := []SearchResult{}
+
+	// Stops the walk once enough results are found.
+	errLimitReached := errors.New("limit reached")
+
+	err = filepath.WalkDir(filesystemPath, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip anything that disappeared or can't be read rather than failing the whole search.
+			if walkPath != filesystemPath {
+				return nil
+			}
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(filesystemPath, walkPath)
+		if err != nil || relativePath == "." {
+			return err
+		}
+
+		verifiedPath := path.Join(rootPath, filepath.ToSlash(relativePath))
+
+		if isInternalPath(verifiedPath) || !access.canSee(verifiedPath) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Directories leading to something the user was granted are searched, but aren't results.
+		if access.level(verifiedPath) < auth.View || !strings.Contains(strings.ToLower(entry.Name()), query) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		results = append(results, SearchResult{
+			Path: verifiedPath,
+			Entry: Entry{
+				Name:         entry.Name(),
+				IsDirectory:  entry.IsDir(),
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			},
+		})
+
+		if limit > 0 && len(results) >= limit {
+			return errLimitReached
+		}
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"lod2/auth"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func searchPaths(results []SearchResult) []string {
+	var paths []string
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	return paths
+}
+
+func TestSearch_OnlyFindsVisiblePaths(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "shared", "Reports"), 0755)
+	os.MkdirAll(filepath.Join(storageRoot, "private"), 0755)
+	os.MkdirAll(filepath.Join(storageRoot, ".trash", "report"), 0755)
+	os.WriteFile(filepath.Join(storageRoot, "shared", "Reports", "report-1.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(storageRoot, "private", "report-2.txt"), nil, 0644)
+
+	results, err := Search(testContext("admin", auth.View), "/", "report", 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	want := []string{"/private/report-2.txt", "/shared/Reports", "/shared/Reports/report-1.txt"}
+	if got := searchPaths(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Search = %v, want %v", got, want)
+	}
+
+	AdminSetGrant(context.Background(), "user_a", "/shared", auth.View)
+
+	results, err = Search(testContext("user_a", auth.AccessLevelNone), "/", "report", 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	want = []string{"/shared/Reports", "/shared/Reports/report-1.txt"}
+	if got := searchPaths(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Search with a grant = %v, want %v", got, want)
+	}
+
+	if results, _ := Search(testContext("admin", auth.View), "/", "report", 1); len(results) != 1 {
+		t.Errorf("Search with a limit returned %d results, want 1", len(results))
+	}
+}
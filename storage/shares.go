@@ -0,0 +1,489 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/db"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.jetify.com/typeid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share links give anyone with the link View access to a single path, without an account. A link stops
+// working when it expires, runs out of downloads, is revoked, or its creator loses access to the path.
+//
+// Requests made through a link carry the share in their context (see WithShare), and are checked by
+// the same functions as everything else, so they can never reach outside the shared path.
+
+// storageShares table has rows:
+// shareId TEXT -- also the secret part of the link
+// path TEXT -- a verified path
+// createdByUserId TEXT
+// createdAt INTEGER -- unix time
+// expiresAt INTEGER -- unix time; NULL if the link never expires
+// passwordHash TEXT -- bcrypt; NULL if no password is needed
+// maxDownloads INTEGER -- 0 for no limit
+// downloads INTEGER
+// allowListing INTEGER -- whether directory contents can be listed
+
+// storageShareAccesses table has rows:
+// shareId TEXT
+// path TEXT -- the verified path that was opened
+// accessedAt INTEGER -- unix time
+// remoteAddr TEXT
+// userAgent TEXT
+
+const shareIdPrefix = "share"
+
+type shareContextKeyType struct{}
+
+var shareContextKey = shareContextKeyType{}
+
+var ErrShareNotFound = errors.New("this link does not exist or has expired")
+var ErrShareDownloadLimit = errors.New("this link has reached its download limit")
+
+type Share struct {
+	ShareId string
+
+	// Everything at and below this path is shared.
+	Path string
+
+	CreatedByUserId string
+	CreatedAt       time.Time
+
+	// Zero if the link never expires.
+	ExpiresAt time.Time
+
+	HasPassword  bool
+	passwordHash string
+
+	// 0 for no limit.
+	MaxDownloads int
+	Downloads    int
+
+	// If false, files inside a shared directory can still be downloaded by name, but its contents
+	// aren't listed.
+	AllowListing bool
+
+	// How many times the link has been opened, and when it was last opened.
+	Accesses       int
+	LastAccessedAt time.Time
+}
+
+// Returns true if the link has expired or run out of downloads.
+func (share Share) IsExpired() bool {
+	if !share.ExpiresAt.IsZero() && !time.Now().Before(share.ExpiresAt) {
+		return true
+	}
+
+	return share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads
+}
+
+type ShareOptions struct {
+	// Zero if the link never expires.
+	ExpiresAt time.Time
+
+	// Empty if no password is needed.
+	Password string
+
+	// 0 for no limit.
+	MaxDownloads int
+
+	AllowListing bool
+}
+
+// Creates a link to a path. The current user needs View access to it.
+func CreateShare(ctx context.Context, userPath string, options ShareOptions) (Share, error) {
+	userInfo := auth.GetCurrentUserInfo(ctx)
+	if userInfo == nil {
+		return Share{}, ErrAccessDenied
+	}
+
+	filesystemPath, err := authorizedFilesystemPath(ctx, userPath, auth.View)
+	if err != nil {
+		return Share{}, err
+	}
+
+	if _, err := os.Stat(filesystemPath); err != nil {
+		return Share{}, err
+	}
+
+	if options.MaxDownloads < 0 {
+		return Share{}, errors.New("download limit can't be negative")
+	}
+
+	if !options.ExpiresAt.IsZero() && !options.ExpiresAt.After(time.Now()) {
+		return Share{}, errors.New("expiry must be in the future")
+	}
+
+	verifiedPath, _ := VerifyPath(userPath)
+	shareId, _ := typeid.WithPrefix(shareIdPrefix)
+
+	share := Share{
+		ShareId:         shareId.String(),
+		Path:            verifiedPath,
+		CreatedByUserId: userInfo.UserId,
+		CreatedAt:       time.Now(),
+		ExpiresAt:       options.ExpiresAt,
+		HasPassword:     options.Password != "",
+		MaxDownloads:    options.MaxDownloads,
+		AllowListing:    options.AllowListing,
+	}
+
+	var passwordHash, expiresAt any
+
+	if share.HasPassword {
+		hash, err := bcrypt.GenerateFromPassword([]byte(options.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, err
+		}
+		share.passwordHash = string(hash)
+		passwordHash = share.passwordHash
+	}
+
+	if !share.ExpiresAt.IsZero() {
+		expiresAt = share.ExpiresAt.Unix()
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO storageShares (shareId, path, createdByUserId, createdAt, expiresAt, passwordHash, maxDownloads, allowListing)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		share.ShareId, share.Path, share.CreatedByUserId, share.CreatedAt.Unix(), expiresAt, passwordHash,
+		share.MaxDownloads, share.AllowListing)
+
+	if err != nil {
+		return Share{}, err
+	}
+
+	log.Printf("user %s shared %s as %s", share.CreatedByUserId, share.Path, share.ShareId)
+
+	return share, audit.Record(ctx, audit.ShareCreate, share.Path, map[string]interface{}{
+		"shareId":      share.ShareId,
+		"expiresAt":    share.ExpiresAt,
+		"hasPassword":  share.HasPassword,
+		"maxDownloads": share.MaxDownloads,
+		"allowListing": share.AllowListing,
+	})
+}
+
+const shareColumns = `
+	s.shareId, s.path, s.createdByUserId, s.createdAt, s.expiresAt, s.passwordHash, s.maxDownloads, s.downloads,
+	s.allowListing, COUNT(a.shareId), COALESCE(MAX(a.accessedAt), 0)`
+
+const shareJoins = `
+	FROM storageShares AS s
+	LEFT JOIN storageShareAccesses AS a ON a.shareId = s.shareId`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanShare(row rowScanner) (Share, error) {
+	var share Share
+	var createdAt, lastAccessedAt int64
+	var expiresAt sql.NullInt64
+	var passwordHash sql.NullString
+
+	err := row.Scan(&share.ShareId, &share.Path, &share.CreatedByUserId, &createdAt, &expiresAt, &passwordHash,
+		&share.MaxDownloads, &share.Downloads, &share.AllowListing, &share.Accesses, &lastAccessedAt)
+	if err != nil {
+		return Share{}, err
+	}
+
+	share.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt.Valid {
+		share.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	if lastAccessedAt != 0 {
+		share.LastAccessedAt = time.Unix(lastAccessedAt, 0)
+	}
+	share.HasPassword = passwordHash.Valid
+	share.passwordHash = passwordHash.String
+
+	return share, nil
+}
+
+// Returns every link to exactly this path, newest first. The current user needs View access to it.
+func ListShares(ctx context.Context, userPath string) ([]Share, error) {
+	if _, err := authorizedFilesystemPath(ctx, userPath, auth.View); err != nil {
+		return nil, err
+	}
+
+	verifiedPath, _ := VerifyPath(userPath)
+
+	rows, err := db.DB.Query(`SELECT `+shareColumns+shareJoins+`
+		WHERE s.path = ?
+		GROUP BY s.shareId
+		ORDER BY s.createdAt DESC`, verifiedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var shares []Share
+
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+func getShare(shareId string) (Share, error) {
+	if id, err := typeid.FromString(shareId); err != nil || id.Prefix() != shareIdPrefix {
+		return Share{}, ErrShareNotFound
+	}
+
+	share, err := scanShare(db.DB.QueryRow(`SELECT `+shareColumns+shareJoins+`
+		WHERE s.shareId = ?
+		GROUP BY s.shareId`, shareId))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return Share{}, ErrShareNotFound
+	}
+
+	return share, err
+}
+
+// Deletes a link. Its creator can always revoke it; anyone else needs Edit access to the path.
+func RevokeShare(ctx context.Context, shareId string) error {
+	share, err := getShare(shareId)
+	if err != nil {
+		return err
+	}
+
+	userInfo := auth.GetCurrentUserInfo(ctx)
+	if userInfo == nil {
+		return ErrAccessDenied
+	}
+
+	if userInfo.UserId != share.CreatedByUserId {
+		if err := checkAccess(ctx, share.Path, auth.Edit); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.DB.Exec("DELETE FROM storageShares WHERE shareId = ?", shareId); err != nil {
+		return err
+	}
+
+	log.Printf("user %s revoked share %s of %s", userInfo.UserId, share.ShareId, share.Path)
+
+	return audit.Record(ctx, audit.ShareRevoke, share.Path, map[string]string{"shareId": share.ShareId})
+}
+
+// Looks up a link for someone following it. Returns ErrShareNotFound unless the link still works.
+func OpenShare(shareId string) (Share, error) {
+	share, err := getShare(shareId)
+	if err != nil {
+		return Share{}, err
+	}
+
+	if share.IsExpired() {
+		return Share{}, ErrShareNotFound
+	}
+
+	// A link can't outlive its creator's access.
+	creator, err := auth.AdminGetUserById(share.CreatedByUserId)
+	if err != nil {
+		return Share{}, ErrShareNotFound
+	}
+
+	roles, err := auth.GetUserRoles(creator.UserId)
+	if err != nil {
+		return Share{}, err
+	}
+
+	access, err := userPathAccess(creator.UserId, roles)
+	if err != nil {
+		return Share{}, err
+	}
+
+	if access.level(share.Path) < auth.View {
+		return Share{}, ErrShareNotFound
+	}
+
+	return share, nil
+}
+
+// Returns true if the password is correct for the link.
+func (share Share) CheckPassword(password string) bool {
+	if !share.HasPassword {
+		return true
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(share.passwordHash), []byte(password)) == nil
+}
+
+// Returns a token proving the link's password was entered, to be kept by the visitor's browser. Tokens
+// stop working if the link is recreated with another password.
+func (share Share) UnlockToken() string {
+	sum := sha256.Sum256([]byte(share.ShareId + "\x00" + share.passwordHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns true if the token came from UnlockToken, or the link doesn't need a password.
+func (share Share) CheckUnlockToken(token string) bool {
+	if !share.HasPassword {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(share.UnlockToken())) == 1
+}
+
+// Returns a context in which storage functions act on behalf of someone following the link, who can
+// view the shared path and nothing else.
+func WithShare(ctx context.Context, share Share) context.Context {
+	return context.WithValue(ctx, shareContextKey, share)
+}
+
+// Returns the verified path of something inside a shared path, given its path relative to the share.
+func SharePath(share Share, relativePath string) (string, error) {
+	verifiedPath, err := VerifyPath(path.Join(share.Path, relativePath))
+	if err != nil {
+		return "", err
+	}
+
+	if !pathContains(share.Path, verifiedPath) {
+		return "", ErrAccessDenied
+	}
+
+	return verifiedPath, nil
+}
+
+// Counts a download against the link's limit, returning ErrShareDownloadLimit if it has none left.
+func CountShareDownload(share Share) error {
+	result, err := db.DB.Exec(`
+		UPDATE storageShares SET downloads = downloads + 1
+		WHERE shareId = ? AND (maxDownloads = 0 OR downloads < maxDownloads)`, share.ShareId)
+	if err != nil {
+		return err
+	}
+
+	if count, err := result.RowsAffected(); err == nil && count == 0 {
+		return ErrShareDownloadLimit
+	}
+
+	return nil
+}
+
+// Whether http.ServeContent would send the start of a file of this size for the request, and so whether it
+// counts as a download rather than the rest of one. Follows ServeContent's rules rather than the Range
+// header's text: any spelling of offset 0 is still offset 0, and a Range that isn't honoured (because it
+// asks for more than the whole file, or its If-Range doesn't match) gets the whole file. Anything that
+// doesn't parse counts, to be safe.
+func ServesFileStart(r *http.Request, size int64, modTime time.Time) bool {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return true
+	}
+
+	// http.ServeFile sets no ETag, so only a date can match.
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		date, err := http.ParseTime(ifRange)
+		if err != nil || !date.Equal(modTime.Truncate(time.Second)) {
+			return true
+		}
+	}
+
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return true
+	}
+
+	var total int64
+	ranges, skipped := 0, 0
+
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		startText, endText, ok := strings.Cut(spec, "-")
+		if !ok {
+			return true
+		}
+		startText, endText = strings.TrimSpace(startText), strings.TrimSpace(endText)
+
+		var start, length int64
+		if startText == "" {
+			// The last n bytes.
+			if endText == "" || endText[0] == '-' {
+				return true
+			}
+			n, err := strconv.ParseInt(endText, 10, 64)
+			if n < 0 || err != nil {
+				return true
+			}
+			start = size - min(n, size)
+			length = size - start
+		} else {
+			var err error
+			start, err = strconv.ParseInt(startText, 10, 64)
+			if err != nil || start < 0 {
+				return true
+			}
+			if start >= size {
+				skipped++
+				continue
+			}
+
+			end := size - 1
+			if endText != "" {
+				end, err = strconv.ParseInt(endText, 10, 64)
+				if err != nil || start > end {
+					return true
+				}
+				end = min(end, size-1)
+			}
+			length = end - start + 1
+		}
+
+		if start == 0 {
+			return true
+		}
+
+		ranges++
+		total += length
+	}
+
+	// Ranges that are all past the end get nothing; no ranges at all, or more than the file, get all of it.
+	if ranges == 0 {
+		return skipped == 0
+	}
+	return total > size
+}
+
+// Records that someone opened a path through the link.
+func RecordShareAccess(share Share, verifiedPath string, remoteAddr string, userAgent string) {
+	log.Printf("share %s: %s opened %s", share.ShareId, remoteAddr, verifiedPath)
+
+	_, err := db.DB.Exec(`
+		INSERT INTO storageShareAccesses (shareId, path, accessedAt, remoteAddr, userAgent)
+		VALUES (?, ?, ?, ?, ?)`, share.ShareId, verifiedPath, time.Now().Unix(), remoteAddr, userAgent)
+
+	if err != nil {
+		log.Printf("unable to record access to share %s: %v", share.ShareId, err)
+	}
+}
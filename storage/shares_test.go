@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"lod2/auth"
+	"lod2/db"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Adds a user who can view everything, so links they create keep working.
+func createShareTestUser(t *testing.T, userId string) {
+	if _, err := db.DB.Exec("INSERT INTO authUsers (userId, userName, userPasswordHash) VALUES (?, ?, '')", userId, userId); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	roleId, err := auth.AdminCreateRoleDefinition(context.Background(), "Viewer "+userId, "", []auth.Role{{Scope: auth.Storage, Level: auth.View}})
+	if err != nil {
+		t.Fatalf("failed to create role: %v", err)
+	}
+
+	if err := auth.AdminSetUserRoleIds(context.Background(), userId, []string{roleId}); err != nil {
+		t.Fatalf("failed to set roles: %v", err)
+	}
+}
+
+func TestShares_LimitedToSharedPath(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	createShareTestUser(t, "user_a")
+
+	os.MkdirAll(filepath.Join(storageRoot, "public", "inner"), 0755)
+	os.WriteFile(filepath.Join(storageRoot, "public", "inner", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(storageRoot, "private.txt"), []byte("b"), 0644)
+
+	created, err := CreateShare(testContext("user_a", auth.View), "/public", ShareOptions{AllowListing: true})
+	if err != nil {
+		t.Fatalf("CreateShare failed: %v", err)
+	}
+
+	share, err := OpenShare(created.ShareId)
+	if err != nil {
+		t.Fatalf("OpenShare failed: %v", err)
+	}
+
+	ctx := WithShare(testContext("", auth.AccessLevelNone), share)
+
+	insidePath, err := SharePath(share, "inner/a.txt")
+	if err != nil || insidePath != "/public/inner/a.txt" {
+		t.Fatalf("SharePath = %q (%v), want /public/inner/a.txt", insidePath, err)
+	}
+
+	if exists, _ := Exists(ctx, insidePath); !exists {
+		t.Errorf("files inside the share should be visible")
+	}
+
+	if _, err := SharePath(share, "../private.txt"); err == nil {
+		t.Errorf("SharePath should reject paths outside the share")
+	}
+
+	if exists, _ := Exists(ctx, "/private.txt"); exists {
+		t.Errorf("files outside the share should not be visible")
+	}
+
+	if err := CreateDirectory(ctx, "/public/new"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("creating a directory through a share = %v, want ErrAccessDenied", err)
+	}
+
+	if _, err := CreateShare(testContext("user_b", auth.AccessLevelNone), "/public", ShareOptions{}); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("sharing without access = %v, want ErrAccessDenied", err)
+	}
+}
+
+func TestShares_StopWorking(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	createShareTestUser(t, "user_a")
+	os.WriteFile(filepath.Join(storageRoot, "file.txt"), []byte("a"), 0644)
+
+	creator := testContext("user_a", auth.View)
+
+	limited, _ := CreateShare(creator, "/file.txt", ShareOptions{MaxDownloads: 1})
+	if err := CountShareDownload(limited); err != nil {
+		t.Fatalf("first download failed: %v", err)
+	}
+	if err := CountShareDownload(limited); !errors.Is(err, ErrShareDownloadLimit) {
+		t.Errorf("second download = %v, want ErrShareDownloadLimit", err)
+	}
+	if _, err := OpenShare(limited.ShareId); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("opening a used up link = %v, want ErrShareNotFound", err)
+	}
+
+	expiring, _ := CreateShare(creator, "/file.txt", ShareOptions{ExpiresAt: time.Now().Add(time.Hour)})
+	db.DB.Exec("UPDATE storageShares SET expiresAt = ? WHERE shareId = ?", time.Now().Add(-time.Minute).Unix(), expiring.ShareId)
+	if _, err := OpenShare(expiring.ShareId); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("opening an expired link = %v, want ErrShareNotFound", err)
+	}
+
+	orphaned, _ := CreateShare(creator, "/file.txt", ShareOptions{})
+	db.DB.Exec("DELETE FROM authUserRoles WHERE userId = ?", "user_a")
+	if _, err := OpenShare(orphaned.ShareId); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("opening a link after its creator lost access = %v, want ErrShareNotFound", err)
+	}
+
+	if err := RevokeShare(testContext("user_b", auth.View), orphaned.ShareId); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("revoking someone else's link without Edit = %v, want ErrAccessDenied", err)
+	}
+	if err := RevokeShare(creator, orphaned.ShareId); err != nil {
+		t.Errorf("revoking your own link failed: %v", err)
+	}
+	if _, err := getShare(orphaned.ShareId); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("revoked link still exists: %v", err)
+	}
+}
+
+func TestShares_Password(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	createShareTestUser(t, "user_a")
+	os.WriteFile(filepath.Join(storageRoot, "file.txt"), []byte("a"), 0644)
+
+	created, err := CreateShare(testContext("user_a", auth.View), "/file.txt", ShareOptions{Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("CreateShare failed: %v", err)
+	}
+
+	share, _ := OpenShare(created.ShareId)
+
+	if share.CheckPassword("wrong") || !share.CheckPassword("hunter2") {
+		t.Errorf("CheckPassword accepted the wrong password or rejected the right one")
+	}
+
+	if share.CheckUnlockToken("") || !share.CheckUnlockToken(share.UnlockToken()) {
+		t.Errorf("CheckUnlockToken accepted a missing token or rejected a valid one")
+	}
+
+	RecordShareAccess(share, "/file.txt", "127.0.0.1", "test")
+
+	shares, err := ListShares(testContext("user_a", auth.View), "/file.txt")
+	if err != nil || len(shares) != 1 || shares[0].Accesses != 1 || !shares[0].HasPassword {
+		t.Errorf("ListShares = %+v (%v), want one password protected link opened once", shares, err)
+	}
+}
+
+func TestServesFileStart(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rangeHeader string
+		ifRange     string
+		want        bool
+	}{
+		{"", "", true},
+		{"bytes=0-", "", true},
+		{"bytes=00-", "", true},
+		{"bytes=0000-9", "", true},
+		{"bytes= 0 - 5", "", true},
+		{"bytes=1-", "", false},
+		{"bytes=50-99", "", false},
+		{"bytes=1-,0-0", "", true},
+		{"bytes=-100", "", true},
+		{"bytes=-10", "", false},
+		{"bytes=1-99,2-99", "", true},
+		{"bytes=", "", true},
+		{"bytes=100-", "", false},
+		{"bytes=x-", "", true},
+		{"chunks=1-", "", true},
+		{"bytes=1-", modTime.Format(http.TimeFormat), false},
+		{"bytes=1-", modTime.Add(time.Hour).Format(http.TimeFormat), true},
+		{"bytes=1-", `"etag"`, true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.rangeHeader != "" {
+			r.Header.Set("Range", test.rangeHeader)
+		}
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+
+		if got := ServesFileStart(r, 100, modTime.Add(300*time.Millisecond)); got != test.want {
+			t.Errorf("Range %q, If-Range %q: got %v, want %v", test.rangeHeader, test.ifRange, got, test.want)
+		}
+	}
+}
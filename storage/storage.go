@@ -4,6 +4,7 @@ import (
 	"lod2/config"
 	"log"
 	"os"
+	"time"
 )
 
 func Init() {
@@ -12,4 +13,15 @@ func Init() {
 	} else {
 		log.Printf("storage ready")
 	}
+
+	go runPeriodically(time.Hour, purgeStaleUploads)
+	go runPeriodically(time.Hour, purgeExpiredTrash)
+}
+
+// Calls fn immediately, then once every interval, forever.
+func runPeriodically(interval time.Duration, fn func()) {
+	for {
+		fn()
+		time.Sleep(interval)
+	}
 }
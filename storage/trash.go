@@ -0,0 +1,511 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/config"
+	"lod2/db"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"go.jetify.com/typeid"
+)
+
+// Deleting a file moves it to /.trash/<trashId>/<original path> and records where it came from in the
+// storageTrash table, so it can be listed, restored or permanently deleted later. Old items are purged
+// in the background according to config.Config.Trash. Items found in the trash with no record, such as
+// those deleted before it was kept, are recorded then too.
+//
+// Users only see (and can restore or purge) trashed items from paths they can edit.
+
+// storageTrash table has rows:
+// trashId TEXT -- also the name of the item's directory inside the trash
+// originalPath TEXT -- the verified path the item was deleted from
+// deletedAt INTEGER -- unix time
+// deletedByUserId TEXT -- NULL if unknown
+// size INTEGER -- bytes, including everything inside directories
+// isDirectory INTEGER
+
+const trashDirectory = "/.trash"
+const trashIdPrefix = "trash"
+
+var ErrTrashEntryNotFound = errors.New("item not found in trash")
+
+type TrashEntry struct {
+	TrashId string
+
+	// Where the item was before it was deleted.
+	OriginalPath string
+
+	// The last component of OriginalPath.
+	Name string
+
+	DeletedAt time.Time
+
+	// Empty if unknown.
+	DeletedByUserId string
+
+	// Size, in bytes, including everything inside directories.
+	Size int64
+
+	IsDirectory bool
+}
+
+// Returns the filesystem path of the directory holding a trashed item.
+func trashEntryDirectory(trashId string) (string, error) {
+	id, err := typeid.FromString(trashId)
+	if err != nil || id.Prefix() != trashIdPrefix {
+		return "", ErrTrashEntryNotFound
+	}
+
+	return DangerousFilesystemPath(path.Join(trashDirectory, id.String()))
+}
+
+// Returns the filesystem path of the trashed item itself.
+func trashItemPath(entry TrashEntry) (string, error) {
+	directory, err := trashEntryDirectory(entry.TrashId)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, entry.OriginalPath), nil
+}
+
+// Returns the total size of the files at or below filesystemPath.
+func diskUsage(filesystemPath string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(filesystemPath, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// Moves a file or directory into the trash.
+func DeleteFile(ctx context.Context, path string) error {
+	filesystemPath, err := authorizedFilesystemPath(ctx, path, auth.Edit)
+	if err != nil {
+		return err
+	}
+
+	var userId string
+	if userInfo := auth.GetCurrentUserInfo(ctx); userInfo != nil {
+		userId = userInfo.UserId
+	}
+
+	verifiedPath, _ := VerifyPath(path)
+	if verifiedPath == "/" {
+		return errors.New("cannot delete the storage root")
+	}
+
+	fi, err := os.Lstat(filesystemPath)
+	if err != nil {
+		return err
+	}
+
+	size, err := diskUsage(filesystemPath)
+	if err != nil {
+		return err
+	}
+
+	trashId, _ := typeid.WithPrefix(trashIdPrefix)
+
+	entry := TrashEntry{
+		TrashId:         trashId.String(),
+		OriginalPath:    verifiedPath,
+		DeletedAt:       time.Now(),
+		DeletedByUserId: userId,
+		Size:            size,
+		IsDirectory:     fi.IsDir(),
+	}
+
+	trashPath, err := trashItemPath(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		return err
+	}
+
+	log.Printf("moving file %s to %s", path, trashPath)
+
+	if err := os.Rename(filesystemPath, trashPath); err != nil {
+		removeTrashEntryDirectory(entry.TrashId)
+		return err
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO storageTrash (trashId, originalPath, deletedAt, deletedByUserId, size, isDirectory)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.TrashId, entry.OriginalPath, entry.DeletedAt.Unix(), sql.NullString{String: userId, Valid: userId != ""}, entry.Size, entry.IsDirectory)
+
+	if err != nil {
+		// An item in the trash that we have no record of can never be restored, so put it back.
+		log.Printf("unable to record trash item %s; restoring %s: %v", entry.TrashId, path, err)
+		if restoreErr := os.Rename(trashPath, filesystemPath); restoreErr != nil {
+			log.Printf("unable to restore %s from %s: %v", path, trashPath, restoreErr)
+		} else {
+			removeTrashEntryDirectory(entry.TrashId)
+		}
+		return err
+	}
+
+	return audit.Record(ctx, audit.FileDelete, verifiedPath, map[string]string{"trashId": entry.TrashId})
+}
+
+func scanTrashEntry(row interface{ Scan(...any) error }) (TrashEntry, error) {
+	var entry TrashEntry
+	var deletedAt int64
+	var deletedByUserId sql.NullString
+
+	err := row.Scan(&entry.TrashId, &entry.OriginalPath, &deletedAt, &deletedByUserId, &entry.Size, &entry.IsDirectory)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+
+	entry.Name = path.Base(entry.OriginalPath)
+	entry.DeletedAt = time.Unix(deletedAt, 0)
+	entry.DeletedByUserId = deletedByUserId.String
+
+	return entry, nil
+}
+
+// Returns everything in the trash, most recently deleted first.
+func listAllTrash() ([]TrashEntry, error) {
+	rows, err := db.DB.Query(`
+		SELECT trashId, originalPath, deletedAt, deletedByUserId, size, isDirectory
+		FROM storageTrash
+		ORDER BY deletedAt DESC, trashId DESC`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries []TrashEntry
+
+	for rows.Next() {
+		entry, err := scanTrashEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Returns everything in the trash the current user can edit, most recently deleted first.
+func ListTrash(ctx context.Context) ([]TrashEntry, error) {
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := listAllTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	var visible []TrashEntry
+
+	for _, entry := range entries {
+		if access.level(entry.OriginalPath) >= auth.Edit {
+			visible = append(visible, entry)
+		}
+	}
+
+	return visible, nil
+}
+
+// Returns a trashed item, if the current user can edit where it came from.
+func GetTrashEntry(ctx context.Context, trashId string) (TrashEntry, error) {
+	entry, err := getTrashEntry(trashId)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+
+	if err := checkAccess(ctx, entry.OriginalPath, auth.Edit); err != nil {
+		return TrashEntry{}, ErrTrashEntryNotFound
+	}
+
+	return entry, nil
+}
+
+func getTrashEntry(trashId string) (TrashEntry, error) {
+	row := db.DB.QueryRow(`
+		SELECT trashId, originalPath, deletedAt, deletedByUserId, size, isDirectory
+		FROM storageTrash
+		WHERE trashId = ?`, trashId)
+
+	entry, err := scanTrashEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TrashEntry{}, ErrTrashEntryNotFound
+	}
+
+	return entry, err
+}
+
+// Moves an item out of the trash, to destPath if provided or else back where it came from. Missing
+// parent directories are recreated. Returns ErrExists if something is already at the destination, in
+// which case the item stays in the trash. Returns the path the item was restored to.
+func RestoreTrashEntry(ctx context.Context, trashId string, destPath string) (string, error) {
+	entry, err := GetTrashEntry(ctx, trashId)
+	if err != nil {
+		return "", err
+	}
+
+	if destPath == "" {
+		destPath = entry.OriginalPath
+	}
+
+	destFilesystemPath, err := authorizedFilesystemPath(ctx, destPath, auth.Edit)
+	if err != nil {
+		return "", err
+	}
+
+	verifiedDestPath, _ := VerifyPath(destPath)
+	if verifiedDestPath == "/" {
+		return "", ErrExists
+	}
+
+	trashPath, err := trashItemPath(entry)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destFilesystemPath), 0755); err != nil {
+		return "", err
+	}
+
+	if err := renameNoClobber(trashPath, destFilesystemPath); err != nil {
+		return "", err
+	}
+
+	log.Printf("restored %s from the trash to %s", entry.OriginalPath, verifiedDestPath)
+
+	if err := forgetTrashEntry(trashId); err != nil {
+		return verifiedDestPath, err
+	}
+
+	return verifiedDestPath, audit.Record(ctx, audit.TrashRestore, verifiedDestPath,
+		map[string]string{"trashId": trashId, "originalPath": entry.OriginalPath})
+}
+
+// Permanently deletes an item in the trash.
+func PurgeTrashEntry(ctx context.Context, trashId string) error {
+	entry, err := GetTrashEntry(ctx, trashId)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("permanently deleting %s from the trash", trashId)
+
+	if err := forgetTrashEntry(trashId); err != nil {
+		return err
+	}
+
+	return audit.Record(ctx, audit.TrashPurge, entry.OriginalPath, map[string]string{"trashId": trashId})
+}
+
+// Permanently deletes everything in the trash that the current user can edit.
+func EmptyTrash(ctx context.Context) error {
+	entries, err := ListTrash(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		log.Printf("permanently deleting %s from the trash", entry.TrashId)
+
+		if err := forgetTrashEntry(entry.TrashId); err != nil {
+			return err
+		}
+	}
+
+	return audit.Record(ctx, audit.TrashEmpty, "", map[string]int{"items": len(entries)})
+}
+
+func removeTrashEntryDirectory(trashId string) error {
+	directory, err := trashEntryDirectory(trashId)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(directory)
+}
+
+// Removes a trash item's directory (and anything left in it) along with its record.
+func forgetTrashEntry(trashId string) error {
+	if err := removeTrashEntryDirectory(trashId); err != nil {
+		return err
+	}
+
+	_, err := db.DB.Exec("DELETE FROM storageTrash WHERE trashId = ?", trashId)
+	return err
+}
+
+// Trash directories newer than this are left alone by adoptUntrackedTrash, since DeleteFile moves an item in
+// before recording it.
+const untrackedTrashGrace = time.Minute
+
+// Records items in the trash that have no row in storageTrash, such as everything deleted before the table
+// existed, so they can be listed, restored and purged like any other. Items were trashed under their whole
+// original path, but nothing says which part of it was deleted, so a chain of directories that each hold
+// only one thing is taken to be the path of whatever is at the end of it. Restoring that recreates the
+// same files either way. The deletion time is taken from when the item's directory was last changed.
+func adoptUntrackedTrash() error {
+	trashPath, err := DangerousFilesystemPath(trashDirectory)
+	if err != nil {
+		return err
+	}
+
+	directories, err := os.ReadDir(trashPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, directory := range directories {
+		id, err := typeid.FromString(directory.Name())
+		if err != nil || id.Prefix() != trashIdPrefix || !directory.IsDir() {
+			continue
+		}
+
+		if _, err := getTrashEntry(id.String()); !errors.Is(err, ErrTrashEntryNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := directory.Info()
+		if err != nil {
+			return err
+		}
+
+		if time.Since(info.ModTime()) < untrackedTrashGrace {
+			continue
+		}
+
+		itemPath, isDirectory, err := untrackedTrashItem(filepath.Join(trashPath, directory.Name()))
+		if err != nil {
+			return err
+		}
+
+		originalPath, err := filepath.Rel(filepath.Join(trashPath, directory.Name()), itemPath)
+		if err != nil || originalPath == "." {
+			log.Printf("trash item %s is empty; leaving it alone", directory.Name())
+			continue
+		}
+
+		size, err := diskUsage(itemPath)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("recording untracked trash item %s (/%s)", id, filepath.ToSlash(originalPath))
+
+		_, err = db.DB.Exec(`
+			INSERT INTO storageTrash (trashId, originalPath, deletedAt, deletedByUserId, size, isDirectory)
+			VALUES (?, ?, ?, NULL, ?, ?)
+			ON CONFLICT (trashId) DO NOTHING`,
+			id.String(), "/"+filepath.ToSlash(originalPath), info.ModTime().Unix(), size, isDirectory)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Follows a trash item's directory down while each level holds exactly one directory, and returns the
+// filesystem path it ends at and whether that's a directory.
+func untrackedTrashItem(filesystemPath string) (string, bool, error) {
+	for {
+		children, err := os.ReadDir(filesystemPath)
+		if err != nil {
+			return "", false, err
+		}
+
+		if len(children) != 1 {
+			return filesystemPath, true, nil
+		}
+
+		filesystemPath = filepath.Join(filesystemPath, children[0].Name())
+		if !children[0].IsDir() {
+			return filesystemPath, false, nil
+		}
+	}
+}
+
+// Permanently deletes trash items that are past the retention period, then the oldest items until the
+// trash fits within its maximum size.
+func purgeExpiredTrash() {
+	if err := adoptUntrackedTrash(); err != nil {
+		log.Printf("unable to record untracked trash: %v", err)
+	}
+
+	entries, err := listAllTrash()
+	if err != nil {
+		log.Printf("unable to list trash for retention: %v", err)
+		return
+	}
+
+	retention := config.Config.Trash.Retention
+	maxSize := config.Config.Trash.MaxSize
+
+	var kept []TrashEntry
+	var keptSize int64
+
+	for _, entry := range entries {
+		if retention > 0 && time.Since(entry.DeletedAt) > retention {
+			log.Printf("trash item %s (%s) is past retention", entry.TrashId, entry.OriginalPath)
+			if err := forgetTrashEntry(entry.TrashId); err != nil {
+				log.Printf("unable to purge trash item %s: %v", entry.TrashId, err)
+			}
+			continue
+		}
+
+		kept = append(kept, entry)
+		keptSize += entry.Size
+	}
+
+	// kept is newest first, so evict from the end.
+	for maxSize > 0 && keptSize > maxSize && len(kept) > 0 {
+		oldest := kept[len(kept)-1]
+		kept = kept[:len(kept)-1]
+
+		log.Printf("trash is over its size limit; purging %s (%s)", oldest.TrashId, oldest.OriginalPath)
+		if err := forgetTrashEntry(oldest.TrashId); err != nil {
+			log.Printf("unable to purge trash item %s: %v", oldest.TrashId, err)
+			return
+		}
+
+		keptSize -= oldest.Size
+	}
+}
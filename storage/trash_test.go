@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"errors"
+	"lod2/auth"
+	"lod2/config"
+	"lod2/db"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.jetify.com/typeid"
+)
+
+func setupTestDatabase(t *testing.T) func() {
+	tempDir, err := os.MkdirTemp("", "trash_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	if err := db.Open(filepath.Join(tempDir, "test.db")); err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	if err := db.RunMigrations(); err != nil {
+		t.Fatalf("failed to run migrations: %v", err)
+	}
+
+	return func() {
+		db.DB.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+// Full access, and no user ID to record.
+var fullAccess = testContext("", auth.Edit)
+
+func TestTrash_DeleteAndRestore(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.MkdirAll(filepath.Join(storageRoot, "photos"), 0755)
+	os.WriteFile(filepath.Join(storageRoot, "photos", "cat.jpg"), []byte("meow"), 0644)
+
+	if err := DeleteFile(testContext("user_a", auth.Edit), "/photos"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(storageRoot, "photos")); !os.IsNotExist(err) {
+		t.Fatalf("deleted directory should be gone, stat returned %v", err)
+	}
+
+	entries, err := ListTrash(fullAccess)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ListTrash = %v (%v), want one entry", entries, err)
+	}
+
+	entry := entries[0]
+	if entry.OriginalPath != "/photos" || entry.DeletedByUserId != "user_a" || !entry.IsDirectory || entry.Size != 4 {
+		t.Errorf("unexpected trash entry: %+v", entry)
+	}
+
+	restoredPath, err := RestoreTrashEntry(fullAccess, entry.TrashId, "")
+	if err != nil || restoredPath != "/photos" {
+		t.Fatalf("RestoreTrashEntry = %q (%v), want /photos", restoredPath, err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(storageRoot, "photos", "cat.jpg"))
+	if err != nil || string(content) != "meow" {
+		t.Errorf("restored content = %q (%v), want %q", content, err, "meow")
+	}
+
+	if entries, _ := ListTrash(fullAccess); len(entries) != 0 {
+		t.Errorf("trash should be empty after restoring, got %v", entries)
+	}
+}
+
+func TestTrash_RestoreConflict(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	notes := filepath.Join(storageRoot, "notes.txt")
+	os.WriteFile(notes, []byte("old"), 0644)
+
+	if err := DeleteFile(testContext("user_a", auth.Edit), "/notes.txt"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+
+	os.WriteFile(notes, []byte("new"), 0644)
+
+	entries, _ := ListTrash(fullAccess)
+	trashId := entries[0].TrashId
+
+	if _, err := RestoreTrashEntry(fullAccess, trashId, ""); !errors.Is(err, ErrExists) {
+		t.Fatalf("restoring over an existing file = %v, want ErrExists", err)
+	}
+
+	if content, _ := os.ReadFile(notes); string(content) != "new" {
+		t.Errorf("existing file was modified: %q", content)
+	}
+
+	restoredPath, err := RestoreTrashEntry(fullAccess, trashId, "/archive/notes.txt")
+	if err != nil || restoredPath != "/archive/notes.txt" {
+		t.Fatalf("RestoreTrashEntry elsewhere = %q (%v)", restoredPath, err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(storageRoot, "archive", "notes.txt")); string(content) != "old" {
+		t.Errorf("restored content = %q, want %q", content, "old")
+	}
+}
+
+func TestTrash_IsNotReachableAsStorage(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.WriteFile(filepath.Join(storageRoot, "secret.txt"), []byte("shh"), 0644)
+
+	if err := DeleteFile(fullAccess, "/secret.txt"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+
+	if exists, _ := Exists(fullAccess, "/.trash"); exists {
+		t.Errorf("the trash should not be visible as a storage path")
+	}
+
+	if err := DeleteFile(fullAccess, "/.trash"); err == nil {
+		t.Errorf("deleting the trash itself should fail")
+	}
+
+	if err := DeleteFile(fullAccess, "/"); err == nil {
+		t.Errorf("deleting the storage root should fail")
+	}
+
+	if _, err := GetTrashEntry(fullAccess, "../../etc"); !errors.Is(err, ErrTrashEntryNotFound) {
+		t.Errorf("GetTrashEntry with a malformed id = %v, want ErrTrashEntryNotFound", err)
+	}
+}
+
+func TestTrash_PurgeByRetentionAndSize(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	originalTrash := config.Config.Trash
+	defer func() { config.Config.Trash = originalTrash }()
+
+	for _, name := range []string{"old.txt", "middle.txt", "new.txt"} {
+		os.WriteFile(filepath.Join(storageRoot, name), []byte("0123456789"), 0644)
+		if err := DeleteFile(fullAccess, "/"+name); err != nil {
+			t.Fatalf("DeleteFile failed: %v", err)
+		}
+	}
+
+	// Backdate the entries so their order and age are well defined.
+	ages := map[string]time.Duration{"/old.txt": 40 * 24 * time.Hour, "/middle.txt": 2 * time.Hour, "/new.txt": time.Hour}
+	for path, age := range ages {
+		db.DB.Exec("UPDATE storageTrash SET deletedAt = ? WHERE originalPath = ?", time.Now().Add(-age).Unix(), path)
+	}
+
+	config.Config.Trash.Retention = 30 * 24 * time.Hour
+	config.Config.Trash.MaxSize = 15
+
+	purgeExpiredTrash()
+
+	entries, err := ListTrash(fullAccess)
+	if err != nil {
+		t.Fatalf("ListTrash failed: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].OriginalPath != "/new.txt" {
+		t.Fatalf("after purge, trash = %+v, want only /new.txt", entries)
+	}
+
+	trashDir, _ := DangerousFilesystemPath(trashDirectory)
+	items, _ := os.ReadDir(trashDir)
+	if len(items) != 1 {
+		t.Errorf("purged items should be removed from disk, found %d", len(items))
+	}
+}
+
+// Items deleted before storageTrash existed were moved to /.trash/<trashId>/<original path> with no record.
+func TestTrash_AdoptsUntrackedItems(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	originalTrash := config.Config.Trash
+	defer func() { config.Config.Trash = originalTrash }()
+	config.Config.Trash.Retention = 30 * 24 * time.Hour
+	config.Config.Trash.MaxSize = 0
+
+	trashId, _ := typeid.WithPrefix(trashIdPrefix)
+	entryDirectory := filepath.Join(storageRoot, ".trash", trashId.String())
+	os.MkdirAll(filepath.Join(entryDirectory, "photos"), 0755)
+	os.WriteFile(filepath.Join(entryDirectory, "photos", "cat.jpg"), []byte("meow"), 0644)
+	deletedAt := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	os.Chtimes(entryDirectory, deletedAt, deletedAt)
+
+	// Too recent to be anything but a delete in progress.
+	recentId, _ := typeid.WithPrefix(trashIdPrefix)
+	os.MkdirAll(filepath.Join(storageRoot, ".trash", recentId.String(), "recent"), 0755)
+
+	purgeExpiredTrash()
+
+	entries, err := ListTrash(fullAccess)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ListTrash = %+v (%v), want one entry", entries, err)
+	}
+
+	entry := entries[0]
+	if entry.TrashId != trashId.String() || entry.OriginalPath != "/photos/cat.jpg" || entry.IsDirectory || entry.Size != 4 || !entry.DeletedAt.Equal(deletedAt) {
+		t.Errorf("unexpected trash entry: %+v", entry)
+	}
+
+	if _, err := RestoreTrashEntry(fullAccess, entry.TrashId, ""); err != nil {
+		t.Fatalf("RestoreTrashEntry failed: %v", err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(storageRoot, "photos", "cat.jpg")); string(content) != "meow" {
+		t.Errorf("restored content = %q, want %q", content, "meow")
+	}
+
+	// Old enough to be past retention once recorded.
+	expiredId, _ := typeid.WithPrefix(trashIdPrefix)
+	expiredDirectory := filepath.Join(storageRoot, ".trash", expiredId.String())
+	os.MkdirAll(filepath.Join(expiredDirectory, "old"), 0755)
+	os.WriteFile(filepath.Join(expiredDirectory, "old", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(expiredDirectory, "old", "b.txt"), []byte("b"), 0644)
+	expiredAt := time.Now().Add(-40 * 24 * time.Hour)
+	os.Chtimes(expiredDirectory, expiredAt, expiredAt)
+
+	purgeExpiredTrash()
+
+	if _, err := os.Stat(expiredDirectory); !os.IsNotExist(err) {
+		t.Errorf("an untracked item past retention should be purged, stat returned %v", err)
+	}
+}
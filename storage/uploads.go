@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"lod2/auth"
+	"lod2/config"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.jetify.com/typeid"
+)
+
+// Resumable uploads. Each upload session lives in its own directory under the data path
+// (never inside the storage root) and contains:
+//   - info.json: the session metadata
+//   - data.part: every byte received so far
+//
+// The current offset of an upload is always the size of data.part, so a client can resume
+// by asking for the offset and sending the remainder. Once all bytes have arrived, data.part
+// is imported into storage with ImportFile and the session is removed.
+
+var ErrUploadNotFound = errors.New("upload not found")
+var ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+var ErrUploadChecksumMismatch = errors.New("upload chunk checksum does not match")
+var ErrUploadTooLarge = errors.New("upload chunk exceeds declared upload size")
+
+// Sessions that haven't been touched in this long are deleted.
+const uploadExpirationDuration = 24 * time.Hour
+
+const uploadIdPrefix = "upload"
+const uploadInfoFilename = "info.json"
+const uploadDataFilename = "data.part"
+
+type Upload struct {
+	UploadId string
+
+	// The user who started this upload; nobody else can see or continue it.
+	UserId string
+
+	// The destination path within storage.
+	Path string
+
+	// The total size of the upload, in bytes.
+	Size int64
+
+	// The number of bytes received so far. Not persisted; derived from the data file.
+	Offset int64 `json:"-"`
+
+	CreatedAt time.Time
+}
+
+// Serializes chunk writes so two requests can't append to the same upload at once.
+var uploadLocks sync.Map
+
+func lockUpload(uploadId string) func() {
+	lock, _ := uploadLocks.LoadOrStore(uploadId, &sync.Mutex{})
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func uploadsDirectory() string {
+	return filepath.Join(config.Config.DataPath, "uploads")
+}
+
+// Returns the session directory for an upload, rejecting anything that isn't a valid upload ID
+// so that IDs from requests can never be used to escape the uploads directory.
+func uploadDirectory(uploadId string) (string, error) {
+	id, err := typeid.FromString(uploadId)
+	if err != nil || id.Prefix() != uploadIdPrefix {
+		return "", ErrUploadNotFound
+	}
+
+	return filepath.Join(uploadsDirectory(), id.String()), nil
+}
+
+// Returns the ID of the current user, who owns any uploads they start.
+func uploadUserId(ctx context.Context) (string, error) {
+	userInfo := auth.GetCurrentUserInfo(ctx)
+	if userInfo == nil {
+		return "", ErrAccessDenied
+	}
+
+	return userInfo.UserId, nil
+}
+
+// Starts a new upload session for a file of `size` bytes that will be written to `path` once complete.
+// The current user needs Edit access to `path`, both now and when the upload finishes.
+func CreateUpload(ctx context.Context, path string, size int64) (Upload, error) {
+	userId, err := uploadUserId(ctx)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	path, err = VerifyPath(path)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if _, err := authorizedFilesystemPath(ctx, path, auth.Edit); err != nil {
+		return Upload{}, err
+	}
+
+	if size < 0 {
+		return Upload{}, errors.New("invalid upload size")
+	}
+
+	exists, err := Exists(ctx, path)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if exists {
+		return Upload{}, ErrExists
+	}
+
+	uploadId, _ := typeid.WithPrefix(uploadIdPrefix)
+
+	upload := Upload{
+		UploadId:  uploadId.String(),
+		UserId:    userId,
+		Path:      path,
+		Size:      size,
+		CreatedAt: time.Now(),
+	}
+
+	directory, err := uploadDirectory(upload.UploadId)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return Upload{}, err
+	}
+
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if err := os.WriteFile(filepath.Join(directory, uploadInfoFilename), info, 0o600); err != nil {
+		os.RemoveAll(directory)
+		return Upload{}, err
+	}
+
+	dataFile, err := os.OpenFile(filepath.Join(directory, uploadDataFilename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		os.RemoveAll(directory)
+		return Upload{}, err
+	}
+	dataFile.Close()
+
+	log.Printf("started upload %s (%d bytes) to %s", upload.UploadId, upload.Size, upload.Path)
+
+	// Nothing will ever be sent for an empty file, so finish it right away.
+	if size == 0 {
+		if err := finishUpload(ctx, upload); err != nil {
+			return Upload{}, err
+		}
+	}
+
+	return upload, nil
+}
+
+// Returns the upload with the given ID, if it exists and belongs to the current user.
+func GetUpload(ctx context.Context, uploadId string) (Upload, error) {
+	userId, err := uploadUserId(ctx)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	directory, err := uploadDirectory(uploadId)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	info, err := os.ReadFile(filepath.Join(directory, uploadInfoFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Upload{}, ErrUploadNotFound
+		}
+		return Upload{}, err
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return Upload{}, err
+	}
+
+	if upload.UserId != userId {
+		return Upload{}, ErrUploadNotFound
+	}
+
+	fi, err := os.Stat(filepath.Join(directory, uploadDataFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Upload{}, ErrUploadNotFound
+		}
+		return Upload{}, err
+	}
+
+	upload.Offset = fi.Size()
+
+	return upload, nil
+}
+
+// Appends a chunk to an upload. `offset` must be the current offset of the upload, and if `checksum`
+// is non-nil it must be the SHA-256 digest of the chunk; if it doesn't match, the chunk is discarded.
+// When the final chunk arrives, the file is moved into storage.
+func WriteUploadChunk(ctx context.Context, uploadId string, offset int64, chunk io.Reader, checksum []byte) (Upload, error) {
+	unlock := lockUpload(uploadId)
+	defer unlock()
+
+	upload, err := GetUpload(ctx, uploadId)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch
+	}
+
+	directory, _ := uploadDirectory(uploadId)
+	dataPath := filepath.Join(directory, uploadDataFilename)
+
+	dataFile, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return upload, err
+	}
+
+	// Read at most one byte past the end so we can tell if the client sent too much.
+	remaining := upload.Size - upload.Offset
+	hash := sha256.New()
+	written, err := io.Copy(dataFile, io.TeeReader(io.LimitReader(chunk, remaining+1), hash))
+
+	// Roll back to the previous offset if anything about this chunk was wrong. The client can
+	// then retry the same chunk.
+	discard := func(reason error) (Upload, error) {
+		dataFile.Close()
+		if truncateErr := os.Truncate(dataPath, upload.Offset); truncateErr != nil {
+			log.Printf("unable to roll back upload %s: %v", uploadId, truncateErr)
+		}
+		return upload, reason
+	}
+
+	if err != nil {
+		return discard(err)
+	}
+
+	if written > remaining {
+		return discard(ErrUploadTooLarge)
+	}
+
+	if checksum != nil && !bytes.Equal(hash.Sum(nil), checksum) {
+		return discard(ErrUploadChecksumMismatch)
+	}
+
+	if err := dataFile.Sync(); err != nil {
+		return discard(err)
+	}
+
+	if err := dataFile.Close(); err != nil {
+		return discard(err)
+	}
+
+	upload.Offset += written
+
+	if upload.Offset == upload.Size {
+		if err := finishUpload(ctx, upload); err != nil {
+			return upload, err
+		}
+	}
+
+	return upload, nil
+}
+
+// Moves a completed upload into storage and removes the session.
+func finishUpload(ctx context.Context, upload Upload) error {
+	directory, err := uploadDirectory(upload.UploadId)
+	if err != nil {
+		return err
+	}
+
+	if err := ImportFile(ctx, filepath.Join(directory, uploadDataFilename), upload.Path); err != nil {
+		// Somebody else got there first, or access was revoked; there's no way to complete this upload now.
+		if errors.Is(err, ErrExists) || errors.Is(err, ErrAccessDenied) {
+			uploadLocks.Delete(upload.UploadId)
+			os.RemoveAll(directory)
+		}
+		return err
+	}
+
+	log.Printf("finished upload %s to %s", upload.UploadId, upload.Path)
+
+	uploadLocks.Delete(upload.UploadId)
+	return os.RemoveAll(directory)
+}
+
+// Abandons an upload and deletes everything received so far.
+func CancelUpload(ctx context.Context, uploadId string) error {
+	unlock := lockUpload(uploadId)
+	defer unlock()
+
+	if _, err := GetUpload(ctx, uploadId); err != nil {
+		return err
+	}
+
+	directory, _ := uploadDirectory(uploadId)
+
+	log.Printf("cancelled upload %s", uploadId)
+
+	uploadLocks.Delete(uploadId)
+	return os.RemoveAll(directory)
+}
+
+// Removes upload sessions that haven't received any data in a while.
+func purgeStaleUploads() {
+	entries, err := os.ReadDir(uploadsDirectory())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("unable to list uploads: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		directory, err := uploadDirectory(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fi, err := os.Stat(filepath.Join(directory, uploadDataFilename))
+		if err == nil && time.Since(fi.ModTime()) < uploadExpirationDuration {
+			continue
+		}
+
+		log.Printf("removing stale upload %s", entry.Name())
+
+		if err := os.RemoveAll(directory); err != nil {
+			log.Printf("unable to remove stale upload %s: %v", entry.Name(), err)
+		}
+	}
+}
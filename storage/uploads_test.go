@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"lod2/auth"
+	"lod2/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupTestDataPath(t *testing.T) func() {
+	tempDir, err := os.MkdirTemp("", "uploads_test_*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	originalDataPath := config.Config.DataPath
+	config.Config.DataPath = tempDir
+
+	return func() {
+		config.Config.DataPath = originalDataPath
+		os.RemoveAll(tempDir)
+	}
+}
+
+func checksumOf(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func TestUpload_ChunksAreAssembled(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDataPath(t)()
+
+	content := []byte("hello, resumable world")
+
+	upload, err := CreateUpload(testContext("user_a", auth.Edit), "/greeting.txt", int64(len(content)))
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	first, second := content[:5], content[5:]
+
+	upload, err = WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, 0, bytes.NewReader(first), checksumOf(first))
+	if err != nil {
+		t.Fatalf("first chunk failed: %v", err)
+	}
+
+	if upload.Offset != int64(len(first)) {
+		t.Errorf("offset after first chunk = %d, want %d", upload.Offset, len(first))
+	}
+
+	if _, err := WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, upload.Offset, bytes.NewReader(second), nil); err != nil {
+		t.Fatalf("second chunk failed: %v", err)
+	}
+
+	result, err := os.ReadFile(filepath.Join(storageRoot, "greeting.txt"))
+	if err != nil {
+		t.Fatalf("uploaded file missing: %v", err)
+	}
+
+	if !bytes.Equal(result, content) {
+		t.Errorf("uploaded content = %q, want %q", result, content)
+	}
+
+	if _, err := GetUpload(testContext("user_a", auth.Edit), upload.UploadId); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("upload session should be removed after completion, got %v", err)
+	}
+}
+
+func TestUpload_ChecksumMismatchIsDiscarded(t *testing.T) {
+	_, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDataPath(t)()
+
+	content := []byte("0123456789")
+
+	upload, err := CreateUpload(testContext("user_a", auth.Edit), "/digits.txt", int64(len(content)))
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	_, err = WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, 0, bytes.NewReader(content[:4]), checksumOf([]byte("nope")))
+	if !errors.Is(err, ErrUploadChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	upload, err = GetUpload(testContext("user_a", auth.Edit), upload.UploadId)
+	if err != nil {
+		t.Fatalf("GetUpload failed: %v", err)
+	}
+
+	if upload.Offset != 0 {
+		t.Errorf("offset after rejected chunk = %d, want 0", upload.Offset)
+	}
+
+	// Retrying the same chunk with the right checksum works.
+	upload, err = WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, 0, bytes.NewReader(content[:4]), checksumOf(content[:4]))
+	if err != nil {
+		t.Fatalf("retried chunk failed: %v", err)
+	}
+
+	if upload.Offset != 4 {
+		t.Errorf("offset after retried chunk = %d, want 4", upload.Offset)
+	}
+}
+
+func TestUpload_RejectsWrongOffsetAndOversizedChunks(t *testing.T) {
+	_, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDataPath(t)()
+
+	upload, err := CreateUpload(testContext("user_a", auth.Edit), "/small.txt", 4)
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	if _, err := WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, 2, bytes.NewReader([]byte("ab")), nil); !errors.Is(err, ErrUploadOffsetMismatch) {
+		t.Errorf("expected offset mismatch, got %v", err)
+	}
+
+	if _, err := WriteUploadChunk(testContext("user_a", auth.Edit), upload.UploadId, 0, bytes.NewReader([]byte("abcdef")), nil); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("expected oversized chunk to be rejected, got %v", err)
+	}
+
+	upload, err = GetUpload(testContext("user_a", auth.Edit), upload.UploadId)
+	if err != nil {
+		t.Fatalf("GetUpload failed: %v", err)
+	}
+
+	if upload.Offset != 0 {
+		t.Errorf("offset after rejected chunks = %d, want 0", upload.Offset)
+	}
+}
+
+func TestUpload_IsPrivateToItsUser(t *testing.T) {
+	_, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDataPath(t)()
+
+	upload, err := CreateUpload(testContext("user_a", auth.Edit), "/private.txt", 10)
+	if err != nil {
+		t.Fatalf("CreateUpload failed: %v", err)
+	}
+
+	if _, err := GetUpload(testContext("user_b", auth.Edit), upload.UploadId); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("another user should not see the upload, got %v", err)
+	}
+
+	if err := CancelUpload(testContext("user_b", auth.Edit), upload.UploadId); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("another user should not cancel the upload, got %v", err)
+	}
+}
+
+func TestUpload_RejectsMalformedIds(t *testing.T) {
+	defer setupTestDataPath(t)()
+
+	for _, uploadId := range []string{"", "..", "../../etc", "upload_/../../x", "session_01h455vb4pex5vsknk084sn02q"} {
+		if _, err := GetUpload(testContext("user_a", auth.Edit), uploadId); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("GetUpload(%q) = %v, want ErrUploadNotFound", uploadId, err)
+		}
+	}
+}
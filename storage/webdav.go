@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"lod2/audit"
+	"lod2/auth"
+	"lod2/config"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+)
+
+// A webdav.FileSystem over the storage root, for mounting storage as a network drive. Paths are
+// sandboxed the same way as everywhere else in this package, access is checked for the user in ctx,
+// internal directories are invisible, and deleted items go to the trash.
+type WebdavFileSystem struct{}
+
+var _ webdav.FileSystem = WebdavFileSystem{}
+
+// Resolves a WebDAV path to the filesystem, requiring `level` access. Paths that are invalid, internal
+// or that the user can't see are reported as missing so clients treat them like anything else that
+// isn't there.
+func webdavFilesystemPath(ctx context.Context, op string, name string, level auth.AccessLevel) (string, error) {
+	filesystemPath, err := userFilesystemPath(name)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	verifiedPath, _ := VerifyPath(name)
+
+	if !access.canSee(verifiedPath) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	if access.level(verifiedPath) < level {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+
+	return filesystemPath, nil
+}
+
+func isStorageRoot(filesystemPath string) bool {
+	return filesystemPath == filepath.Clean(config.Config.StoragePath)
+}
+
+func (fileSystem WebdavFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	filesystemPath, err := webdavFilesystemPath(ctx, "mkdir", name, auth.Edit)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("creating directory %s", filesystemPath)
+
+	return os.Mkdir(filesystemPath, 0755)
+}
+
+func (fileSystem WebdavFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	level := auth.View
+	if writing {
+		level = auth.Edit
+	}
+
+	filesystemPath, err := webdavFilesystemPath(ctx, "open", name, auth.AccessLevelNone)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := loadPathAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verifiedPath, _ := VerifyPath(name)
+	canView := access.level(verifiedPath) >= auth.View
+
+	// Replacing a file's contents is done on a staged copy that is swapped in when the file is closed, so
+	// readers never see a half-written file.
+	if writing && flag&os.O_TRUNC != 0 {
+		if access.level(verifiedPath) < level {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		return openStagedWebdavFile(ctx, name, filesystemPath)
+	}
+
+	file, err := os.OpenFile(filesystemPath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories above a grant can be opened to list the way there, but nothing else can.
+	if access.level(verifiedPath) < level {
+		if fi, err := file.Stat(); writing || err != nil || !fi.IsDir() {
+			file.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+	}
+
+	return webdavFile{File: file, verifiedPath: verifiedPath, access: access, canView: canView}, nil
+}
+
+// Moves the item to the trash.
+func (fileSystem WebdavFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if _, err := webdavFilesystemPath(ctx, "remove", name, auth.Edit); err != nil {
+		return err
+	}
+
+	return DeleteFile(ctx, name)
+}
+
+// Never replaces anything; WebDAV clients that want to overwrite delete the destination first.
+func (fileSystem WebdavFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := webdavFilesystemPath(ctx, "rename", oldName, auth.Edit)
+	if err != nil {
+		return err
+	}
+
+	// The destination doesn't exist yet, so only the parent needs to be visible.
+	if _, err := webdavFilesystemPath(ctx, "rename", filepath.Dir(newName), auth.AccessLevelNone); err != nil {
+		return err
+	}
+
+	newPath, err := userFilesystemPath(newName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrNotExist}
+	}
+
+	newVerifiedPath, _ := VerifyPath(newName)
+	if err := checkAccess(ctx, newVerifiedPath, auth.Edit); err != nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+
+	if isStorageRoot(oldPath) || isStorageRoot(newPath) {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+
+	err = renameNoClobber(oldPath, newPath)
+	if errors.Is(err, ErrExists) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	} else if err != nil {
+		return err
+	}
+
+	oldVerifiedPath, _ := VerifyPath(oldName)
+
+	return audit.Record(ctx, audit.FileMove, oldVerifiedPath, map[string]string{"to": newVerifiedPath})
+}
+
+func (fileSystem WebdavFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	filesystemPath, err := webdavFilesystemPath(ctx, "stat", name, auth.AccessLevelNone)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(filesystemPath)
+}
+
+// An opened file or directory. Listings leave out internal directories and anything the user can't see.
+type webdavFile struct {
+	*os.File
+	verifiedPath string
+	access       pathAccess
+
+	// False if this is a directory the user can only pass through on the way to a grant.
+	canView bool
+}
+
+func (directory webdavFile) Readdir(count int) ([]fs.FileInfo, error) {
+	var results []fs.FileInfo
+
+	for {
+		infos, err := directory.File.Readdir(count)
+
+		for _, info := range infos {
+			if directory.verifiedPath == "/" && hiddenRootEntries[info.Name()] {
+				continue
+			}
+
+			if !directory.canView && !directory.access.canSee(path.Join(directory.verifiedPath, info.Name())) {
+				continue
+			}
+
+			results = append(results, info)
+		}
+
+		// When reading in batches, don't return an empty batch just because everything in it was hidden.
+		if err != nil || count <= 0 || len(results) > 0 {
+			return results, err
+		}
+	}
+}
+
+// A file being written in the staging directory that replaces name (at destPath on the filesystem) when
+// closed, moving whatever was there to the trash.
+type stagedWebdavFile struct {
+	*os.File
+	ctx      context.Context
+	name     string
+	destPath string
+}
+
+func openStagedWebdavFile(ctx context.Context, name string, destPath string) (webdav.File, error) {
+	// Match os.OpenFile, which fails if the parent directory is missing.
+	if _, err := os.Stat(filepath.Dir(destPath)); err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(destPath); err == nil && fi.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: destPath, Err: errors.New("is a directory")}
+	}
+
+	stagingPath, err := DangerousFilesystemPath(stagingDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(stagingPath, "webdav-*.part")
+	if err != nil {
+		return nil, err
+	}
+
+	return &stagedWebdavFile{File: file, ctx: ctx, name: name, destPath: destPath}, nil
+}
+
+func (file *stagedWebdavFile) Close() error {
+	defer os.Remove(file.File.Name())
+
+	// Temp files are private, but stored files aren't.
+	err := file.File.Chmod(0644)
+	if err == nil {
+		err = file.File.Sync()
+	}
+	if closeErr := file.File.Close(); err == nil {
+		err = closeErr
+	}
+
+	// The old contents go to the trash like any other delete, so an overwrite can be undone.
+	replaced := false
+	if err == nil {
+		if _, statErr := os.Lstat(file.destPath); statErr == nil {
+			err = DeleteFile(file.ctx, file.name)
+			replaced = true
+		}
+	}
+
+	// Linked rather than renamed so that anything created in the meantime isn't silently replaced.
+	if err == nil {
+		err = placeNoClobber(file.File.Name(), file.destPath)
+	}
+
+	if err != nil {
+		log.Printf("unable to write %s: %v", file.destPath, err)
+		return err
+	}
+
+	syncDirectory(filepath.Dir(file.destPath))
+
+	verifiedPath, _ := VerifyPath(file.name)
+	return audit.Record(file.ctx, audit.FileWrite, verifiedPath, map[string]bool{"replaced": replaced})
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"lod2/auth"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebdav_RootHidesInternalDirectories(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+
+	os.MkdirAll(filepath.Join(storageRoot, ".trash"), 0755)
+	os.MkdirAll(filepath.Join(storageRoot, "visible"), 0755)
+
+	fileSystem := WebdavFileSystem{}
+	ctx := testContext("user_a", auth.Edit)
+
+	root, err := fileSystem.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(/) failed: %v", err)
+	}
+	defer root.Close()
+
+	infos, err := root.Readdir(0)
+	if err != nil {
+		t.Fatalf("Readdir failed: %v", err)
+	}
+
+	if len(infos) != 1 || infos[0].Name() != "visible" {
+		t.Errorf("root listing = %v, want only 'visible'", infos)
+	}
+
+	if _, err := fileSystem.Stat(ctx, "/.trash"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/.trash) = %v, want ErrNotExist", err)
+	}
+
+	if _, err := fileSystem.OpenFile(ctx, "/../outside", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a path outside storage = %v, want ErrNotExist", err)
+	}
+}
+
+func TestWebdav_WritesReplaceOnClose(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	target := filepath.Join(storageRoot, "doc.txt")
+	os.WriteFile(target, []byte("before"), 0644)
+
+	fileSystem := WebdavFileSystem{}
+
+	file, err := fileSystem.OpenFile(testContext("user_a", auth.Edit), "/doc.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile for writing failed: %v", err)
+	}
+
+	file.Write([]byte("after"))
+
+	if content, _ := os.ReadFile(target); string(content) != "before" {
+		t.Errorf("file changed before close: %q", content)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if content, _ := os.ReadFile(target); string(content) != "after" {
+		t.Errorf("file after close = %q, want %q", content, "after")
+	}
+
+	// The replaced contents can be restored from the trash.
+	entries, err := ListTrash(fullAccess)
+	if err != nil || len(entries) != 1 || entries[0].OriginalPath != "/doc.txt" {
+		t.Fatalf("trash after overwrite = %+v (%v)", entries, err)
+	}
+	trashPath, _ := trashItemPath(entries[0])
+	if content, _ := os.ReadFile(trashPath); string(content) != "before" {
+		t.Errorf("trashed file = %q, want %q", content, "before")
+	}
+
+	if _, err := fileSystem.OpenFile(testContext("user_a", auth.Edit), "/missing/doc.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("writing into a missing directory = %v, want ErrNotExist", err)
+	}
+}
+
+func TestWebdav_RemoveAllMovesToTrash(t *testing.T) {
+	storageRoot, cleanup := setupTestStorageRoot(t)
+	defer cleanup()
+	defer setupTestDatabase(t)()
+
+	os.WriteFile(filepath.Join(storageRoot, "old.txt"), []byte("old"), 0644)
+
+	fileSystem := WebdavFileSystem{}
+
+	if err := fileSystem.RemoveAll(testContext("user_a", auth.Edit), "/old.txt"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+
+	entries, err := ListTrash(fullAccess)
+	if err != nil || len(entries) != 1 || entries[0].OriginalPath != "/old.txt" || entries[0].DeletedByUserId != "user_a" {
+		t.Errorf("trash after RemoveAll = %+v (%v)", entries, err)
+	}
+}